@@ -15,6 +15,7 @@ import (
 	"text/tabwriter"
 	"time"
 
+	"github.com/stregato/bao/lib/relay"
 	"github.com/stregato/bao/lib/replica"
 	"github.com/stregato/bao/lib/security"
 	"github.com/stregato/bao/lib/sqlx"
@@ -860,6 +861,166 @@ func (a *App) cmdReplicaPreview(args []string) error {
 	return nil
 }
 
+func (a *App) cmdReplicaExport(args []string) error {
+	if err := a.mustReplica(); err != nil {
+		return err
+	}
+	fs := flag.NewFlagSet("replica-export", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	format := fs.String("format", "sql", "jsonl, csv or sql")
+	out := fs.String("out", "", "output file (default stdout)")
+	if err := fs.Parse(args); err != nil {
+		return fmt.Errorf("usage: replica-export [--format jsonl|csv|sql] [--out file] [tables...]")
+	}
+	w := io.Writer(os.Stdout)
+	if *out != "" {
+		f, err := os.Create(*out)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		w = f
+	}
+	return a.replica.Export(w, replica.Format(*format), fs.Args()...)
+}
+
+func (a *App) cmdReplicaImport(args []string) error {
+	if err := a.mustReplica(); err != nil {
+		return err
+	}
+	fs := flag.NewFlagSet("replica-import", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	format := fs.String("format", "sql", "jsonl, csv or sql")
+	table := fs.String("table", "", "target table")
+	if err := fs.Parse(args); err != nil || *table == "" || len(fs.Args()) != 1 {
+		return fmt.Errorf("usage: replica-import [--format jsonl|csv|sql] --table <table> <file>")
+	}
+	f, err := os.Open(fs.Args()[0])
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	n, err := a.replica.Import(f, replica.Format(*format), *table)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Imported %d rows (published on next replica-sync)\n", n)
+	return nil
+}
+
+func (a *App) cmdKv(cmd string, args []string) error {
+	if err := a.mustReplica(); err != nil {
+		return err
+	}
+	switch {
+	case cmd == "kv-get" && len(args) == 2:
+		var value json.RawMessage
+		if err := a.replica.KV(args[0]).Get(args[1], &value); err != nil {
+			return err
+		}
+		fmt.Println(string(value))
+	case cmd == "kv-put" && len(args) == 3:
+		if !json.Valid([]byte(args[2])) {
+			return fmt.Errorf("invalid JSON value: %s", args[2])
+		}
+		if err := a.replica.KV(args[0]).Put(args[1], json.RawMessage(args[2])); err != nil {
+			return err
+		}
+		fmt.Println("Put OK (published on next replica-sync)")
+	case cmd == "kv-delete" && len(args) == 2:
+		if err := a.replica.KV(args[0]).Delete(args[1]); err != nil {
+			return err
+		}
+		fmt.Println("Delete OK (published on next replica-sync)")
+	case cmd == "kv-scan" && (len(args) == 1 || len(args) == 2):
+		prefix := ""
+		if len(args) == 2 {
+			prefix = args[1]
+		}
+		entries, err := a.replica.KV(args[0]).Scan(prefix)
+		if err != nil {
+			return err
+		}
+		tw := tabwriter.NewWriter(os.Stdout, 0, 2, 2, ' ', 0)
+		for _, e := range entries {
+			fmt.Fprintf(tw, "%s\t%s\n", e.Key, e.Value)
+		}
+		_ = tw.Flush()
+		fmt.Printf("%d entries\n", len(entries))
+	default:
+		return fmt.Errorf("usage: kv-get <store> <key> | kv-put <store> <key> <json> | kv-delete <store> <key> | kv-scan <store> [prefix]")
+	}
+	return nil
+}
+
+func (a *App) cmdDoc(cmd string, args []string) error {
+	if err := a.mustReplica(); err != nil {
+		return err
+	}
+	if cmd == "doc-find" {
+		fs := flag.NewFlagSet("doc-find", flag.ContinueOnError)
+		fs.SetOutput(io.Discard)
+		where := fs.String("where", "", `JSON filters, e.g. '[{"field":"a","op":"=","value":1}]'`)
+		if err := fs.Parse(args); err != nil {
+			return err
+		}
+		if len(fs.Args()) != 1 {
+			return fmt.Errorf("usage: doc-find [--where '[{\"field\":\"a\",\"op\":\"=\",\"value\":1}]'] <collection>")
+		}
+		var filters []replica.Filter
+		if strings.TrimSpace(*where) != "" {
+			if err := json.Unmarshal([]byte(*where), &filters); err != nil {
+				return err
+			}
+		}
+		docs, err := a.replica.Collection(fs.Args()[0]).Find(filters...)
+		if err != nil {
+			return err
+		}
+		tw := tabwriter.NewWriter(os.Stdout, 0, 2, 2, ' ', 0)
+		for _, d := range docs {
+			fmt.Fprintf(tw, "%s\t%s\n", d.Id, d.Data)
+		}
+		_ = tw.Flush()
+		fmt.Printf("%d documents\n", len(docs))
+		return nil
+	}
+
+	switch {
+	case cmd == "doc-get" && len(args) == 2:
+		var doc json.RawMessage
+		if err := a.replica.Collection(args[0]).Get(args[1], &doc); err != nil {
+			return err
+		}
+		fmt.Println(string(doc))
+	case cmd == "doc-insert" && len(args) == 2:
+		if !json.Valid([]byte(args[1])) {
+			return fmt.Errorf("invalid JSON document: %s", args[1])
+		}
+		id, err := a.replica.Collection(args[0]).Insert(json.RawMessage(args[1]))
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Inserted %s (published on next replica-sync)\n", id)
+	case cmd == "doc-update" && len(args) == 3:
+		if !json.Valid([]byte(args[2])) {
+			return fmt.Errorf("invalid JSON patch: %s", args[2])
+		}
+		if err := a.replica.Collection(args[0]).Update(args[1], json.RawMessage(args[2])); err != nil {
+			return err
+		}
+		fmt.Println("Update OK (published on next replica-sync)")
+	case cmd == "doc-delete" && len(args) == 2:
+		if err := a.replica.Collection(args[0]).Delete(args[1]); err != nil {
+			return err
+		}
+		fmt.Println("Delete OK (published on next replica-sync)")
+	default:
+		return fmt.Errorf("usage: doc-get <collection> <id> | doc-insert <collection> <json> | doc-update <collection> <id> <json-patch> | doc-delete <collection> <id>")
+	}
+	return nil
+}
+
 func (a *App) cmdStatus(args []string) error {
 	fmt.Printf("Session: %s\n", a.sessionPath)
 	fmt.Printf("Vault open: %t\n", a.v != nil)
@@ -873,7 +1034,17 @@ func (a *App) cmdStatus(args []string) error {
 }
 
 func (a *App) cmdIdNew(args []string) error {
-	id, err := security.NewPrivateID()
+	fs := flag.NewFlagSet("id-new", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	hybrid := fs.Bool("hybrid", false, "Include a post-quantum ML-KEM key")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	newPrivateID := security.NewPrivateID
+	if *hybrid {
+		newPrivateID = security.NewHybridPrivateID
+	}
+	id, err := newPrivateID()
 	if err != nil {
 		return err
 	}
@@ -897,6 +1068,35 @@ func (a *App) cmdIdPublic(args []string) error {
 	return nil
 }
 
+func (a *App) cmdRelay(args []string) error {
+	if len(args) == 0 || args[0] != "serve" {
+		return fmt.Errorf("usage: relay serve [--addr :8787] [--anonymous] [--members file] [--owner vault=public-id]...")
+	}
+	fs := flag.NewFlagSet("relay serve", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	addr := fs.String("addr", ":8787", "listen address")
+	anonymous := fs.Bool("anonymous", false, "accept clients that do not authenticate")
+	members := fs.String("members", "", "file where the members of the vaults are kept across restarts")
+	owners := map[string]security.PublicID{}
+	fs.Func("owner", "owner of a vault as vault=public-id", func(s string) error {
+		vault, id, ok := strings.Cut(s, "=")
+		if !ok || vault == "" || id == "" {
+			return fmt.Errorf("invalid owner %q, expected vault=public-id", s)
+		}
+		owners[vault] = security.PublicID(id)
+		return nil
+	})
+	if err := fs.Parse(args[1:]); err != nil {
+		return err
+	}
+	server := relay.NewServer()
+	server.Anonymous = *anonymous
+	server.Owners = owners
+	server.MembersFile = *members
+	fmt.Printf("sync relay listening on %s\n", *addr)
+	return server.ListenAndServe(*addr)
+}
+
 func (a *App) help() {
 	fmt.Print(`Commands:
   help
@@ -904,7 +1104,7 @@ func (a *App) help() {
   status
   close
 
-  id-new
+  id-new [--hybrid]
   id-public <private-id>
 
   open --private <id> --creator <public-id> --config <store.yaml|json> [--db myapp/main.sqlite]
@@ -922,6 +1122,20 @@ func (a *App) help() {
   replica-query [--max N] [--args '{"k":1}'] <sql-or-key>
   replica-exec  [--args '{"k":1}'] <sql-or-key>
   replica-preview [--limit N] <table>
+  replica-export [--format jsonl|csv|sql] [--out file] [tables...]
+  replica-import [--format jsonl|csv|sql] --table <table> <file>
+
+  kv-get <store> <key>
+  kv-put <store> <key> <json>
+  kv-delete <store> <key>
+  kv-scan <store> [prefix]
+  doc-get <collection> <id>
+  doc-insert <collection> <json>
+  doc-update <collection> <id> <json-patch>
+  doc-delete <collection> <id>
+  doc-find [--where '[{"field":"a","op":"=","value":1}]'] <collection>
+
+  relay serve [--addr :8787] [--anonymous] [--members file] [--owner vault=public-id]...   Run a sync relay server
 
   tui   Start full-screen text UI
 
@@ -979,6 +1193,16 @@ func (a *App) execute(parts []string) error {
 		return a.cmdReplicaExec(args)
 	case "replica-preview":
 		return a.cmdReplicaPreview(args)
+	case "replica-export":
+		return a.cmdReplicaExport(args)
+	case "replica-import":
+		return a.cmdReplicaImport(args)
+	case "kv-get", "kv-put", "kv-delete", "kv-scan":
+		return a.cmdKv(cmd, args)
+	case "doc-get", "doc-insert", "doc-update", "doc-delete", "doc-find":
+		return a.cmdDoc(cmd, args)
+	case "relay":
+		return a.cmdRelay(args)
 	case "tui":
 		return a.runTUI()
 	default:
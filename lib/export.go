@@ -135,6 +135,9 @@ var (
 	vaults   core.Registry[*vault.Vault]
 	replicas core.Registry[*replica.Replica]
 	rows     core.Registry[*sqlx.RowsX]
+	signals  core.Registry[*vault.Subscription]
+	changes  core.Registry[*replica.Subscription]
+	txs      core.Registry[*replica.Tx]
 )
 
 // bao_setLogLevel sets the log level for the vault library. Possible values are: trace, debug, info, warn, error, fatal, panic.
@@ -206,6 +209,23 @@ func bao_security_newPrivateID() C.Result {
 	return cResult(identity, 0, nil)
 }
 
+// bao_security_newHybridPrivateID creates a new identity that includes an ML-KEM key next to the classic keys.
+// Data encrypted for the corresponding public ID is protected by both secp256k1 and ML-KEM.
+//
+//export bao_security_newHybridPrivateID
+func bao_security_newHybridPrivateID() C.Result {
+	core.Start("")
+	core.TimeTrack()
+	identity, err := security.NewHybridPrivateID()
+	if err != nil {
+		core.LogError("cannot generate hybrid private ID", err)
+		core.End("failed to generate hybrid private ID")
+		return cResult(nil, 0, err)
+	}
+	core.End("generated new hybrid private ID")
+	return cResult(identity, 0, nil)
+}
+
 // bao_security_publicID returns the public ID of the specified identity.
 //
 //export bao_security_publicID
@@ -1040,6 +1060,38 @@ func bao_vault_write(sH C.longlong, destC, sourceC *C.char, attrsC C.Data, optio
 	return cResult(file, 0, nil)
 }
 
+// bao_vault_writeBatch writes many files to the bao, packing the small ones in shared store objects.
+//
+//export bao_vault_writeBatch
+func bao_vault_writeBatch(sH C.longlong, itemsC, optionsC *C.char) C.Result {
+	core.TimeTrack()
+	core.Start("called with sH: %d", sH)
+	s, err := vaults.Get(int64(sH))
+	if err != nil {
+		core.LogError("cannot get vault with handle %d: %v", sH, err)
+		return cResult(nil, 0, err)
+	}
+	options, err := cIOOption(optionsC)
+	if err != nil {
+		return cResult(nil, 0, err)
+	}
+
+	var items []vault.BatchItem
+	if err := json.Unmarshal([]byte(C.GoString(itemsC)), &items); err != nil {
+		core.LogError("cannot unmarshal batch items", err)
+		return cResult(nil, 0, err)
+	}
+
+	files, err := s.WriteBatch(items, options)
+	if err != nil {
+		core.LogError("cannot write batch of %d files to vault %d: %v", len(items), sH, err)
+		return cResult(nil, 0, err)
+	}
+
+	core.End("successfully wrote %d files to vault %d", len(files), sH)
+	return cResult(files, 0, nil)
+}
+
 // bao_vault_delete deletes the specified file from the bao.
 //
 //export bao_vault_delete
@@ -1141,264 +1193,1295 @@ func bao_vault_interruptWait(sH C.longlong) C.Result {
 	return cResult(true, 0, nil)
 }
 
-// bao_replica_open returns a SQL like layer for the specified bao. The layer is used to execute SQL like commands on the vault data.
+// bao_vault_setQuota records per-user or per-role storage quotas for the specified vault.
 //
-//export bao_replica_open
-func bao_replica_open(sH C.longlong, dbH C.int) C.Result {
+//export bao_vault_setQuota
+func bao_vault_setQuota(sH C.longlong, optionsC, quotasC *C.char) C.Result {
+	core.Start("handle %d", sH)
 	core.TimeTrack()
-	core.Start("called with sH: %d, dbH: %d", sH, dbH)
 	s, err := vaults.Get(int64(sH))
 	if err != nil {
 		core.LogError("cannot get vault with handle %d", sH, err)
 		return cResult(nil, 0, err)
 	}
 
-	db, err := dbs.Get(int64(dbH))
+	var quotas []vault.Quota
+	if err := json.Unmarshal([]byte(C.GoString(quotasC)), &quotas); err != nil {
+		core.LogError("cannot unmarshal quota payload", err)
+		return cResult(nil, 0, err)
+	}
+
+	options, err := cIOOption(optionsC)
 	if err != nil {
-		core.LogError("cannot get db with handle %d", dbH, err)
 		return cResult(nil, 0, err)
 	}
 
-	dt, err := replica.Open(s, db)
+	err = s.SetQuota(options, quotas...)
 	if err != nil {
-		core.LogError("cannot create sql layer for vault %d", sH, err)
+		core.LogError("cannot set quotas", err)
 		return cResult(nil, 0, err)
 	}
-	core.End("sql layer for vault %d created", sH)
-	return cResult(dt, replicas.Add(dt), err)
+	core.End("set %d quotas", len(quotas))
+	return cResult(nil, 0, nil)
 }
 
-// bao_replica_exec executes the specified SQL like command on the specified data table.
+// bao_vault_usage returns the storage usage of the specified vault by author and directory.
 //
-//export bao_replica_exec
-func bao_replica_exec(dtH C.longlong, keyC, argsC *C.char) C.Result {
+//export bao_vault_usage
+func bao_vault_usage(sH C.longlong) C.Result {
 	core.TimeTrack()
-
-	key := C.GoString(keyC)
-	core.Start("dtH: %d, key: %s", dtH, key)
-
-	dt, err := replicas.Get(int64(dtH))
+	core.Start("called with sH: %d", sH)
+	s, err := vaults.Get(int64(sH))
 	if err != nil {
-		core.LogError("cannot get sql layer %d for query %s", dtH, key, err)
+		core.LogError("cannot get vault with handle %d", sH, err)
 		return cResult(nil, 0, err)
 	}
 
-	var args sqlx.Args
-	err = cInput(err, argsC, &args)
+	usage, err := s.Usage()
 	if err != nil {
-		core.LogError("cannot convert input for query %s with args %v", key, map[string]any(args), err)
+		core.LogError("cannot get usage for vault %d", sH, err)
 		return cResult(nil, 0, err)
 	}
-
-	_, err = dt.Exec(C.GoString(keyC), args)
-	if err != nil {
-		core.LogError("cannot execute query %s with args %v", key, map[string]any(args), err)
-	}
-	core.End("")
-	return cResult(nil, 0, err)
+	core.End("usage for vault %d: %d", sH, usage.Total)
+	return cResult(usage, 0, nil)
 }
 
-// bao_replica_query executes the specified SQL like query on the specified data table.
+// bao_vault_setHold records legal-hold/WORM rules for the specified vault.
 //
-//export bao_replica_query
-func bao_replica_query(dtH C.longlong, keyC, argsC *C.char) C.Result {
+//export bao_vault_setHold
+func bao_vault_setHold(sH C.longlong, optionsC, holdsC *C.char) C.Result {
+	core.Start("handle %d", sH)
 	core.TimeTrack()
+	s, err := vaults.Get(int64(sH))
+	if err != nil {
+		core.LogError("cannot get vault with handle %d", sH, err)
+		return cResult(nil, 0, err)
+	}
 
-	key := C.GoString(keyC)
-	core.Start("called with dtH: %d, key: %s", dtH, key)
-	dt, err := replicas.Get(int64(dtH))
+	var holds []vault.Hold
+	if err := json.Unmarshal([]byte(C.GoString(holdsC)), &holds); err != nil {
+		core.LogError("cannot unmarshal hold payload", err)
+		return cResult(nil, 0, err)
+	}
+
+	options, err := cIOOption(optionsC)
 	if err != nil {
-		core.LogError("cannot get sql layer %d for query %s", dtH, key, err)
 		return cResult(nil, 0, err)
 	}
 
-	var args sqlx.Args
-	err = cInput(err, argsC, &args)
+	err = s.SetHold(options, holds...)
 	if err != nil {
-		core.LogError("cannot convert input for query %s with args %v", key, map[string]any(args), err)
+		core.LogError("cannot set holds", err)
 		return cResult(nil, 0, err)
 	}
+	core.End("set %d holds", len(holds))
+	return cResult(nil, 0, nil)
+}
 
-	rows_, err := dt.Query(key, args)
+// bao_vault_getHolds returns the active holds of the specified vault.
+//
+//export bao_vault_getHolds
+func bao_vault_getHolds(sH C.longlong) C.Result {
+	core.TimeTrack()
+	core.Start("called with sH: %d", sH)
+	s, err := vaults.Get(int64(sH))
 	if err != nil {
-		core.LogError("cannot execute query %s with args %v", key, map[string]any(args), err)
+		core.LogError("cannot get vault with handle %d", sH, err)
 		return cResult(nil, 0, err)
 	}
-	core.End("")
-	return cResult(nil, rows.Add(&rows_), err)
+	holds, err := s.GetHolds()
+	if err != nil {
+		core.LogError("cannot get holds for vault %d", sH, err)
+		return cResult(nil, 0, err)
+	}
+	core.End("%d holds for vault %d", len(holds), sH)
+	return cResult(holds, 0, nil)
 }
 
-// bao_replica_sync synchronizes the SQL tables with the vault data.
+// bao_vault_setRetentionPolicy records per-prefix retention and version-count policies for the specified vault.
 //
-//export bao_replica_sync
-func bao_replica_sync(dtH C.longlong, destsC *C.char) C.Result {
+//export bao_vault_setRetentionPolicy
+func bao_vault_setRetentionPolicy(sH C.longlong, optionsC, policiesC *C.char) C.Result {
+	core.Start("handle %d", sH)
 	core.TimeTrack()
-	core.Start("")
-	replica, err := replicas.Get(int64(dtH))
+	s, err := vaults.Get(int64(sH))
 	if err != nil {
-		core.LogError("cannot get sql layer %d", dtH, err)
+		core.LogError("cannot get vault with handle %d", sH, err)
 		return cResult(nil, 0, err)
 	}
 
-	var dests []security.PublicID
-	err = cInput(err, destsC, &dests)
+	var policies []vault.RetentionPolicy
+	if err := json.Unmarshal([]byte(C.GoString(policiesC)), &policies); err != nil {
+		core.LogError("cannot unmarshal retention policy payload", err)
+		return cResult(nil, 0, err)
+	}
+
+	options, err := cIOOption(optionsC)
 	if err != nil {
-		core.LogError("cannot convert input for sync with dests %v", dests, err)
 		return cResult(nil, 0, err)
 	}
 
-	updates, err := replica.Sync(dests...)
+	err = s.SetRetentionPolicy(options, policies...)
 	if err != nil {
-		core.LogError("cannot synchronize tables in sql layer %d", dtH, err)
+		core.LogError("cannot set retention policies", err)
 		return cResult(nil, 0, err)
 	}
-	core.End("")
-	return cResult(updates, 0, nil)
+	core.End("set %d retention policies", len(policies))
+	return cResult(nil, 0, nil)
 }
 
-// bao_replica_fetch fetches the specified number of rows from the specified rows.
+// bao_vault_getRetentionPolicies returns the retention policies of the specified vault.
 //
-//export bao_replica_fetch
-func bao_replica_fetch(dtH C.longlong, keyC, argsC *C.char, maxRows C.int) C.Result {
+//export bao_vault_getRetentionPolicies
+func bao_vault_getRetentionPolicies(sH C.longlong) C.Result {
 	core.TimeTrack()
+	core.Start("called with sH: %d", sH)
+	s, err := vaults.Get(int64(sH))
+	if err != nil {
+		core.LogError("cannot get vault with handle %d", sH, err)
+		return cResult(nil, 0, err)
+	}
+	policies, err := s.GetRetentionPolicies()
+	if err != nil {
+		core.LogError("cannot get retention policies for vault %d", sH, err)
+		return cResult(nil, 0, err)
+	}
+	core.End("%d retention policies for vault %d", len(policies), sH)
+	return cResult(policies, 0, nil)
+}
 
-	key := C.GoString(keyC)
-	core.Start("key: %s", key)
-	dt, err := replicas.Get(int64(dtH))
+// bao_vault_setReplicaGrants records the grants on replica tables and statements for the specified vault.
+//
+//export bao_vault_setReplicaGrants
+func bao_vault_setReplicaGrants(sH C.longlong, optionsC, grantsC *C.char) C.Result {
+	core.Start("handle %d", sH)
+	core.TimeTrack()
+	s, err := vaults.Get(int64(sH))
 	if err != nil {
-		core.LogError("cannot get sql layer %d for query %s", dtH, key, err)
+		core.LogError("cannot get vault with handle %d", sH, err)
 		return cResult(nil, 0, err)
 	}
 
-	var args sqlx.Args
-	err = cInput(err, argsC, &args)
+	var grants []vault.ReplicaGrant
+	if err := json.Unmarshal([]byte(C.GoString(grantsC)), &grants); err != nil {
+		core.LogError("cannot unmarshal replica grant payload", err)
+		return cResult(nil, 0, err)
+	}
+
+	options, err := cIOOption(optionsC)
 	if err != nil {
-		core.LogError("cannot convert input for query %s with args %v", key, map[string]any(args), err)
 		return cResult(nil, 0, err)
 	}
 
-	rows_, err := dt.Fetch(key, args, int(maxRows))
+	err = s.SetReplicaGrants(options, grants...)
 	if err != nil {
-		core.LogError("cannot execute query %s with args %v", key, map[string]any(args), err)
+		core.LogError("cannot set replica grants", err)
 		return cResult(nil, 0, err)
 	}
-	core.End("")
-	return cResult(rows_, 0, nil)
+	core.End("set %d replica grants", len(grants))
+	return cResult(nil, 0, nil)
 }
 
-// bao_replica_fetchOne fetches a single row for the specified SQL like query and arguments.
+// bao_vault_getReplicaGrants returns the grants on replica tables and statements of the specified vault.
 //
-//export bao_replica_fetchOne
-func bao_replica_fetchOne(dtH C.longlong, keyC, argsC *C.char) C.Result {
+//export bao_vault_getReplicaGrants
+func bao_vault_getReplicaGrants(sH C.longlong) C.Result {
 	core.TimeTrack()
-	key := C.GoString(keyC)
-	core.Start("key: %s", key)
-
-	dt, err := replicas.Get(int64(dtH))
+	core.Start("called with sH: %d", sH)
+	s, err := vaults.Get(int64(sH))
 	if err != nil {
-		core.LogError("cannot get sql layer %d for query %s", dtH, key, err)
+		core.LogError("cannot get vault with handle %d", sH, err)
 		return cResult(nil, 0, err)
 	}
-
-	var args sqlx.Args
-	err = cInput(err, argsC, &args)
+	grants, err := s.GetReplicaGrants()
 	if err != nil {
-		core.LogError("cannot convert input for query %s with args %v", key, map[string]any(args), err)
+		core.LogError("cannot get replica grants for vault %d", sH, err)
 		return cResult(nil, 0, err)
 	}
+	core.End("%d replica grants for vault %d", len(grants), sH)
+	return cResult(grants, 0, nil)
+}
 
-	values, err := dt.FetchOne(key, args)
+// bao_vault_relayStatus returns the state of the connection to the sync relay of the specified vault.
+//
+//export bao_vault_relayStatus
+func bao_vault_relayStatus(sH C.longlong) C.Result {
+	core.TimeTrack()
+	core.Start("called with sH: %d", sH)
+	s, err := vaults.Get(int64(sH))
 	if err != nil {
-		core.LogError("cannot execute query %s with args %v", key, map[string]any(args), err)
+		core.LogError("cannot get vault with handle %d", sH, err)
 		return cResult(nil, 0, err)
 	}
-	core.End("")
-	return cResult(values, 0, nil)
+	status := s.RelayStatus()
+	core.End("relay status for vault %d: connected %t", sH, status.Connected)
+	return cResult(status, 0, nil)
 }
 
-// bao_replica_current returns the next row from the specified rows.
+// bao_vault_clockSkews returns the clock skew of the writers of the specified vault, estimated during sync.
 //
-//export bao_replica_current
-func bao_replica_current(rowsH C.longlong) C.Result {
+//export bao_vault_clockSkews
+func bao_vault_clockSkews(sH C.longlong) C.Result {
 	core.TimeTrack()
-
-	core.Start("rowsH: %d", rowsH)
-	r, err := rows.Get(int64(rowsH))
+	core.Start("called with sH: %d", sH)
+	s, err := vaults.Get(int64(sH))
 	if err != nil {
-		core.LogError("cannot get rows with handle %d", rowsH, err)
+		core.LogError("cannot get vault with handle %d", sH, err)
 		return cResult(nil, 0, err)
 	}
+	skews := s.ClockSkews()
+	core.End("%d writers for vault %d", len(skews), sH)
+	return cResult(skews, 0, nil)
+}
 
-	values, err := r.Current()
+// bao_vault_publish sends an ephemeral signal on a topic to the other members connected to the sync relay.
+//
+//export bao_vault_publish
+func bao_vault_publish(sH C.longlong, topicC *C.char, payloadC C.Data) C.Result {
+	core.TimeTrack()
+	core.Start("called with sH: %d, topic: %s", sH, C.GoString(topicC))
+	s, err := vaults.Get(int64(sH))
 	if err != nil {
-		core.LogError("cannot get current row from rows %d", rowsH, err)
+		core.LogError("cannot get vault with handle %d", sH, err)
 		return cResult(nil, 0, err)
 	}
-	core.End("%d values", len(values))
-	return cResult(values, 0, err)
+	payload := C.GoBytes(payloadC.ptr, C.int(payloadC.len))
+	err = s.Publish(C.GoString(topicC), payload)
+	if err != nil {
+		core.LogError("cannot publish signal for vault %d", sH, err)
+		return cResult(nil, 0, err)
+	}
+	core.End("published %d bytes on %s", len(payload), C.GoString(topicC))
+	return cResult(nil, 0, nil)
 }
 
-// bao_rowsNext checks if there are more rows to read.
+// bao_vault_subscribe subscribes to the signals on a topic, or on all topics when the topic is empty, and returns
+// the handle of the subscription.
 //
-//export bao_replica_next
-func bao_replica_next(rowsH C.longlong) C.Result {
+//export bao_vault_subscribe
+func bao_vault_subscribe(sH C.longlong, topicC *C.char) C.Result {
 	core.TimeTrack()
-
-	core.Start("rowsH: %d", rowsH)
-	r, err := rows.Get(int64(rowsH))
+	core.Start("called with sH: %d, topic: %s", sH, C.GoString(topicC))
+	s, err := vaults.Get(int64(sH))
 	if err != nil {
-		core.LogError("cannot get rows with handle %d", rowsH, err)
+		core.LogError("cannot get vault with handle %d", sH, err)
 		return cResult(nil, 0, err)
 	}
-
-	res := r.Next()
-	core.End("successfully checked for next row handle %d, more rows %t: %v", rowsH, res, r)
-	return cResult(res, 0, nil)
+	subH := signals.Add(s.Subscribe(C.GoString(topicC)))
+	core.End("subscription %d for vault %d", subH, sH)
+	return cResult(nil, subH, nil)
 }
 
-// bao_replica_closeRows closes the specified rows.
+// bao_vault_nextSignal waits for the next signal of a subscription. It returns null on timeout.
 //
-//export bao_replica_closeRows
-func bao_replica_closeRows(rowsH C.longlong) C.Result {
+//export bao_vault_nextSignal
+func bao_vault_nextSignal(subH C.longlong, timeoutMs C.longlong) C.Result {
 	core.TimeTrack()
-	core.Start("called with rowsH: %d", rowsH)
-	r, err := rows.Get(int64(rowsH))
+	core.Start("called with subH: %d, timeout: %dms", subH, timeoutMs)
+	sub, err := signals.Get(int64(subH))
 	if err != nil {
-		core.LogError("cannot get rows with handle %d", rowsH, err)
+		core.LogError("cannot get subscription with handle %d", subH, err)
 		return cResult(nil, 0, err)
 	}
+	signal, ok := sub.Next(time.Duration(timeoutMs) * time.Millisecond)
+	if !ok {
+		core.End("no signal for subscription %d", subH)
+		return cResult(nil, 0, nil)
+	}
+	core.End("signal on %s for subscription %d", signal.Topic, subH)
+	return cResult(signal, 0, nil)
+}
 
-	err = r.Close()
+// bao_vault_unsubscribe closes a subscription.
+//
+//export bao_vault_unsubscribe
+func bao_vault_unsubscribe(subH C.longlong) C.Result {
+	core.TimeTrack()
+	core.Start("called with subH: %d", subH)
+	sub, err := signals.Get(int64(subH))
 	if err != nil {
-		core.LogError("cannot close rows with handle %d", rowsH, err)
+		core.LogError("cannot get subscription with handle %d", subH, err)
 		return cResult(nil, 0, err)
 	}
-	rows.Remove(int64(rowsH))
-	core.End("successfully closed rows with handle %d", rowsH)
+	sub.Close()
+	signals.Remove(int64(subH))
+	core.End("closed subscription %d", subH)
 	return cResult(nil, 0, nil)
 }
 
-// bao_replica_cancel rolls back the changes since the last sync
+// bao_vault_presence returns the members of the specified vault connected to the sync relay.
 //
-//export bao_replica_cancel
-func bao_replica_cancel(dtH C.longlong) C.Result {
+//export bao_vault_presence
+func bao_vault_presence(sH C.longlong) C.Result {
 	core.TimeTrack()
+	core.Start("called with sH: %d", sH)
+	s, err := vaults.Get(int64(sH))
+	if err != nil {
+		core.LogError("cannot get vault with handle %d", sH, err)
+		return cResult(nil, 0, err)
+	}
+	members := s.Presence()
+	core.End("%d members online in vault %d", len(members), sH)
+	return cResult(members, 0, nil)
+}
 
-	core.Start("called with dtH: %d", dtH)
-	dt, err := replicas.Get(int64(dtH))
+// bao_vault_recoverWithEscrow restores keys and EC-encrypted files using the escrow identity of the vault.
+// Only admins can recover. Recovered EC files are written in destDir.
+//
+//export bao_vault_recoverWithEscrow
+func bao_vault_recoverWithEscrow(sH C.longlong, escrowC, destDirC *C.char) C.Result {
+	core.TimeTrack()
+	core.Start("called with sH: %d", sH)
+	s, err := vaults.Get(int64(sH))
 	if err != nil {
-		core.LogError("cannot get sql layer %d: %v", dtH, err)
+		core.LogError("cannot get vault with handle %d", sH, err)
 		return cResult(nil, 0, err)
 	}
 
-	err = dt.Cancel()
+	recovery, err := s.RecoverWithEscrow(security.PrivateID(C.GoString(escrowC)), C.GoString(destDirC))
 	if err != nil {
-		core.LogError("cannot cancel sql layer %d", dtH, err)
+		core.LogError("cannot recover with escrow in vault %d", sH, err)
+		return cResult(nil, 0, err)
+	}
+	core.End("recovered %d keys and %d files in vault %d", recovery.Keys, len(recovery.Files), sH)
+	return cResult(recovery, 0, nil)
+}
+
+// bao_replica_open returns a SQL like layer for the specified bao. The layer is used to execute SQL like commands on the vault data.
+//
+//export bao_replica_open
+func bao_replica_open(sH C.longlong, dbH C.int) C.Result {
+	core.TimeTrack()
+	core.Start("called with sH: %d, dbH: %d", sH, dbH)
+	s, err := vaults.Get(int64(sH))
+	if err != nil {
+		core.LogError("cannot get vault with handle %d", sH, err)
+		return cResult(nil, 0, err)
+	}
+
+	db, err := dbs.Get(int64(dbH))
+	if err != nil {
+		core.LogError("cannot get db with handle %d", dbH, err)
+		return cResult(nil, 0, err)
+	}
+
+	dt, err := replica.Open(s, db)
+	if err != nil {
+		core.LogError("cannot create sql layer for vault %d", sH, err)
+		return cResult(nil, 0, err)
+	}
+	core.End("sql layer for vault %d created", sH)
+	return cResult(dt, replicas.Add(dt), err)
+}
+
+// bao_replica_exec executes the specified SQL like command on the specified data table.
+//
+//export bao_replica_exec
+func bao_replica_exec(dtH C.longlong, keyC, argsC *C.char) C.Result {
+	core.TimeTrack()
+
+	key := C.GoString(keyC)
+	core.Start("dtH: %d, key: %s", dtH, key)
+
+	dt, err := replicas.Get(int64(dtH))
+	if err != nil {
+		core.LogError("cannot get sql layer %d for query %s", dtH, key, err)
+		return cResult(nil, 0, err)
+	}
+
+	var args sqlx.Args
+	err = cInput(err, argsC, &args)
+	if err != nil {
+		core.LogError("cannot convert input for query %s with args %v", key, map[string]any(args), err)
+		return cResult(nil, 0, err)
+	}
+
+	_, err = dt.Exec(C.GoString(keyC), args)
+	if err != nil {
+		core.LogError("cannot execute query %s with args %v", key, map[string]any(args), err)
+	}
+	core.End("")
+	return cResult(nil, 0, err)
+}
+
+// bao_replica_begin starts an explicit transaction on the specified replica and returns its handle.
+//
+//export bao_replica_begin
+func bao_replica_begin(dtH C.longlong) C.Result {
+	core.TimeTrack()
+	core.Start("called with dtH: %d", dtH)
+	dt, err := replicas.Get(int64(dtH))
+	if err != nil {
+		core.LogError("cannot get sql layer %d: %v", dtH, err)
+		return cResult(nil, 0, err)
+	}
+
+	tx, err := dt.Begin()
+	if err != nil {
+		core.LogError("cannot begin transaction in sql layer %d", dtH, err)
+		return cResult(nil, 0, err)
+	}
+	txH := txs.Add(tx)
+	core.End("transaction %d for sql layer %d", txH, dtH)
+	return cResult(nil, txH, nil)
+}
+
+// bao_replica_txExec executes the specified statement in the specified transaction.
+//
+//export bao_replica_txExec
+func bao_replica_txExec(txH C.longlong, keyC, argsC *C.char) C.Result {
+	core.TimeTrack()
+
+	key := C.GoString(keyC)
+	core.Start("txH: %d, key: %s", txH, key)
+	tx, err := txs.Get(int64(txH))
+	if err != nil {
+		core.LogError("cannot get transaction %d for query %s", txH, key, err)
+		return cResult(nil, 0, err)
+	}
+
+	var args sqlx.Args
+	err = cInput(err, argsC, &args)
+	if err != nil {
+		core.LogError("cannot convert input for query %s with args %v", key, map[string]any(args), err)
+		return cResult(nil, 0, err)
+	}
+
+	_, err = tx.Exec(key, args)
+	if err != nil {
+		core.LogError("cannot execute query %s with args %v", key, map[string]any(args), err)
+	}
+	core.End("")
+	return cResult(nil, 0, err)
+}
+
+// bao_replica_txSavepoint sets a savepoint with the specified name in the specified transaction.
+//
+//export bao_replica_txSavepoint
+func bao_replica_txSavepoint(txH C.longlong, nameC *C.char) C.Result {
+	core.TimeTrack()
+	core.Start("called with txH: %d, name: %s", txH, C.GoString(nameC))
+	tx, err := txs.Get(int64(txH))
+	if err != nil {
+		core.LogError("cannot get transaction %d", txH, err)
+		return cResult(nil, 0, err)
+	}
+
+	err = tx.Savepoint(C.GoString(nameC))
+	if err != nil {
+		core.LogError("cannot set savepoint %s in transaction %d", C.GoString(nameC), txH, err)
+	}
+	core.End("")
+	return cResult(nil, 0, err)
+}
+
+// bao_replica_txRollbackTo undoes the statements executed after the specified savepoint in the specified transaction.
+//
+//export bao_replica_txRollbackTo
+func bao_replica_txRollbackTo(txH C.longlong, nameC *C.char) C.Result {
+	core.TimeTrack()
+	core.Start("called with txH: %d, name: %s", txH, C.GoString(nameC))
+	tx, err := txs.Get(int64(txH))
+	if err != nil {
+		core.LogError("cannot get transaction %d", txH, err)
+		return cResult(nil, 0, err)
+	}
+
+	err = tx.RollbackTo(C.GoString(nameC))
+	if err != nil {
+		core.LogError("cannot rollback to savepoint %s in transaction %d", C.GoString(nameC), txH, err)
+	}
+	core.End("")
+	return cResult(nil, 0, err)
+}
+
+// bao_replica_txCommit commits the specified transaction, which is published on the next sync, and releases its
+// handle.
+//
+//export bao_replica_txCommit
+func bao_replica_txCommit(txH C.longlong) C.Result {
+	core.TimeTrack()
+	core.Start("called with txH: %d", txH)
+	tx, err := txs.Get(int64(txH))
+	if err != nil {
+		core.LogError("cannot get transaction %d", txH, err)
+		return cResult(nil, 0, err)
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		core.LogError("cannot commit transaction %d", txH, err)
+		return cResult(nil, 0, err)
+	}
+	txs.Remove(int64(txH))
+	core.End("")
+	return cResult(nil, 0, nil)
+}
+
+// bao_replica_txRollback rolls back the specified transaction and releases its handle.
+//
+//export bao_replica_txRollback
+func bao_replica_txRollback(txH C.longlong) C.Result {
+	core.TimeTrack()
+	core.Start("called with txH: %d", txH)
+	tx, err := txs.Get(int64(txH))
+	if err != nil {
+		core.LogError("cannot get transaction %d", txH, err)
+		return cResult(nil, 0, err)
+	}
+
+	err = tx.Rollback()
+	txs.Remove(int64(txH))
+	if err != nil {
+		core.LogError("cannot rollback transaction %d", txH, err)
+	}
+	core.End("")
+	return cResult(nil, 0, err)
+}
+
+// bao_replica_query executes the specified SQL like query on the specified data table.
+//
+//export bao_replica_query
+func bao_replica_query(dtH C.longlong, keyC, argsC *C.char) C.Result {
+	core.TimeTrack()
+
+	key := C.GoString(keyC)
+	core.Start("called with dtH: %d, key: %s", dtH, key)
+	dt, err := replicas.Get(int64(dtH))
+	if err != nil {
+		core.LogError("cannot get sql layer %d for query %s", dtH, key, err)
+		return cResult(nil, 0, err)
+	}
+
+	var args sqlx.Args
+	err = cInput(err, argsC, &args)
+	if err != nil {
+		core.LogError("cannot convert input for query %s with args %v", key, map[string]any(args), err)
+		return cResult(nil, 0, err)
+	}
+
+	rows_, err := dt.Query(key, args)
+	if err != nil {
+		core.LogError("cannot execute query %s with args %v", key, map[string]any(args), err)
+		return cResult(nil, 0, err)
+	}
+	core.End("")
+	return cResult(nil, rows.Add(&rows_), err)
+}
+
+// bao_replica_sync synchronizes the SQL tables with the vault data.
+//
+//export bao_replica_sync
+func bao_replica_sync(dtH C.longlong, destsC *C.char) C.Result {
+	core.TimeTrack()
+	core.Start("")
+	replica, err := replicas.Get(int64(dtH))
+	if err != nil {
+		core.LogError("cannot get sql layer %d", dtH, err)
+		return cResult(nil, 0, err)
+	}
+
+	var dests []security.PublicID
+	err = cInput(err, destsC, &dests)
+	if err != nil {
+		core.LogError("cannot convert input for sync with dests %v", dests, err)
+		return cResult(nil, 0, err)
+	}
+
+	updates, err := replica.Sync(dests...)
+	if err != nil {
+		core.LogError("cannot synchronize tables in sql layer %d", dtH, err)
+		return cResult(nil, 0, err)
+	}
+	core.End("")
+	return cResult(updates, 0, nil)
+}
+
+// bao_replica_fetch fetches the specified number of rows from the specified rows.
+//
+//export bao_replica_fetch
+func bao_replica_fetch(dtH C.longlong, keyC, argsC *C.char, maxRows C.int) C.Result {
+	core.TimeTrack()
+
+	key := C.GoString(keyC)
+	core.Start("key: %s", key)
+	dt, err := replicas.Get(int64(dtH))
+	if err != nil {
+		core.LogError("cannot get sql layer %d for query %s", dtH, key, err)
+		return cResult(nil, 0, err)
+	}
+
+	var args sqlx.Args
+	err = cInput(err, argsC, &args)
+	if err != nil {
+		core.LogError("cannot convert input for query %s with args %v", key, map[string]any(args), err)
+		return cResult(nil, 0, err)
+	}
+
+	rows_, err := dt.Fetch(key, args, int(maxRows))
+	if err != nil {
+		core.LogError("cannot execute query %s with args %v", key, map[string]any(args), err)
+		return cResult(nil, 0, err)
+	}
+	core.End("")
+	return cResult(rows_, 0, nil)
+}
+
+// bao_replica_fetchOne fetches a single row for the specified SQL like query and arguments.
+//
+//export bao_replica_fetchOne
+func bao_replica_fetchOne(dtH C.longlong, keyC, argsC *C.char) C.Result {
+	core.TimeTrack()
+	key := C.GoString(keyC)
+	core.Start("key: %s", key)
+
+	dt, err := replicas.Get(int64(dtH))
+	if err != nil {
+		core.LogError("cannot get sql layer %d for query %s", dtH, key, err)
+		return cResult(nil, 0, err)
+	}
+
+	var args sqlx.Args
+	err = cInput(err, argsC, &args)
+	if err != nil {
+		core.LogError("cannot convert input for query %s with args %v", key, map[string]any(args), err)
+		return cResult(nil, 0, err)
+	}
+
+	values, err := dt.FetchOne(key, args)
+	if err != nil {
+		core.LogError("cannot execute query %s with args %v", key, map[string]any(args), err)
+		return cResult(nil, 0, err)
+	}
+	core.End("")
+	return cResult(values, 0, nil)
+}
+
+// bao_replica_queryAt executes the specified query on the tables as they were at the specified point of the history.
+// The point is a JSON object with the id of a transaction or a time.
+//
+//export bao_replica_queryAt
+func bao_replica_queryAt(dtH C.longlong, atC, keyC, argsC *C.char) C.Result {
+	core.TimeTrack()
+
+	key := C.GoString(keyC)
+	core.Start("called with dtH: %d, at: %s, key: %s", dtH, C.GoString(atC), key)
+	dt, err := replicas.Get(int64(dtH))
+	if err != nil {
+		core.LogError("cannot get sql layer %d for query %s", dtH, key, err)
+		return cResult(nil, 0, err)
+	}
+
+	var at replica.At
+	err = cInput(err, atC, &at)
+	var args sqlx.Args
+	err = cInput(err, argsC, &args)
+	if err != nil {
+		core.LogError("cannot convert input for query %s with args %v", key, map[string]any(args), err)
+		return cResult(nil, 0, err)
+	}
+
+	rows_, err := dt.QueryAt(at, key, args)
+	if err != nil {
+		core.LogError("cannot execute query %s at %v", key, at, err)
+		return cResult(nil, 0, err)
+	}
+	core.End("%d rows", len(rows_))
+	return cResult(rows_, 0, nil)
+}
+
+// bao_replica_history returns the transactions that changed the row of the specified table with the primary key in
+// the JSON array.
+//
+//export bao_replica_history
+func bao_replica_history(dtH C.longlong, tableC, keyC *C.char) C.Result {
+	core.TimeTrack()
+	core.Start("called with dtH: %d, table: %s, key: %s", dtH, C.GoString(tableC), C.GoString(keyC))
+	dt, err := replicas.Get(int64(dtH))
+	if err != nil {
+		core.LogError("cannot get sql layer %d: %v", dtH, err)
+		return cResult(nil, 0, err)
+	}
+
+	var key []any
+	err = cInput(err, keyC, &key)
+	if err != nil {
+		core.LogError("cannot unmarshal key %s", C.GoString(keyC), err)
+		return cResult(nil, 0, err)
+	}
+
+	revisions, err := dt.History(C.GoString(tableC), key...)
+	if err != nil {
+		core.LogError("cannot read history of %s in sql layer %d", C.GoString(tableC), dtH, err)
+		return cResult(nil, 0, err)
+	}
+	core.End("%d revisions", len(revisions))
+	return cResult(revisions, 0, nil)
+}
+
+// bao_replica_revert queues a transaction that undoes the specified transaction, published on the next sync.
+//
+//export bao_replica_revert
+func bao_replica_revert(dtH C.longlong, id C.longlong) C.Result {
+	core.TimeTrack()
+	core.Start("called with dtH: %d, id: %d", dtH, id)
+	dt, err := replicas.Get(int64(dtH))
+	if err != nil {
+		core.LogError("cannot get sql layer %d: %v", dtH, err)
+		return cResult(nil, 0, err)
+	}
+
+	err = dt.Revert(vault.FileId(id))
+	if err != nil {
+		core.LogError("cannot revert transaction %d in sql layer %d", id, dtH, err)
+	}
+	core.End("")
+	return cResult(nil, 0, err)
+}
+
+// bao_replica_kvGet returns the JSON value of the key in the specified key-value store.
+//
+//export bao_replica_kvGet
+func bao_replica_kvGet(dtH C.longlong, storeC, keyC *C.char) C.Result {
+	core.TimeTrack()
+	core.Start("called with dtH: %d, store: %s, key: %s", dtH, C.GoString(storeC), C.GoString(keyC))
+	dt, err := replicas.Get(int64(dtH))
+	if err != nil {
+		core.LogError("cannot get sql layer %d: %v", dtH, err)
+		return cResult(nil, 0, err)
+	}
+
+	var value json.RawMessage
+	err = dt.KV(C.GoString(storeC)).Get(C.GoString(keyC), &value)
+	if err != nil {
+		core.LogError("cannot get %s in store %s", C.GoString(keyC), C.GoString(storeC), err)
+		return cResult(nil, 0, err)
+	}
+	core.End("")
+	return cResult(value, 0, nil)
+}
+
+// bao_replica_kvPut sets the key in the specified key-value store to the JSON value.
+//
+//export bao_replica_kvPut
+func bao_replica_kvPut(dtH C.longlong, storeC, keyC, valueC *C.char) C.Result {
+	core.TimeTrack()
+	core.Start("called with dtH: %d, store: %s, key: %s", dtH, C.GoString(storeC), C.GoString(keyC))
+	dt, err := replicas.Get(int64(dtH))
+	if err != nil {
+		core.LogError("cannot get sql layer %d: %v", dtH, err)
+		return cResult(nil, 0, err)
+	}
+
+	var value json.RawMessage
+	err = cInput(err, valueC, &value)
+	if err != nil {
+		core.LogError("cannot unmarshal value %s", C.GoString(valueC), err)
+		return cResult(nil, 0, err)
+	}
+	err = dt.KV(C.GoString(storeC)).Put(C.GoString(keyC), value)
+	if err != nil {
+		core.LogError("cannot put %s in store %s", C.GoString(keyC), C.GoString(storeC), err)
+	}
+	core.End("")
+	return cResult(nil, 0, err)
+}
+
+// bao_replica_kvDelete removes the key from the specified key-value store.
+//
+//export bao_replica_kvDelete
+func bao_replica_kvDelete(dtH C.longlong, storeC, keyC *C.char) C.Result {
+	core.TimeTrack()
+	core.Start("called with dtH: %d, store: %s, key: %s", dtH, C.GoString(storeC), C.GoString(keyC))
+	dt, err := replicas.Get(int64(dtH))
+	if err != nil {
+		core.LogError("cannot get sql layer %d: %v", dtH, err)
+		return cResult(nil, 0, err)
+	}
+
+	err = dt.KV(C.GoString(storeC)).Delete(C.GoString(keyC))
+	if err != nil {
+		core.LogError("cannot delete %s in store %s", C.GoString(keyC), C.GoString(storeC), err)
+	}
+	core.End("")
+	return cResult(nil, 0, err)
+}
+
+// bao_replica_kvScan returns the entries of the specified key-value store whose key starts with the prefix.
+//
+//export bao_replica_kvScan
+func bao_replica_kvScan(dtH C.longlong, storeC, prefixC *C.char) C.Result {
+	core.TimeTrack()
+	core.Start("called with dtH: %d, store: %s, prefix: %s", dtH, C.GoString(storeC), C.GoString(prefixC))
+	dt, err := replicas.Get(int64(dtH))
+	if err != nil {
+		core.LogError("cannot get sql layer %d: %v", dtH, err)
+		return cResult(nil, 0, err)
+	}
+
+	entries, err := dt.KV(C.GoString(storeC)).Scan(C.GoString(prefixC))
+	if err != nil {
+		core.LogError("cannot scan store %s", C.GoString(storeC), err)
+		return cResult(nil, 0, err)
+	}
+	core.End("%d entries", len(entries))
+	return cResult(entries, 0, nil)
+}
+
+// bao_replica_docInsert adds the JSON document to the specified collection and returns its id.
+//
+//export bao_replica_docInsert
+func bao_replica_docInsert(dtH C.longlong, collectionC, docC *C.char) C.Result {
+	core.TimeTrack()
+	core.Start("called with dtH: %d, collection: %s", dtH, C.GoString(collectionC))
+	dt, err := replicas.Get(int64(dtH))
+	if err != nil {
+		core.LogError("cannot get sql layer %d: %v", dtH, err)
+		return cResult(nil, 0, err)
+	}
+
+	var doc json.RawMessage
+	err = cInput(err, docC, &doc)
+	if err != nil {
+		core.LogError("cannot unmarshal document %s", C.GoString(docC), err)
+		return cResult(nil, 0, err)
+	}
+	id, err := dt.Collection(C.GoString(collectionC)).Insert(doc)
+	if err != nil {
+		core.LogError("cannot insert document in collection %s", C.GoString(collectionC), err)
+		return cResult(nil, 0, err)
+	}
+	core.End("id %s", id)
+	return cResult(id, 0, nil)
+}
+
+// bao_replica_docUpdate changes the fields of a document in the specified collection with the JSON merge patch.
+//
+//export bao_replica_docUpdate
+func bao_replica_docUpdate(dtH C.longlong, collectionC, idC, patchC *C.char) C.Result {
+	core.TimeTrack()
+	core.Start("called with dtH: %d, collection: %s, id: %s", dtH, C.GoString(collectionC), C.GoString(idC))
+	dt, err := replicas.Get(int64(dtH))
+	if err != nil {
+		core.LogError("cannot get sql layer %d: %v", dtH, err)
+		return cResult(nil, 0, err)
+	}
+
+	var patch json.RawMessage
+	err = cInput(err, patchC, &patch)
+	if err != nil {
+		core.LogError("cannot unmarshal patch %s", C.GoString(patchC), err)
+		return cResult(nil, 0, err)
+	}
+	err = dt.Collection(C.GoString(collectionC)).Update(C.GoString(idC), patch)
+	if err != nil {
+		core.LogError("cannot update document %s in collection %s", C.GoString(idC), C.GoString(collectionC), err)
+	}
+	core.End("")
+	return cResult(nil, 0, err)
+}
+
+// bao_replica_docDelete removes a document from the specified collection.
+//
+//export bao_replica_docDelete
+func bao_replica_docDelete(dtH C.longlong, collectionC, idC *C.char) C.Result {
+	core.TimeTrack()
+	core.Start("called with dtH: %d, collection: %s, id: %s", dtH, C.GoString(collectionC), C.GoString(idC))
+	dt, err := replicas.Get(int64(dtH))
+	if err != nil {
+		core.LogError("cannot get sql layer %d: %v", dtH, err)
+		return cResult(nil, 0, err)
+	}
+
+	err = dt.Collection(C.GoString(collectionC)).Delete(C.GoString(idC))
+	if err != nil {
+		core.LogError("cannot delete document %s in collection %s", C.GoString(idC), C.GoString(collectionC), err)
+	}
+	core.End("")
+	return cResult(nil, 0, err)
+}
+
+// bao_replica_docGet returns a document of the specified collection.
+//
+//export bao_replica_docGet
+func bao_replica_docGet(dtH C.longlong, collectionC, idC *C.char) C.Result {
+	core.TimeTrack()
+	core.Start("called with dtH: %d, collection: %s, id: %s", dtH, C.GoString(collectionC), C.GoString(idC))
+	dt, err := replicas.Get(int64(dtH))
+	if err != nil {
+		core.LogError("cannot get sql layer %d: %v", dtH, err)
+		return cResult(nil, 0, err)
+	}
+
+	var doc json.RawMessage
+	err = dt.Collection(C.GoString(collectionC)).Get(C.GoString(idC), &doc)
+	if err != nil {
+		core.LogError("cannot get document %s in collection %s", C.GoString(idC), C.GoString(collectionC), err)
+		return cResult(nil, 0, err)
+	}
+	core.End("")
+	return cResult(doc, 0, nil)
+}
+
+// bao_replica_docFind returns the documents of the specified collection that match the filters in the JSON array.
+//
+//export bao_replica_docFind
+func bao_replica_docFind(dtH C.longlong, collectionC, filtersC *C.char) C.Result {
+	core.TimeTrack()
+	core.Start("called with dtH: %d, collection: %s, filters: %s", dtH, C.GoString(collectionC), C.GoString(filtersC))
+	dt, err := replicas.Get(int64(dtH))
+	if err != nil {
+		core.LogError("cannot get sql layer %d: %v", dtH, err)
+		return cResult(nil, 0, err)
+	}
+
+	var filters []replica.Filter
+	err = cInput(err, filtersC, &filters)
+	if err != nil {
+		core.LogError("cannot unmarshal filters %s", C.GoString(filtersC), err)
+		return cResult(nil, 0, err)
+	}
+	docs, err := dt.Collection(C.GoString(collectionC)).Find(filters...)
+	if err != nil {
+		core.LogError("cannot find documents in collection %s", C.GoString(collectionC), err)
+		return cResult(nil, 0, err)
+	}
+	core.End("%d documents", len(docs))
+	return cResult(docs, 0, nil)
+}
+
+// bao_replica_export writes the rows of the tables in the JSON array to the file at path, in the specified format:
+// jsonl, csv or sql. An empty array exports all the tables in an SQL dump.
+//
+//export bao_replica_export
+func bao_replica_export(dtH C.longlong, formatC, tablesC, pathC *C.char) C.Result {
+	core.TimeTrack()
+	core.Start("called with dtH: %d, format: %s, tables: %s, path: %s", dtH, C.GoString(formatC), C.GoString(tablesC),
+		C.GoString(pathC))
+	dt, err := replicas.Get(int64(dtH))
+	if err != nil {
+		core.LogError("cannot get sql layer %d: %v", dtH, err)
+		return cResult(nil, 0, err)
+	}
+
+	var tables []string
+	err = cInput(err, tablesC, &tables)
+	if err != nil {
+		core.LogError("cannot unmarshal tables %s", C.GoString(tablesC), err)
+		return cResult(nil, 0, err)
+	}
+
+	f, err := os.Create(C.GoString(pathC))
+	if err != nil {
+		core.LogError("cannot create file %s", C.GoString(pathC), err)
+		return cResult(nil, 0, core.Error(core.FileError, "cannot create file %s", C.GoString(pathC), err))
+	}
+	defer f.Close()
+
+	err = dt.Export(f, replica.Format(C.GoString(formatC)), tables...)
+	if err != nil {
+		core.LogError("cannot export tables %v in sql layer %d", tables, dtH, err)
+		return cResult(nil, 0, err)
+	}
+	core.End("")
+	return cResult(nil, 0, nil)
+}
+
+// bao_replica_import inserts the rows in the file at path into the specified table and returns the number of rows.
+// The rows are published on the next sync.
+//
+//export bao_replica_import
+func bao_replica_import(dtH C.longlong, formatC, tableC, pathC *C.char) C.Result {
+	core.TimeTrack()
+	core.Start("called with dtH: %d, format: %s, table: %s, path: %s", dtH, C.GoString(formatC), C.GoString(tableC),
+		C.GoString(pathC))
+	dt, err := replicas.Get(int64(dtH))
+	if err != nil {
+		core.LogError("cannot get sql layer %d: %v", dtH, err)
+		return cResult(nil, 0, err)
+	}
+
+	f, err := os.Open(C.GoString(pathC))
+	if err != nil {
+		core.LogError("cannot open file %s", C.GoString(pathC), err)
+		return cResult(nil, 0, core.Error(core.FileError, "cannot open file %s", C.GoString(pathC), err))
+	}
+	defer f.Close()
+
+	n, err := dt.Import(f, replica.Format(C.GoString(formatC)), C.GoString(tableC))
+	if err != nil {
+		core.LogError("cannot import into %s in sql layer %d", C.GoString(tableC), dtH, err)
+		return cResult(nil, 0, err)
+	}
+	core.End("%d rows", n)
+	return cResult(n, 0, nil)
+}
+
+// bao_replica_current returns the next row from the specified rows.
+//
+//export bao_replica_current
+func bao_replica_current(rowsH C.longlong) C.Result {
+	core.TimeTrack()
+
+	core.Start("rowsH: %d", rowsH)
+	r, err := rows.Get(int64(rowsH))
+	if err != nil {
+		core.LogError("cannot get rows with handle %d", rowsH, err)
+		return cResult(nil, 0, err)
+	}
+
+	values, err := r.Current()
+	if err != nil {
+		core.LogError("cannot get current row from rows %d", rowsH, err)
+		return cResult(nil, 0, err)
+	}
+	core.End("%d values", len(values))
+	return cResult(values, 0, err)
+}
+
+// bao_rowsNext checks if there are more rows to read.
+//
+//export bao_replica_next
+func bao_replica_next(rowsH C.longlong) C.Result {
+	core.TimeTrack()
+
+	core.Start("rowsH: %d", rowsH)
+	r, err := rows.Get(int64(rowsH))
+	if err != nil {
+		core.LogError("cannot get rows with handle %d", rowsH, err)
+		return cResult(nil, 0, err)
+	}
+
+	res := r.Next()
+	core.End("successfully checked for next row handle %d, more rows %t: %v", rowsH, res, r)
+	return cResult(res, 0, nil)
+}
+
+// bao_replica_closeRows closes the specified rows.
+//
+//export bao_replica_closeRows
+func bao_replica_closeRows(rowsH C.longlong) C.Result {
+	core.TimeTrack()
+	core.Start("called with rowsH: %d", rowsH)
+	r, err := rows.Get(int64(rowsH))
+	if err != nil {
+		core.LogError("cannot get rows with handle %d", rowsH, err)
+		return cResult(nil, 0, err)
+	}
+
+	err = r.Close()
+	if err != nil {
+		core.LogError("cannot close rows with handle %d", rowsH, err)
+		return cResult(nil, 0, err)
+	}
+	rows.Remove(int64(rowsH))
+	core.End("successfully closed rows with handle %d", rowsH)
+	return cResult(nil, 0, nil)
+}
+
+// bao_replica_cancel rolls back the changes since the last sync
+//
+//export bao_replica_cancel
+func bao_replica_cancel(dtH C.longlong) C.Result {
+	core.TimeTrack()
+
+	core.Start("called with dtH: %d", dtH)
+	dt, err := replicas.Get(int64(dtH))
+	if err != nil {
+		core.LogError("cannot get sql layer %d: %v", dtH, err)
+		return cResult(nil, 0, err)
+	}
+
+	err = dt.Cancel()
+	if err != nil {
+		core.LogError("cannot cancel sql layer %d", dtH, err)
 	}
 	core.End("successfully cancelled sql layer %d", dtH)
 	return cResult(nil, 0, err)
 }
 
+// bao_replica_merge declares a table whose rows are merged by column with the specified merge mode.
+//
+//export bao_replica_merge
+func bao_replica_merge(dtH C.longlong, tableC *C.char, mode C.int) C.Result {
+	core.TimeTrack()
+
+	table := C.GoString(tableC)
+	core.Start("called with dtH: %d, table: %s, mode: %d", dtH, table, mode)
+	dt, err := replicas.Get(int64(dtH))
+	if err != nil {
+		core.LogError("cannot get sql layer %d: %v", dtH, err)
+		return cResult(nil, 0, err)
+	}
+
+	err = dt.Merge(table, replica.MergeMode(mode))
+	if err != nil {
+		core.LogError("cannot declare merged table %s in sql layer %d", table, dtH, err)
+	}
+	core.End("")
+	return cResult(nil, 0, err)
+}
+
+// bao_replica_checkpoint writes a snapshot of the replicated tables to the vault.
+//
+//export bao_replica_checkpoint
+func bao_replica_checkpoint(dtH C.longlong) C.Result {
+	core.TimeTrack()
+
+	core.Start("called with dtH: %d", dtH)
+	dt, err := replicas.Get(int64(dtH))
+	if err != nil {
+		core.LogError("cannot get sql layer %d: %v", dtH, err)
+		return cResult(nil, 0, err)
+	}
+
+	err = dt.Checkpoint()
+	if err != nil {
+		core.LogError("cannot write checkpoint of sql layer %d", dtH, err)
+	}
+	core.End("")
+	return cResult(nil, 0, err)
+}
+
+// bao_replica_migrate publishes a schema with the specified version in the vault and applies it.
+//
+//export bao_replica_migrate
+func bao_replica_migrate(dtH C.longlong, version C.double, ddlC *C.char) C.Result {
+	core.TimeTrack()
+
+	core.Start("called with dtH: %d, version: %g", dtH, version)
+	dt, err := replicas.Get(int64(dtH))
+	if err != nil {
+		core.LogError("cannot get sql layer %d: %v", dtH, err)
+		return cResult(nil, 0, err)
+	}
+
+	err = dt.Migrate(float32(version), C.GoString(ddlC))
+	if err != nil {
+		core.LogError("cannot migrate sql layer %d to version %g", dtH, version, err)
+		return cResult(nil, 0, err)
+	}
+	core.End("")
+	return cResult(dt.SchemaVersion(), 0, nil)
+}
+
+// bao_replica_rejections returns the transactions rejected because their authors have no grant on the tables or
+// statements they write.
+//
+//export bao_replica_rejections
+func bao_replica_rejections(dtH C.longlong) C.Result {
+	core.TimeTrack()
+
+	core.Start("called with dtH: %d", dtH)
+	dt, err := replicas.Get(int64(dtH))
+	if err != nil {
+		core.LogError("cannot get sql layer %d: %v", dtH, err)
+		return cResult(nil, 0, err)
+	}
+
+	rejections, err := dt.Rejections()
+	if err != nil {
+		core.LogError("cannot get rejections of sql layer %d", dtH, err)
+		return cResult(nil, 0, err)
+	}
+	core.End("%d rejections in sql layer %d", len(rejections), dtH)
+	return cResult(rejections, 0, nil)
+}
+
+// bao_replica_subscribe subscribes to the changes on the tables in the JSON array, or on all tables when the array is
+// empty, and returns the handle of the subscription.
+//
+//export bao_replica_subscribe
+func bao_replica_subscribe(dtH C.longlong, tablesC *C.char) C.Result {
+	core.TimeTrack()
+	core.Start("called with dtH: %d, tables: %s", dtH, C.GoString(tablesC))
+	dt, err := replicas.Get(int64(dtH))
+	if err != nil {
+		core.LogError("cannot get sql layer %d: %v", dtH, err)
+		return cResult(nil, 0, err)
+	}
+
+	var tables []string
+	err = cInput(nil, tablesC, &tables)
+	if err != nil {
+		core.LogError("cannot unmarshal tables %s", C.GoString(tablesC), err)
+		return cResult(nil, 0, err)
+	}
+	subH := changes.Add(dt.Subscribe(tables...))
+	core.End("subscription %d for sql layer %d", subH, dtH)
+	return cResult(nil, subH, nil)
+}
+
+// bao_replica_nextChange waits for the next change of a subscription. It returns null on timeout.
+//
+//export bao_replica_nextChange
+func bao_replica_nextChange(subH C.longlong, timeoutMs C.longlong) C.Result {
+	core.TimeTrack()
+	core.Start("called with subH: %d, timeout: %dms", subH, timeoutMs)
+	sub, err := changes.Get(int64(subH))
+	if err != nil {
+		core.LogError("cannot get subscription with handle %d", subH, err)
+		return cResult(nil, 0, err)
+	}
+	change, ok := sub.Next(time.Duration(timeoutMs) * time.Millisecond)
+	if !ok {
+		core.End("no change for subscription %d", subH)
+		return cResult(nil, 0, nil)
+	}
+	core.End("change %d on %v for subscription %d", change.Id, change.Tables, subH)
+	return cResult(change, 0, nil)
+}
+
+// bao_replica_unsubscribe closes a subscription to the changes of a replica.
+//
+//export bao_replica_unsubscribe
+func bao_replica_unsubscribe(subH C.longlong) C.Result {
+	core.TimeTrack()
+	core.Start("called with subH: %d", subH)
+	sub, err := changes.Get(int64(subH))
+	if err != nil {
+		core.LogError("cannot get subscription with handle %d", subH, err)
+		return cResult(nil, 0, err)
+	}
+	sub.Close()
+	changes.Remove(int64(subH))
+	core.End("closed subscription %d", subH)
+	return cResult(nil, 0, nil)
+}
+
+// bao_replica_startAutoSync syncs the replica in the background when the vault receives new files and at least once
+// every interval.
+//
+//export bao_replica_startAutoSync
+func bao_replica_startAutoSync(dtH C.longlong, intervalMs C.longlong) C.Result {
+	core.TimeTrack()
+	core.Start("called with dtH: %d, interval: %dms", dtH, intervalMs)
+	dt, err := replicas.Get(int64(dtH))
+	if err != nil {
+		core.LogError("cannot get sql layer %d: %v", dtH, err)
+		return cResult(nil, 0, err)
+	}
+	dt.StartAutoSync(time.Duration(intervalMs) * time.Millisecond)
+	core.End("")
+	return cResult(nil, 0, nil)
+}
+
+// bao_replica_stopAutoSync stops the background sync of the replica.
+//
+//export bao_replica_stopAutoSync
+func bao_replica_stopAutoSync(dtH C.longlong) C.Result {
+	core.TimeTrack()
+	core.Start("called with dtH: %d", dtH)
+	dt, err := replicas.Get(int64(dtH))
+	if err != nil {
+		core.LogError("cannot get sql layer %d: %v", dtH, err)
+		return cResult(nil, 0, err)
+	}
+	dt.StopAutoSync()
+	core.End("")
+	return cResult(nil, 0, nil)
+}
+
 // bao_mailbox_send sends the specified message using the specified dir as container
 //
 //export bao_mailbox_send
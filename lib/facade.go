@@ -27,6 +27,11 @@ func NewPrivateID() (security.PrivateID, error) {
 	return security.NewPrivateID()
 }
 
+// NewHybridPrivateID generates a new identity that also carries an ML-KEM key for post-quantum encryption.
+func NewHybridPrivateID() (security.PrivateID, error) {
+	return security.NewHybridPrivateID()
+}
+
 // PublicID derives the public half of a PrivateID.
 func PublicID(id security.PrivateID) (security.PublicID, error) {
 	return id.PublicID()
@@ -0,0 +1,204 @@
+package relay
+
+import (
+	"encoding/base64"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/stregato/bao/lib/core"
+	"github.com/stregato/bao/lib/security"
+)
+
+// AuthPrefix starts the message that authenticates a vault member on a connection:
+// "!vaultID:publicID:unixTime:ownerID:signature". The owner is the identity that created the vault, which members
+// know from the vault itself. The signature covers the room, the vault, the owner and the time, so it cannot be
+// replayed on other rooms or vaults or long after it was created.
+const AuthPrefix = "!"
+
+// MembersPrefix starts the message that sets the members of a vault in a room:
+// "=vaultID:signerID:unixTime:ownerID:version:member,member,...:admin,admin,...:signature". Members are kept by
+// vault and owner, so an identity that sets the members of a vault it does not own only sets them for connections
+// that trust it as the owner. The owner and the admins in the current list can sign the next list, and the version,
+// the length of the chain of the vault as known to the signer, keeps a list from a signer that is behind from
+// replacing a newer one.
+const MembersPrefix = "="
+
+// AcceptedPrefix starts the message that the relay sends when it accepts an auth: "@vaultID:publicID". A pending
+// auth is accepted when the members of the vault arrive, so clients wait for it before they announce themselves.
+const AcceptedPrefix = "@"
+
+// MaxAuthSkew is the maximum difference between the time in an auth or members message and the relay clock.
+const MaxAuthSkew = 5 * time.Minute
+
+// Room returns the room of the relay for the path of the websocket URL.
+func Room(urlPath string) string {
+	room := strings.Trim(urlPath, "/")
+	if room == "" {
+		return defaultRoom
+	}
+	return room
+}
+
+// identity is a proven identity of a connection for a vault, together with the owner of the vault it trusts.
+type identity struct {
+	id    security.PublicID
+	owner security.PublicID
+}
+
+// members are the identities that can authenticate for a vault in a room. The fields are exported for the file
+// that keeps them across restarts.
+type members struct {
+	Vault   string                         `json:"vault"`
+	Owner   security.PublicID              `json:"owner"`
+	Unix    int64                          `json:"unix"`
+	Version int64                          `json:"version"`
+	IDs     map[security.PublicID]struct{} `json:"ids"`
+	Admins  map[security.PublicID]struct{} `json:"admins"`
+
+	signer security.PublicID
+}
+
+func (m *members) has(id security.PublicID) bool {
+	_, ok := m.IDs[id]
+	return ok || id == m.Owner
+}
+
+// canSet returns true when the identity can sign the next members of the vault.
+func (m *members) canSet(id security.PublicID) bool {
+	_, ok := m.Admins[id]
+	return ok || id == m.Owner
+}
+
+// MemberList is the content of a members message.
+type MemberList struct {
+	Owner   security.PublicID   // Owner is the identity that created the vault
+	Version int64               // Version orders the lists of the vault; a list older than the current one is rejected
+	IDs     []security.PublicID // IDs are the members of the vault. The owner is always a member
+	Admins  []security.PublicID // Admins are the members that can sign the next list, besides the owner
+}
+
+func authSignedData(room, vault, owner string, unix int64) []byte {
+	return []byte(fmt.Sprintf("bao-relay-auth:%s:%s:%s:%d", room, vault, owner, unix))
+}
+
+func membersSignedData(room, vault string, unix int64, owner, version, ids, admins string) []byte {
+	return []byte(fmt.Sprintf("bao-relay-members:%s:%s:%s:%d:%s:%s:%s", room, vault, owner, unix, version, ids, admins))
+}
+
+// signMessage returns prefix followed by the fields, the identity of privateID, the time and the signature of the
+// data returned by signed for that time.
+func signMessage(privateID security.PrivateID, prefix, vault string, signed func(unix int64) []byte,
+	fields ...string) (string, error) {
+	publicID, err := privateID.PublicID()
+	if err != nil {
+		return "", core.Error(core.ParseError, "invalid private ID for relay message", err)
+	}
+	unix := core.Now().Unix()
+	sig, err := security.Sign(privateID, signed(unix))
+	if err != nil {
+		return "", core.Error(core.GenericError, "cannot sign relay message", err)
+	}
+	parts := append([]string{vault, string(publicID), strconv.FormatInt(unix, 10)}, fields...)
+	parts = append(parts, base64.RawURLEncoding.EncodeToString(sig))
+	return prefix + strings.Join(parts, ":"), nil
+}
+
+// verifyMessage splits a signed message into the vault, the identity, the time and the n fields in between, and
+// checks the time and the signature of the data returned by signed.
+func verifyMessage(message, prefix string, n int, now time.Time,
+	signed func(vault string, unix int64, fields []string) []byte) (string, security.PublicID, int64, []string, error) {
+	parts := strings.Split(strings.TrimPrefix(message, prefix), ":")
+	if len(parts) != 4+n || parts[0] == "" {
+		return "", "", 0, nil, core.Error(core.ParseError, "malformed relay message")
+	}
+	vault, publicID, fields := parts[0], security.PublicID(parts[1]), parts[3:3+n]
+	unix, err := strconv.ParseInt(parts[2], 10, 64)
+	if err != nil {
+		return "", "", 0, nil, core.Error(core.ParseError, "invalid time in relay message", err)
+	}
+	if skew := now.Sub(time.Unix(unix, 0)); skew > MaxAuthSkew || skew < -MaxAuthSkew {
+		return "", "", 0, nil, core.Error(core.AuthError, "relay message time is off by %s", skew)
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[3+n])
+	if err != nil {
+		return "", "", 0, nil, core.Error(core.ParseError, "invalid signature in relay message", err)
+	}
+	if !security.Verify(publicID, signed(vault, unix, fields), sig) {
+		return "", "", 0, nil, core.Error(core.AuthError, "invalid signature in relay message from %s", publicID)
+	}
+	return vault, publicID, unix, fields, nil
+}
+
+// AuthMessage returns the message that authenticates a connection to room as a member of the vault created by
+// owner.
+func AuthMessage(privateID security.PrivateID, room, vault string, owner security.PublicID) (string, error) {
+	return signMessage(privateID, AuthPrefix, vault, func(unix int64) []byte {
+		return authSignedData(room, vault, string(owner), unix)
+	}, string(owner))
+}
+
+// MembersMessage returns the message that sets the members of the vault in room, signed by the owner or by an
+// admin of the vault.
+func MembersMessage(signer security.PrivateID, room, vault string, list MemberList) (string, error) {
+	ids, admins := joinIDs(list.IDs), joinIDs(list.Admins)
+	version := strconv.FormatInt(list.Version, 10)
+	return signMessage(signer, MembersPrefix, vault, func(unix int64) []byte {
+		return membersSignedData(room, vault, unix, string(list.Owner), version, ids, admins)
+	}, string(list.Owner), version, ids, admins)
+}
+
+func joinIDs(ids []security.PublicID) string {
+	list := make([]string, len(ids))
+	for i, id := range ids {
+		list[i] = string(id)
+	}
+	return strings.Join(list, ",")
+}
+
+func splitIDs(s string) map[security.PublicID]struct{} {
+	ids := map[security.PublicID]struct{}{}
+	for _, id := range strings.Split(s, ",") {
+		if id != "" {
+			ids[security.PublicID(id)] = struct{}{}
+		}
+	}
+	return ids
+}
+
+// verifyAuth checks an auth message for room and returns the vault and the identity that signed it.
+func verifyAuth(message, room string, now time.Time) (string, identity, error) {
+	vault, publicID, _, fields, err := verifyMessage(message, AuthPrefix, 1, now,
+		func(vault string, unix int64, fields []string) []byte {
+			return authSignedData(room, vault, fields[0], unix)
+		})
+	if err != nil {
+		return "", identity{}, err
+	}
+	if fields[0] == "" {
+		return "", identity{}, core.Error(core.ParseError, "missing owner in relay auth message")
+	}
+	return vault, identity{id: publicID, owner: security.PublicID(fields[0])}, nil
+}
+
+// verifyMembers checks a members message for room and returns the members it sets. Whether the signer can set
+// them depends on the current members, which the caller checks.
+func verifyMembers(message, room string, now time.Time) (*members, error) {
+	vault, signer, unix, fields, err := verifyMessage(message, MembersPrefix, 4, now,
+		func(vault string, unix int64, fields []string) []byte {
+			return membersSignedData(room, vault, unix, fields[0], fields[1], fields[2], fields[3])
+		})
+	if err != nil {
+		return nil, err
+	}
+	if fields[0] == "" {
+		return nil, core.Error(core.ParseError, "missing owner in relay members message")
+	}
+	version, err := strconv.ParseInt(fields[1], 10, 64)
+	if err != nil {
+		return nil, core.Error(core.ParseError, "invalid version in relay members message", err)
+	}
+	return &members{Vault: vault, Owner: security.PublicID(fields[0]), Unix: unix, Version: version,
+		IDs: splitIDs(fields[2]), Admins: splitIDs(fields[3]), signer: signer}, nil
+}
@@ -0,0 +1,180 @@
+package relay
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/stregato/bao/lib/core"
+	"golang.org/x/net/websocket"
+)
+
+// Conn is a client connection to a relay server. Messages have the same format on all the transports.
+type Conn interface {
+	Send(message string) error
+	Receive() (string, error)
+	Close() error
+}
+
+const (
+	sseContentType = "text/event-stream"
+	sseOpenEvent   = "open"
+	sseConnParam   = "conn"
+	ssePostTimeout = 30 * time.Second
+)
+
+// Dial connects to the relay server at rawURL. The scheme selects the transport: ws and wss use a websocket,
+// while http and https use Server-Sent Events to receive and POST requests to send, for networks that block
+// websockets.
+func Dial(rawURL string) (Conn, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, core.Error(core.ParseError, "cannot parse relay URL", err)
+	}
+	if u.Host == "" {
+		return nil, core.Error(core.NetError, "relay host is empty")
+	}
+
+	switch u.Scheme {
+	case "ws", "wss":
+		origin := "http://" + u.Host
+		if u.Scheme == "wss" {
+			origin = "https://" + u.Host
+		}
+		ws, err := websocket.Dial(u.String(), "", origin)
+		if err != nil {
+			return nil, core.Error(core.NetError, "cannot connect to relay %s", u, err)
+		}
+		return &wsConn{ws: ws}, nil
+	case "http", "https":
+		return dialSSE(u)
+	default:
+		return nil, core.Error(core.NetError, "relay URL must be ws, wss, http or https: %s", u)
+	}
+}
+
+type wsConn struct {
+	ws *websocket.Conn
+}
+
+func (c *wsConn) Send(message string) error {
+	return websocket.Message.Send(c.ws, message)
+}
+
+func (c *wsConn) Receive() (string, error) {
+	var message string
+	err := websocket.Message.Receive(c.ws, &message)
+	return message, err
+}
+
+func (c *wsConn) Close() error {
+	return c.ws.Close()
+}
+
+// sseConn receives messages from an event stream and sends them with POST requests. The stream starts with an
+// open event that carries the token of the connection, which POST requests use to refer to it.
+type sseConn struct {
+	postURL string
+	body    io.ReadCloser
+	reader  *bufio.Reader
+	cancel  context.CancelFunc
+	client  *http.Client
+}
+
+func dialSSE(u *url.URL) (Conn, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		cancel()
+		return nil, core.Error(core.NetError, "cannot create request for relay %s", u, err)
+	}
+	req.Header.Set("Accept", sseContentType)
+	req.Header.Set("Cache-Control", "no-cache")
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		cancel()
+		return nil, core.Error(core.NetError, "cannot connect to relay %s", u, err)
+	}
+	if res.StatusCode != http.StatusOK || !strings.HasPrefix(res.Header.Get("Content-Type"), sseContentType) {
+		res.Body.Close()
+		cancel()
+		return nil, core.Error(core.NetError, "relay %s does not serve event streams: %s", u, res.Status)
+	}
+
+	c := &sseConn{
+		body:   res.Body,
+		reader: bufio.NewReader(res.Body),
+		cancel: cancel,
+		client: &http.Client{Timeout: ssePostTimeout},
+	}
+	event, token, err := c.readEvent()
+	if err != nil || event != sseOpenEvent || token == "" {
+		c.Close()
+		return nil, core.Error(core.NetError, "relay %s did not open the event stream", u, err)
+	}
+
+	post := *u
+	query := post.Query()
+	query.Set(sseConnParam, token)
+	post.RawQuery = query.Encode()
+	c.postURL = post.String()
+	return c, nil
+}
+
+// readEvent returns the type and the data of the next event in the stream.
+func (c *sseConn) readEvent() (event string, data string, err error) {
+	var lines []string
+	for {
+		line, err := c.reader.ReadString('\n')
+		if err != nil {
+			return "", "", err
+		}
+		line = strings.TrimRight(line, "\r\n")
+		switch {
+		case line == "":
+			if len(lines) > 0 || event != "" {
+				return event, strings.Join(lines, "\n"), nil
+			}
+		case strings.HasPrefix(line, ":"):
+			// comment, used as keep-alive
+		case strings.HasPrefix(line, "event:"):
+			event = strings.TrimSpace(line[len("event:"):])
+		case strings.HasPrefix(line, "data:"):
+			lines = append(lines, strings.TrimPrefix(line[len("data:"):], " "))
+		}
+	}
+}
+
+func (c *sseConn) Send(message string) error {
+	res, err := c.client.Post(c.postURL, "text/plain", strings.NewReader(message))
+	if err != nil {
+		return core.Error(core.NetError, "cannot post message to relay", err)
+	}
+	io.Copy(io.Discard, res.Body)
+	res.Body.Close()
+	if res.StatusCode != http.StatusNoContent && res.StatusCode != http.StatusOK {
+		return core.Error(core.NetError, "relay rejected message: %s", res.Status)
+	}
+	return nil
+}
+
+func (c *sseConn) Receive() (string, error) {
+	for {
+		event, data, err := c.readEvent()
+		if err != nil {
+			return "", err
+		}
+		if event == "" || event == "message" {
+			return data, nil
+		}
+	}
+}
+
+func (c *sseConn) Close() error {
+	c.cancel()
+	return c.body.Close()
+}
@@ -0,0 +1,507 @@
+// Package relay implements the sync relay server that notifies vault replicas about changes in the store.
+// It speaks the same websocket protocol as the Cloudflare worker in server/sync-relay-worker, so it can replace
+// the worker on-prem or run in-process in tests.
+//
+// Clients connect to /<vault-id>, which isolates the notifications of each vault. Where websockets are blocked,
+// clients can open a Server-Sent Events stream on the same path and send their messages with POST requests; see
+// Dial for the client side. A client watches a folder by
+// sending "+folder" and stops watching with "-folder". Any other message has the format
+// "vaultID:clientID:filename" and is relayed to all the connections of the vault that watch a folder matching
+// the filename, including the sender: clients share a connection among vault instances and drop their own
+// notifications by clientID.
+//
+// Before watching or notifying, a connection must authenticate with an AuthPrefix message signed by the identity
+// of a vault member, unless the server accepts anonymous clients. A connection can authenticate several identities,
+// e.g. for vault instances that share it. The members of a vault are kept by vault and owner, the identity that
+// created it, and are set with a MembersPrefix message signed by the owner or by an admin named in the current
+// members, so that the members stay current while the owner is offline. A connection receives and sends the
+// notifications of the vaults it authenticated for only, and only with the connections that trust the same owner.
+// An auth for a vault whose members are not known yet is kept pending until they are set, and the relay confirms
+// each auth it accepts with an AcceptedPrefix message. An auth that is not from a member is dropped, and the
+// connection is closed when it has no other identity. Set MembersFile to keep the members across restarts. Clients
+// also check that notifications come from vault members and keep filenames encrypted, so the relay never learns
+// them.
+package relay
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/stregato/bao/lib/core"
+	"github.com/stregato/bao/lib/security"
+	"golang.org/x/net/websocket"
+)
+
+const (
+	watchAddPrefix    = "+"
+	watchRemovePrefix = "-"
+	defaultRoom       = "default"
+)
+
+// Server is a sync relay server. It implements http.Handler so it can be mounted on an existing HTTP server.
+type Server struct {
+	Anonymous   bool                         // Accept clients that do not authenticate, e.g. older versions
+	Owners      map[string]security.PublicID // Owners by vault ID; auths and members for other owners are rejected
+	MembersFile string                       // File that keeps the members across restarts; empty keeps them in memory
+
+	mu          sync.Mutex
+	rooms       map[string]*room
+	members     map[string]*members // members of the vaults by room, vault ID and owner
+	loaded      bool                // loaded is set once the members in MembersFile are read
+	streams     map[string]*stream  // SSE connections by token
+	connCounter int64
+	ws          websocket.Server
+	listener    net.Listener
+	http        *http.Server
+}
+
+type room struct {
+	mu    sync.Mutex
+	conns map[*conn]struct{}
+}
+
+type conn struct {
+	id      int64
+	sender  sender
+	folders map[string]struct{}    // guarded by the room mutex
+	vaults  map[vaultIdentity]bool // identities the connection authenticated with; guarded by the room mutex
+	pending map[vaultIdentity]bool // identities waiting for the members of their vault; guarded by the room mutex
+	recvMu  sync.Mutex             // serializes the messages of the connection
+}
+
+// sender delivers messages to a client over a websocket or an event stream.
+type sender interface {
+	send(message string) error
+	close()
+}
+
+type wsSender struct {
+	mu sync.Mutex
+	ws *websocket.Conn
+}
+
+func (w *wsSender) send(message string) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return websocket.Message.Send(w.ws, message)
+}
+
+func (w *wsSender) close() {
+	w.ws.Close()
+}
+
+// NewServer returns a relay server that is not listening yet. Use ListenAndServe or mount it on an HTTP server.
+func NewServer() *Server {
+	s := &Server{rooms: map[string]*room{}, streams: map[string]*stream{}, members: map[string]*members{}}
+	s.ws = websocket.Server{
+		Handler: websocket.Handler(s.handle),
+		// Replicas run outside the browser, so the origin is not meaningful
+		Handshake: func(*websocket.Config, *http.Request) error { return nil },
+	}
+	return s
+}
+
+// Start runs a relay server in the background on addr, e.g. "127.0.0.1:0" to pick a free port in tests.
+func Start(addr string) (*Server, error) {
+	s := NewServer()
+	if err := s.start(addr); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// start runs the server in the background on addr.
+func (s *Server) start(addr string) error {
+	core.Start("addr %s", addr)
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return core.Error(core.NetError, "cannot listen on %s", addr, err)
+	}
+	s.listener = listener
+	s.http = &http.Server{Handler: s}
+	go s.http.Serve(listener)
+	core.End("relay listening on %s", listener.Addr())
+	return nil
+}
+
+// ListenAndServe runs the relay server on addr and blocks until the server fails or is closed.
+func (s *Server) ListenAndServe(addr string) error {
+	s.mu.Lock()
+	s.http = &http.Server{Addr: addr, Handler: s}
+	s.mu.Unlock()
+
+	core.Info("relay listening on %s", addr)
+	err := s.http.ListenAndServe()
+	if err != nil && err != http.ErrServerClosed {
+		return core.Error(core.NetError, "relay server on %s failed", addr, err)
+	}
+	return nil
+}
+
+// URL returns the websocket URL of a server started with Start.
+func (s *Server) URL() string {
+	if s.listener == nil {
+		return ""
+	}
+	return fmt.Sprintf("ws://%s", s.listener.Addr())
+}
+
+// Close stops the server and closes all the connections.
+func (s *Server) Close() error {
+	s.mu.Lock()
+	server := s.http
+	rooms := s.rooms
+	s.rooms = map[string]*room{}
+	s.streams = map[string]*stream{}
+	s.mu.Unlock()
+
+	for _, r := range rooms {
+		r.mu.Lock()
+		for c := range r.conns {
+			c.sender.close()
+		}
+		r.mu.Unlock()
+	}
+	if server != nil {
+		return server.Close()
+	}
+	return nil
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == "/health" {
+		w.Write([]byte("ok"))
+		return
+	}
+	switch {
+	case strings.EqualFold(r.Header.Get("Upgrade"), "websocket"):
+		s.ws.ServeHTTP(w, r)
+	case r.Method == http.MethodGet && strings.Contains(r.Header.Get("Accept"), sseContentType):
+		s.serveStream(w, r)
+	case r.Method == http.MethodPost && r.URL.Query().Has(sseConnParam):
+		s.servePost(w, r)
+	default:
+		http.Error(w, "Expected WebSocket upgrade or event stream", http.StatusBadRequest)
+	}
+}
+
+// join adds the connection to the room of the vault. Rooms are created on demand.
+func (s *Server) join(name string, sender sender) (*room, *conn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	r := s.rooms[name]
+	if r == nil {
+		r = &room{conns: map[*conn]struct{}{}}
+		s.rooms[name] = r
+	}
+	s.connCounter++
+	c := &conn{id: s.connCounter, sender: sender, folders: map[string]struct{}{},
+		vaults: map[vaultIdentity]bool{}, pending: map[vaultIdentity]bool{}}
+	r.mu.Lock()
+	r.conns[c] = struct{}{}
+	r.mu.Unlock()
+	return r, c
+}
+
+// leave removes the connection from the room and drops the room when empty.
+func (s *Server) leave(name string, r *room, c *conn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	r.mu.Lock()
+	delete(r.conns, c)
+	empty := len(r.conns) == 0
+	r.mu.Unlock()
+	if empty && s.rooms[name] == r {
+		delete(s.rooms, name)
+	}
+}
+
+func (s *Server) handle(ws *websocket.Conn) {
+	name := Room(ws.Request().URL.Path)
+
+	r, c := s.join(name, &wsSender{ws: ws})
+	core.Info("relay connection #%d opened for vault %s", c.id, name)
+	defer func() {
+		s.leave(name, r, c)
+		ws.Close()
+		core.Info("relay connection #%d closed for vault %s", c.id, name)
+	}()
+
+	for {
+		var message string
+		if err := websocket.Message.Receive(ws, &message); err != nil {
+			return
+		}
+		s.handleMessage(name, r, c, message)
+	}
+}
+
+func (s *Server) handleMessage(name string, r *room, c *conn, message string) {
+	c.recvMu.Lock()
+	defer c.recvMu.Unlock()
+
+	switch {
+	case strings.HasPrefix(message, MembersPrefix):
+		if err := s.setMembers(name, r, message); err != nil {
+			core.Info("relay connection #%d sent invalid members: %v", c.id, err)
+		}
+		return
+	case strings.HasPrefix(message, AuthPrefix):
+		s.authenticate(name, r, c, message)
+		return
+	}
+	r.mu.Lock()
+	authenticated := len(c.vaults) > 0 || len(c.pending) > 0
+	r.mu.Unlock()
+	if !authenticated && !s.Anonymous {
+		core.Info("relay connection #%d is not authenticated, dropping message", c.id)
+		return
+	}
+
+	switch {
+	case strings.HasPrefix(message, watchAddPrefix):
+		folder := message[len(watchAddPrefix):]
+		if folder == "" {
+			core.Info("relay connection #%d sent an empty folder in add request", c.id)
+			return
+		}
+		r.mu.Lock()
+		c.folders[folder] = struct{}{}
+		r.mu.Unlock()
+	case strings.HasPrefix(message, watchRemovePrefix):
+		folder := message[len(watchRemovePrefix):]
+		if folder == "" {
+			core.Info("relay connection #%d sent an empty folder in remove request", c.id)
+			return
+		}
+		r.mu.Lock()
+		delete(c.folders, folder)
+		r.mu.Unlock()
+	default:
+		parts := strings.SplitN(message, ":", 3)
+		if len(parts) != 3 || parts[0] == "" || parts[1] == "" || parts[2] == "" {
+			core.Info("relay connection #%d sent a malformed message: %q", c.id, message)
+			return
+		}
+		r.broadcast(c, message, parts[0], parts[2], s.Anonymous)
+	}
+}
+
+// vaultIdentity is an identity of a connection for a vault.
+type vaultIdentity struct {
+	vault string
+	identity
+}
+
+// authenticate verifies an auth message. The identity is authenticated for the vault when it is a member, and is
+// dropped when it is not. While the members of the vault are not known, e.g. after the relay restarted, the identity
+// is kept pending until they are set.
+func (s *Server) authenticate(name string, r *room, c *conn, message string) {
+	vault, id, err := verifyAuth(message, name, core.Now())
+	if err == nil && s.Owners[vault] != "" && id.owner != s.Owners[vault] {
+		err = core.Error(core.AuthError, "%s is not the owner of vault %s", id.owner, vault)
+	}
+	if err != nil {
+		core.Info("relay connection #%d failed authentication, closing: %v", c.id, err)
+		c.sender.close()
+		return
+	}
+
+	s.mu.Lock()
+	s.loadMembers()
+	m := s.members[membersKey(name, vault, id.owner)]
+	s.mu.Unlock()
+	vi := vaultIdentity{vault, id}
+	switch {
+	case m == nil:
+		r.mu.Lock()
+		c.pending[vi] = true
+		r.mu.Unlock()
+		core.Info("relay connection #%d waits for the members of vault %s to authenticate %s", c.id, vault, id.id)
+		if s.Anonymous {
+			c.accept(vi)
+		}
+	case m.has(id.id):
+		r.mu.Lock()
+		delete(c.pending, vi)
+		c.vaults[vi] = true
+		r.mu.Unlock()
+		core.Info("relay connection #%d authenticated as %s for vault %s", c.id, id.id, vault)
+		c.accept(vi)
+	default:
+		r.mu.Lock()
+		delete(c.pending, vi)
+		delete(c.vaults, vi)
+		empty := len(c.vaults) == 0 && len(c.pending) == 0
+		r.mu.Unlock()
+		core.Info("relay connection #%d failed authentication: %s is not a member of vault %s", c.id, id.id, vault)
+		if empty {
+			c.sender.close()
+		}
+	}
+}
+
+// accept confirms to the client that the relay accepted the identity for the vault.
+func (c *conn) accept(vi vaultIdentity) {
+	if err := c.sender.send(AcceptedPrefix + vi.vault + ":" + string(vi.id)); err != nil {
+		core.Info("cannot confirm auth to connection #%d: %v", c.id, err)
+	}
+}
+
+func membersKey(name, vault string, owner security.PublicID) string {
+	return name + "/" + vault + "/" + string(owner)
+}
+
+// setMembers sets the members of a vault from a members message signed by the owner or by an admin in the current
+// members. Pending identities of members are authenticated, and the identities that are not members are dropped.
+func (s *Server) setMembers(name string, r *room, message string) error {
+	m, err := verifyMembers(message, name, core.Now())
+	if err != nil {
+		return err
+	}
+	if owner := s.Owners[m.Vault]; owner != "" && m.Owner != owner {
+		return core.Error(core.AuthError, "%s is not the owner of vault %s", m.Owner, m.Vault)
+	}
+	key := membersKey(name, m.Vault, m.Owner)
+	s.mu.Lock()
+	s.loadMembers()
+	current := s.members[key]
+	switch {
+	case m.signer != m.Owner && (current == nil || !current.canSet(m.signer)):
+		err = core.Error(core.AuthError, "%s cannot set the members of vault %s", m.signer, m.Vault)
+	case current != nil && (m.Version < current.Version || m.Version == current.Version && m.Unix < current.Unix):
+		err = core.Error(core.AuthError, "members of vault %s are older than the current ones", m.Vault)
+	default:
+		s.members[key] = m
+		s.saveMembers()
+	}
+	s.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	var accepted []vaultIdentity
+	var acceptedConns, revoked []*conn
+	r.mu.Lock()
+	for c := range r.conns {
+		dropped := false
+		for vi := range c.pending {
+			if vi.vault != m.Vault || vi.owner != m.Owner {
+				continue
+			}
+			delete(c.pending, vi)
+			if m.has(vi.id) {
+				c.vaults[vi] = true
+				accepted = append(accepted, vi)
+				acceptedConns = append(acceptedConns, c)
+			} else {
+				dropped = true
+			}
+		}
+		for vi := range c.vaults {
+			if vi.vault == m.Vault && vi.owner == m.Owner && !m.has(vi.id) {
+				delete(c.vaults, vi)
+				dropped = true
+			}
+		}
+		if dropped && len(c.vaults) == 0 && len(c.pending) == 0 {
+			revoked = append(revoked, c)
+		}
+	}
+	r.mu.Unlock()
+	for i, c := range acceptedConns {
+		c.accept(accepted[i])
+	}
+	for _, c := range revoked {
+		core.Info("relay connection #%d is not a member of vault %s, closing", c.id, m.Vault)
+		c.sender.close()
+	}
+	core.Info("relay members of vault %s set by %s: %d members", m.Vault, m.signer, len(m.IDs))
+	return nil
+}
+
+// loadMembers reads the members in MembersFile the first time they are needed. The caller must hold the mutex.
+func (s *Server) loadMembers() {
+	if s.loaded || s.MembersFile == "" {
+		return
+	}
+	s.loaded = true
+	data, err := os.ReadFile(s.MembersFile)
+	if os.IsNotExist(err) {
+		return
+	}
+	if err == nil {
+		err = json.Unmarshal(data, &s.members)
+	}
+	if err != nil {
+		core.LogError("cannot read relay members from %s", s.MembersFile, err)
+	}
+}
+
+// saveMembers writes the members to MembersFile. The caller must hold the mutex.
+func (s *Server) saveMembers() {
+	if s.MembersFile == "" {
+		return
+	}
+	data, err := json.Marshal(s.members)
+	if err == nil {
+		err = os.WriteFile(s.MembersFile+".tmp", data, 0600)
+	}
+	if err == nil {
+		err = os.Rename(s.MembersFile+".tmp", s.MembersFile)
+	}
+	if err != nil {
+		core.LogError("cannot write relay members to %s", s.MembersFile, err)
+	}
+}
+
+// broadcast relays the message of the sender to the connections that watch a folder matching the filename and,
+// unless the server accepts anonymous clients, authenticated for the vault with the same owner as the sender.
+func (r *room) broadcast(sender *conn, message, vault, filename string, anonymous bool) {
+	r.mu.Lock()
+	owners := map[security.PublicID]bool{}
+	for vi := range sender.vaults {
+		if vi.vault == vault {
+			owners[vi.owner] = true
+		}
+	}
+	if len(owners) == 0 && !anonymous {
+		r.mu.Unlock()
+		core.Info("relay connection #%d is not authenticated for vault %s, dropping message", sender.id, vault)
+		return
+	}
+	var targets []*conn
+	for c := range r.conns {
+		trusted := anonymous
+		for vi := range c.vaults {
+			trusted = trusted || vi.vault == vault && owners[vi.owner]
+		}
+		if trusted && matchesAnyFolder(filename, c.folders) {
+			targets = append(targets, c)
+		}
+	}
+	r.mu.Unlock()
+
+	for _, c := range targets {
+		if err := c.sender.send(message); err != nil {
+			core.Info("cannot relay message to connection #%d: %v", c.id, err)
+			c.sender.close()
+		}
+	}
+}
+
+func matchesAnyFolder(name string, folders map[string]struct{}) bool {
+	for folder := range folders {
+		if name == folder || strings.HasPrefix(name, folder+"/") {
+			return true
+		}
+	}
+	return false
+}
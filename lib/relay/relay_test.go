@@ -0,0 +1,361 @@
+package relay
+
+import (
+	"io"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stregato/bao/lib/core"
+	"github.com/stregato/bao/lib/security"
+	"golang.org/x/net/websocket"
+)
+
+// testOwner owns the vaults in the tests. Vaults are named like their rooms.
+var testOwner = security.NewPrivateIDMust()
+var testOwnerID, _ = testOwner.PublicID()
+
+// testVersion orders the members lists in the tests.
+var testVersion int64
+
+// membersTest returns a members message for the vault of testOwner signed by signer, newer than the previous ones.
+func membersTest(t *testing.T, signer security.PrivateID, vault string, members []security.PublicID,
+	admins ...security.PublicID) string {
+	t.Helper()
+	testVersion++
+	list, err := MembersMessage(signer, Room(vault), vault, MemberList{Owner: testOwnerID, Version: testVersion,
+		IDs: members, Admins: admins})
+	core.TestErr(t, err, "cannot create members message: %v")
+	return list
+}
+
+// sendTest sends the members message of testOwner and the auth message of id for the vault on the connection, and
+// waits for the relay to accept the auth.
+func sendTest(t *testing.T, ws *websocket.Conn, vault string, id security.PrivateID, members ...security.PublicID) {
+	t.Helper()
+	err := websocket.Message.Send(ws, membersTest(t, testOwner, vault, members))
+	core.TestErr(t, err, "cannot send members message: %v")
+	authTest(t, ws, vault, id)
+	acceptedTest(t, ws, vault, id)
+}
+
+// authTest sends the auth message of id for the vault of testOwner on the connection.
+func authTest(t *testing.T, ws *websocket.Conn, vault string, id security.PrivateID) {
+	t.Helper()
+	auth, err := AuthMessage(id, Room(vault), vault, testOwnerID)
+	core.TestErr(t, err, "cannot create auth message: %v")
+	err = websocket.Message.Send(ws, auth)
+	core.TestErr(t, err, "cannot send auth message: %v")
+}
+
+// acceptedTest waits for the relay to accept the auth of id for the vault on the connection.
+func acceptedTest(t *testing.T, ws *websocket.Conn, vault string, id security.PrivateID) {
+	t.Helper()
+	publicID, _ := id.PublicID()
+	got, ok := receiveTest(ws, time.Second)
+	core.Assert(t, ok && got == AcceptedPrefix+vault+":"+string(publicID), "expected the auth accepted, got %q", got)
+}
+
+func dialTest(t *testing.T, s *Server, vault string, folders ...string) *websocket.Conn {
+	t.Helper()
+	ws, err := websocket.Dial(s.URL()+"/"+vault, "", "http://localhost")
+	core.TestErr(t, err, "cannot dial relay: %v")
+	sendTest(t, ws, vault, testOwner)
+	for _, folder := range folders {
+		err = websocket.Message.Send(ws, watchAddPrefix+folder)
+		core.TestErr(t, err, "cannot send watch message: %v")
+	}
+	return ws
+}
+
+func receiveTest(ws *websocket.Conn, timeout time.Duration) (string, bool) {
+	ws.SetReadDeadline(time.Now().Add(timeout))
+	var message string
+	err := websocket.Message.Receive(ws, &message)
+	return message, err == nil
+}
+
+// closedTest returns true when the relay closes the connection within a second.
+func closedTest(ws *websocket.Conn) bool {
+	ws.SetReadDeadline(time.Now().Add(time.Second))
+	var message string
+	err := websocket.Message.Receive(ws, &message)
+	return err == io.EOF
+}
+
+func TestRelay(t *testing.T) {
+	s, err := Start("127.0.0.1:0")
+	core.TestErr(t, err, "Start failed: %v")
+	defer s.Close()
+
+	res, err := http.Get(strings.Replace(s.URL(), "ws://", "http://", 1) + "/health")
+	core.TestErr(t, err, "health check failed: %v")
+	body, _ := io.ReadAll(res.Body)
+	res.Body.Close()
+	core.Assert(t, string(body) == "ok", "unexpected health response %q", body)
+
+	alice := dialTest(t, s, "v1", "v1/data")
+	defer alice.Close()
+	bob := dialTest(t, s, "v1", "v1/data", "v1/blockchain")
+	defer bob.Close()
+	other := dialTest(t, s, "v2", "v1/data")
+	defer other.Close()
+	time.Sleep(100 * time.Millisecond) // let the relay process the watch messages
+
+	message := "v1:alice:v1/data/202401/h/123"
+	err = websocket.Message.Send(alice, message)
+	core.TestErr(t, err, "cannot send notification: %v")
+
+	got, ok := receiveTest(bob, time.Second)
+	core.Assert(t, ok && got == message, "bob should receive the notification, got %q", got)
+	got, ok = receiveTest(alice, time.Second)
+	core.Assert(t, ok && got == message, "the sender connection receives the notification too, got %q", got)
+	_, ok = receiveTest(other, 200*time.Millisecond)
+	core.Assert(t, !ok, "notifications must not cross vaults")
+
+	err = websocket.Message.Send(alice, "v1:alice:v1/blockchain/1")
+	core.TestErr(t, err, "cannot send notification: %v")
+	_, ok = receiveTest(bob, time.Second)
+	core.Assert(t, ok, "bob watches the blockchain folder")
+	_, ok = receiveTest(alice, 200*time.Millisecond)
+	core.Assert(t, !ok, "alice does not watch the blockchain folder")
+
+	bob = dialTest(t, s, "v1", "v1/data")
+	defer bob.Close()
+	err = websocket.Message.Send(bob, watchRemovePrefix+"v1/data")
+	core.TestErr(t, err, "cannot send unwatch message: %v")
+	err = websocket.Message.Send(bob, "malformed")
+	core.TestErr(t, err, "cannot send malformed message: %v")
+	time.Sleep(100 * time.Millisecond)
+	err = websocket.Message.Send(alice, message)
+	core.TestErr(t, err, "cannot send notification: %v")
+	_, ok = receiveTest(bob, 200*time.Millisecond)
+	core.Assert(t, !ok, "bob should not receive notifications after unwatching")
+}
+
+func TestRelayAuth(t *testing.T) {
+	s, err := Start("127.0.0.1:0")
+	core.TestErr(t, err, "Start failed: %v")
+	defer s.Close()
+
+	bob := security.NewPrivateIDMust()
+	bobID, _ := bob.PublicID()
+	member := dialTest(t, s, "v1", "data")
+	defer member.Close()
+	bobConn, err := websocket.Dial(s.URL()+"/v1", "", "http://localhost")
+	core.TestErr(t, err, "cannot dial relay: %v")
+	defer bobConn.Close()
+	sendTest(t, bobConn, "v1", bob, bobID)
+	websocket.Message.Send(bobConn, watchAddPrefix+"data")
+
+	// an anonymous client can neither watch nor notify
+	anonymous, err := websocket.Dial(s.URL()+"/v1", "", "http://localhost")
+	core.TestErr(t, err, "cannot dial relay: %v")
+	defer anonymous.Close()
+	websocket.Message.Send(anonymous, watchAddPrefix+"data")
+	time.Sleep(100 * time.Millisecond)
+	websocket.Message.Send(anonymous, "v1:intruder:data/fake")
+	_, ok := receiveTest(member, 200*time.Millisecond)
+	core.Assert(t, !ok, "notifications from unauthenticated clients must be dropped")
+
+	websocket.Message.Send(member, "v1:member:data/real")
+	_, ok = receiveTest(anonymous, 200*time.Millisecond)
+	core.Assert(t, !ok, "unauthenticated clients must not receive notifications")
+	_, ok = receiveTest(member, time.Second)
+	core.Assert(t, ok, "authenticated clients receive notifications")
+	_, ok = receiveTest(bobConn, time.Second)
+	core.Assert(t, ok, "members receive notifications")
+
+	// a signature for another room and an identity that is not a member are rejected
+	wrongRoom, err := websocket.Dial(s.URL()+"/v1", "", "http://localhost")
+	core.TestErr(t, err, "cannot dial relay: %v")
+	defer wrongRoom.Close()
+	auth, err := AuthMessage(testOwner, "v2", "v1", testOwnerID)
+	core.TestErr(t, err, "cannot create auth message: %v")
+	websocket.Message.Send(wrongRoom, auth)
+	core.Assert(t, closedTest(wrongRoom), "a failed authentication must close the connection")
+
+	intruder := security.NewPrivateIDMust()
+	intruderID, _ := intruder.PublicID()
+	outsider, err := websocket.Dial(s.URL()+"/v1", "", "http://localhost")
+	core.TestErr(t, err, "cannot dial relay: %v")
+	defer outsider.Close()
+	auth, err = AuthMessage(intruder, "v1", "v1", testOwnerID)
+	core.TestErr(t, err, "cannot create auth message: %v")
+	websocket.Message.Send(outsider, auth)
+	core.Assert(t, closedTest(outsider), "an identity that is not a member must be rejected")
+
+	// an intruder that claims the vault only reaches the connections that trust it as the owner
+	claimer, err := websocket.Dial(s.URL()+"/v1", "", "http://localhost")
+	core.TestErr(t, err, "cannot dial relay: %v")
+	defer claimer.Close()
+	list, err := MembersMessage(intruder, "v1", "v1", MemberList{Owner: intruderID, IDs: []security.PublicID{intruderID}})
+	core.TestErr(t, err, "cannot create members message: %v")
+	websocket.Message.Send(claimer, list)
+	auth, err = AuthMessage(intruder, "v1", "v1", intruderID)
+	core.TestErr(t, err, "cannot create auth message: %v")
+	websocket.Message.Send(claimer, auth)
+	acceptedTest(t, claimer, "v1", intruder)
+	websocket.Message.Send(claimer, watchAddPrefix+"data")
+	time.Sleep(100 * time.Millisecond)
+	websocket.Message.Send(claimer, "v1:intruder:data/fake")
+	_, ok = receiveTest(claimer, time.Second)
+	core.Assert(t, ok, "the intruder is authenticated for its own members")
+	_, ok = receiveTest(member, 200*time.Millisecond)
+	core.Assert(t, !ok, "notifications must not cross owners")
+	websocket.Message.Send(member, "v1:member:data/real")
+	_, ok = receiveTest(claimer, 200*time.Millisecond)
+	core.Assert(t, !ok, "an intruder must not receive the notifications of the real vault")
+	_, ok = receiveTest(bobConn, time.Second)
+	core.Assert(t, ok, "members still receive notifications after a foreign members list")
+	receiveTest(member, time.Second)
+
+	// removing a member closes its connection
+	websocket.Message.Send(member, membersTest(t, testOwner, "v1", nil))
+	core.Assert(t, closedTest(bobConn), "the connection of a removed member must be closed")
+
+	_, _, err = verifyAuth(auth, "v1", core.Now().Add(MaxAuthSkew+time.Minute))
+	core.Assert(t, err != nil, "old auth messages must be rejected")
+}
+
+func TestRelayPendingAuth(t *testing.T) {
+	s, err := Start("127.0.0.1:0")
+	core.TestErr(t, err, "Start failed: %v")
+	defer s.Close()
+
+	// a member that connects before the owner, e.g. after the relay restarted, waits for the members
+	bob := security.NewPrivateIDMust()
+	bobID, _ := bob.PublicID()
+	bobConn, err := websocket.Dial(s.URL()+"/v1", "", "http://localhost")
+	core.TestErr(t, err, "cannot dial relay: %v")
+	defer bobConn.Close()
+	auth, err := AuthMessage(bob, "v1", "v1", testOwnerID)
+	core.TestErr(t, err, "cannot create auth message: %v")
+	websocket.Message.Send(bobConn, auth)
+	websocket.Message.Send(bobConn, watchAddPrefix+"data")
+	_, ok := receiveTest(bobConn, 200*time.Millisecond)
+	core.Assert(t, !ok, "a pending connection must stay open")
+
+	owner, err := websocket.Dial(s.URL()+"/v1", "", "http://localhost")
+	core.TestErr(t, err, "cannot dial relay: %v")
+	defer owner.Close()
+	sendTest(t, owner, "v1", testOwner, bobID)
+	websocket.Message.Send(owner, watchAddPrefix+"data")
+	time.Sleep(100 * time.Millisecond)
+	websocket.Message.Send(owner, "v1:owner:data/1")
+	acceptedTest(t, bobConn, "v1", bob)
+	got, ok := receiveTest(bobConn, time.Second)
+	core.Assert(t, ok && got == "v1:owner:data/1", "a pending member is authenticated by the members, got %q", got)
+}
+
+func TestRelayMembers(t *testing.T) {
+	s := NewServer()
+	s.MembersFile = filepath.Join(t.TempDir(), "members.json")
+	core.TestErr(t, s.start("127.0.0.1:0"), "cannot start relay: %v")
+	defer s.Close()
+
+	carol, bob, dave := security.NewPrivateIDMust(), security.NewPrivateIDMust(), security.NewPrivateIDMust()
+	carolID, _ := carol.PublicID()
+	bobID, _ := bob.PublicID()
+	daveID, _ := dave.PublicID()
+	dial := func(s *Server) *websocket.Conn {
+		ws, err := websocket.Dial(s.URL()+"/v1", "", "http://localhost")
+		core.TestErr(t, err, "cannot dial relay: %v")
+		return ws
+	}
+
+	owner := dial(s)
+	defer owner.Close()
+	websocket.Message.Send(owner, membersTest(t, testOwner, "v1", []security.PublicID{carolID, bobID}, carolID))
+	authTest(t, owner, "v1", testOwner)
+	acceptedTest(t, owner, "v1", testOwner)
+	bobConn := dial(s)
+	defer bobConn.Close()
+	authTest(t, bobConn, "v1", bob)
+	acceptedTest(t, bobConn, "v1", bob)
+	websocket.Message.Send(bobConn, watchAddPrefix+"data")
+
+	// only the owner and the admins set the members
+	websocket.Message.Send(bobConn, membersTest(t, bob, "v1", []security.PublicID{carolID, bobID, daveID}, carolID))
+	daveConn := dial(s)
+	defer daveConn.Close()
+	authTest(t, daveConn, "v1", dave)
+	core.Assert(t, closedTest(daveConn), "members set by a member that is not an admin must be rejected")
+	websocket.Message.Send(owner, membersTest(t, carol, "v1", []security.PublicID{carolID, bobID, daveID}, carolID))
+	daveConn = dial(s)
+	defer daveConn.Close()
+	authTest(t, daveConn, "v1", dave)
+	acceptedTest(t, daveConn, "v1", dave)
+
+	// members older than the current ones are rejected
+	old, err := MembersMessage(carol, "v1", "v1", MemberList{Owner: testOwnerID, Version: testVersion - 1,
+		IDs: []security.PublicID{carolID}, Admins: []security.PublicID{carolID}})
+	core.TestErr(t, err, "cannot create members message: %v")
+	websocket.Message.Send(owner, old)
+	core.Assert(t, !closedTest(bobConn), "older members must be rejected")
+
+	// identities that share a connection are kept apart
+	authTest(t, bobConn, "v1", dave)
+	acceptedTest(t, bobConn, "v1", dave)
+	websocket.Message.Send(owner, membersTest(t, carol, "v1", []security.PublicID{carolID, daveID}, carolID))
+	time.Sleep(100 * time.Millisecond)
+	websocket.Message.Send(owner, "v1:owner:data/1")
+	got, ok := receiveTest(bobConn, time.Second)
+	core.Assert(t, ok && got == "v1:owner:data/1", "the connection keeps the identities that are members, got %q", got)
+
+	// the members survive a restart, so members authenticate while the owner is offline
+	s.Close()
+	restarted := NewServer()
+	restarted.MembersFile = s.MembersFile
+	core.TestErr(t, restarted.start("127.0.0.1:0"), "cannot start relay: %v")
+	defer restarted.Close()
+	daveConn = dial(restarted)
+	defer daveConn.Close()
+	authTest(t, daveConn, "v1", dave)
+	acceptedTest(t, daveConn, "v1", dave)
+	bobConn = dial(restarted)
+	defer bobConn.Close()
+	authTest(t, bobConn, "v1", bob)
+	core.Assert(t, closedTest(bobConn), "a removed member must be rejected after a restart")
+}
+
+func TestRelaySSE(t *testing.T) {
+	s, err := Start("127.0.0.1:0")
+	core.TestErr(t, err, "Start failed: %v")
+	defer s.Close()
+	httpURL := strings.Replace(s.URL(), "ws://", "http://", 1)
+
+	ws := dialTest(t, s, "v1", "data")
+	defer ws.Close()
+	sse, err := Dial(httpURL + "/v1")
+	core.TestErr(t, err, "cannot dial relay over SSE: %v")
+	defer sse.Close()
+	auth, err := AuthMessage(testOwner, "v1", "v1", testOwnerID)
+	core.TestErr(t, err, "cannot create auth message: %v")
+	core.TestErr(t, sse.Send(auth), "cannot send auth message: %v")
+	got, err := sse.Receive()
+	core.TestErr(t, err, "cannot receive auth confirmation: %v")
+	core.Assert(t, got == AcceptedPrefix+"v1:"+string(testOwnerID), "expected the auth accepted, got %q", got)
+	core.TestErr(t, sse.Send(watchAddPrefix+"data"), "cannot send watch message: %v")
+
+	// messages flow in both directions between the transports
+	core.TestErr(t, sse.Send("v1:sse:data/1"), "cannot send notification: %v")
+	got, ok := receiveTest(ws, time.Second)
+	core.Assert(t, ok && got == "v1:sse:data/1", "the websocket client should receive the notification, got %q", got)
+	got, err = sse.Receive()
+	core.TestErr(t, err, "cannot receive notification: %v")
+	core.Assert(t, got == "v1:sse:data/1", "the sender receives the notification too, got %q", got)
+
+	err = websocket.Message.Send(ws, "v1:ws:data/2")
+	core.TestErr(t, err, "cannot send notification: %v")
+	got, err = sse.Receive()
+	core.TestErr(t, err, "cannot receive notification: %v")
+	core.Assert(t, got == "v1:ws:data/2", "the SSE client should receive the notification, got %q", got)
+
+	res, err := http.Post(httpURL+"/v1?conn=unknown", "text/plain", strings.NewReader("v1:intruder:data/3"))
+	core.TestErr(t, err, "post failed: %v")
+	res.Body.Close()
+	core.Assert(t, res.StatusCode == http.StatusNotFound, "posts to unknown streams must be rejected, got %d", res.StatusCode)
+}
@@ -0,0 +1,128 @@
+package relay
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/stregato/bao/lib/core"
+)
+
+const (
+	sseQueueSize     = 256
+	sseKeepAlive     = 20 * time.Second
+	sseMaxPostLength = 64 * 1024
+)
+
+// stream is an SSE connection. POST requests refer to it by its token, which is random so that other clients
+// cannot send messages on behalf of the connection.
+type stream struct {
+	name string
+	room *room
+	conn *conn
+}
+
+// sseSender queues the messages for the goroutine that writes the event stream.
+type sseSender struct {
+	out  chan string
+	done chan struct{}
+	once sync.Once
+}
+
+func (e *sseSender) send(message string) error {
+	select {
+	case <-e.done:
+		return core.Error(core.NetError, "event stream closed")
+	case e.out <- message:
+		return nil
+	default:
+		return core.Error(core.NetError, "event stream queue is full")
+	}
+}
+
+func (e *sseSender) close() {
+	e.once.Do(func() { close(e.done) })
+}
+
+func newStreamToken() string {
+	var token [16]byte
+	rand.Read(token[:])
+	return hex.EncodeToString(token[:])
+}
+
+// serveStream opens an event stream. The first event has type open and carries the token of the connection;
+// the following events carry the relayed messages.
+func (s *Server) serveStream(w http.ResponseWriter, req *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming not supported", http.StatusInternalServerError)
+		return
+	}
+
+	name := Room(req.URL.Path)
+	sender := &sseSender{out: make(chan string, sseQueueSize), done: make(chan struct{})}
+	r, c := s.join(name, sender)
+	token := newStreamToken()
+	s.mu.Lock()
+	s.streams[token] = &stream{name: name, room: r, conn: c}
+	s.mu.Unlock()
+	core.Info("relay event stream #%d opened for vault %s", c.id, name)
+	defer func() {
+		s.mu.Lock()
+		delete(s.streams, token)
+		s.mu.Unlock()
+		s.leave(name, r, c)
+		sender.close()
+		core.Info("relay event stream #%d closed for vault %s", c.id, name)
+	}()
+
+	w.Header().Set("Content-Type", sseContentType)
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no") // disable buffering in nginx
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintf(w, "event: %s\ndata: %s\n\n", sseOpenEvent, token)
+	flusher.Flush()
+
+	keepAlive := time.NewTicker(sseKeepAlive)
+	defer keepAlive.Stop()
+	for {
+		var err error
+		select {
+		case <-req.Context().Done():
+			return
+		case <-sender.done:
+			return
+		case message := <-sender.out:
+			_, err = fmt.Fprintf(w, "data: %s\n\n", message)
+		case <-keepAlive.C:
+			_, err = io.WriteString(w, ": ping\n\n")
+		}
+		if err != nil {
+			return
+		}
+		flusher.Flush()
+	}
+}
+
+// servePost handles a message sent by the client of an event stream.
+func (s *Server) servePost(w http.ResponseWriter, req *http.Request) {
+	s.mu.Lock()
+	st := s.streams[req.URL.Query().Get(sseConnParam)]
+	s.mu.Unlock()
+	if st == nil || st.name != Room(req.URL.Path) {
+		http.Error(w, "Unknown event stream", http.StatusNotFound)
+		return
+	}
+
+	body, err := io.ReadAll(io.LimitReader(req.Body, sseMaxPostLength))
+	if err != nil {
+		http.Error(w, "Cannot read message", http.StatusBadRequest)
+		return
+	}
+	s.handleMessage(st.name, st.room, st.conn, string(body))
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,478 @@
+package replica
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/stregato/bao/lib/core"
+	"github.com/stregato/bao/lib/sqlx"
+	"github.com/stregato/bao/lib/vault"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+// A checkpoint is a snapshot of a replica stored in the vault, so that a replica that joins after the early
+// transactions expired can still build the tables. It holds the base of the ordered tables, the transactions
+// applied after the base, and the merged tables with their merge state, so the replica that restores it orders and
+// merges the next transactions like the one that wrote it. The body of the file is compressed and encrypted like
+// any other file; the head carries the position of the checkpoint in the order.
+//
+// Sync restores the latest checkpoint when the replica is behind it, and writes a new checkpoint when the latest
+// one is older than half the retention of the vault, so a checkpoint is always available before the transactions
+// it covers expire. Only the checkpoints written by admins are restored, since a checkpoint replaces the tables
+// without checking the grants, and only admins write them.
+var checkpointDir = path.Join(replicaDir, "checkpoints")
+
+// checkpointHead is the head of a checkpoint file.
+type checkpointHead struct {
+	Base orderKey // Base is the position of the base
+	Last orderKey // Last is the position of the last transaction applied
+}
+
+type checkpoint struct {
+	checkpointHead
+	Tables  map[string]tableRows // Tables are the base of the ordered tables, the merged tables and the merge state
+	Log     []transaction        // Log are the transactions applied after the base, replayed with the rejections in Tables
+	Schemas []schema             // Schemas are the schemas applied to the replica
+}
+
+type tableRows struct {
+	Columns []string
+	Rows    [][]any
+}
+
+// stateTables are the internal tables copied in a checkpoint: the merge state and the rejected transactions.
+var stateTables = []string{"replica_cells", "replica_tags", "replica_rejected"}
+
+// Checkpoint writes a snapshot of the replicated tables to the vault. Transactions that expire after the
+// checkpoint are not needed by the replicas that restore it. Only admins can write checkpoints.
+func (ds *Replica) Checkpoint() error {
+	core.Start("")
+	ds.syncLock.Lock()
+	defer ds.syncLock.Unlock()
+
+	admin, err := ds.isAdmin(ds.vault.UserID)
+	if err != nil {
+		return err
+	}
+	if !admin {
+		return core.Error(core.AccessDenied, "only admins can write checkpoints in replica of vault %s", ds.vault.ID)
+	}
+	err = ds.writeCheckpoint()
+	if err != nil {
+		return err
+	}
+	core.End("")
+	return nil
+}
+
+func (ds *Replica) writeCheckpoint() error {
+	core.Start("")
+	ds.queryLock.Lock()
+	cp, err := ds.readCheckpoint()
+	ds.queryLock.Unlock()
+	if err != nil {
+		return err
+	}
+
+	data, err := msgpack.Marshal(cp)
+	if err != nil {
+		return core.Error(core.EncodeError, "cannot marshal checkpoint", err)
+	}
+	data, err = core.GzipCompress(data)
+	if err != nil {
+		return core.Error(core.EncodeError, "cannot compress checkpoint", err)
+	}
+	head, err := msgpack.Marshal(cp.checkpointHead)
+	if err != nil {
+		return core.Error(core.EncodeError, "cannot marshal checkpoint head", err)
+	}
+
+	f, err := os.CreateTemp("", "bao-checkpoint")
+	if err != nil {
+		return core.Error(core.FileError, "cannot create temporary file for checkpoint", err)
+	}
+	defer os.Remove(f.Name())
+	_, err = f.Write(data)
+	f.Close()
+	if err != nil {
+		return core.Error(core.FileError, "cannot write checkpoint to %s", f.Name(), err)
+	}
+
+	name := path.Join(checkpointDir, strconv.FormatUint(core.SnowID(), 16))
+	_, err = ds.vault.Write(name, f.Name(), head, vault.IOOption{})
+	if err != nil {
+		return core.Error(core.FileError, "cannot write checkpoint %s", name, err)
+	}
+	core.End("checkpoint %s, %d tables, %d transactions, %d bytes", name, len(cp.Tables), len(cp.Log), len(data))
+	return nil
+}
+
+// readCheckpoint builds a checkpoint from the state of the replica.
+func (ds *Replica) readCheckpoint() (checkpoint, error) {
+	tx, err := ds.db.Begin()
+	if err != nil {
+		return checkpoint{}, core.Error(core.DbError, "cannot start transaction", err)
+	}
+	defer tx.Rollback() // read only
+
+	cp := checkpoint{Tables: map[string]tableRows{}}
+	err = tx.QueryRow("GET_REPLICA_STATE", sqlx.Args{}, &cp.Base.Hlc, &cp.Base.Origin)
+	if err != nil && err != sqlx.ErrNoRows {
+		return checkpoint{}, core.Error(core.DbError, "cannot read replica state", err)
+	}
+	cp.Last = cp.Base
+	cp.Schemas, err = ds.readSchemas()
+	if err != nil {
+		return checkpoint{}, err
+	}
+
+	tables, err := listTables(tx, "GET_REPLICATED_TABLES")
+	if err != nil {
+		return checkpoint{}, err
+	}
+	bases, err := listTables(tx, "GET_REPLICA_BASE_TABLES")
+	if err != nil {
+		return checkpoint{}, err
+	}
+	for _, table := range tables {
+		source := table
+		if !ds.isMerged(table) {
+			source = "replica_base_" + table
+			if !slices.Contains(bases, table) {
+				continue // the table was created after the base
+			}
+		}
+		cp.Tables[table], err = readTableRows(tx, table, source)
+		if err != nil {
+			return checkpoint{}, err
+		}
+	}
+	for _, table := range stateTables {
+		cp.Tables[table], err = readTableRows(tx, table, table)
+		if err != nil {
+			return checkpoint{}, err
+		}
+	}
+
+	rows, err := tx.Query("GET_REPLICA_LOG", sqlx.Args{})
+	if err != nil {
+		return checkpoint{}, core.Error(core.DbError, "cannot read replica log", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var data []byte
+		if err := rows.Scan(&data); err != nil {
+			return checkpoint{}, core.Error(core.DbError, "cannot scan replica log", err)
+		}
+		var t transaction
+		if err := msgpack.Unmarshal(data, &t); err != nil {
+			return checkpoint{}, core.Error(core.ParseError, "cannot unmarshal transaction in replica log", err)
+		}
+		cp.Log = append(cp.Log, t)
+		cp.Last = t.key()
+	}
+	return cp, nil
+}
+
+// readTableRows reads the rows of source, which has the columns of table.
+func readTableRows(tx *sqlx.TxX, table, source string) (tableRows, error) {
+	var tr tableRows
+	var err error
+	tr.Columns, err = tableColumns(tx, table)
+	if err != nil {
+		return tableRows{}, err
+	}
+	rows, err := tx.Query("SELECT_TABLE_ROWS", sqlx.Args{"#table": source})
+	if err != nil {
+		return tableRows{}, core.Error(core.DbError, "cannot read rows of %s", source, err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		row, err := rows.Current()
+		if err != nil {
+			return tableRows{}, core.Error(core.DbError, "cannot scan row of %s", source, err)
+		}
+		tr.Rows = append(tr.Rows, row)
+	}
+	return tr, nil
+}
+
+func tableColumns(tx *sqlx.TxX, table string) ([]string, error) {
+	rows, err := tx.Query("GET_TABLE_COLUMNS", sqlx.Args{"tbl": table})
+	if err != nil {
+		return nil, core.Error(core.DbError, "cannot read columns of table %s", table, err)
+	}
+	defer rows.Close()
+	var columns []string
+	for rows.Next() {
+		var name string
+		var pk int
+		if err := rows.Scan(&name, &pk); err != nil {
+			return nil, core.Error(core.DbError, "cannot scan columns of table %s", table, err)
+		}
+		columns = append(columns, name)
+	}
+	return columns, nil
+}
+
+// latestCheckpoint returns the head of the latest checkpoint in the vault.
+func (ds *Replica) latestCheckpoint() (file vault.File, head checkpointHead, found bool, err error) {
+	files, heads, err := ds.listCheckpoints()
+	if err != nil {
+		return vault.File{}, checkpointHead{}, false, err
+	}
+	for i, h := range heads {
+		if !found || h.Last.compare(head.Last) > 0 {
+			file, head, found = files[i], h, true
+		}
+	}
+	return file, head, found, nil
+}
+
+// listCheckpoints returns the checkpoints written by admins in the vault with their heads.
+func (ds *Replica) listCheckpoints() ([]vault.File, []checkpointHead, error) {
+	files, err := ds.vault.ReadDir(checkpointDir, time.Time{}, 0, 0)
+	if err != nil && err != sqlx.ErrNoRows {
+		return nil, nil, core.Error(core.FileError, "cannot list checkpoints", err)
+	}
+	var checkpoints []vault.File
+	var heads []checkpointHead
+	for _, f := range files {
+		if f.IsDir {
+			continue
+		}
+		admin, err := ds.isAdmin(f.AuthorId)
+		if err != nil {
+			return nil, nil, err
+		}
+		if !admin {
+			core.Info("ignoring checkpoint %s by %s, who is not an admin", f.Name, f.AuthorId)
+			continue
+		}
+		var h checkpointHead
+		if err := msgpack.Unmarshal(f.Attrs, &h); err != nil {
+			core.LogError("invalid checkpoint %s", f.Name, err)
+			continue
+		}
+		checkpoints = append(checkpoints, f)
+		heads = append(heads, h)
+	}
+	return checkpoints, heads, nil
+}
+
+// loadCheckpoint reads a checkpoint from the vault.
+func (ds *Replica) loadCheckpoint(file vault.File) (checkpoint, error) {
+	f, err := os.CreateTemp("", "bao-checkpoint")
+	if err != nil {
+		return checkpoint{}, core.Error(core.FileError, "cannot create temporary file for checkpoint", err)
+	}
+	f.Close()
+	defer os.Remove(f.Name())
+	_, err = ds.vault.Read(path.Join(checkpointDir, path.Base(file.Name)), f.Name(), vault.IOOption{}, nil)
+	if err != nil {
+		return checkpoint{}, core.Error(core.FileError, "cannot read checkpoint %s", file.Name, err)
+	}
+	data, err := os.ReadFile(f.Name())
+	if err != nil {
+		return checkpoint{}, core.Error(core.FileError, "cannot read checkpoint %s", file.Name, err)
+	}
+	data, err = core.GzipDecompress(data)
+	if err != nil {
+		return checkpoint{}, core.Error(core.EncodeError, "cannot decompress checkpoint %s", file.Name, err)
+	}
+	var cp checkpoint
+	err = msgpack.Unmarshal(data, &cp)
+	if err != nil {
+		return checkpoint{}, core.Error(core.ParseError, "cannot unmarshal checkpoint %s", file.Name, err)
+	}
+	return cp, nil
+}
+
+// restoreLatestCheckpoint replaces the state of the replica with the latest checkpoint when the replica is behind
+// it.
+func (ds *Replica) restoreLatestCheckpoint() error {
+	core.Start("")
+	file, head, found, err := ds.latestCheckpoint()
+	if err != nil {
+		return err
+	}
+	if !found {
+		core.End("no checkpoint")
+		return nil
+	}
+	last, err := ds.lastApplied()
+	if err != nil {
+		return err
+	}
+	if last.compare(head.Last) >= 0 {
+		core.End("replica is ahead of checkpoint %s", file.Name)
+		return nil
+	}
+
+	cp, err := ds.loadCheckpoint(file)
+	if err != nil {
+		return err
+	}
+
+	for _, s := range cp.Schemas {
+		if s.Version > ds.schema {
+			if err := ds.applySchema(s); err != nil {
+				return err
+			}
+		}
+	}
+
+	ds.queryLock.Lock()
+	defer ds.queryLock.Unlock()
+	tx, err := ds.db.Begin()
+	if err != nil {
+		return core.Error(core.DbError, "cannot start transaction", err)
+	}
+	err = ds.restoreCheckpoint(tx, cp)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	err = tx.Commit()
+	if err != nil {
+		return core.Error(core.DbError, "cannot commit checkpoint %s", file.Name, err)
+	}
+
+	change := Change{Time: core.Now()}
+	for table := range cp.Tables {
+		if !slices.Contains(stateTables, table) {
+			change.Tables = append(change.Tables, table)
+		}
+	}
+	slices.Sort(change.Tables)
+	ds.notify(change)
+	core.End("restored checkpoint %s, %d tables, %d transactions", file.Name, len(cp.Tables), len(cp.Log))
+	return nil
+}
+
+// restoreCheckpoint replaces the tables with the checkpoint and replays the transactions after its base. The log is
+// replayed like the replica that wrote the checkpoint applied it: a transaction is rejected only when it is in the
+// rejected transactions of the checkpoint.
+func (ds *Replica) restoreCheckpoint(tx *sqlx.TxX, cp checkpoint) error {
+	tables, err := listTables(tx, "GET_REPLICATED_TABLES")
+	if err != nil {
+		return err
+	}
+	for _, table := range append(tables, stateTables...) {
+		if _, err := tx.Exec("CLEAR_REPLICATED_TABLE", sqlx.Args{"#table": table}); err != nil {
+			return core.Error(core.DbError, "cannot clear table %s", table, err)
+		}
+	}
+	for table, tr := range cp.Tables {
+		if !slices.Contains(tables, table) && !slices.Contains(stateTables, table) {
+			core.LogError("table %s in checkpoint does not exist in the replica", table)
+			continue
+		}
+		if err := insertRows(tx, table, tr); err != nil {
+			return err
+		}
+	}
+
+	err = ds.saveBase(tx, cp.Base)
+	if err != nil {
+		return err
+	}
+	if _, err := tx.Exec("CLEAR_REPLICA_LOG", sqlx.Args{}); err != nil {
+		return core.Error(core.DbError, "cannot clear replica log", err)
+	}
+	for _, t := range cp.Log {
+		success, err := ds.applyTransaction(tx, t, true)
+		if err != nil {
+			return err
+		}
+		if err := ds.logTransaction(tx, t, success); err != nil {
+			return err
+		}
+		ds.clock.observe(t.Hlc)
+	}
+	if _, err := tx.Exec("CLEAR_REPLICA_CAPTURE", sqlx.Args{}); err != nil {
+		return core.Error(core.DbError, "cannot clear capture", err)
+	}
+	_, err = tx.Exec("SET_REPLICA_CHECKPOINT", sqlx.Args{"hlc": cp.Base.Hlc, "origin": cp.Base.Origin})
+	if err != nil {
+		return core.Error(core.DbError, "cannot set replica checkpoint", err)
+	}
+	ds.clock.observe(cp.Base.Hlc)
+	return nil
+}
+
+// insertRows writes the rows in the columns that exist in the table.
+func insertRows(tx *sqlx.TxX, table string, tr tableRows) error {
+	existing, err := tableColumns(tx, table)
+	if err != nil {
+		return err
+	}
+	var cols, params []int
+	for i, c := range tr.Columns {
+		if slices.Contains(existing, c) {
+			cols = append(cols, i)
+		}
+	}
+	names := make([]string, len(cols))
+	values := make([]string, len(cols))
+	for i, c := range cols {
+		names[i] = quoteIdent(tr.Columns[c])
+		values[i] = fmt.Sprintf(":c%d", i)
+		params = append(params, c)
+	}
+	query := fmt.Sprintf("SQL:INSERT INTO %s (%s) VALUES (%s)", quoteIdent(table), strings.Join(names, ", "),
+		strings.Join(values, ", "))
+	for _, row := range tr.Rows {
+		args := sqlx.Args{}
+		for i, c := range params {
+			args[fmt.Sprintf("c%d", i)] = row[c]
+		}
+		if _, err := tx.Exec(query, args); err != nil {
+			return core.Error(core.DbError, "cannot insert row in %s", table, err)
+		}
+	}
+	return nil
+}
+
+// isInCheckpoint returns true when the transaction is in the base of the checkpoint restored by the replica.
+func (ds *Replica) isInCheckpoint(t transaction) (bool, error) {
+	var key orderKey
+	err := ds.db.QueryRow("GET_REPLICA_CHECKPOINT", sqlx.Args{}, &key.Hlc, &key.Origin)
+	if err == sqlx.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		return false, core.Error(core.DbError, "cannot read replica checkpoint", err)
+	}
+	return t.key().compare(key) <= 0, nil
+}
+
+// checkpointIfDue writes a checkpoint when the latest one is older than half the retention of the vault and the
+// replica applied transactions after it.
+func (ds *Replica) checkpointIfDue() error {
+	file, head, found, err := ds.latestCheckpoint()
+	if err != nil {
+		return err
+	}
+	last, err := ds.lastApplied()
+	if err != nil {
+		return err
+	}
+	if last.compare(head.Last) <= 0 {
+		return nil
+	}
+	retention := core.DefaultIfZero(ds.vault.Config.Retention, vault.DefaultRetention)
+	if found && core.Since(file.ModTime) < retention/2 {
+		return nil
+	}
+	admin, err := ds.isAdmin(ds.vault.UserID)
+	if err != nil || !admin {
+		return err // the checkpoints of the other users are not restored
+	}
+	return ds.writeCheckpoint()
+}
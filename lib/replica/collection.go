@@ -0,0 +1,134 @@
+package replica
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/stregato/bao/lib/core"
+	"github.com/stregato/bao/lib/sqlx"
+)
+
+// Collection is a collection of JSON documents in a replica.
+type Collection struct {
+	r    *Replica
+	name string
+}
+
+// Document is a document in a collection.
+type Document struct {
+	Id   string          `json:"id"`
+	Data json.RawMessage `json:"data"`
+}
+
+// Filter selects the documents whose field compares to a value. Field is a path like "address.city", and Op is one
+// of =, !=, <, <=, >, >= and like.
+type Filter struct {
+	Field string `json:"field"`
+	Op    string `json:"op"`
+	Value any    `json:"value"`
+}
+
+var filterOps = map[string]string{"=": "=", "!=": "!=", "<": "<", "<=": "<=", ">": ">", ">=": ">=", "like": "LIKE"}
+
+// Collection returns the collection of documents with the given name.
+func (ds *Replica) Collection(name string) *Collection {
+	return &Collection{r: ds, name: name}
+}
+
+// Insert adds a document to the collection and returns its id. The change is published on the next Sync.
+func (c *Collection) Insert(doc any) (string, error) {
+	core.Start("collection %s", c.name)
+	data, err := json.Marshal(doc)
+	if err != nil {
+		return "", core.Error(core.EncodeError, "cannot marshal document for collection %s", c.name, err)
+	}
+	id := strconv.FormatUint(core.SnowID(), 16)
+	_, err = c.r.Exec("INSERT_BAO_DOCUMENT", sqlx.Args{"collection": c.name, "id": id, "doc": string(data)})
+	if err != nil {
+		return "", err
+	}
+	core.End("id %s", id)
+	return id, nil
+}
+
+// Update changes the fields of a document in the collection as a JSON merge patch: the fields in patch replace the
+// ones in the document, and a null field removes it. The change is published on the next Sync.
+func (c *Collection) Update(id string, patch any) error {
+	core.Start("collection %s, id %s", c.name, id)
+	data, err := json.Marshal(patch)
+	if err != nil {
+		return core.Error(core.EncodeError, "cannot marshal patch for document %s", id, err)
+	}
+	_, err = c.r.Exec("UPDATE_BAO_DOCUMENT", sqlx.Args{"collection": c.name, "id": id, "patch": string(data)})
+	if err != nil {
+		return err
+	}
+	core.End("")
+	return nil
+}
+
+// Delete removes a document from the collection. The change is published on the next Sync.
+func (c *Collection) Delete(id string) error {
+	core.Start("collection %s, id %s", c.name, id)
+	_, err := c.r.Exec("DELETE_BAO_DOCUMENT", sqlx.Args{"collection": c.name, "id": id})
+	if err != nil {
+		return err
+	}
+	core.End("")
+	return nil
+}
+
+// Get unmarshals the document with the given id into doc. It returns sqlx.ErrNoRows when the document does not
+// exist.
+func (c *Collection) Get(id string, doc any) error {
+	core.Start("collection %s, id %s", c.name, id)
+	row, err := c.r.FetchOne("GET_BAO_DOCUMENT", sqlx.Args{"collection": c.name, "id": id})
+	if err != nil {
+		return err
+	}
+	data, _ := row[0].(string)
+	err = json.Unmarshal([]byte(data), doc)
+	if err != nil {
+		return core.Error(core.ParseError, "cannot unmarshal document %s in collection %s", id, c.name, err)
+	}
+	core.End("")
+	return nil
+}
+
+// Find returns the documents that match all the filters, in the order they were inserted.
+func (c *Collection) Find(filters ...Filter) ([]Document, error) {
+	core.Start("collection %s, %d filters", c.name, len(filters))
+	conds := []string{"collection = :collection"}
+	args := sqlx.Args{"collection": c.name}
+	for i, f := range filters {
+		op, ok := filterOps[strings.ToLower(f.Op)]
+		if !ok {
+			return nil, core.Error(core.GenericError, "invalid operator %s in filter on %s", f.Op, f.Field)
+		}
+		conds = append(conds, fmt.Sprintf("json_extract(doc, :f%d) %s :v%d", i, op, i))
+		args[fmt.Sprintf("f%d", i)] = "$." + f.Field
+		args[fmt.Sprintf("v%d", i)] = f.Value
+	}
+	query := fmt.Sprintf("SQL:SELECT id, doc FROM bao_documents WHERE %s ORDER BY length(id), id",
+		strings.Join(conds, " AND "))
+
+	rows, err := c.r.Query(query, args)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var docs []Document
+	for rows.Next() {
+		var d Document
+		var data string
+		if err := rows.Scan(&d.Id, &data); err != nil {
+			return nil, core.Error(core.DbError, "cannot scan document of collection %s", c.name, err)
+		}
+		d.Data = json.RawMessage(data)
+		docs = append(docs, d)
+	}
+	core.End("%d documents", len(docs))
+	return docs, nil
+}
@@ -0,0 +1,468 @@
+package replica
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/stregato/bao/lib/core"
+	"github.com/stregato/bao/lib/sqlx"
+)
+
+// Format is the format of the data exported from or imported to a replica.
+type Format string
+
+const (
+	JSONLines Format = "jsonl" // One JSON object per row, with the columns as fields and BLOBs in base64
+	CSV       Format = "csv"   // A header and one record per row, with BLOBs in base64; an unquoted empty field is NULL
+	SQLDump   Format = "sql"   // One INSERT statement per row
+)
+
+// importChunk is the number of rows in each transaction written by Import.
+const importChunk = 1000
+
+// Export writes the rows of the tables to w. JSON Lines and CSV hold a single table, while an SQL dump holds all the
+// replicated tables when no table is given.
+func (ds *Replica) Export(w io.Writer, format Format, tables ...string) error {
+	core.Start("format %s, tables %v", format, tables)
+	if len(tables) == 0 && format == SQLDump {
+		rows, err := ds.Fetch("GET_REPLICATED_TABLES", sqlx.Args{}, 1<<20)
+		if err != nil {
+			return err
+		}
+		for _, row := range rows {
+			tables = append(tables, row[0].(string))
+		}
+	}
+	if format != SQLDump && len(tables) != 1 {
+		return core.Error(core.GenericError, "format %s requires a single table, got %d", format, len(tables))
+	}
+
+	bw := bufio.NewWriter(w)
+	n := 0
+	for _, table := range tables {
+		columns, err := ds.columns(table)
+		if err != nil {
+			return err
+		}
+		rows, err := ds.Query(fmt.Sprintf("SQL:SELECT %s FROM %s", joinIdents(columns), quoteIdent(table)), sqlx.Args{})
+		if err != nil {
+			return err
+		}
+		switch format {
+		case JSONLines:
+			err = exportJSONLines(bw, columns, &rows)
+		case CSV:
+			err = exportCSV(bw, columns, &rows)
+		case SQLDump:
+			err = exportSQL(bw, table, columns, &rows)
+		default:
+			err = core.Error(core.GenericError, "unknown format %s", format)
+		}
+		rows.Close()
+		if err != nil {
+			return err
+		}
+		n++
+	}
+	err := bw.Flush()
+	if err != nil {
+		return core.Error(core.FileError, "cannot write export", err)
+	}
+	core.End("%d tables", n)
+	return nil
+}
+
+// Import inserts the rows in r into the table. The rows are written in transactions of importChunk rows, like the
+// transactions started with Begin. Each full chunk is synced as it fills, so that the rows held in memory and in the
+// open transaction stay bounded, and the last chunk is published on the next Sync. The values of BLOB columns are
+// decoded from base64 in JSON Lines and CSV. An SQL dump can only insert into the table. Import writes raw SQL, so
+// once the replica has grants only admins can import. It returns the number of rows imported.
+func (ds *Replica) Import(r io.Reader, format Format, table string) (int, error) {
+	core.Start("format %s, table %s", format, table)
+	columns, err := ds.columns(table)
+	if err != nil {
+		return 0, err
+	}
+	blobs, err := ds.blobColumns(table)
+	if err != nil {
+		return 0, err
+	}
+
+	var next func() (string, sqlx.Args, error) // next returns the statement for the next row, or io.EOF
+	switch format {
+	case JSONLines:
+		d := json.NewDecoder(r)
+		d.UseNumber()
+		next = func() (string, sqlx.Args, error) {
+			var row map[string]any
+			if err := d.Decode(&row); err != nil {
+				return "", nil, err
+			}
+			for k, v := range row {
+				if n, ok := v.(json.Number); ok {
+					row[k] = numberValue(n)
+				}
+			}
+			if err := decodeBlobs(row, blobs); err != nil {
+				return "", nil, err
+			}
+			return insertStatement(table, columns, row)
+		}
+	case CSV:
+		br := bufio.NewReader(r)
+		header, err := readCSVRecord(br)
+		if err != nil {
+			return 0, core.Error(core.ParseError, "cannot read CSV header", err)
+		}
+		next = func() (string, sqlx.Args, error) {
+			record, err := readCSVRecord(br)
+			if err != nil {
+				return "", nil, err
+			}
+			if len(record) != len(header) {
+				return "", nil, core.Error(core.ParseError, "record has %d fields, header has %d", len(record),
+					len(header))
+			}
+			row := map[string]any{}
+			for i, f := range record {
+				row[header[i].value] = core.If[any](f.value == "" && !f.quoted, nil, f.value)
+			}
+			if err := decodeBlobs(row, blobs); err != nil {
+				return "", nil, err
+			}
+			return insertStatement(table, columns, row)
+		}
+	case SQLDump:
+		sr := bufio.NewReader(r)
+		next = func() (string, sqlx.Args, error) {
+			query, err := readStatement(sr)
+			if err != nil {
+				return "", nil, err
+			}
+			key := "SQL:" + query
+			if !strings.HasPrefix(strings.ToUpper(query), "INSERT") ||
+				!slices.Equal(ds.statementTables(key), []string{table}) {
+				return "", nil, core.Error(core.ParseError, "statement %.80s does not insert into %s", query, table)
+			}
+			return key, sqlx.Args{}, nil
+		}
+	default:
+		return 0, core.Error(core.GenericError, "unknown format %s", format)
+	}
+
+	n := 0
+	for done := false; !done; {
+		tx, err := ds.Begin()
+		if err != nil {
+			return n, err
+		}
+		chunk := 0
+		for ; chunk < importChunk; chunk++ {
+			key, args, err := next()
+			if err == io.EOF {
+				done = true
+				break
+			}
+			if err == nil {
+				_, err = tx.Exec(key, args)
+			}
+			if err != nil {
+				tx.Rollback()
+				return n, core.Error(core.ParseError, "cannot import row %d into %s", n+chunk+1, table, err)
+			}
+		}
+		err = tx.Commit()
+		if err != nil {
+			return n, err
+		}
+		n += chunk
+		if !done {
+			_, err = ds.Sync()
+			if err != nil {
+				return n, err
+			}
+		}
+	}
+	core.End("%d rows", n)
+	return n, nil
+}
+
+// columns returns the columns of a table.
+func (ds *Replica) columns(table string) ([]string, error) {
+	rows, err := ds.Fetch("GET_TABLE_COLUMNS", sqlx.Args{"tbl": table}, 1<<16)
+	if err != nil {
+		return nil, err
+	}
+	if len(rows) == 0 {
+		return nil, core.Error(core.DbError, "table %s does not exist", table)
+	}
+	columns := make([]string, len(rows))
+	for i, row := range rows {
+		columns[i] = row[0].(string)
+	}
+	return columns, nil
+}
+
+// blobColumns returns the columns of a table declared as BLOB.
+func (ds *Replica) blobColumns(table string) (map[string]bool, error) {
+	rows, err := ds.Fetch("GET_TABLE_BLOB_COLUMNS", sqlx.Args{"tbl": table}, 1<<16)
+	if err != nil {
+		return nil, err
+	}
+	blobs := map[string]bool{}
+	for _, row := range rows {
+		blobs[row[0].(string)] = true
+	}
+	return blobs, nil
+}
+
+// decodeBlobs decodes from base64 the values of the BLOB columns in the row.
+func decodeBlobs(row map[string]any, blobs map[string]bool) error {
+	for k, v := range row {
+		s, ok := v.(string)
+		if !ok || !blobs[k] {
+			continue
+		}
+		b, err := base64.StdEncoding.DecodeString(s)
+		if err != nil {
+			return core.Error(core.ParseError, "invalid base64 in BLOB column %s", k, err)
+		}
+		row[k] = b
+	}
+	return nil
+}
+
+func exportJSONLines(w io.Writer, columns []string, rows *sqlx.RowsX) error {
+	e := json.NewEncoder(w)
+	for rows.Next() {
+		values, err := rows.Current()
+		if err != nil {
+			return core.Error(core.DbError, "cannot scan row", err)
+		}
+		row := make(map[string]any, len(columns))
+		for i, c := range columns {
+			row[c] = values[i]
+		}
+		if err := e.Encode(row); err != nil {
+			return core.Error(core.FileError, "cannot write row", err)
+		}
+	}
+	return nil
+}
+
+func exportCSV(w io.Writer, columns []string, rows *sqlx.RowsX) error {
+	header := make([]any, len(columns))
+	for i, c := range columns {
+		header[i] = c
+	}
+	if err := writeCSVRecord(w, header); err != nil {
+		return core.Error(core.FileError, "cannot write CSV header", err)
+	}
+	for rows.Next() {
+		values, err := rows.Current()
+		if err != nil {
+			return core.Error(core.DbError, "cannot scan row", err)
+		}
+		if err := writeCSVRecord(w, values); err != nil {
+			return core.Error(core.FileError, "cannot write row", err)
+		}
+	}
+	return nil
+}
+
+// writeCSVRecord writes a CSV record. NULL is an unquoted empty field, so that the empty string is quoted, and
+// BLOBs are in base64.
+func writeCSVRecord(w io.Writer, values []any) error {
+	var sb strings.Builder
+	for i, v := range values {
+		if i > 0 {
+			sb.WriteByte(',')
+		}
+		var s string
+		switch v := v.(type) {
+		case nil:
+			continue
+		case []byte:
+			s = base64.StdEncoding.EncodeToString(v)
+		case string:
+			s = v
+		default:
+			s = fmt.Sprint(v)
+		}
+		if s == "" || strings.ContainsAny(s, ",\"\r\n") || s[0] == ' ' {
+			s = `"` + strings.ReplaceAll(s, `"`, `""`) + `"`
+		}
+		sb.WriteString(s)
+	}
+	sb.WriteByte('\n')
+	_, err := io.WriteString(w, sb.String())
+	return err
+}
+
+func exportSQL(w io.Writer, table string, columns []string, rows *sqlx.RowsX) error {
+	prefix := fmt.Sprintf("INSERT INTO %s (%s) VALUES (", quoteIdent(table), joinIdents(columns))
+	for rows.Next() {
+		values, err := rows.Current()
+		if err != nil {
+			return core.Error(core.DbError, "cannot scan row", err)
+		}
+		literals := make([]string, len(values))
+		for i, v := range values {
+			literals[i] = sqlLiteral(v)
+		}
+		_, err = fmt.Fprintf(w, "%s%s);\n", prefix, strings.Join(literals, ", "))
+		if err != nil {
+			return core.Error(core.FileError, "cannot write row", err)
+		}
+	}
+	return nil
+}
+
+// sqlLiteral returns the SQL literal of a value.
+func sqlLiteral(v any) string {
+	switch v := v.(type) {
+	case nil:
+		return "NULL"
+	case []byte:
+		return "X'" + hex.EncodeToString(v) + "'"
+	case string:
+		return quoteString(v)
+	case bool:
+		return core.If(v, "1", "0")
+	case float64:
+		return strconv.FormatFloat(v, 'g', -1, 64)
+	case time.Time:
+		return quoteString(v.Format(time.RFC3339Nano))
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+// numberValue returns a JSON number as an integer when it has no fraction.
+func numberValue(n json.Number) any {
+	if i, err := n.Int64(); err == nil {
+		return i
+	}
+	f, _ := n.Float64()
+	return f
+}
+
+// insertStatement returns the statement that inserts a row given as a map of columns. Fields that are not columns
+// of the table are an error.
+func insertStatement(table string, columns []string, row map[string]any) (string, sqlx.Args, error) {
+	var names, params []string
+	args := sqlx.Args{}
+	for _, c := range columns {
+		v, ok := row[c]
+		if !ok {
+			continue
+		}
+		param := fmt.Sprintf("c%d", len(names))
+		names = append(names, quoteIdent(c))
+		params = append(params, ":"+param)
+		args[param] = v
+	}
+	if len(names) != len(row) {
+		return "", nil, core.Error(core.ParseError, "row has fields that are not columns of %s", table)
+	}
+	return fmt.Sprintf("SQL:INSERT INTO %s (%s) VALUES (%s)", quoteIdent(table), strings.Join(names, ", "),
+		strings.Join(params, ", ")), args, nil
+}
+
+// readStatement reads the next statement of an SQL dump, up to a semicolon outside quotes. It returns io.EOF when
+// there are no more statements.
+func readStatement(r *bufio.Reader) (string, error) {
+	var sb strings.Builder
+	var quote rune
+	for {
+		c, _, err := r.ReadRune()
+		if err == io.EOF {
+			if s := strings.TrimSpace(sb.String()); s != "" {
+				return s, nil
+			}
+			return "", io.EOF
+		}
+		if err != nil {
+			return "", core.Error(core.FileError, "cannot read SQL dump", err)
+		}
+		switch {
+		case quote != 0 && c == quote:
+			quote = 0
+		case quote == 0 && (c == '\'' || c == '"'):
+			quote = c
+		case quote == 0 && c == ';':
+			if s := strings.TrimSpace(sb.String()); s != "" {
+				return s, nil
+			}
+			continue
+		}
+		sb.WriteRune(c)
+	}
+}
+
+// csvField is a field of a CSV record. An unquoted empty field is NULL.
+type csvField struct {
+	value  string
+	quoted bool
+}
+
+// readCSVRecord reads the next record of a CSV file. It returns io.EOF when there are no more records.
+func readCSVRecord(r *bufio.Reader) ([]csvField, error) {
+	var record []csvField
+	for {
+		var f csvField
+		var sb strings.Builder
+		c, _, err := r.ReadRune()
+		if err == io.EOF && record == nil {
+			return nil, io.EOF
+		}
+		if err == nil && c == '"' {
+			f.quoted = true
+			for {
+				c, _, err = r.ReadRune()
+				if err == io.EOF {
+					return nil, core.Error(core.ParseError, "unterminated quoted field in CSV")
+				}
+				if err != nil {
+					return nil, core.Error(core.FileError, "cannot read CSV", err)
+				}
+				if c == '"' {
+					c, _, err = r.ReadRune()
+					if err != nil || c != '"' {
+						break
+					}
+				}
+				sb.WriteRune(c)
+			}
+		} else {
+			for err == nil && c != ',' && c != '\n' {
+				sb.WriteRune(c)
+				c, _, err = r.ReadRune()
+			}
+		}
+		if err != nil && err != io.EOF {
+			return nil, core.Error(core.FileError, "cannot read CSV", err)
+		}
+		f.value = sb.String()
+		if !f.quoted {
+			f.value = strings.TrimSuffix(f.value, "\r")
+		} else if c == '\r' && err == nil {
+			c, _, err = r.ReadRune()
+		}
+		record = append(record, f)
+		switch {
+		case err == io.EOF || c == '\n':
+			return record, nil
+		case c != ',':
+			return nil, core.Error(core.ParseError, "unexpected %q after quoted field in CSV", c)
+		}
+	}
+}
@@ -0,0 +1,153 @@
+package replica
+
+import (
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/stregato/bao/lib/core"
+	"github.com/stregato/bao/lib/security"
+	"github.com/stregato/bao/lib/vault"
+)
+
+const changeQueueSize = 256
+
+// Change is a transaction applied to the replica, or the restore of a checkpoint when Id is 0.
+type Change struct {
+	Id     vault.FileId      `json:"id"`     // Id is the id of the transaction file
+	Author security.PublicID `json:"author"` // Author is the author of the transaction file
+	Time   time.Time         `json:"time"`   // Time is the time of the transaction
+	Keys   []string          `json:"keys"`   // Keys are the keys of the statements in the transaction
+	Tables []string          `json:"tables"` // Tables are the tables changed by the transaction
+}
+
+// Subscription receives the changes to some tables of a replica. Changes are dropped when C is full.
+type Subscription struct {
+	C      <-chan Change
+	tables []string
+	ch     chan Change
+	r      *Replica
+}
+
+// changeFeed keeps the subscriptions and the background sync of a replica. The zero value is ready to use.
+type changeFeed struct {
+	mu   sync.Mutex
+	subs map[*Subscription]struct{}
+	stop chan struct{} // stop ends the background sync; nil when it is not running
+}
+
+// Subscribe returns a subscription to the changes applied to the given tables, or to all tables when no table is
+// given. Local changes are notified when they are applied in Sync.
+func (ds *Replica) Subscribe(tables ...string) *Subscription {
+	ch := make(chan Change, changeQueueSize)
+	s := &Subscription{C: ch, tables: tables, ch: ch, r: ds}
+
+	ds.feed.mu.Lock()
+	if ds.feed.subs == nil {
+		ds.feed.subs = map[*Subscription]struct{}{}
+	}
+	ds.feed.subs[s] = struct{}{}
+	ds.feed.mu.Unlock()
+	core.Info("subscribed to changes on %v in replica of vault %s", tables, ds.vault.ID)
+	return s
+}
+
+// Next waits up to timeout for the next change. It returns false on timeout or when the subscription is closed.
+func (s *Subscription) Next(timeout time.Duration) (Change, bool) {
+	select {
+	case change, ok := <-s.ch:
+		return change, ok
+	case <-time.After(timeout):
+		return Change{}, false
+	}
+}
+
+// Close cancels the subscription and closes C.
+func (s *Subscription) Close() {
+	s.r.feed.mu.Lock()
+	defer s.r.feed.mu.Unlock()
+	if _, ok := s.r.feed.subs[s]; ok {
+		delete(s.r.feed.subs, s)
+		close(s.ch)
+	}
+}
+
+// changeOf returns the change for a transaction applied to the replica.
+func (ds *Replica) changeOf(t transaction) Change {
+	c := Change{Id: t.Id, Author: t.Author, Time: t.Tm}
+	for _, u := range t.Updates {
+		if !slices.Contains(c.Keys, u.Key) {
+			c.Keys = append(c.Keys, u.Key)
+		}
+		for _, table := range ds.statementTables(u.Key) {
+			if !slices.Contains(c.Tables, table) {
+				c.Tables = append(c.Tables, table)
+			}
+		}
+	}
+	for _, cell := range t.Cells {
+		if !slices.Contains(c.Tables, cell.Table) {
+			c.Tables = append(c.Tables, cell.Table)
+		}
+	}
+	return c
+}
+
+// notify delivers a change to the subscribers of the tables it changes.
+func (ds *Replica) notify(c Change) {
+	ds.feed.mu.Lock()
+	defer ds.feed.mu.Unlock()
+	for s := range ds.feed.subs {
+		if len(s.tables) > 0 && !slices.ContainsFunc(c.Tables, func(table string) bool {
+			return slices.Contains(s.tables, table)
+		}) {
+			continue
+		}
+		select {
+		case s.ch <- c:
+		default:
+			core.Info("subscription to %v in replica of vault %s is full, dropping change %d", s.tables, ds.vault.ID, c.Id)
+		}
+	}
+}
+
+// StartAutoSync runs Sync in the background every time the vault receives new files, for instance after a
+// notification of the sync relay, and at least once every interval. It does nothing when the background sync is
+// already running.
+func (ds *Replica) StartAutoSync(interval time.Duration) {
+	ds.feed.mu.Lock()
+	defer ds.feed.mu.Unlock()
+	if ds.feed.stop != nil {
+		return
+	}
+	stop := make(chan struct{})
+	ds.feed.stop = stop
+
+	go func() {
+		core.Info("background sync started for replica of vault %s", ds.vault.ID)
+		for {
+			ds.vault.WaitUpdates(interval)
+			select {
+			case <-stop:
+				core.Info("background sync stopped for replica of vault %s", ds.vault.ID)
+				return
+			default:
+			}
+			if _, err := ds.Sync(); err != nil {
+				core.LogError("background sync failed for replica of vault %s", ds.vault.ID, err)
+			}
+		}
+	}()
+}
+
+// StopAutoSync stops the background sync started with StartAutoSync.
+func (ds *Replica) StopAutoSync() {
+	ds.feed.mu.Lock()
+	defer ds.feed.mu.Unlock()
+	if ds.feed.stop == nil {
+		return
+	}
+	close(ds.feed.stop)
+	ds.feed.stop = nil
+	ds.vault.InterruptWait()
+}
@@ -0,0 +1,221 @@
+package replica
+
+import (
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/stregato/bao/lib/core"
+	"github.com/stregato/bao/lib/security"
+	"github.com/stregato/bao/lib/sqlx"
+	"github.com/stregato/bao/lib/vault"
+)
+
+// Rejection is a transaction that the replica did not apply because its author has no grant on one of the tables
+// or statements it writes.
+type Rejection struct {
+	Id     vault.FileId      // Id is the id of the transaction file
+	Author security.PublicID // Author is the author of the transaction file
+	Target string            // Target is the table or statement key the author has no grant on
+	Tm     time.Time         // Tm is the time of the transaction
+}
+
+// writtenTables matches the tables written by a defined statement. Raw SQL is not trusted to it, see allows.
+var writtenTables = regexp.MustCompile(`(?i)\b(?:INSERT(?:\s+OR\s+\w+)?\s+INTO|REPLACE\s+INTO|UPDATE(?:\s+OR\s+\w+)?|DELETE\s+FROM)\s+("(?:[^"]|"")+"|\w+)`)
+
+// statementTables returns the tables written by the statement with the given key.
+func (ds *Replica) statementTables(key string) []string {
+	query, ok := ds.db.Statement(key)
+	if !ok {
+		query = strings.TrimPrefix(key, "SQL:")
+	}
+	var tables []string
+	for _, m := range writtenTables.FindAllStringSubmatch(query, -1) {
+		table := m[1]
+		if strings.HasPrefix(table, `"`) {
+			table = strings.ReplaceAll(table[1:len(table)-1], `""`, `"`)
+		}
+		tables = append(tables, table)
+	}
+	return tables
+}
+
+// statementTargets returns the statement key and the tables written by the statement.
+func (ds *Replica) statementTargets(key string) []string {
+	return append([]string{key}, ds.statementTables(key)...)
+}
+
+// grantChecker checks the writes of a user against the replica grants in the vault.
+type grantChecker struct {
+	grants map[string][]vault.ReplicaGrant
+	access map[security.PublicID]vault.Access
+	vault  *vault.Vault
+}
+
+func (ds *Replica) newGrantChecker() (*grantChecker, error) {
+	grants, err := ds.vault.GetReplicaGrants()
+	if err != nil {
+		return nil, err
+	}
+	gc := &grantChecker{
+		grants: map[string][]vault.ReplicaGrant{},
+		access: map[security.PublicID]vault.Access{},
+		vault:  ds.vault,
+	}
+	for _, g := range grants {
+		gc.grants[g.Target] = append(gc.grants[g.Target], g)
+	}
+	return gc, nil
+}
+
+// allows returns true when the user can write the target: the target has no grants or one of them applies to the
+// user. Once the replica has grants, only admins can run raw SQL, since the tables it writes cannot be told
+// reliably from the text.
+func (gc *grantChecker) allows(userId security.PublicID, target string) (bool, error) {
+	if strings.HasPrefix(target, "SQL:") {
+		if len(gc.grants) == 0 {
+			return true, nil
+		}
+		access, err := gc.accessOf(userId)
+		if err != nil {
+			return false, err
+		}
+		return access&vault.Admin != 0, nil
+	}
+	grants := gc.grants[target]
+	if len(grants) == 0 {
+		return true, nil
+	}
+	access, err := gc.accessOf(userId)
+	if err != nil {
+		return false, err
+	}
+	for _, g := range grants {
+		if g.Allows(userId, access) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// accessOf returns the access of the user to the vault, with the creator of the vault as admin.
+func (gc *grantChecker) accessOf(userId security.PublicID) (vault.Access, error) {
+	if access, ok := gc.access[userId]; ok {
+		return access, nil
+	}
+	access, err := gc.vault.GetAccess(userId)
+	if err != nil {
+		return 0, err
+	}
+	if userId == gc.vault.Author {
+		access |= vault.ReadWriteAdmin
+	}
+	gc.access[userId] = access
+	return access, nil
+}
+
+// isAdmin returns true when the user is the creator or an admin of the vault.
+func (ds *Replica) isAdmin(userId security.PublicID) (bool, error) {
+	if userId == ds.vault.Author {
+		return true, nil
+	}
+	access, err := ds.vault.GetAccess(userId)
+	if err != nil {
+		return false, err
+	}
+	return access&vault.Admin != 0, nil
+}
+
+// unauthorized returns the first table or statement key in the transaction that its author cannot write, or an
+// empty string when the author can write all of them.
+func (ds *Replica) unauthorized(t transaction) (string, error) {
+	gc, err := ds.newGrantChecker()
+	if err != nil {
+		return "", err
+	}
+	if len(gc.grants) == 0 {
+		return "", nil
+	}
+	var targets []string
+	for _, u := range t.Updates {
+		targets = append(targets, ds.statementTargets(u.Key)...)
+	}
+	for _, c := range t.Cells {
+		targets = append(targets, c.Table)
+	}
+	for _, target := range targets {
+		ok, err := gc.allows(t.Author, target)
+		if err != nil {
+			return "", err
+		}
+		if !ok {
+			return target, nil
+		}
+	}
+	return "", nil
+}
+
+// checkGrant returns an AccessDenied error when the user of the replica cannot run the statement.
+func (ds *Replica) checkGrant(key string) error {
+	gc, err := ds.newGrantChecker()
+	if err != nil {
+		return err
+	}
+	for _, target := range ds.statementTargets(key) {
+		ok, err := gc.allows(ds.vault.UserID, target)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return core.Error(core.AccessDenied, "user %s has no grant on %s in replica of vault %s", ds.vault.UserID,
+				target, ds.vault.ID)
+		}
+	}
+	return nil
+}
+
+// rejectedTarget returns the target recorded when the transaction was rejected, or an empty string when it was
+// not. Replays reuse the decision taken when the transaction was first applied, since the grants may have changed.
+func rejectedTarget(tx *sqlx.TxX, t transaction) (string, error) {
+	var target string
+	err := tx.QueryRow("GET_REPLICA_REJECTED_TARGET", sqlx.Args{"hlc": t.Hlc, "origin": t.Origin}, &target)
+	if err != nil {
+		return "", core.Error(core.DbError, "cannot read rejection of transaction %d", t.Id, err)
+	}
+	return target, nil
+}
+
+// reject records a transaction rejected for the missing grant on the target.
+func reject(tx *sqlx.TxX, t transaction, target string) error {
+	core.Info("rejecting transaction %d by %s: no grant on %s", t.Id, t.Author, target)
+	_, err := tx.Exec("INSERT_REPLICA_REJECTED", sqlx.Args{"hlc": t.Hlc, "origin": t.Origin, "id": t.Id,
+		"author": t.Author, "target": target, "tm": t.Tm.UnixMilli()})
+	if err != nil {
+		return core.Error(core.DbError, "cannot record rejected transaction %d", t.Id, err)
+	}
+	return nil
+}
+
+// Rejections returns the transactions rejected because their authors have no grant on the tables or statements
+// they write.
+func (ds *Replica) Rejections() ([]Rejection, error) {
+	core.Start("")
+	rows, err := ds.db.Query("GET_REPLICA_REJECTED", sqlx.Args{})
+	if err != nil {
+		return nil, core.Error(core.DbError, "cannot read rejected transactions", err)
+	}
+	defer rows.Close()
+
+	var rejections []Rejection
+	for rows.Next() {
+		var r Rejection
+		var tm int64
+		if err := rows.Scan(&r.Id, &r.Author, &r.Target, &tm); err != nil {
+			return nil, core.Error(core.DbError, "cannot scan rejected transaction", err)
+		}
+		r.Tm = time.UnixMilli(tm)
+		rejections = append(rejections, r)
+	}
+	core.End("%d rejections", len(rejections))
+	return rejections, nil
+}
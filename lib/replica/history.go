@@ -0,0 +1,511 @@
+package replica
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"reflect"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/stregato/bao/lib/core"
+	"github.com/stregato/bao/lib/security"
+	"github.com/stregato/bao/lib/sqlx"
+	"github.com/stregato/bao/lib/vault"
+)
+
+// The history of a replica is the sequence of the transaction files in the vault. QueryAt, History and Revert
+// rebuild the tables at a point of the history in a temporary database: the rebuild starts from the latest
+// checkpoint before the point, or from empty tables, and applies the transactions up to the point in order. The
+// temporary tables have the current schema, and the history covers the transactions the vault still retains.
+
+// At is a point in the history of a replica.
+type At struct {
+	Id   vault.FileId `json:"id"`   // Id is the id of a transaction file
+	Time time.Time    `json:"time"` // Time is used when Id is 0: the point is the last transaction stamped at or before Time
+}
+
+// Revision is a transaction that changed a row.
+type Revision struct {
+	Id     vault.FileId      `json:"id"`     // Id is the id of the transaction file
+	Author security.PublicID `json:"author"` // Author is the author of the transaction file
+	Time   time.Time         `json:"time"`   // Time is the time of the transaction
+	Keys   []string          `json:"keys"`   // Keys are the keys of the statements in the transaction
+	Row    map[string]any    `json:"row"`    // Row is the row after the transaction, nil when the transaction deleted it
+}
+
+// QueryAt executes a query on the tables as they were at the given point of the history and returns all the rows.
+func (ds *Replica) QueryAt(at At, query string, args sqlx.Args) ([][]any, error) {
+	core.Start("id %d, time %s, query %s", at.Id, at.Time, query)
+	history, err := ds.readHistory()
+	if err != nil {
+		return nil, err
+	}
+	n, err := position(history, at)
+	if err != nil {
+		return nil, err
+	}
+	tmp, tx, err := ds.rebuild(history, n)
+	if err != nil {
+		return nil, err
+	}
+	defer tmp.drop(tx)
+
+	rows, err := tx.Query(query, args)
+	if err != nil {
+		return nil, core.Error(core.DbError, "cannot execute query %s at transaction %d", query, at.Id, err)
+	}
+	defer rows.Close()
+	var results [][]any
+	for rows.Next() {
+		row, err := rows.Current()
+		if err != nil {
+			return nil, core.Error(core.DbError, "cannot get current row", err)
+		}
+		results = append(results, row)
+	}
+	core.End("%d rows", len(results))
+	return results, nil
+}
+
+// History returns the transactions that changed the row of the table with the given primary key, in order. The
+// values of a composite key follow the order of the key columns.
+func (ds *Replica) History(table string, key ...any) ([]Revision, error) {
+	core.Start("table %s, key %v", table, key)
+	history, err := ds.readHistory()
+	if err != nil {
+		return nil, err
+	}
+	tmp, tx, err := ds.rebuild(history, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer tmp.drop(tx)
+
+	columns, pk, err := tableKey(tx, table)
+	if err != nil {
+		return nil, err
+	}
+	if len(key) != len(pk) {
+		return nil, core.Error(core.GenericError, "table %s has %d key columns, got %d values", table, len(pk), len(key))
+	}
+	args := sqlx.Args{}
+	query := fmt.Sprintf("SQL:SELECT %s FROM %s WHERE %s", joinIdents(columns), quoteIdent(table),
+		rowCondition(pk, key, args))
+
+	var revisions []Revision
+	var prev []any
+	for _, t := range history {
+		success, err := tmp.applyTransaction(tx, t, true)
+		if err != nil {
+			return nil, err
+		}
+		if !success {
+			continue
+		}
+		row, err := readRow(tx, query, args)
+		if err != nil {
+			return nil, err
+		}
+		if reflect.DeepEqual(row, prev) {
+			continue
+		}
+		r := Revision{Id: t.Id, Author: t.Author, Time: t.Tm, Keys: ds.changeOf(t).Keys}
+		if row != nil {
+			r.Row = map[string]any{}
+			for i, c := range columns {
+				r.Row[c] = row[i]
+			}
+		}
+		revisions = append(revisions, r)
+		prev = row
+	}
+	core.End("%d revisions", len(revisions))
+	return revisions, nil
+}
+
+// Revert queues a transaction that undoes the changes of the transaction with the given id, published on the next
+// Sync. The before and after images of the rows come from the history; a row changed again after the transaction
+// is left as it is.
+func (ds *Replica) Revert(id vault.FileId) error {
+	core.Start("id %d", id)
+	history, err := ds.readHistory()
+	if err != nil {
+		return err
+	}
+	n, err := position(history, At{Id: id})
+	if err != nil {
+		return err
+	}
+	t := history[n-1]
+	tmp, tx, err := ds.rebuild(history, n-1)
+	if err != nil {
+		return err
+	}
+	defer tmp.drop(tx)
+
+	tables := ds.changeOf(t).Tables
+	before := map[string]map[string][]any{}
+	for _, table := range tables {
+		if before[table], err = readKeyedRows(tx, table); err != nil {
+			return err
+		}
+	}
+	success, err := tmp.applyTransaction(tx, t, true)
+	if err != nil {
+		return err
+	}
+	if !success {
+		return core.Error(core.GenericError, "transaction %d was not applied and cannot be reverted", id)
+	}
+
+	type statement struct {
+		key  string
+		args sqlx.Args
+	}
+	var statements []statement
+	for _, table := range tables {
+		after, err := readKeyedRows(tx, table)
+		if err != nil {
+			return err
+		}
+		columns, pk, err := tableKey(tx, table)
+		if err != nil {
+			return err
+		}
+		var keys []string
+		for k := range before[table] {
+			keys = append(keys, k)
+		}
+		for k := range after {
+			if _, ok := before[table][k]; !ok {
+				keys = append(keys, k)
+			}
+		}
+		slices.Sort(keys)
+
+		for _, k := range keys {
+			oldRow, newRow := before[table][k], after[k]
+			if reflect.DeepEqual(oldRow, newRow) {
+				continue
+			}
+			values := rowKey(columns, pk, core.If(newRow != nil, newRow, oldRow))
+			args := sqlx.Args{}
+			where := rowCondition(pk, values, args)
+			current, err := ds.FetchOne(fmt.Sprintf("SQL:SELECT %s FROM %s WHERE %s", joinIdents(columns),
+				quoteIdent(table), where), args)
+			if err == sqlx.ErrNoRows {
+				current, err = nil, nil
+			}
+			if err != nil {
+				return err
+			}
+			if !reflect.DeepEqual(current, newRow) {
+				core.Info("row %s of %s changed after transaction %d, not reverted", k, table, id)
+				continue
+			}
+			if oldRow == nil {
+				statements = append(statements, statement{fmt.Sprintf("SQL:DELETE FROM %s WHERE %s",
+					quoteIdent(table), where), args})
+				continue
+			}
+			args = sqlx.Args{}
+			params := make([]string, len(columns))
+			for i := range columns {
+				params[i] = fmt.Sprintf(":c%d", i)
+				args[fmt.Sprintf("c%d", i)] = oldRow[i]
+			}
+			statements = append(statements, statement{fmt.Sprintf("SQL:INSERT OR REPLACE INTO %s (%s) VALUES (%s)",
+				quoteIdent(table), joinIdents(columns), strings.Join(params, ", ")), args})
+		}
+	}
+	if len(statements) == 0 {
+		core.End("nothing to revert")
+		return nil
+	}
+
+	rtx, err := ds.Begin()
+	if err != nil {
+		return err
+	}
+	for _, s := range statements {
+		if _, err := rtx.Exec(s.key, s.args); err != nil {
+			rtx.Rollback()
+			return core.Error(core.DbError, "cannot revert transaction %d", id, err)
+		}
+	}
+	err = rtx.Commit()
+	if err != nil {
+		return err
+	}
+	core.End("%d statements", len(statements))
+	return nil
+}
+
+// readHistory returns the transactions in the vault in order.
+func (ds *Replica) readHistory() ([]transaction, error) {
+	files, err := ds.vault.ReadDir(replicaDir, time.Time{}, 0, 0)
+	if err != nil && err != sqlx.ErrNoRows {
+		return nil, core.Error(core.FileError, "cannot read files in replica", err)
+	}
+	files = slices.DeleteFunc(files, func(f vault.File) bool {
+		return f.IsDir
+	})
+	history, err := ds.readTransactionFiles(files)
+	if err != nil {
+		return nil, err
+	}
+	slices.SortFunc(history, compareTransactions)
+	return history, nil
+}
+
+// position returns the number of transactions in the history up to the given point.
+func position(history []transaction, at At) (int, error) {
+	if at.Id != 0 {
+		i := slices.IndexFunc(history, func(t transaction) bool { return t.Id == at.Id })
+		if i < 0 {
+			return 0, core.Error(core.GenericError, "transaction %d is not in the history", at.Id)
+		}
+		return i + 1, nil
+	}
+	n := 0
+	for n < len(history) && hlcWall(history[n].Hlc) <= at.Time.UnixMilli() {
+		n++
+	}
+	return n, nil
+}
+
+// rebuild returns a replica on a temporary database with the tables after the first n transactions of the history,
+// and the transaction that holds them. The caller must release both with drop.
+func (ds *Replica) rebuild(history []transaction, n int) (*Replica, *sqlx.TxX, error) {
+	core.Start("%d transactions", n)
+	f, err := os.CreateTemp("", "bao-history-*.db")
+	if err != nil {
+		return nil, nil, core.Error(core.FileError, "cannot create temporary database", err)
+	}
+	f.Close()
+	db, err := sqlx.Open("sqlite3", f.Name(), "")
+	if err != nil {
+		os.Remove(f.Name())
+		return nil, nil, err
+	}
+	db.CopyStatements(ds.db)
+	tmp := &Replica{vault: ds.vault, db: db}
+	fail := func(err error) (*Replica, *sqlx.TxX, error) {
+		tmp.drop(nil)
+		return nil, nil, err
+	}
+
+	ddl, err := ds.tablesDdl()
+	if err != nil {
+		return fail(err)
+	}
+	for _, sql := range ddl {
+		if _, err := db.Exec("SQL:"+sql, sqlx.Args{}); err != nil {
+			return fail(core.Error(core.DbError, "cannot create table in temporary database", err))
+		}
+	}
+	r, err := Open(ds.vault, db)
+	if err != nil {
+		return fail(err)
+	}
+	tmp = r
+	tmp.merged, tmp.schema = ds.merged, ds.schema
+
+	var cp *checkpoint
+	start := 0
+	if n > 0 {
+		files, heads, err := ds.listCheckpoints()
+		if err != nil {
+			return fail(err)
+		}
+		last := -1
+		for i, h := range heads {
+			if h.Last.compare(history[n-1].key()) <= 0 && (last < 0 || h.Last.compare(heads[last].Last) > 0) {
+				last = i
+			}
+		}
+		if last >= 0 {
+			c, err := ds.loadCheckpoint(files[last])
+			if err != nil {
+				return fail(err)
+			}
+			cp = &c
+			for start < n && history[start].key().compare(c.Last) <= 0 {
+				start++
+			}
+		}
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return fail(core.Error(core.DbError, "cannot start transaction", err))
+	}
+	if cp != nil {
+		if err := tmp.restoreCheckpoint(tx, *cp); err != nil {
+			tx.Rollback()
+			return fail(err)
+		}
+	}
+	if err := ds.copyRejected(tx); err != nil {
+		tx.Rollback()
+		return fail(err)
+	}
+	for _, t := range history[start:n] {
+		if _, err := tmp.applyTransaction(tx, t, true); err != nil {
+			tx.Rollback()
+			return fail(err)
+		}
+	}
+	core.End("%d transactions applied, checkpoint %t", n-start, cp != nil)
+	return tmp, tx, nil
+}
+
+// copyRejected copies the transactions rejected by the replica into the temporary database in tx, so that the
+// history rejects the same transactions.
+func (ds *Replica) copyRejected(tx *sqlx.TxX) error {
+	src, err := ds.db.Begin()
+	if err != nil {
+		return core.Error(core.DbError, "cannot start transaction", err)
+	}
+	tr, err := readTableRows(src, "replica_rejected", "replica_rejected")
+	src.Rollback() // read only
+	if err != nil {
+		return err
+	}
+	if _, err := tx.Exec("CLEAR_REPLICATED_TABLE", sqlx.Args{"#table": "replica_rejected"}); err != nil {
+		return core.Error(core.DbError, "cannot clear rejected transactions", err)
+	}
+	return insertRows(tx, "replica_rejected", tr)
+}
+
+// drop rolls back tx and deletes the temporary database of a replica built with rebuild.
+func (ds *Replica) drop(tx *sqlx.TxX) {
+	if tx != nil {
+		tx.Rollback()
+	}
+	ds.db.Close()
+	os.Remove(ds.db.DbPath)
+}
+
+// tablesDdl returns the statements that create the replicated tables.
+func (ds *Replica) tablesDdl() ([]string, error) {
+	tx, err := ds.db.Begin()
+	if err != nil {
+		return nil, core.Error(core.DbError, "cannot start transaction", err)
+	}
+	defer tx.Rollback() // read only
+
+	tables, err := listTables(tx, "GET_REPLICATED_TABLES")
+	if err != nil {
+		return nil, err
+	}
+	var ddl []string
+	for _, table := range tables {
+		var sql string
+		if err := tx.QueryRow("GET_TABLE_SQL", sqlx.Args{"name": table}, &sql); err != nil {
+			return nil, core.Error(core.DbError, "cannot read definition of table %s", table, err)
+		}
+		ddl = append(ddl, sql)
+	}
+	return ddl, nil
+}
+
+// tableKey returns the columns and the primary key columns of a table, in key order.
+func tableKey(tx *sqlx.TxX, table string) (columns, pk []string, err error) {
+	rows, err := tx.Query("GET_TABLE_COLUMNS", sqlx.Args{"tbl": table})
+	if err != nil {
+		return nil, nil, core.Error(core.DbError, "cannot read columns of table %s", table, err)
+	}
+	defer rows.Close()
+	keys := map[int]string{}
+	for rows.Next() {
+		var name string
+		var idx int
+		if err := rows.Scan(&name, &idx); err != nil {
+			return nil, nil, core.Error(core.DbError, "cannot scan columns of table %s", table, err)
+		}
+		columns = append(columns, name)
+		if idx > 0 {
+			keys[idx] = name
+		}
+	}
+	for i := 1; i <= len(keys); i++ {
+		pk = append(pk, keys[i])
+	}
+	if len(columns) == 0 {
+		return nil, nil, core.Error(core.DbError, "table %s does not exist", table)
+	}
+	if len(pk) == 0 {
+		return nil, nil, core.Error(core.DbError, "table %s has no primary key", table)
+	}
+	return columns, pk, nil
+}
+
+// rowKey returns the values of the primary key in a row.
+func rowKey(columns, pk []string, row []any) []any {
+	values := make([]any, len(pk))
+	for i, k := range pk {
+		values[i] = row[slices.Index(columns, k)]
+	}
+	return values
+}
+
+// rowCondition returns the condition that selects the row with the given key values, and adds its parameters to
+// args.
+func rowCondition(pk []string, values []any, args sqlx.Args) string {
+	conds := make([]string, len(pk))
+	for i, k := range pk {
+		param := fmt.Sprintf("k%d", i)
+		conds[i] = fmt.Sprintf("%s = :%s", quoteIdent(k), param)
+		args[param] = values[i]
+	}
+	return strings.Join(conds, " AND ")
+}
+
+// readRow returns the first row of a query, or nil when there are no rows.
+func readRow(tx *sqlx.TxX, query string, args sqlx.Args) ([]any, error) {
+	rows, err := tx.Query(query, args)
+	if err != nil {
+		return nil, core.Error(core.DbError, "cannot read row", err)
+	}
+	defer rows.Close()
+	if !rows.Next() {
+		return nil, nil
+	}
+	row, err := rows.Current()
+	if err != nil {
+		return nil, core.Error(core.DbError, "cannot scan row", err)
+	}
+	return row, nil
+}
+
+// readKeyedRows returns the rows of a table by their primary key as a JSON array.
+func readKeyedRows(tx *sqlx.TxX, table string) (map[string][]any, error) {
+	columns, pk, err := tableKey(tx, table)
+	if err != nil {
+		return nil, err
+	}
+	tr, err := readTableRows(tx, table, table)
+	if err != nil {
+		return nil, err
+	}
+	rows := map[string][]any{}
+	for _, row := range tr.Rows {
+		key, err := json.Marshal(rowKey(columns, pk, row))
+		if err != nil {
+			return nil, core.Error(core.EncodeError, "cannot marshal key of row in %s", table, err)
+		}
+		rows[string(key)] = row
+	}
+	return rows, nil
+}
+
+func joinIdents(names []string) string {
+	quoted := make([]string, len(names))
+	for i, n := range names {
+		quoted[i] = quoteIdent(n)
+	}
+	return strings.Join(quoted, ", ")
+}
@@ -0,0 +1,61 @@
+package replica
+
+import (
+	"sync"
+	"time"
+
+	"github.com/stregato/bao/lib/core"
+)
+
+// hlc is a hybrid logical clock. A stamp keeps the wall time in milliseconds in the high 48 bits and a counter in
+// the low 16 bits, so stamps follow the wall clock but never go back, and a transaction written after reading
+// another always gets a larger stamp, even when the clocks of the peers are skewed.
+type hlc struct {
+	mu   sync.Mutex
+	last uint64
+}
+
+const hlcCounterBits = 16
+
+// hlcMaxDrift is how far ahead of the wall clock an observed stamp can be. The clock ignores the stamps beyond it,
+// so a peer with a wrong clock cannot push the clocks of the others to the end of time, where the counter wraps.
+const hlcMaxDrift = time.Hour
+
+// now returns a new stamp, larger than all stamps returned or observed before.
+func (c *hlc) now() uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	wall := uint64(core.Now().UnixMilli()) << hlcCounterBits
+	if wall > c.last {
+		c.last = wall
+	} else {
+		c.last++
+	}
+	return c.last
+}
+
+// observe moves the clock forward to a stamp received from another peer. Stamps more than hlcMaxDrift ahead of
+// the wall clock are ignored.
+func (c *hlc) observe(stamp uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if hlcWall(stamp) > core.Now().Add(hlcMaxDrift).UnixMilli() {
+		core.Info("ignoring stamp %d, too far in the future", stamp)
+		return
+	}
+	if stamp > c.last {
+		c.last = stamp
+	}
+}
+
+// hlcWall returns the wall time in milliseconds of a stamp.
+func hlcWall(stamp uint64) int64 {
+	return int64(stamp >> hlcCounterBits)
+}
+
+// hlcStamp returns the first stamp of a wall time.
+func hlcStamp(t time.Time) uint64 {
+	return uint64(t.UnixMilli()) << hlcCounterBits
+}
@@ -0,0 +1,104 @@
+package replica
+
+import (
+	"encoding/json"
+
+	"github.com/stregato/bao/lib/core"
+	"github.com/stregato/bao/lib/sqlx"
+)
+
+// The key-value stores and the collections of documents live in the tables bao_kv and bao_documents, which every
+// replica creates when it opens, so they need no DDL from the app. Their changes are statements like any other, so
+// they are ordered, synced and checked against the grants in the same way.
+
+// KV is a key-value store in a replica. The values are JSON.
+type KV struct {
+	r    *Replica
+	name string
+}
+
+// Entry is a key and its value in a key-value store.
+type Entry struct {
+	Key   string          `json:"key"`
+	Value json.RawMessage `json:"value"`
+}
+
+// initStores creates the tables of the key-value stores and of the collections.
+func (ds *Replica) initStores() error {
+	for _, key := range []string{"CREATE_BAO_KV", "CREATE_BAO_DOCUMENTS"} {
+		if _, err := ds.db.Exec(key, sqlx.Args{}); err != nil {
+			return core.Error(core.DbError, "cannot create replica tables", err)
+		}
+	}
+	return nil
+}
+
+// KV returns the key-value store with the given name.
+func (ds *Replica) KV(name string) *KV {
+	return &KV{r: ds, name: name}
+}
+
+// Get unmarshals the value of the key into value. It returns sqlx.ErrNoRows when the key does not exist.
+func (kv *KV) Get(key string, value any) error {
+	core.Start("store %s, key %s", kv.name, key)
+	row, err := kv.r.FetchOne("GET_BAO_KV", sqlx.Args{"store": kv.name, "key": key})
+	if err != nil {
+		return err
+	}
+	data, _ := row[0].(string)
+	err = json.Unmarshal([]byte(data), value)
+	if err != nil {
+		return core.Error(core.ParseError, "cannot unmarshal value of %s in store %s", key, kv.name, err)
+	}
+	core.End("")
+	return nil
+}
+
+// Put sets the value of the key. The change is published on the next Sync.
+func (kv *KV) Put(key string, value any) error {
+	core.Start("store %s, key %s", kv.name, key)
+	data, err := json.Marshal(value)
+	if err != nil {
+		return core.Error(core.EncodeError, "cannot marshal value of %s in store %s", key, kv.name, err)
+	}
+	_, err = kv.r.Exec("PUT_BAO_KV", sqlx.Args{"store": kv.name, "key": key, "value": string(data)})
+	if err != nil {
+		return err
+	}
+	core.End("")
+	return nil
+}
+
+// Delete removes the key. The change is published on the next Sync.
+func (kv *KV) Delete(key string) error {
+	core.Start("store %s, key %s", kv.name, key)
+	_, err := kv.r.Exec("DELETE_BAO_KV", sqlx.Args{"store": kv.name, "key": key})
+	if err != nil {
+		return err
+	}
+	core.End("")
+	return nil
+}
+
+// Scan returns the entries whose key starts with prefix, in key order.
+func (kv *KV) Scan(prefix string) ([]Entry, error) {
+	core.Start("store %s, prefix %s", kv.name, prefix)
+	rows, err := kv.r.Query("SCAN_BAO_KV", sqlx.Args{"store": kv.name, "prefix": prefix})
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var entries []Entry
+	for rows.Next() {
+		var e Entry
+		var value string
+		if err := rows.Scan(&e.Key, &value); err != nil {
+			return nil, core.Error(core.DbError, "cannot scan entry of store %s", kv.name, err)
+		}
+		e.Value = json.RawMessage(value)
+		entries = append(entries, e)
+	}
+	core.End("%d entries", len(entries))
+	return entries, nil
+}
@@ -0,0 +1,411 @@
+package replica
+
+import (
+	"encoding/json"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/stregato/bao/lib/core"
+	"github.com/stregato/bao/lib/sqlx"
+)
+
+// Merged tables are not replicated by replaying SQL. Triggers capture the rows and columns that Exec changes, and
+// the transaction carries them as cells. Every peer merges the cells in a state of registers, one per column of a
+// row, where the cell with the largest HLC stamp wins, so the result does not depend on the order the transactions
+// arrive in. The existence of a row is a register as well, unless the table is an add-wins set: then every insert
+// adds a tag to the row, a delete removes the tags it has seen, and a row exists while it has a tag, so an insert
+// concurrent to a delete wins. The rows of the table are rebuilt from the state after the merge.
+//
+// All peers must declare the same merged tables before they sync.
+
+// MergeMode is how the rows of a merged table are merged.
+type MergeMode int
+
+const (
+	LastWriterWins MergeMode = iota // Each column and the existence of a row are last-writer-wins registers
+	AddWins                         // Like LastWriterWins, but an insert wins over a concurrent delete of the row
+)
+
+type cellOp uint8
+
+const (
+	cellSet    cellOp = iota // Set a column
+	cellInsert               // Insert the row in a last-writer-wins table
+	cellDelete               // Delete the row in a last-writer-wins table
+	cellAdd                  // Insert the row in an add-wins table
+	cellRemove               // Delete the row in an add-wins table
+)
+
+// cell is a change to a row of a merged table.
+type cell struct {
+	Table   string
+	Key     string // Primary key of the row as a JSON array
+	Op      cellOp
+	Column  string     // Column set by cellSet
+	Value   any        // Value set by cellSet
+	Removed []orderKey // Tags seen by cellRemove
+}
+
+type mergedTable struct {
+	mode    MergeMode
+	columns []string
+	pk      []string
+}
+
+// Merge declares a table whose rows are merged by column instead of replaying the SQL statements that change them.
+// The table must have a primary key. Merge must be called when the replica has no pending changes.
+func (ds *Replica) Merge(table string, mode MergeMode) error {
+	core.Start("table %s, mode %d", table, mode)
+	ds.execLock.Lock()
+	defer ds.execLock.Unlock()
+
+	if ds.transaction != nil {
+		return core.Error(core.GenericError, "cannot declare merged table %s with pending changes", table)
+	}
+	return ds.merge(table, mode)
+}
+
+// merge reads the columns of the table and creates its capture triggers.
+func (ds *Replica) merge(table string, mode MergeMode) error {
+	rows, err := ds.db.Query("GET_TABLE_COLUMNS", sqlx.Args{"tbl": table})
+	if err != nil {
+		return core.Error(core.DbError, "cannot read columns of table %s", table, err)
+	}
+	m := mergedTable{mode: mode}
+	var pkIdx []int
+	for rows.Next() {
+		var name string
+		var pk int
+		if err := rows.Scan(&name, &pk); err != nil {
+			rows.Close()
+			return core.Error(core.DbError, "cannot scan columns of table %s", table, err)
+		}
+		m.columns = append(m.columns, name)
+		if pk > 0 {
+			m.pk = append(m.pk, name)
+			pkIdx = append(pkIdx, pk)
+		}
+	}
+	rows.Close()
+	if len(m.columns) == 0 {
+		return core.Error(core.DbError, "table %s does not exist", table)
+	}
+	if len(m.pk) == 0 {
+		return core.Error(core.DbError, "table %s has no primary key and cannot be merged", table)
+	}
+	sorted := make([]string, len(m.pk)) // columns of a composite key in key order
+	for i, idx := range pkIdx {
+		sorted[idx-1] = m.pk[i]
+	}
+	m.pk = sorted
+
+	for _, trigger := range captureTriggers(table, m) {
+		if _, err := ds.db.Exec("SQL:"+trigger, sqlx.Args{}); err != nil {
+			return core.Error(core.DbError, "cannot create capture trigger on table %s", table, err)
+		}
+	}
+	ds.merged[table] = &m
+	core.End("%d columns", len(m.columns))
+	return nil
+}
+
+func quoteIdent(s string) string {
+	return `"` + strings.ReplaceAll(s, `"`, `""`) + `"`
+}
+
+func quoteString(s string) string {
+	return `'` + strings.ReplaceAll(s, `'`, `''`) + `'`
+}
+
+// captureTriggers returns the statements that create the triggers recording the changes to the table in
+// replica_capture. A row with a NULL column is the insert (value 1) or the delete (value 0) of a row.
+func captureTriggers(table string, m mergedTable) []string {
+	keyOf := func(row string) string {
+		var cols []string
+		for _, c := range m.pk {
+			cols = append(cols, row+"."+quoteIdent(c))
+		}
+		return "json_array(" + strings.Join(cols, ", ") + ")"
+	}
+	name := func(op string) string {
+		return quoteIdent("replica_capture_" + table + "_" + op)
+	}
+	capture := func(key, col, value, when string) string {
+		return fmt.Sprintf("INSERT INTO replica_capture (tbl, pk, col, value) SELECT %s, %s, %s, %s%s;\n",
+			quoteString(table), key, col, value, when)
+	}
+	t, newKey, oldKey := quoteIdent(table), keyOf("NEW"), keyOf("OLD")
+	keyChanged := oldKey + " IS NOT " + newKey
+
+	insert := fmt.Sprintf("CREATE TRIGGER %s AFTER INSERT ON %s BEGIN\n", name("i"), t)
+	insert += capture(newKey, "NULL", "1", "")
+	update := fmt.Sprintf("CREATE TRIGGER %s AFTER UPDATE ON %s BEGIN\n", name("u"), t)
+	update += capture(oldKey, "NULL", "0", " WHERE "+keyChanged)
+	update += capture(newKey, "NULL", "1", " WHERE "+keyChanged)
+	for _, c := range m.columns {
+		col, value := quoteString(c), "NEW."+quoteIdent(c)
+		insert += capture(newKey, col, value, "")
+		update += capture(newKey, col, value, fmt.Sprintf(" WHERE OLD.%s IS NOT %s OR %s", quoteIdent(c), value, keyChanged))
+	}
+	del := fmt.Sprintf("CREATE TRIGGER %s AFTER DELETE ON %s BEGIN\n", name("d"), t)
+	del += capture(oldKey, "NULL", "0", "")
+
+	return []string{
+		"DROP TRIGGER IF EXISTS " + name("i"),
+		"DROP TRIGGER IF EXISTS " + name("u"),
+		"DROP TRIGGER IF EXISTS " + name("d"),
+		insert + "END",
+		update + "END",
+		del + "END",
+	}
+}
+
+// initMerge creates the tables of the merge state and drops the capture triggers left by a previous instance, since
+// only the tables declared with Merge are captured.
+func (ds *Replica) initMerge() error {
+	for _, key := range []string{"CREATE_REPLICA_CELLS", "CREATE_REPLICA_TAGS", "CREATE_REPLICA_CAPTURE"} {
+		if _, err := ds.db.Exec(key, sqlx.Args{}); err != nil {
+			return core.Error(core.DbError, "cannot create replica tables", err)
+		}
+	}
+	rows, err := ds.db.Query("GET_REPLICA_CAPTURE_TRIGGERS", sqlx.Args{})
+	if err != nil {
+		return core.Error(core.DbError, "cannot list capture triggers", err)
+	}
+	var triggers []string
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			rows.Close()
+			return core.Error(core.DbError, "cannot scan capture trigger", err)
+		}
+		triggers = append(triggers, name)
+	}
+	rows.Close()
+	for _, trigger := range triggers {
+		if _, err := ds.db.Exec("DROP_REPLICA_CAPTURE_TRIGGER", sqlx.Args{"#trigger": trigger}); err != nil {
+			return core.Error(core.DbError, "cannot drop capture trigger %s", trigger, err)
+		}
+	}
+	if _, err := ds.db.Exec("CLEAR_REPLICA_CAPTURE", sqlx.Args{}); err != nil {
+		return core.Error(core.DbError, "cannot clear capture", err)
+	}
+	return nil
+}
+
+// isMerged returns true when the table is declared with Merge.
+func (ds *Replica) isMerged(table string) bool {
+	_, ok := ds.merged[table]
+	return ok
+}
+
+// readCapture returns the cells for the changes captured in tx. Only the last change to a column of a row is kept.
+func (ds *Replica) readCapture(tx *sqlx.TxX) ([]cell, error) {
+	if len(ds.merged) == 0 {
+		return nil, nil
+	}
+	rows, err := tx.Query("GET_REPLICA_CAPTURE", sqlx.Args{})
+	if err != nil {
+		return nil, core.Error(core.DbError, "cannot read captured changes", err)
+	}
+	var cells []cell
+	index := map[[3]string]int{} // position in cells of the last change to a table, row and column
+	for rows.Next() {
+		var c cell
+		var col *string
+		if err := rows.Scan(&c.Table, &c.Key, &col, &c.Value); err != nil {
+			rows.Close()
+			return nil, core.Error(core.DbError, "cannot scan captured change", err)
+		}
+		m, ok := ds.merged[c.Table]
+		if !ok {
+			continue
+		}
+		if col != nil {
+			c.Op, c.Column = cellSet, *col
+		} else {
+			insert := c.Value == int64(1)
+			c.Value = nil
+			switch {
+			case m.mode == AddWins && insert:
+				c.Op = cellAdd
+			case m.mode == AddWins:
+				c.Op = cellRemove
+			case insert:
+				c.Op = cellInsert
+			default:
+				c.Op = cellDelete
+			}
+		}
+		id := [3]string{c.Table, c.Key, c.Column}
+		if i, ok := index[id]; ok {
+			cells[i] = c
+		} else {
+			index[id] = len(cells)
+			cells = append(cells, c)
+		}
+	}
+	rows.Close()
+
+	for i, c := range cells {
+		if c.Op != cellRemove {
+			continue
+		}
+		cells[i].Removed, err = liveTags(tx, c.Table, c.Key)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return cells, nil
+}
+
+func liveTags(tx *sqlx.TxX, table, key string) ([]orderKey, error) {
+	rows, err := tx.Query("GET_REPLICA_LIVE_TAGS", sqlx.Args{"tbl": table, "pk": key})
+	if err != nil {
+		return nil, core.Error(core.DbError, "cannot read tags of %s in %s", key, table, err)
+	}
+	defer rows.Close()
+	var tags []orderKey
+	for rows.Next() {
+		var tag orderKey
+		if err := rows.Scan(&tag.Hlc, &tag.Origin); err != nil {
+			return nil, core.Error(core.DbError, "cannot scan tag of %s in %s", key, table, err)
+		}
+		tags = append(tags, tag)
+	}
+	return tags, nil
+}
+
+// mergeCells merges the cells of a transaction in the state and rebuilds the rows they change.
+func (ds *Replica) mergeCells(tx *sqlx.TxX, t transaction) error {
+	if len(t.Cells) == 0 {
+		return nil
+	}
+	core.Start("id %d, %d cells", t.Id, len(t.Cells))
+	var changed [][2]string
+	for _, c := range t.Cells {
+		args := sqlx.Args{"tbl": c.Table, "pk": c.Key, "hlc": t.Hlc, "origin": t.Origin}
+		var err error
+		switch c.Op {
+		case cellSet:
+			args["col"], args["value"] = c.Column, c.Value
+			_, err = tx.Exec("SET_REPLICA_CELL", args)
+		case cellInsert, cellDelete:
+			args["col"], args["value"] = "", c.Op == cellInsert
+			_, err = tx.Exec("SET_REPLICA_CELL", args)
+		case cellAdd:
+			_, err = tx.Exec("ADD_REPLICA_TAG", args)
+		case cellRemove:
+			for _, tag := range c.Removed {
+				args["hlc"], args["origin"] = tag.Hlc, tag.Origin
+				if _, err = tx.Exec("REMOVE_REPLICA_TAG", args); err != nil {
+					break
+				}
+			}
+		}
+		if err != nil {
+			return core.Error(core.DbError, "cannot merge cell of %s in %s", c.Key, c.Table, err)
+		}
+		if row := [2]string{c.Table, c.Key}; !slices.Contains(changed, row) {
+			changed = append(changed, row)
+		}
+	}
+
+	for _, row := range changed {
+		m, ok := ds.merged[row[0]]
+		if !ok {
+			core.Info("table %s is not merged in this replica, skipping row %s", row[0], row[1])
+			continue
+		}
+		if err := ds.rebuildRow(tx, row[0], row[1], m); err != nil {
+			return err
+		}
+	}
+	core.End("%d rows", len(changed))
+	return nil
+}
+
+// rebuildRow writes a row of a merged table as it is in the state, or deletes it when it does not exist.
+func (ds *Replica) rebuildRow(tx *sqlx.TxX, table, key string, m *mergedTable) error {
+	var exists bool
+	if m.mode == AddWins {
+		tags, err := liveTags(tx, table, key)
+		if err != nil {
+			return err
+		}
+		exists = len(tags) > 0
+	} else {
+		err := tx.QueryRow("GET_REPLICA_CELL", sqlx.Args{"tbl": table, "pk": key, "col": ""}, &exists)
+		if err != nil && err != sqlx.ErrNoRows {
+			return core.Error(core.DbError, "cannot read existence of %s in %s", key, table, err)
+		}
+	}
+
+	args := sqlx.Args{}
+	where, err := keyCondition(key, m, args)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		_, err = tx.Exec(fmt.Sprintf("SQL:DELETE FROM %s WHERE %s", quoteIdent(table), where), args)
+		if err != nil {
+			return core.Error(core.DbError, "cannot delete %s in %s", key, table, err)
+		}
+		return nil
+	}
+
+	rows, err := tx.Query("GET_REPLICA_ROW_CELLS", sqlx.Args{"tbl": table, "pk": key})
+	if err != nil {
+		return core.Error(core.DbError, "cannot read cells of %s in %s", key, table, err)
+	}
+	var cols, params []string
+	values := sqlx.Args{}
+	for rows.Next() {
+		var col string
+		var value any
+		if err := rows.Scan(&col, &value); err != nil {
+			rows.Close()
+			return core.Error(core.DbError, "cannot scan cell of %s in %s", key, table, err)
+		}
+		if !slices.Contains(m.columns, col) {
+			continue // the column was dropped
+		}
+		param := fmt.Sprintf("c%d", len(cols))
+		cols = append(cols, quoteIdent(col))
+		params = append(params, ":"+param)
+		values[param] = value
+	}
+	rows.Close()
+
+	_, err = tx.Exec(fmt.Sprintf("SQL:INSERT OR REPLACE INTO %s (%s) VALUES (%s)", quoteIdent(table),
+		strings.Join(cols, ", "), strings.Join(params, ", ")), values)
+	if err != nil {
+		return core.Error(core.DbError, "cannot write %s in %s", key, table, err)
+	}
+	return nil
+}
+
+// keyCondition returns the condition that selects the row with the given key, and adds its parameters to args.
+func keyCondition(key string, m *mergedTable, args sqlx.Args) (string, error) {
+	var values []any
+	d := json.NewDecoder(strings.NewReader(key))
+	d.UseNumber()
+	if err := d.Decode(&values); err != nil || len(values) != len(m.pk) {
+		return "", core.Error(core.ParseError, "invalid row key %s", key, err)
+	}
+	var conds []string
+	for i, v := range values {
+		if n, ok := v.(json.Number); ok {
+			if i, err := n.Int64(); err == nil {
+				v = i
+			} else {
+				v, _ = n.Float64()
+			}
+		}
+		param := fmt.Sprintf("k%d", i)
+		conds = append(conds, fmt.Sprintf("%s = :%s", quoteIdent(m.pk[i]), param))
+		args[param] = v
+	}
+	return strings.Join(conds, " AND "), nil
+}
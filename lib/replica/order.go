@@ -0,0 +1,430 @@
+package replica
+
+import (
+	"cmp"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/stregato/bao/lib/core"
+	"github.com/stregato/bao/lib/sqlx"
+	"github.com/stregato/bao/lib/vault"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+// Transactions are applied in the total order of their HLC stamp and origin, so all peers end with the same
+// tables whatever order the transaction files arrive in. Every applied transaction is kept in the replica log
+// together with a base, a copy of the replicated tables before the first logged transaction. When a transaction
+// arrives that sorts before one already applied, the replica restores the base and replays the log with the new
+// transaction in its place. The base moves forward during a replay, past the transactions older than replayWindow,
+// and a replay is forced when the log holds transactions older than twice the window, so the log stays short.
+//
+// A transaction that reaches the store more than lateMargin after its stamp, e.g. from a peer that was offline,
+// takes the position of its store time minus lateMargin on every peer. Since the store time is the same for all
+// peers, so is the position, and no transaction can sort before the base of a peer whose clock is within
+// lateMargin/2 of the store.
+const (
+	replayWindow = 24 * time.Hour
+	lateMargin   = replayWindow / 2
+)
+
+// orderKey is the position of a transaction in the total order.
+type orderKey struct {
+	Hlc    uint64
+	Origin string
+}
+
+func (k orderKey) compare(o orderKey) int {
+	if c := cmp.Compare(k.Hlc, o.Hlc); c != 0 {
+		return c
+	}
+	return strings.Compare(k.Origin, o.Origin)
+}
+
+func (t *transaction) key() orderKey {
+	return orderKey{t.Hlc, t.Origin}
+}
+
+func compareTransactions(a, b transaction) int {
+	return a.key().compare(b.key())
+}
+
+// initOrder creates the replica log and the base of the replicated tables when missing, and moves the clock to the
+// last applied stamp.
+func (ds *Replica) initOrder() error {
+	core.Start("")
+	for _, key := range []string{"CREATE_REPLICA_LOG", "CREATE_REPLICA_STATE", "CREATE_REPLICA_CHECKPOINT",
+		"CREATE_REPLICA_REJECTED"} {
+		if _, err := ds.db.Exec(key, sqlx.Args{}); err != nil {
+			return core.Error(core.DbError, "cannot create replica tables", err)
+		}
+	}
+
+	var base orderKey
+	err := ds.db.QueryRow("GET_REPLICA_STATE", sqlx.Args{}, &base.Hlc, &base.Origin)
+	if err == sqlx.ErrNoRows {
+		tx, err := ds.db.Begin()
+		if err != nil {
+			return core.Error(core.DbError, "cannot start transaction", err)
+		}
+		err = ds.saveBase(tx, base)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+		err = tx.Commit()
+		if err != nil {
+			return core.Error(core.DbError, "cannot commit base of replica", err)
+		}
+	} else if err != nil {
+		return core.Error(core.DbError, "cannot read replica state", err)
+	}
+
+	last, err := ds.lastApplied()
+	if err != nil {
+		return err
+	}
+	ds.clock.observe(last.Hlc)
+	core.End("last hlc %d", last.Hlc)
+	return nil
+}
+
+// lastApplied returns the key of the last transaction applied, or the key of the base when the log is empty.
+func (ds *Replica) lastApplied() (orderKey, error) {
+	var key orderKey
+	err := ds.db.QueryRow("GET_LAST_REPLICA_LOG", sqlx.Args{}, &key.Hlc, &key.Origin)
+	if err == sqlx.ErrNoRows {
+		err = ds.db.QueryRow("GET_REPLICA_STATE", sqlx.Args{}, &key.Hlc, &key.Origin)
+	}
+	if err != nil && err != sqlx.ErrNoRows {
+		return orderKey{}, core.Error(core.DbError, "cannot read last applied transaction", err)
+	}
+	return key, nil
+}
+
+// transactionStamp returns the stamp that positions the transaction in the file fi. The store time is read only
+// for stamps older than lateMargin/2, since a newer stamp cannot be late for a peer whose clock is close to the store.
+func (ds *Replica) transactionStamp(fi vault.File, stamp uint64) (uint64, error) {
+	if hlcWall(stamp) >= core.Now().Add(-lateMargin/2).UnixMilli() {
+		return stamp, nil
+	}
+	storeTime, err := ds.vault.StoreTime(fi)
+	if err != nil {
+		return 0, err
+	}
+	if earliest := storeTime.Add(-lateMargin); hlcWall(stamp) < earliest.UnixMilli() {
+		core.Info("transaction %s is late, moving it to %s", fi.Name, earliest)
+		return hlcStamp(earliest), nil
+	}
+	return stamp, nil
+}
+
+// isApplied returns true when the transaction is in the replica log.
+func (ds *Replica) isApplied(t transaction) (bool, error) {
+	var count int
+	err := ds.db.QueryRow("COUNT_REPLICA_LOG", sqlx.Args{"hlc": t.Hlc, "origin": t.Origin}, &count)
+	if err != nil {
+		return false, core.Error(core.DbError, "cannot check replica log for transaction %d", t.Id, err)
+	}
+	return count > 0, nil
+}
+
+// listTables returns the names of the tables returned by the query with the given key.
+func listTables(tx *sqlx.TxX, key string) ([]string, error) {
+	rows, err := tx.Query(key, sqlx.Args{})
+	if err != nil {
+		return nil, core.Error(core.DbError, "cannot list tables", err)
+	}
+	defer rows.Close()
+
+	var tables []string
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, core.Error(core.DbError, "cannot scan table name", err)
+		}
+		tables = append(tables, name)
+	}
+	return tables, nil
+}
+
+// saveBase copies the replicated tables into the base, which is then positioned at key.
+func (ds *Replica) saveBase(tx *sqlx.TxX, key orderKey) error {
+	core.Start("hlc %d, origin %s", key.Hlc, key.Origin)
+	bases, err := listTables(tx, "GET_REPLICA_BASE_TABLES")
+	if err != nil {
+		return err
+	}
+	for _, table := range bases {
+		if _, err := tx.Exec("DROP_REPLICA_BASE_TABLE", sqlx.Args{"#table": table}); err != nil {
+			return core.Error(core.DbError, "cannot drop base of table %s", table, err)
+		}
+	}
+	tables, err := listTables(tx, "GET_REPLICATED_TABLES")
+	if err != nil {
+		return err
+	}
+	for _, table := range tables {
+		if ds.isMerged(table) {
+			continue // the rows of merged tables do not depend on the order
+		}
+		if _, err := tx.Exec("CREATE_REPLICA_BASE_TABLE", sqlx.Args{"#table": table}); err != nil {
+			return core.Error(core.DbError, "cannot save base of table %s", table, err)
+		}
+	}
+	if _, err := tx.Exec("SET_REPLICA_STATE", sqlx.Args{"hlc": key.Hlc, "origin": key.Origin}); err != nil {
+		return core.Error(core.DbError, "cannot set replica state", err)
+	}
+	if _, err := tx.Exec("DELETE_REPLICA_LOG_UNTIL", sqlx.Args{"hlc": key.Hlc, "origin": key.Origin}); err != nil {
+		return core.Error(core.DbError, "cannot trim replica log", err)
+	}
+	core.End("%d tables", len(tables))
+	return nil
+}
+
+// restoreBase replaces the content of the replicated tables with the base. Tables created after the base are
+// emptied.
+func (ds *Replica) restoreBase(tx *sqlx.TxX) error {
+	core.Start("")
+	bases, err := listTables(tx, "GET_REPLICA_BASE_TABLES")
+	if err != nil {
+		return err
+	}
+	tables, err := listTables(tx, "GET_REPLICATED_TABLES")
+	if err != nil {
+		return err
+	}
+	for _, table := range tables {
+		if ds.isMerged(table) {
+			continue
+		}
+		if _, err := tx.Exec("CLEAR_REPLICATED_TABLE", sqlx.Args{"#table": table}); err != nil {
+			return core.Error(core.DbError, "cannot clear table %s", table, err)
+		}
+		if !slices.Contains(bases, table) {
+			continue
+		}
+		if _, err := tx.Exec("RESTORE_REPLICATED_TABLE", sqlx.Args{"#table": table}); err != nil {
+			return core.Error(core.DbError, "cannot restore table %s", table, err)
+		}
+	}
+	core.End("%d tables", len(tables))
+	return nil
+}
+
+// readLog returns the transactions in the replica log in order.
+func (ds *Replica) readLog() ([]transaction, error) {
+	rows, err := ds.db.Query("GET_REPLICA_LOG", sqlx.Args{})
+	if err != nil {
+		return nil, core.Error(core.DbError, "cannot read replica log", err)
+	}
+	defer rows.Close()
+
+	var transactions []transaction
+	for rows.Next() {
+		var data []byte
+		if err := rows.Scan(&data); err != nil {
+			return nil, core.Error(core.DbError, "cannot scan replica log", err)
+		}
+		var t transaction
+		if err := msgpack.Unmarshal(data, &t); err != nil {
+			return nil, core.Error(core.ParseError, "cannot unmarshal transaction in replica log", err)
+		}
+		transactions = append(transactions, t)
+	}
+	return transactions, nil
+}
+
+// applyTransactions applies the new transactions in order. When one of them sorts before the last applied
+// transaction, or the log is too old, the base is restored and the log is replayed with the new transactions.
+func (ds *Replica) applyTransactions(transactions []transaction) error {
+	core.Start("%d transactions", len(transactions))
+	slices.SortFunc(transactions, compareTransactions)
+
+	var fresh []transaction
+	for _, t := range transactions {
+		applied, err := ds.isApplied(t)
+		if err != nil {
+			return err
+		}
+		if applied {
+			continue
+		}
+		restored, err := ds.isInCheckpoint(t)
+		if err != nil {
+			return err
+		}
+		if !restored {
+			fresh = append(fresh, t)
+		}
+	}
+
+	last, err := ds.lastApplied()
+	if err != nil {
+		return err
+	}
+	var first uint64
+	err = ds.db.QueryRow("GET_FIRST_REPLICA_LOG_HLC", sqlx.Args{}, &first)
+	if err != nil {
+		return core.Error(core.DbError, "cannot read replica log", err)
+	}
+	horizon := core.Now().Add(-replayWindow).UnixMilli()
+	stale := first != 0 && hlcWall(first) < horizon-replayWindow.Milliseconds()
+	replay := stale || len(fresh) > 0 && fresh[0].key().compare(last) <= 0
+	if len(fresh) == 0 && !replay {
+		core.End("nothing to apply")
+		return nil
+	}
+
+	sequence := fresh
+	if replay {
+		logged, err := ds.readLog()
+		if err != nil {
+			return err
+		}
+		sequence = append(logged, fresh...)
+		slices.SortFunc(sequence, compareTransactions)
+	}
+	results := make(map[orderKey]*bool, len(fresh)) // outcome of the fresh transactions
+	for _, t := range fresh {
+		results[t.key()] = new(bool)
+	}
+
+	ds.queryLock.Lock()
+	defer ds.queryLock.Unlock()
+
+	tx, err := ds.db.Begin()
+	if err != nil {
+		return core.Error(core.DbError, "cannot start transaction", err)
+	}
+	err = ds.runSequence(tx, sequence, replay, horizon, results)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	err = tx.Commit()
+	if err != nil {
+		return core.Error(core.DbError, "cannot commit transactions", err)
+	}
+	for _, t := range fresh {
+		_, err = ds.vault.DB.Exec("INSERT_TRANSACTION_METADATA", sqlx.Args{"vault": ds.vault.ID, "id": t.Id,
+			"tm": t.Tm, "success": *results[t.key()]})
+		if err != nil {
+			return core.Error(core.DbError, "cannot insert transaction metadata %d for %d updates", t.Id, len(t.Updates), err)
+		}
+		if *results[t.key()] {
+			ds.notify(ds.changeOf(t))
+		}
+	}
+	core.End("%d applied, replay %t", len(sequence), replay)
+	return nil
+}
+
+// runSequence applies a sequence of transactions in tx, restoring the base first on a replay. During a replay the
+// base moves to the last transaction older than horizon, a time in milliseconds.
+func (ds *Replica) runSequence(tx *sqlx.TxX, sequence []transaction, replay bool, horizon int64, results map[orderKey]*bool) error {
+	if replay {
+		err := ds.restoreBase(tx)
+		if err != nil {
+			return err
+		}
+		core.Info("replaying %d transactions of replica in vault %s", len(sequence), ds.vault.ID)
+	}
+
+	var prev *transaction
+	for i := range sequence {
+		t := &sequence[i]
+		if replay && prev != nil && hlcWall(prev.Hlc) < horizon && hlcWall(t.Hlc) >= horizon {
+			err := ds.saveBase(tx, prev.key()) // the transactions up to prev are in the new base
+			if err != nil {
+				return err
+			}
+		}
+		result, fresh := results[t.key()]
+		success, err := ds.applyTransaction(tx, *t, !fresh)
+		if err != nil {
+			return err
+		}
+		if fresh {
+			*result = success
+			if err := ds.logTransaction(tx, *t, success); err != nil {
+				return err
+			}
+		}
+		prev = t
+	}
+	if replay && prev != nil && hlcWall(prev.Hlc) < horizon {
+		err := ds.saveBase(tx, prev.key())
+		if err != nil {
+			return err
+		}
+	}
+	if _, err := tx.Exec("CLEAR_REPLICA_CAPTURE", sqlx.Args{}); err != nil {
+		return core.Error(core.DbError, "cannot clear capture", err) // rebuilt rows are captured too
+	}
+	return nil
+}
+
+// applyTransaction runs the updates of a transaction. A transaction whose updates fail is rolled back as a whole
+// and reported as failed, so that all peers skip it in the same way. On a replay the grants are not checked again:
+// the transaction is rejected only when it was rejected the first time.
+func (ds *Replica) applyTransaction(tx *sqlx.TxX, t transaction, replay bool) (bool, error) {
+	core.Start("id %d, hlc %d, %d updates, replay %t", t.Id, t.Hlc, len(t.Updates), replay)
+	if replay {
+		target, err := rejectedTarget(tx, t)
+		if err != nil {
+			return false, err
+		}
+		if target != "" {
+			core.End("rejected on %s", target)
+			return false, nil
+		}
+	} else {
+		target, err := ds.unauthorized(t)
+		if err != nil {
+			return false, err
+		}
+		if target != "" {
+			return false, reject(tx, t, target)
+		}
+	}
+	if _, err := tx.Exec("REPLICA_SAVEPOINT", sqlx.Args{}); err != nil {
+		return false, core.Error(core.DbError, "cannot set savepoint for transaction %d", t.Id, err)
+	}
+	success := true
+	for _, u := range t.Updates {
+		_, err := tx.Exec(u.Key, u.Args)
+		if err != nil {
+			core.LogError("cannot execute %s in transaction %d, skipping the transaction", u.Key, t.Id, err)
+			success = false
+			break
+		}
+	}
+	if success {
+		if err := ds.mergeCells(tx, t); err != nil {
+			return false, err
+		}
+	} else {
+		if _, err := tx.Exec("REPLICA_ROLLBACK_TO", sqlx.Args{}); err != nil {
+			return false, core.Error(core.DbError, "cannot roll back transaction %d", t.Id, err)
+		}
+	}
+	if _, err := tx.Exec("REPLICA_RELEASE", sqlx.Args{}); err != nil {
+		return false, core.Error(core.DbError, "cannot release savepoint for transaction %d", t.Id, err)
+	}
+	core.End("success %t", success)
+	return success, nil
+}
+
+// logTransaction adds a transaction to the replica log, so that it can be replayed.
+func (ds *Replica) logTransaction(tx *sqlx.TxX, t transaction, success bool) error {
+	data, err := msgpack.Marshal(t)
+	if err != nil {
+		return core.Error(core.EncodeError, "cannot marshal transaction %d", t.Id, err)
+	}
+	_, err = tx.Exec("INSERT_REPLICA_LOG", sqlx.Args{"hlc": t.Hlc, "origin": t.Origin, "success": success, "data": data})
+	if err != nil {
+		return core.Error(core.DbError, "cannot add transaction %d to replica log", t.Id, err)
+	}
+	return nil
+}
@@ -6,30 +6,45 @@ import (
 	"time"
 
 	"github.com/stregato/bao/lib/core"
+	"github.com/stregato/bao/lib/security"
 	"github.com/stregato/bao/lib/sqlx"
 	"github.com/stregato/bao/lib/vault"
 )
 
 type transaction struct {
 	tx      *sqlx.TxX
-	Updates []Update     // Updates is a list of Update encoded in msgpack and encrypted
-	Version float32      // Version is the highest version of the updates
-	Id      vault.FileId // Id is the id of the transaction
-	Tm      time.Time    // Tm is the time of the transaction
+	Updates []Update          // Updates is a list of Update encoded in msgpack and encrypted
+	Version float32           // Version is the version of the schema the transaction was written against
+	Id      vault.FileId      // Id is the id of the transaction
+	Tm      time.Time         // Tm is the time of the transaction
+	Hlc     uint64            // Hlc is the hybrid logical clock stamp of the transaction, set when it is written
+	Origin  string            // Origin is the unique name of the transaction, which breaks ties between equal stamps
+	Cells   []cell            // Cells are the changes to merged tables
+	Author  security.PublicID `msgpack:"-"` // Author is the signer of the transaction file, checked against the replica grants
+	capture int               // capture is the number of changes captured so far in merged tables
 }
 
 type Replica struct {
 	vault       *vault.Vault
-	lastId      vault.FileId // lastId is the last id used for the transaction
-	db          *sqlx.DB     // db is the database connection for the layer
-	syncLock    sync.Mutex   // syncLock serializes Sync calls on a replica instance
-	execLock    sync.Mutex   // execLock is a lock for executing SQL statements
-	queryLock   sync.Mutex   // queryLock is a lock for executing SQL queries
-	transaction *transaction // transaction is the current transaction for the layer
+	lastId      vault.FileId            // lastId is the last id used for the transaction
+	db          *sqlx.DB                // db is the database connection for the layer
+	syncLock    sync.Mutex              // syncLock serializes Sync calls on a replica instance
+	execLock    sync.Mutex              // execLock is a lock for executing SQL statements
+	queryLock   sync.Mutex              // queryLock is a lock for executing SQL queries
+	transaction *transaction            // transaction is the current transaction for the layer
+	pending     []transaction           // pending are the transactions committed with Tx and not yet synced
+	open        *Tx                     // open is the transaction started with Begin and not yet finished
+	clock       hlc                     // clock stamps the transactions written by this replica
+	merged      map[string]*mergedTable // merged are the tables declared with Merge
+	schema      float32                 // schema is the version of the last schema applied
+	feed        changeFeed              // feed notifies the changes to the subscribers
 }
 
 const replicaDir = "replica"
 
+//go:embed replica.sql
+var replicaDdl string
+
 func Open(v *vault.Vault, db *sqlx.DB) (*Replica, error) {
 	core.Start("vault %s", v.ID)
 
@@ -38,9 +53,12 @@ func Open(v *vault.Vault, db *sqlx.DB) (*Replica, error) {
 		return nil, core.Error(core.GenericError, "cannot read last transaction id", err)
 	}
 
-	core.End("lastId %d", lastId)
+	err = db.Define(replicaDdl)
+	if err != nil {
+		return nil, core.Error(core.DbError, "cannot define replica statements", err)
+	}
 
-	return &Replica{
+	r := &Replica{
 		vault:       v,
 		lastId:      vault.FileId(lastId),
 		db:          db,
@@ -48,7 +66,27 @@ func Open(v *vault.Vault, db *sqlx.DB) (*Replica, error) {
 		execLock:    sync.Mutex{},
 		queryLock:   sync.Mutex{},
 		transaction: nil,
-	}, nil
+		merged:      map[string]*mergedTable{},
+	}
+	err = r.initOrder()
+	if err != nil {
+		return nil, err
+	}
+	err = r.initMerge()
+	if err != nil {
+		return nil, err
+	}
+	err = r.initSchemas()
+	if err != nil {
+		return nil, err
+	}
+	err = r.initStores()
+	if err != nil {
+		return nil, err
+	}
+
+	core.End("lastId %d", lastId)
+	return r, nil
 }
 
 func readLastTransactionsId(db *sqlx.DB, vaultID string) (lastId int64, err error) {
@@ -0,0 +1,262 @@
+-- CREATE_REPLICA_LOG 1.0
+CREATE TABLE IF NOT EXISTS replica_log (
+    hlc INTEGER NOT NULL,
+    origin VARCHAR(128) NOT NULL,
+    success INTEGER NOT NULL,
+    data BLOB NOT NULL,
+    PRIMARY KEY(hlc, origin)
+)
+
+-- CREATE_REPLICA_STATE 1.0
+CREATE TABLE IF NOT EXISTS replica_state (
+    id INTEGER NOT NULL PRIMARY KEY CHECK (id = 0),
+    hlc INTEGER NOT NULL,
+    origin VARCHAR(128) NOT NULL
+)
+
+-- GET_REPLICA_STATE 1.0
+SELECT hlc, origin FROM replica_state WHERE id = 0
+
+-- SET_REPLICA_STATE 1.0
+INSERT OR REPLACE INTO replica_state (id, hlc, origin) VALUES (0, :hlc, :origin)
+
+-- INSERT_REPLICA_LOG 1.0
+INSERT OR IGNORE INTO replica_log (hlc, origin, success, data) VALUES (:hlc, :origin, :success, :data)
+
+-- GET_REPLICA_LOG 1.0
+SELECT data FROM replica_log ORDER BY hlc, origin
+
+-- GET_LAST_REPLICA_LOG 1.0
+SELECT hlc, origin FROM replica_log ORDER BY hlc DESC, origin DESC LIMIT 1
+
+-- GET_FIRST_REPLICA_LOG_HLC 1.0
+SELECT COALESCE(MIN(hlc), 0) FROM replica_log
+
+-- COUNT_REPLICA_LOG 1.0
+SELECT COUNT(*) FROM replica_log WHERE hlc = :hlc AND origin = :origin
+
+-- DELETE_REPLICA_LOG_UNTIL 1.0
+DELETE FROM replica_log WHERE hlc < :hlc OR (hlc = :hlc AND origin <= :origin)
+
+-- GET_REPLICATED_TABLES 1.0
+SELECT name FROM sqlite_master WHERE type = 'table'
+AND name NOT LIKE 'sqlite\_%' ESCAPE '\' AND name NOT LIKE 'replica\_%' ESCAPE '\'
+AND name NOT IN ('versions', 'settings') ORDER BY name
+
+-- GET_REPLICA_BASE_TABLES 1.0
+SELECT substr(name, 14) FROM sqlite_master WHERE type = 'table' AND name LIKE 'replica\_base\_%' ESCAPE '\'
+
+-- DROP_REPLICA_BASE_TABLE 1.0
+DROP TABLE IF EXISTS "replica_base_#table"
+
+-- CREATE_REPLICA_BASE_TABLE 1.0
+CREATE TABLE "replica_base_#table" AS SELECT * FROM "#table"
+
+-- CLEAR_REPLICATED_TABLE 1.0
+DELETE FROM "#table"
+
+-- RESTORE_REPLICATED_TABLE 1.0
+INSERT INTO "#table" SELECT * FROM "replica_base_#table"
+
+-- REPLICA_SAVEPOINT 1.0
+SAVEPOINT replica_apply
+
+-- REPLICA_RELEASE 1.0
+RELEASE replica_apply
+
+-- REPLICA_ROLLBACK_TO 1.0
+ROLLBACK TO replica_apply
+
+-- CREATE_REPLICA_CELLS 1.0
+CREATE TABLE IF NOT EXISTS replica_cells (
+    tbl VARCHAR(256) NOT NULL,
+    pk VARCHAR(1024) NOT NULL,
+    col VARCHAR(256) NOT NULL,
+    value,
+    hlc INTEGER NOT NULL,
+    origin VARCHAR(128) NOT NULL,
+    PRIMARY KEY(tbl, pk, col)
+)
+
+-- CREATE_REPLICA_TAGS 1.0
+CREATE TABLE IF NOT EXISTS replica_tags (
+    tbl VARCHAR(256) NOT NULL,
+    pk VARCHAR(1024) NOT NULL,
+    hlc INTEGER NOT NULL,
+    origin VARCHAR(128) NOT NULL,
+    removed INTEGER NOT NULL,
+    PRIMARY KEY(tbl, pk, hlc, origin)
+)
+
+-- CREATE_REPLICA_CAPTURE 1.0
+CREATE TABLE IF NOT EXISTS replica_capture (
+    seq INTEGER PRIMARY KEY AUTOINCREMENT,
+    tbl VARCHAR(256) NOT NULL,
+    pk VARCHAR(1024) NOT NULL,
+    col VARCHAR(256),
+    value
+)
+
+-- GET_REPLICA_CAPTURE_TRIGGERS 1.0
+SELECT name FROM sqlite_master WHERE type = 'trigger' AND name LIKE 'replica\_capture\_%' ESCAPE '\'
+
+-- DROP_REPLICA_CAPTURE_TRIGGER 1.0
+DROP TRIGGER IF EXISTS "#trigger"
+
+-- GET_REPLICA_CAPTURE 1.0
+SELECT tbl, pk, col, value FROM replica_capture ORDER BY seq
+
+-- COUNT_REPLICA_CAPTURE 1.0
+SELECT COUNT(*) FROM replica_capture
+
+-- CLEAR_REPLICA_CAPTURE 1.0
+DELETE FROM replica_capture
+
+-- SET_REPLICA_CELL 1.0
+INSERT INTO replica_cells (tbl, pk, col, value, hlc, origin) VALUES (:tbl, :pk, :col, :value, :hlc, :origin)
+ON CONFLICT(tbl, pk, col) DO UPDATE SET value = excluded.value, hlc = excluded.hlc, origin = excluded.origin
+WHERE excluded.hlc > replica_cells.hlc OR (excluded.hlc = replica_cells.hlc AND excluded.origin > replica_cells.origin)
+
+-- GET_REPLICA_CELL 1.0
+SELECT value FROM replica_cells WHERE tbl = :tbl AND pk = :pk AND col = :col
+
+-- GET_REPLICA_ROW_CELLS 1.0
+SELECT col, value FROM replica_cells WHERE tbl = :tbl AND pk = :pk AND col <> '' ORDER BY col
+
+-- ADD_REPLICA_TAG 1.0
+INSERT OR IGNORE INTO replica_tags (tbl, pk, hlc, origin, removed) VALUES (:tbl, :pk, :hlc, :origin, 0)
+
+-- REMOVE_REPLICA_TAG 1.0
+INSERT INTO replica_tags (tbl, pk, hlc, origin, removed) VALUES (:tbl, :pk, :hlc, :origin, 1)
+ON CONFLICT(tbl, pk, hlc, origin) DO UPDATE SET removed = 1
+
+-- GET_REPLICA_LIVE_TAGS 1.0
+SELECT hlc, origin FROM replica_tags WHERE tbl = :tbl AND pk = :pk AND removed = 0
+
+-- GET_TABLE_COLUMNS 1.0
+SELECT name, pk FROM pragma_table_info(:tbl) ORDER BY cid
+
+-- GET_TABLE_BLOB_COLUMNS 1.0
+SELECT name FROM pragma_table_info(:tbl) WHERE upper(type) LIKE '%BLOB%'
+
+-- CREATE_REPLICA_CHECKPOINT 1.0
+CREATE TABLE IF NOT EXISTS replica_checkpoint (
+    id INTEGER NOT NULL PRIMARY KEY CHECK (id = 0),
+    hlc INTEGER NOT NULL,
+    origin VARCHAR(128) NOT NULL
+)
+
+-- GET_REPLICA_CHECKPOINT 1.0
+SELECT hlc, origin FROM replica_checkpoint WHERE id = 0
+
+-- SET_REPLICA_CHECKPOINT 1.0
+INSERT OR REPLACE INTO replica_checkpoint (id, hlc, origin) VALUES (0, :hlc, :origin)
+
+-- SELECT_TABLE_ROWS 1.0
+SELECT * FROM "#table"
+
+-- CLEAR_REPLICA_LOG 1.0
+DELETE FROM replica_log
+
+-- CREATE_REPLICA_SCHEMAS 1.0
+CREATE TABLE IF NOT EXISTS replica_schemas (
+    version REAL NOT NULL PRIMARY KEY,
+    ddl TEXT NOT NULL
+)
+
+-- GET_REPLICA_SCHEMAS 1.0
+SELECT version, ddl FROM replica_schemas ORDER BY version
+
+-- INSERT_REPLICA_SCHEMA 1.0
+INSERT OR IGNORE INTO replica_schemas (version, ddl) VALUES (:version, :ddl)
+
+-- CREATE_REPLICA_DEFERRED 1.0
+CREATE TABLE IF NOT EXISTS replica_deferred (
+    hlc INTEGER NOT NULL,
+    origin VARCHAR(128) NOT NULL,
+    version REAL NOT NULL,
+    data BLOB NOT NULL,
+    PRIMARY KEY(hlc, origin)
+)
+
+-- INSERT_REPLICA_DEFERRED 1.0
+INSERT OR IGNORE INTO replica_deferred (hlc, origin, version, data) VALUES (:hlc, :origin, :version, :data)
+
+-- GET_REPLICA_DEFERRED 1.0
+SELECT data FROM replica_deferred WHERE version <= :version ORDER BY hlc, origin
+
+-- DELETE_REPLICA_DEFERRED 1.0
+DELETE FROM replica_deferred WHERE version <= :version
+
+-- CREATE_REPLICA_REJECTED 1.0
+CREATE TABLE IF NOT EXISTS replica_rejected (
+    hlc INTEGER NOT NULL,
+    origin VARCHAR(128) NOT NULL,
+    id INTEGER NOT NULL,
+    author VARCHAR(100) NOT NULL,
+    target VARCHAR(256) NOT NULL,
+    tm INTEGER NOT NULL,
+    PRIMARY KEY(hlc, origin)
+)
+
+-- INSERT_REPLICA_REJECTED 1.0
+INSERT OR IGNORE INTO replica_rejected (hlc, origin, id, author, target, tm)
+VALUES (:hlc, :origin, :id, :author, :target, :tm)
+
+-- GET_REPLICA_REJECTED 1.0
+SELECT id, author, target, tm FROM replica_rejected ORDER BY hlc, origin
+
+-- GET_REPLICA_REJECTED_TARGET 1.0
+SELECT COALESCE(MAX(target), '') FROM replica_rejected WHERE hlc = :hlc AND origin = :origin
+
+-- SET_REPLICA_TX_SAVEPOINT 1.0
+SAVEPOINT "#savepoint"
+
+-- ROLLBACK_REPLICA_TX_SAVEPOINT 1.0
+ROLLBACK TO "#savepoint"
+
+-- RELEASE_REPLICA_TX_SAVEPOINT 1.0
+RELEASE "#savepoint"
+
+-- GET_TABLE_SQL 1.0
+SELECT sql FROM sqlite_master WHERE type = 'table' AND name = :name
+
+-- CREATE_BAO_KV 1.0
+CREATE TABLE IF NOT EXISTS bao_kv (
+    store VARCHAR(256) NOT NULL,
+    key VARCHAR(1024) NOT NULL,
+    value TEXT NOT NULL,
+    PRIMARY KEY(store, key)
+)
+
+-- PUT_BAO_KV 1.0
+INSERT OR REPLACE INTO bao_kv (store, key, value) VALUES (:store, :key, :value)
+
+-- DELETE_BAO_KV 1.0
+DELETE FROM bao_kv WHERE store = :store AND key = :key
+
+-- GET_BAO_KV 1.0
+SELECT value FROM bao_kv WHERE store = :store AND key = :key
+
+-- SCAN_BAO_KV 1.0
+SELECT key, value FROM bao_kv WHERE store = :store AND substr(key, 1, length(:prefix)) = :prefix ORDER BY key
+
+-- CREATE_BAO_DOCUMENTS 1.0
+CREATE TABLE IF NOT EXISTS bao_documents (
+    collection VARCHAR(256) NOT NULL,
+    id VARCHAR(64) NOT NULL,
+    doc TEXT NOT NULL,
+    PRIMARY KEY(collection, id)
+)
+
+-- INSERT_BAO_DOCUMENT 1.0
+INSERT INTO bao_documents (collection, id, doc) VALUES (:collection, :id, json(:doc))
+
+-- UPDATE_BAO_DOCUMENT 1.0
+UPDATE bao_documents SET doc = json_patch(doc, :patch) WHERE collection = :collection AND id = :id
+
+-- DELETE_BAO_DOCUMENT 1.0
+DELETE FROM bao_documents WHERE collection = :collection AND id = :id
+
+-- GET_BAO_DOCUMENT 1.0
+SELECT doc FROM bao_documents WHERE collection = :collection AND id = :id
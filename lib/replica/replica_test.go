@@ -1,9 +1,16 @@
 package replica
 
 import (
+	"bytes"
 	"context"
 	_ "embed"
+	"fmt"
+	"os"
+	"path"
+	"slices"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/sirupsen/logrus"
 	"github.com/stregato/bao/lib/core"
@@ -410,3 +417,843 @@ func TestExecWithSyncRelay(t *testing.T) {
 	s.Close()
 	s2.Close()
 }
+
+func TestOrderConvergence(t *testing.T) {
+	_, aliceSecret := security.NewKeyPairMust()
+
+	db := sqlx.NewTestDB(t, "bao_order.db", "")
+	dataDb1 := sqlx.NewTestDB(t, "replica_order1.db", testDdl)
+	dataDb2 := sqlx.NewTestDB(t, "replica_order2.db", testDdl)
+	s := store.LoadTestStore(t, "test")
+	defer s.Close()
+
+	v, err := vault.Create(aliceSecret, s, db, vault.Config{})
+	core.TestErr(t, err, "Create failed: %v")
+	defer v.Close()
+
+	r1, err := Open(v, dataDb1)
+	core.TestErr(t, err, "cannot open replica: %v")
+	r2, err := Open(v, dataDb2)
+	core.TestErr(t, err, "cannot open replica: %v")
+
+	hlc := uint64(core.Now().UnixMilli()) << hlcCounterBits
+	insert := transaction{Hlc: hlc, Origin: "a", Updates: []Update{
+		{"INSERT_TEST_DATA", sqlx.Args{"msg": "x", "cnt": 1, "ratio": 0.5, "bin": []byte{1}}}}}
+	set2 := transaction{Hlc: hlc + 1, Origin: "b", Updates: []Update{{"UPDATE_TEST_DATA", sqlx.Args{"msg": "x", "cnt": 2}}}}
+	set3 := transaction{Hlc: hlc + 2, Origin: "c", Updates: []Update{{"UPDATE_TEST_DATA", sqlx.Args{"msg": "x", "cnt": 3}}}}
+	duplicate := transaction{Hlc: hlc + 3, Origin: "d", Updates: []Update{
+		{"UPDATE_TEST_DATA", sqlx.Args{"msg": "x", "cnt": 4}},
+		{"INSERT_TEST_DATA", sqlx.Args{"msg": "x", "cnt": 5, "ratio": 0.5, "bin": []byte{1}}}}}
+
+	withId := func(t transaction, id vault.FileId) transaction {
+		t.Id = id
+		return t
+	}
+
+	// r1 receives the transactions in order, r2 receives set2 after the later ones
+	_, err = r1.processTransactions([]transaction{withId(insert, 1), withId(set2, 2), withId(set3, 3), withId(duplicate, 4)})
+	core.TestErr(t, err, "cannot process transactions: %v")
+	_, err = r2.processTransactions([]transaction{withId(insert, 11), withId(set3, 13), withId(duplicate, 14)})
+	core.TestErr(t, err, "cannot process transactions: %v")
+	_, err = r2.processTransactions([]transaction{withId(set2, 12)})
+	core.TestErr(t, err, "cannot process transactions: %v")
+
+	rows1, err := r1.Fetch("SELECT_TEST_DATA", sqlx.Args{}, 1000)
+	core.TestErr(t, err, "cannot select test data: %v")
+	rows2, err := r2.Fetch("SELECT_TEST_DATA", sqlx.Args{}, 1000)
+	core.TestErr(t, err, "cannot select test data: %v")
+	core.Assert(t, len(rows1) == 1 && len(rows2) == 1, "expected 1 row, got %d and %d", len(rows1), len(rows2))
+	core.Assert(t, rows1[0][1] == int64(3), "expected the last update and the failed transaction skipped, got %v", rows1[0][1])
+	core.Assert(t, rows2[0][1] == rows1[0][1], "replicas diverged: %v and %v", rows1[0][1], rows2[0][1])
+
+	last, err := r2.lastApplied()
+	core.TestErr(t, err, "cannot read last applied: %v")
+	core.Assert(t, last == duplicate.key(), "unexpected last applied transaction %v", last)
+}
+
+func TestLateTransaction(t *testing.T) {
+	alice, aliceSecret := security.NewKeyPairMust()
+
+	db1 := sqlx.NewTestDB(t, "bao_late1.db", "")
+	db2 := sqlx.NewTestDB(t, "bao_late2.db", "")
+	dataDb1 := sqlx.NewTestDB(t, "replica_late1.db", testDdl)
+	dataDb2 := sqlx.NewTestDB(t, "replica_late2.db", testDdl)
+	s := store.LoadTestStore(t, "test")
+	defer s.Close()
+
+	v1, err := vault.Create(aliceSecret, s, db1, vault.Config{})
+	core.TestErr(t, err, "Create failed: %v")
+	defer v1.Close()
+	v2, err := vault.Open(aliceSecret, alice, s, db2)
+	core.TestErr(t, err, "Open failed: %v")
+	defer v2.Close()
+
+	r1, err := Open(v1, dataDb1)
+	core.TestErr(t, err, "cannot open replica: %v")
+	r2, err := Open(v2, dataDb2)
+	core.TestErr(t, err, "cannot open replica: %v")
+
+	// r1 writes with a clock three windows behind, like a peer that comes back online
+	core.ClockOffset -= 3 * replayWindow
+	r1.clock = hlc{}
+	_, err = r1.Exec("INSERT_TEST_DATA", sqlx.Args{"msg": "late", "cnt": 1, "ratio": 0.5, "bin": []byte{1}})
+	if err == nil {
+		_, err = r1.Sync()
+	}
+	core.ClockOffset += 3 * replayWindow
+	core.TestErr(t, err, "cannot write late transaction: %v")
+
+	_, err = r2.Sync()
+	core.TestErr(t, err, "cannot sync: %v")
+	last, err := r2.lastApplied()
+	core.TestErr(t, err, "cannot read last applied: %v")
+	earliest := core.Now().Add(-lateMargin - time.Minute).UnixMilli()
+	core.Assert(t, hlcWall(last.Hlc) >= earliest, "a late transaction should take the position of its store time, got %s",
+		time.UnixMilli(hlcWall(last.Hlc)))
+
+	// stamps too far in the future are not observed
+	var clock hlc
+	clock.observe(^uint64(0))
+	core.Assert(t, clock.now() > hlcStamp(core.Now().Add(-time.Second)), "the clock should ignore stamps beyond the drift")
+}
+
+func TestMerge(t *testing.T) {
+	alice, aliceSecret := security.NewKeyPairMust()
+	bob, bobSecret := security.NewKeyPairMust()
+
+	db := sqlx.NewTestDB(t, "bao_merge_alice.db", "")
+	dataDb := sqlx.NewTestDB(t, "replica_merge_alice.db", testDdl)
+	s := store.LoadTestStore(t, "test")
+	defer s.Close()
+
+	vAlice, err := vault.Create(aliceSecret, s, db, vault.Config{})
+	core.TestErr(t, err, "Create failed: %v")
+	defer vAlice.Close()
+	err = vAlice.SyncAccess(vault.IOOption{}, vault.AccessChange{Access: vault.ReadWrite, UserId: bob})
+	core.TestErr(t, err, "cannot set access: %v")
+
+	db2 := sqlx.NewTestDB(t, "bao_merge_bob.db", "")
+	dataDb2 := sqlx.NewTestDB(t, "replica_merge_bob.db", testDdl)
+	vBob, err := vault.Open(bobSecret, alice, s, db2)
+	core.TestErr(t, err, "cannot open vault: %v")
+	defer vBob.Close()
+
+	open := func(v *vault.Vault, db *sqlx.DB) *Replica {
+		r, err := Open(v, db)
+		core.TestErr(t, err, "cannot open replica: %v")
+		err = r.Merge("notes", LastWriterWins)
+		core.TestErr(t, err, "cannot merge notes: %v")
+		err = r.Merge("note_tags", AddWins)
+		core.TestErr(t, err, "cannot merge note tags: %v")
+		return r
+	}
+	exec := func(r *Replica, key string, args sqlx.Args) {
+		_, err := r.Exec(key, args)
+		core.TestErr(t, err, "cannot exec %s: %v", key)
+	}
+	sync := func(r *Replica) {
+		_, err := r.Sync()
+		core.TestErr(t, err, "cannot sync: %v")
+	}
+	rAlice, rBob := open(vAlice, dataDb), open(vBob, dataDb2)
+
+	exec(rAlice, "INSERT_NOTE", sqlx.Args{"id": 1, "title": "title", "body": "body"})
+	exec(rAlice, "ADD_NOTE_TAG", sqlx.Args{"note": 1, "tag": "todo"})
+	sync(rAlice)
+	sync(rBob)
+
+	// concurrent edits: different columns merge, the same column goes to the last writer and
+	// the tag added again by Alice survives the concurrent delete by Bob
+	exec(rAlice, "UPDATE_NOTE_TITLE", sqlx.Args{"id": 1, "title": "alice title"})
+	exec(rAlice, "UPDATE_NOTE_BODY", sqlx.Args{"id": 1, "body": "alice body"})
+	exec(rAlice, "ADD_NOTE_TAG", sqlx.Args{"note": 1, "tag": "todo"})
+	exec(rBob, "UPDATE_NOTE_BODY", sqlx.Args{"id": 1, "body": "bob body"})
+	exec(rBob, "DELETE_NOTE_TAG", sqlx.Args{"note": 1, "tag": "todo"})
+	sync(rAlice)
+	sync(rBob)
+	sync(rAlice)
+
+	for _, r := range []*Replica{rAlice, rBob} {
+		rows, err := r.Fetch("SELECT_NOTES", sqlx.Args{}, 10)
+		core.TestErr(t, err, "cannot select notes: %v")
+		core.Assert(t, len(rows) == 1, "expected 1 note, got %d", len(rows))
+		core.Assert(t, rows[0][1] == "alice title" && rows[0][2] == "bob body", "unexpected note %v", rows[0])
+
+		rows, err = r.Fetch("SELECT_NOTE_TAGS", sqlx.Args{}, 10)
+		core.TestErr(t, err, "cannot select tags: %v")
+		core.Assert(t, len(rows) == 1, "expected the tag to survive, got %d tags", len(rows))
+	}
+
+	// a delete that has seen all the adds removes the row everywhere
+	exec(rBob, "DELETE_NOTE_TAG", sqlx.Args{"note": 1, "tag": "todo"})
+	sync(rBob)
+	sync(rAlice)
+	rows, err := rAlice.Fetch("SELECT_NOTE_TAGS", sqlx.Args{}, 10)
+	core.TestErr(t, err, "cannot select tags: %v")
+	core.Assert(t, len(rows) == 0, "expected no tags, got %d", len(rows))
+}
+
+func TestCheckpoint(t *testing.T) {
+	_, aliceSecret := security.NewKeyPairMust()
+
+	db := sqlx.NewTestDB(t, "bao_checkpoint.db", "")
+	dataDb1 := sqlx.NewTestDB(t, "replica_checkpoint1.db", testDdl)
+	dataDb2 := sqlx.NewTestDB(t, "replica_checkpoint2.db", testDdl)
+	s := store.LoadTestStore(t, "test")
+	defer s.Close()
+
+	v, err := vault.Create(aliceSecret, s, db, vault.Config{})
+	core.TestErr(t, err, "Create failed: %v")
+	defer v.Close()
+
+	r1, err := Open(v, dataDb1)
+	core.TestErr(t, err, "cannot open replica: %v")
+
+	// the insert arrives late and is older than the replay window, so the replay moves it in the base
+	old := uint64(core.Now().Add(-3*replayWindow).UnixMilli()) << hlcCounterBits
+	hlc := uint64(core.Now().UnixMilli()) << hlcCounterBits
+	insert := transaction{Id: 1, Hlc: old, Origin: "a", Updates: []Update{
+		{"INSERT_TEST_DATA", sqlx.Args{"msg": "x", "cnt": 1, "ratio": 0.5, "bin": []byte{1}}}}}
+	set2 := transaction{Id: 2, Hlc: hlc, Origin: "b", Updates: []Update{{"UPDATE_TEST_DATA", sqlx.Args{"msg": "x", "cnt": 2}}}}
+	set3 := transaction{Id: 3, Hlc: hlc + 1, Origin: "c", Updates: []Update{{"UPDATE_TEST_DATA", sqlx.Args{"msg": "x", "cnt": 3}}}}
+
+	_, err = r1.processTransactions([]transaction{set2})
+	core.TestErr(t, err, "cannot process transactions: %v")
+	_, err = r1.processTransactions([]transaction{insert})
+	core.TestErr(t, err, "cannot process transactions: %v")
+	err = r1.Checkpoint()
+	core.TestErr(t, err, "cannot write checkpoint: %v")
+
+	r2, err := Open(v, dataDb2)
+	core.TestErr(t, err, "cannot open replica: %v")
+	err = r2.restoreLatestCheckpoint()
+	core.TestErr(t, err, "cannot restore checkpoint: %v")
+
+	rows, err := r2.Fetch("SELECT_TEST_DATA", sqlx.Args{}, 1000)
+	core.TestErr(t, err, "cannot select test data: %v")
+	core.Assert(t, len(rows) == 1 && rows[0][1] == int64(2), "expected the checkpoint rows, got %v", rows)
+	last, err := r2.lastApplied()
+	core.TestErr(t, err, "cannot read last applied: %v")
+	core.Assert(t, last == set2.key(), "unexpected last applied transaction %v", last)
+
+	// the transactions in the checkpoint are not applied again
+	_, err = r2.processTransactions([]transaction{insert, set2, set3})
+	core.TestErr(t, err, "cannot process transactions: %v")
+	rows, err = r2.Fetch("SELECT_TEST_DATA", sqlx.Args{}, 1000)
+	core.TestErr(t, err, "cannot select test data: %v")
+	core.Assert(t, len(rows) == 1 && rows[0][1] == int64(3), "expected only the newer transaction applied, got %v", rows)
+	applied, err := r2.isApplied(insert)
+	core.TestErr(t, err, "cannot check replica log: %v")
+	core.Assert(t, !applied, "transaction in the base of the checkpoint applied again")
+
+	// the checkpoints of users that are not admins are ignored
+	bob, bobSecret := security.NewKeyPairMust()
+	err = v.SyncAccess(vault.IOOption{}, vault.AccessChange{Access: vault.ReadWrite, UserId: bob})
+	core.TestErr(t, err, "cannot set access: %v")
+	vBob, err := vault.Open(bobSecret, v.Author, s, sqlx.NewTestDB(t, "bao_checkpoint_bob.db", ""))
+	core.TestErr(t, err, "cannot open vault: %v")
+	defer vBob.Close()
+	rBob, err := Open(vBob, sqlx.NewTestDB(t, "replica_checkpoint_bob.db", testDdl))
+	core.TestErr(t, err, "cannot open replica: %v")
+	err = rBob.Checkpoint()
+	core.Assert(t, core.ErrorCode(err) == core.AccessDenied, "expected access denied, got %v", err)
+	time.Sleep(1100 * time.Millisecond) // change detection has 1 second resolution
+	err = rBob.writeCheckpoint()
+	core.TestErr(t, err, "cannot write checkpoint: %v")
+	_, err = v.Sync()
+	core.TestErr(t, err, "cannot sync vault: %v")
+	files, _, err := r2.listCheckpoints()
+	core.TestErr(t, err, "cannot list checkpoints: %v")
+	core.Assert(t, len(files) == 1 && files[0].AuthorId == v.UserID, "expected only the checkpoint of alice, got %d", len(files))
+}
+
+const labelSchema = `-- INIT 2.0
+ALTER TABLE db_test ADD COLUMN label VARCHAR(64)
+
+-- SET_TEST_LABEL 1.0
+UPDATE db_test SET label = :label WHERE msg = :msg
+
+-- SELECT_TEST_LABEL 1.0
+SELECT label FROM db_test WHERE msg = :msg
+`
+
+func TestMigrate(t *testing.T) {
+	alice, aliceSecret := security.NewKeyPairMust()
+	bob, bobSecret := security.NewKeyPairMust()
+
+	db := sqlx.NewTestDB(t, "bao_migrate1.db", "")
+	db2 := sqlx.NewTestDB(t, "bao_migrate2.db", "")
+	dataDb := sqlx.NewTestDB(t, "replica_migrate1.db", testDdl)
+	dataDb2 := sqlx.NewTestDB(t, "replica_migrate2.db", testDdl)
+	s := store.LoadTestStore(t, "test")
+	defer s.Close()
+
+	vAlice, err := vault.Create(aliceSecret, s, db, vault.Config{})
+	core.TestErr(t, err, "Create failed: %v")
+	defer vAlice.Close()
+	err = vAlice.SyncAccess(vault.IOOption{}, vault.AccessChange{Access: vault.ReadWrite, UserId: bob})
+	core.TestErr(t, err, "cannot set access: %v")
+	vBob, err := vault.Open(bobSecret, alice, s, db2)
+	core.TestErr(t, err, "cannot open vault: %v")
+	defer vBob.Close()
+
+	replicaAlice, err := Open(vAlice, dataDb)
+	core.TestErr(t, err, "cannot open replica: %v")
+	replicaBob, err := Open(vBob, dataDb2)
+	core.TestErr(t, err, "cannot open replica: %v")
+
+	_, err = replicaAlice.Exec("INSERT_TEST_DATA", sqlx.Args{"msg": "x", "cnt": 1, "ratio": 0.5, "bin": []byte{1}})
+	core.TestErr(t, err, "cannot insert test data: %v")
+	_, err = replicaAlice.Sync()
+	core.TestErr(t, err, "cannot sync: %v")
+
+	err = replicaAlice.Migrate(1.0, labelSchema)
+	core.TestErr(t, err, "cannot migrate: %v")
+	core.Assert(t, replicaAlice.SchemaVersion() == 1.0, "unexpected schema version %g", replicaAlice.SchemaVersion())
+	_, err = replicaAlice.Exec("SET_TEST_LABEL", sqlx.Args{"msg": "x", "label": "alice"})
+	core.TestErr(t, err, "cannot set label: %v")
+	_, err = replicaAlice.Sync()
+	core.TestErr(t, err, "cannot sync: %v")
+
+	// Bob receives a transaction from the new schema before the schema, and defers it
+	later := transaction{Hlc: replicaAlice.clock.now(), Origin: "later", Version: 1.0, Updates: []Update{
+		{"SET_TEST_LABEL", sqlx.Args{"msg": "x", "label": "later"}}}}
+	updates, err := replicaBob.processTransactions([]transaction{later})
+	core.TestErr(t, err, "cannot process transactions: %v")
+	core.Assert(t, updates == 0, "expected the transaction deferred, got %d updates", updates)
+
+	updates, err = replicaBob.Sync()
+	core.TestErr(t, err, "cannot sync: %v")
+	core.Assert(t, updates == 3, "expected 3 updates, got %d", updates)
+	core.Assert(t, replicaBob.SchemaVersion() == 1.0, "unexpected schema version %g", replicaBob.SchemaVersion())
+
+	row, err := replicaBob.FetchOne("SELECT_TEST_LABEL", sqlx.Args{"msg": "x"})
+	core.TestErr(t, err, "cannot select label: %v")
+	core.Assert(t, row[0] == "later", "expected the deferred transaction applied last, got %v", row[0])
+
+	// only admins publish schemas
+	err = replicaBob.Migrate(2.0, labelSchema)
+	core.Assert(t, core.ErrorCode(err) == core.AccessDenied, "expected access denied, got %v", err)
+	writeSchema := func(v *vault.Vault, name, ddl string) {
+		local := path.Join(t.TempDir(), "schema")
+		core.TestErr(t, os.WriteFile(local, []byte(ddl), 0644), "cannot write schema: %v")
+		_, err := v.Write(path.Join(schemaDir, name), local, nil, vault.IOOption{})
+		core.TestErr(t, err, "cannot write schema: %v")
+	}
+	time.Sleep(1100 * time.Millisecond) // change detection has 1 second resolution
+	writeSchema(vBob, "2-bob", "-- INIT 1.0\nDROP TABLE db_test\n")
+	_, err = replicaAlice.Sync()
+	core.TestErr(t, err, "cannot sync: %v")
+	core.Assert(t, replicaAlice.SchemaVersion() == 1.0, "schema of a non admin applied, version %g", replicaAlice.SchemaVersion())
+
+	// a version already published cannot change
+	labelIndex := "-- INIT 1.0\nCREATE INDEX IF NOT EXISTS db_test_label ON db_test(label)\n"
+	writeSchema(vAlice, "2-first", labelIndex)
+	err = replicaAlice.Migrate(2.0, "-- INIT 1.0\nDROP TABLE db_test\n")
+	core.Assert(t, err != nil, "expected a conflict with the published schema")
+	core.Assert(t, replicaAlice.SchemaVersion() == 1.0, "unexpected schema version %g", replicaAlice.SchemaVersion())
+	err = replicaAlice.Migrate(2.0, labelIndex)
+	core.TestErr(t, err, "cannot migrate: %v")
+	core.Assert(t, replicaAlice.SchemaVersion() == 2.0, "unexpected schema version %g", replicaAlice.SchemaVersion())
+}
+
+func TestGrants(t *testing.T) {
+	alice, aliceSecret := security.NewKeyPairMust()
+	bob, bobSecret := security.NewKeyPairMust()
+
+	db := sqlx.NewTestDB(t, "bao_grants1.db", "")
+	db2 := sqlx.NewTestDB(t, "bao_grants2.db", "")
+	dataDb := sqlx.NewTestDB(t, "replica_grants1.db", testDdl)
+	dataDb2 := sqlx.NewTestDB(t, "replica_grants2.db", testDdl)
+	s := store.LoadTestStore(t, "test")
+	defer s.Close()
+
+	vAlice, err := vault.Create(aliceSecret, s, db, vault.Config{})
+	core.TestErr(t, err, "Create failed: %v")
+	defer vAlice.Close()
+	err = vAlice.SyncAccess(vault.IOOption{}, vault.AccessChange{Access: vault.ReadWrite, UserId: bob})
+	core.TestErr(t, err, "cannot set access: %v")
+	vBob, err := vault.Open(bobSecret, alice, s, db2)
+	core.TestErr(t, err, "cannot open vault: %v")
+	defer vBob.Close()
+
+	replicaAlice, err := Open(vAlice, dataDb)
+	core.TestErr(t, err, "cannot open replica: %v")
+	replicaBob, err := Open(vBob, dataDb2)
+	core.TestErr(t, err, "cannot open replica: %v")
+
+	// Bob writes before he knows that only admins can write db_test
+	_, err = replicaBob.Exec("INSERT_TEST_DATA", sqlx.Args{"msg": "bob", "cnt": 1, "ratio": 0.5, "bin": []byte{1}})
+	core.TestErr(t, err, "cannot insert test data: %v")
+	_, err = replicaBob.Exec("INSERT_NOTE", sqlx.Args{"id": 1, "title": "bob", "body": ""})
+	core.TestErr(t, err, "cannot insert note: %v")
+
+	err = vBob.SetReplicaGrants(vault.IOOption{}, vault.ReplicaGrant{Target: "db_test", UserId: bob})
+	core.Assert(t, err != nil, "only admins can set replica grants")
+	time.Sleep(1100 * time.Millisecond) // change detection has 1 second resolution
+	err = vAlice.SetReplicaGrants(vault.IOOption{}, vault.ReplicaGrant{Target: "db_test", Access: vault.Admin})
+	core.TestErr(t, err, "cannot set replica grants: %v")
+	_, err = replicaBob.Sync()
+	core.TestErr(t, err, "cannot sync: %v")
+
+	_, err = replicaAlice.Exec("INSERT_TEST_DATA", sqlx.Args{"msg": "alice", "cnt": 1, "ratio": 0.5, "bin": []byte{1}})
+	core.TestErr(t, err, "cannot insert test data: %v")
+	_, err = replicaAlice.Sync()
+	core.TestErr(t, err, "cannot sync: %v")
+
+	rows, err := replicaAlice.Fetch("SELECT_TEST_DATA", sqlx.Args{}, 1000)
+	core.TestErr(t, err, "cannot select test data: %v")
+	core.Assert(t, len(rows) == 1 && rows[0][0] == "alice", "expected only the row of alice, got %v", rows)
+	rejections, err := replicaAlice.Rejections()
+	core.TestErr(t, err, "cannot read rejections: %v")
+	core.Assert(t, len(rejections) == 1, "expected 1 rejection, got %d", len(rejections))
+	core.Assert(t, rejections[0].Author == bob && rejections[0].Target == "db_test", "unexpected rejection %v", rejections[0])
+
+	// a replay after the grant is revoked rejects the same transactions
+	err = vAlice.SetReplicaGrants(vault.IOOption{}, vault.ReplicaGrant{Target: "db_test", Access: vault.Admin, Revoke: true})
+	core.TestErr(t, err, "cannot revoke replica grant: %v")
+	first, err := replicaAlice.readLog()
+	core.TestErr(t, err, "cannot read replica log: %v")
+	early := transaction{Id: 1000, Hlc: first[0].Hlc - 1, Origin: "early", Author: alice, Updates: []Update{
+		{"INSERT_NOTE", sqlx.Args{"id": 100, "title": "early", "body": ""}}}}
+	_, err = replicaAlice.processTransactions([]transaction{early})
+	core.TestErr(t, err, "cannot process transactions: %v")
+	rows, err = replicaAlice.Fetch("SELECT_TEST_DATA", sqlx.Args{}, 1000)
+	core.TestErr(t, err, "cannot select test data: %v")
+	core.Assert(t, len(rows) == 1 && rows[0][0] == "alice", "a replay should reuse the rejection, got %v", rows)
+	err = vAlice.SetReplicaGrants(vault.IOOption{}, vault.ReplicaGrant{Target: "db_test", Access: vault.Admin})
+	core.TestErr(t, err, "cannot set replica grants: %v")
+
+	// once Bob has the grants, the replica refuses his writes to db_test but not to the other tables
+	vBob.Close()
+	vBob, err = vault.Open(bobSecret, alice, s, db2)
+	core.TestErr(t, err, "cannot open vault: %v")
+	replicaBob, err = Open(vBob, dataDb2)
+	core.TestErr(t, err, "cannot open replica: %v")
+	_, err = replicaBob.Exec("UPDATE_TEST_DATA", sqlx.Args{"msg": "alice", "cnt": 2})
+	core.Assert(t, core.ErrorCode(err) == core.AccessDenied, "expected access denied, got %v", err)
+	_, err = replicaBob.Exec("INSERT_NOTE", sqlx.Args{"id": 2, "title": "bob", "body": ""})
+	core.TestErr(t, err, "cannot insert note: %v")
+
+	// raw SQL cannot be checked against the grants, so only admins can run it
+	for i, query := range []string{
+		"SQL:INSERT INTO main.db_test (msg) VALUES ('bob')",
+		"SQL:UPDATE [db_test] SET cnt = 3",
+		"SQL:DELETE FROM `db_test`",
+		"SQL:INSERT INTO/**/db_test (msg) VALUES ('bob')",
+		"SQL:INSERT INTO notes (id, title, body) VALUES (3, 'bob', '')",
+	} {
+		_, err = replicaBob.Exec(query, sqlx.Args{})
+		core.Assert(t, core.ErrorCode(err) == core.AccessDenied, "expected access denied for %s, got %v", query, err)
+		raw := transaction{Id: vault.FileId(2000 + i), Hlc: replicaAlice.clock.now(), Origin: "raw", Author: bob,
+			Updates: []Update{{query, sqlx.Args{}}}}
+		_, err = replicaAlice.processTransactions([]transaction{raw})
+		core.TestErr(t, err, "cannot process transactions: %v")
+		rejections, err := replicaAlice.Rejections()
+		core.TestErr(t, err, "cannot read rejections: %v")
+		core.Assert(t, slices.ContainsFunc(rejections, func(r Rejection) bool { return r.Id == raw.Id && r.Target == query }),
+			"raw SQL of a non admin applied: %s", query)
+	}
+	rows, err = replicaAlice.Fetch("SELECT_TEST_DATA", sqlx.Args{}, 1000)
+	core.TestErr(t, err, "cannot select test data: %v")
+	core.Assert(t, len(rows) == 1 && rows[0][0] == "alice", "expected only the row of alice, got %v", rows)
+	_, err = replicaAlice.Exec("SQL:UPDATE db_test SET cnt = 4 WHERE msg = 'alice'", sqlx.Args{})
+	core.TestErr(t, err, "admins can run raw SQL: %v")
+}
+
+func TestSubscribe(t *testing.T) {
+	alice, aliceSecret := security.NewKeyPairMust()
+	bob, bobSecret := security.NewKeyPairMust()
+
+	db := sqlx.NewTestDB(t, "bao_feed1.db", "")
+	db2 := sqlx.NewTestDB(t, "bao_feed2.db", "")
+	dataDb := sqlx.NewTestDB(t, "replica_feed1.db", testDdl)
+	dataDb2 := sqlx.NewTestDB(t, "replica_feed2.db", testDdl)
+	s := store.LoadTestStore(t, "test")
+	defer s.Close()
+
+	vAlice, err := vault.Create(aliceSecret, s, db, vault.Config{})
+	core.TestErr(t, err, "Create failed: %v")
+	defer vAlice.Close()
+	err = vAlice.SyncAccess(vault.IOOption{}, vault.AccessChange{Access: vault.ReadWrite, UserId: bob})
+	core.TestErr(t, err, "cannot set access: %v")
+	vBob, err := vault.Open(bobSecret, alice, s, db2)
+	core.TestErr(t, err, "cannot open vault: %v")
+	defer vBob.Close()
+
+	replicaAlice, err := Open(vAlice, dataDb)
+	core.TestErr(t, err, "cannot open replica: %v")
+	replicaBob, err := Open(vBob, dataDb2)
+	core.TestErr(t, err, "cannot open replica: %v")
+
+	notes := replicaBob.Subscribe("notes")
+	defer notes.Close()
+	all := replicaBob.Subscribe()
+	defer all.Close()
+
+	// Bob restores the checkpoint that Alice writes on her first sync
+	_, err = replicaAlice.Exec("INSERT_TEST_DATA", sqlx.Args{"msg": "x", "cnt": 1, "ratio": 0.5, "bin": []byte{1}})
+	core.TestErr(t, err, "cannot insert test data: %v")
+	_, err = replicaAlice.Sync()
+	core.TestErr(t, err, "cannot sync: %v")
+	_, err = replicaBob.Sync()
+	core.TestErr(t, err, "cannot sync: %v")
+	for _, sub := range []*Subscription{notes, all} {
+		change, ok := sub.Next(time.Second)
+		core.Assert(t, ok && change.Id == 0 && slices.Contains(change.Tables, "notes"), "expected the restore, got %v", change)
+	}
+
+	_, err = replicaAlice.Exec("INSERT_TEST_DATA", sqlx.Args{"msg": "y", "cnt": 1, "ratio": 0.5, "bin": []byte{1}})
+	core.TestErr(t, err, "cannot insert test data: %v")
+	_, err = replicaAlice.Sync()
+	core.TestErr(t, err, "cannot sync: %v")
+	_, err = replicaAlice.Exec("INSERT_NOTE", sqlx.Args{"id": 1, "title": "first", "body": ""})
+	core.TestErr(t, err, "cannot insert note: %v")
+	_, err = replicaAlice.Sync()
+	core.TestErr(t, err, "cannot sync: %v")
+
+	_, err = replicaBob.Sync()
+	core.TestErr(t, err, "cannot sync: %v")
+	change, ok := notes.Next(time.Second)
+	core.Assert(t, ok, "expected a change on notes")
+	core.Assert(t, change.Author == alice && change.Id != 0, "unexpected change %v", change)
+	core.Assert(t, len(change.Keys) == 1 && change.Keys[0] == "INSERT_NOTE", "unexpected keys %v", change.Keys)
+	core.Assert(t, len(change.Tables) == 1 && change.Tables[0] == "notes", "unexpected tables %v", change.Tables)
+	_, ok = notes.Next(10 * time.Millisecond)
+	core.Assert(t, !ok, "the change on db_test must not be notified to the subscription on notes")
+	for _, table := range []string{"db_test", "notes"} {
+		change, ok = all.Next(time.Second)
+		core.Assert(t, ok && change.Tables[0] == table, "expected a change on %s, got %v", table, change)
+	}
+
+	// the background sync applies the changes without calling Sync
+	replicaBob.StartAutoSync(50 * time.Millisecond)
+	defer replicaBob.StopAutoSync()
+	_, err = replicaAlice.Exec("INSERT_NOTE", sqlx.Args{"id": 2, "title": "second", "body": ""})
+	core.TestErr(t, err, "cannot insert note: %v")
+	_, err = replicaAlice.Sync()
+	core.TestErr(t, err, "cannot sync: %v")
+	change, ok = notes.Next(5 * time.Second)
+	core.Assert(t, ok && change.Keys[0] == "INSERT_NOTE", "expected a change from the background sync, got %v", change)
+}
+
+func TestTransactions(t *testing.T) {
+	_, aliceSecret := security.NewKeyPairMust()
+
+	db := sqlx.NewTestDB(t, "bao_transactions.db", "")
+	dataDb1 := sqlx.NewTestDB(t, "replica_transactions1.db", testDdl)
+	dataDb2 := sqlx.NewTestDB(t, "replica_transactions2.db", testDdl)
+	s := store.LoadTestStore(t, "test")
+	defer s.Close()
+
+	v, err := vault.Create(aliceSecret, s, db, vault.Config{})
+	core.TestErr(t, err, "Create failed: %v")
+	defer v.Close()
+
+	r1, err := Open(v, dataDb1)
+	core.TestErr(t, err, "cannot open replica: %v")
+	r2, err := Open(v, dataDb2)
+	core.TestErr(t, err, "cannot open replica: %v")
+
+	_, err = r1.Exec("INSERT_NOTE", sqlx.Args{"id": 1, "title": "implicit", "body": ""})
+	core.TestErr(t, err, "cannot insert note: %v")
+
+	tx, err := r1.Begin()
+	core.TestErr(t, err, "cannot begin transaction: %v")
+	_, err = r1.Exec("INSERT_NOTE", sqlx.Args{"id": 9, "title": "outside", "body": ""})
+	core.Assert(t, err != nil, "exec outside an open transaction must fail")
+	_, err = tx.Exec("INSERT_NOTE", sqlx.Args{"id": 2, "title": "kept", "body": ""})
+	core.TestErr(t, err, "cannot insert note: %v")
+	err = tx.Savepoint("a")
+	core.TestErr(t, err, "cannot set savepoint: %v")
+	_, err = tx.Exec("INSERT_NOTE", sqlx.Args{"id": 3, "title": "undone", "body": ""})
+	core.TestErr(t, err, "cannot insert note: %v")
+	err = tx.RollbackTo("a")
+	core.TestErr(t, err, "cannot rollback to savepoint: %v")
+	_, err = tx.Exec("INSERT_NOTE", sqlx.Args{"id": 4, "title": "after savepoint", "body": ""})
+	core.TestErr(t, err, "cannot insert note: %v")
+	err = tx.Commit()
+	core.TestErr(t, err, "cannot commit transaction: %v")
+	_, err = tx.Exec("INSERT_NOTE", sqlx.Args{"id": 9, "title": "closed", "body": ""})
+	core.Assert(t, err != nil, "exec in a committed transaction must fail")
+
+	tx, err = r1.Begin()
+	core.TestErr(t, err, "cannot begin transaction: %v")
+	_, err = tx.Exec("INSERT_NOTE", sqlx.Args{"id": 5, "title": "rolled back", "body": ""})
+	core.TestErr(t, err, "cannot insert note: %v")
+	err = tx.Rollback()
+	core.TestErr(t, err, "cannot rollback transaction: %v")
+
+	// the pending transactions are visible to the local queries
+	core.Assert(t, r1.Pending() == 2, "expected 2 pending transactions, got %d", r1.Pending())
+	ids := func(r *Replica) []any {
+		rows, err := r.Fetch("SELECT_NOTES", sqlx.Args{}, 100)
+		core.TestErr(t, err, "cannot select notes: %v")
+		var ids []any
+		for _, row := range rows {
+			ids = append(ids, row[0])
+		}
+		return ids
+	}
+	core.Assert(t, slices.Equal(ids(r1), []any{int64(1), int64(2), int64(4)}), "unexpected local notes %v", ids(r1))
+
+	_, err = r1.Sync()
+	core.TestErr(t, err, "cannot sync: %v")
+	core.Assert(t, r1.Pending() == 0, "expected no pending transactions after sync")
+	updates, err := r2.Sync()
+	core.TestErr(t, err, "cannot sync: %v")
+	core.Assert(t, updates == 3, "expected 3 updates, got %d", updates)
+	core.Assert(t, slices.Equal(ids(r2), []any{int64(1), int64(2), int64(4)}), "unexpected synced notes %v", ids(r2))
+	log, err := r2.readLog()
+	core.TestErr(t, err, "cannot read log: %v")
+	core.Assert(t, len(log) == 2, "expected 2 transactions, got %d", len(log))
+}
+
+func TestHistory(t *testing.T) {
+	_, aliceSecret := security.NewKeyPairMust()
+
+	db := sqlx.NewTestDB(t, "bao_history.db", "")
+	dataDb := sqlx.NewTestDB(t, "replica_history.db", testDdl)
+	s := store.LoadTestStore(t, "test")
+	defer s.Close()
+
+	v, err := vault.Create(aliceSecret, s, db, vault.Config{})
+	core.TestErr(t, err, "Create failed: %v")
+	defer v.Close()
+
+	r, err := Open(v, dataDb)
+	core.TestErr(t, err, "cannot open replica: %v")
+	exec := func(key string, args sqlx.Args) {
+		_, err := r.Exec(key, args)
+		core.TestErr(t, err, "cannot exec %s: %v", key)
+		_, err = r.Sync()
+		core.TestErr(t, err, "cannot sync: %v")
+	}
+	titles := func(rows [][]any) []any {
+		var titles []any
+		for _, row := range rows {
+			titles = append(titles, row[1])
+		}
+		return titles
+	}
+
+	exec("INSERT_NOTE", sqlx.Args{"id": 1, "title": "v1", "body": ""})
+	time.Sleep(10 * time.Millisecond)
+	mid := core.Now()
+	time.Sleep(10 * time.Millisecond)
+	exec("UPDATE_NOTE_TITLE", sqlx.Args{"id": 1, "title": "v2"})
+	exec("INSERT_NOTE", sqlx.Args{"id": 2, "title": "other", "body": ""})
+
+	revisions, err := r.History("notes", 1)
+	core.TestErr(t, err, "cannot read history: %v")
+	core.Assert(t, len(revisions) == 2, "expected 2 revisions, got %v", revisions)
+	core.Assert(t, revisions[0].Row["title"] == "v1" && revisions[1].Row["title"] == "v2", "unexpected revisions %v",
+		revisions)
+	core.Assert(t, revisions[1].Keys[0] == "UPDATE_NOTE_TITLE", "unexpected keys %v", revisions[1].Keys)
+
+	rows, err := r.QueryAt(At{Id: revisions[0].Id}, "SELECT_NOTES", sqlx.Args{})
+	core.TestErr(t, err, "cannot query at transaction: %v")
+	core.Assert(t, slices.Equal(titles(rows), []any{"v1"}), "unexpected notes at transaction %v", rows)
+	rows, err = r.QueryAt(At{Time: mid}, "SELECT_NOTES", sqlx.Args{})
+	core.TestErr(t, err, "cannot query at time: %v")
+	core.Assert(t, slices.Equal(titles(rows), []any{"v1"}), "unexpected notes at time %v", rows)
+	rows, err = r.QueryAt(At{Time: core.Now()}, "SELECT_NOTES", sqlx.Args{})
+	core.TestErr(t, err, "cannot query at time: %v")
+	core.Assert(t, slices.Equal(titles(rows), []any{"v2", "other"}), "unexpected notes now %v", rows)
+
+	// revert the update and the insert of the second note
+	err = r.Revert(revisions[1].Id)
+	core.TestErr(t, err, "cannot revert: %v")
+	others, err := r.History("notes", 2)
+	core.TestErr(t, err, "cannot read history: %v")
+	core.Assert(t, len(others) == 1, "expected 1 revision, got %v", others)
+	err = r.Revert(others[0].Id)
+	core.TestErr(t, err, "cannot revert: %v")
+	core.Assert(t, r.Pending() == 2, "expected 2 pending transactions, got %d", r.Pending())
+	_, err = r.Sync()
+	core.TestErr(t, err, "cannot sync: %v")
+
+	rows, err = r.Fetch("SELECT_NOTES", sqlx.Args{}, 100)
+	core.TestErr(t, err, "cannot select notes: %v")
+	core.Assert(t, slices.Equal(titles(rows), []any{"v1"}), "unexpected notes after revert %v", rows)
+	revisions, err = r.History("notes", 1)
+	core.TestErr(t, err, "cannot read history: %v")
+	core.Assert(t, len(revisions) == 3 && revisions[2].Row["title"] == "v1", "unexpected revisions %v", revisions)
+}
+
+func TestStores(t *testing.T) {
+	_, aliceSecret := security.NewKeyPairMust()
+
+	db := sqlx.NewTestDB(t, "bao_stores.db", "")
+	dataDb1 := sqlx.NewTestDB(t, "replica_stores1.db", "")
+	dataDb2 := sqlx.NewTestDB(t, "replica_stores2.db", "")
+	s := store.LoadTestStore(t, "test")
+	defer s.Close()
+
+	v, err := vault.Create(aliceSecret, s, db, vault.Config{})
+	core.TestErr(t, err, "Create failed: %v")
+	defer v.Close()
+
+	r1, err := Open(v, dataDb1)
+	core.TestErr(t, err, "cannot open replica: %v")
+	r2, err := Open(v, dataDb2)
+	core.TestErr(t, err, "cannot open replica: %v")
+
+	settings := r1.KV("settings")
+	for key, value := range map[string]any{"ui.theme": "dark", "ui.size": 12, "sync.interval": 30} {
+		err = settings.Put(key, value)
+		core.TestErr(t, err, "cannot put %s: %v", key)
+	}
+	err = settings.Delete("ui.size")
+	core.TestErr(t, err, "cannot delete: %v")
+
+	notes := r1.Collection("notes")
+	first, err := notes.Insert(map[string]any{"title": "first", "tags": 1, "meta": map[string]any{"pinned": true}})
+	core.TestErr(t, err, "cannot insert document: %v")
+	second, err := notes.Insert(map[string]any{"title": "second", "tags": 3})
+	core.TestErr(t, err, "cannot insert document: %v")
+	err = notes.Update(first, map[string]any{"title": "first, edited", "tags": nil})
+	core.TestErr(t, err, "cannot update document: %v")
+
+	_, err = r1.Sync()
+	core.TestErr(t, err, "cannot sync: %v")
+	_, err = r2.Sync()
+	core.TestErr(t, err, "cannot sync: %v")
+
+	var theme string
+	err = r2.KV("settings").Get("ui.theme", &theme)
+	core.TestErr(t, err, "cannot get: %v")
+	core.Assert(t, theme == "dark", "unexpected theme %s", theme)
+	var size int
+	err = r2.KV("settings").Get("ui.size", &size)
+	core.Assert(t, err == sqlx.ErrNoRows, "expected no rows for a deleted key, got %v", err)
+	entries, err := r2.KV("settings").Scan("ui.")
+	core.TestErr(t, err, "cannot scan: %v")
+	core.Assert(t, len(entries) == 1 && entries[0].Key == "ui.theme" && string(entries[0].Value) == `"dark"`,
+		"unexpected entries %v", entries)
+	entries, err = r2.KV("other").Scan("")
+	core.TestErr(t, err, "cannot scan: %v")
+	core.Assert(t, len(entries) == 0, "stores must be separate, got %v", entries)
+
+	var doc map[string]any
+	err = r2.Collection("notes").Get(first, &doc)
+	core.TestErr(t, err, "cannot get document: %v")
+	_, hasTags := doc["tags"]
+	core.Assert(t, doc["title"] == "first, edited" && !hasTags, "unexpected document %v", doc)
+
+	docs, err := r2.Collection("notes").Find(Filter{Field: "tags", Op: ">", Value: 2})
+	core.TestErr(t, err, "cannot find documents: %v")
+	core.Assert(t, len(docs) == 1 && docs[0].Id == second, "unexpected documents %v", docs)
+	docs, err = r2.Collection("notes").Find(Filter{Field: "meta.pinned", Op: "=", Value: true},
+		Filter{Field: "title", Op: "like", Value: "first%"})
+	core.TestErr(t, err, "cannot find documents: %v")
+	core.Assert(t, len(docs) == 1 && docs[0].Id == first, "unexpected documents %v", docs)
+	_, err = r2.Collection("notes").Find(Filter{Field: "title", Op: "; DROP", Value: 1})
+	core.Assert(t, err != nil, "invalid operators must fail")
+
+	err = r2.Collection("notes").Delete(first)
+	core.TestErr(t, err, "cannot delete document: %v")
+	docs, err = r2.Collection("notes").Find()
+	core.TestErr(t, err, "cannot find documents: %v")
+	core.Assert(t, len(docs) == 1 && docs[0].Id == second, "unexpected documents %v", docs)
+}
+
+func TestExportImport(t *testing.T) {
+	alice, aliceSecret := security.NewKeyPairMust()
+
+	db1 := sqlx.NewTestDB(t, "bao_dump1.db", "")
+	db2 := sqlx.NewTestDB(t, "bao_dump2.db", "")
+	dataDb1 := sqlx.NewTestDB(t, "replica_dump1.db", testDdl)
+	dataDb2 := sqlx.NewTestDB(t, "replica_dump2.db", testDdl)
+	s := store.LoadTestStore(t, "test")
+	defer s.Close()
+
+	v1, err := vault.Create(aliceSecret, s, db1, vault.Config{})
+	core.TestErr(t, err, "Create failed: %v")
+	defer v1.Close()
+	v2, err := vault.Open(aliceSecret, alice, s, db2)
+	core.TestErr(t, err, "cannot open vault: %v")
+	defer v2.Close()
+
+	r1, err := Open(v1, dataDb1)
+	core.TestErr(t, err, "cannot open replica: %v")
+	r2, err := Open(v2, dataDb2)
+	core.TestErr(t, err, "cannot open replica: %v")
+
+	_, err = r1.Exec("INSERT_NOTE", sqlx.Args{"id": 1, "title": "it's; quoted", "body": nil})
+	core.TestErr(t, err, "cannot insert note: %v")
+	_, err = r1.Exec("INSERT_TEST_DATA", sqlx.Args{"msg": "x", "cnt": 1, "ratio": 0.5, "bin": []byte{1, 2}})
+	core.TestErr(t, err, "cannot insert test data: %v")
+
+	var sqlDump, jsonl, csv bytes.Buffer
+	err = r1.Export(&sqlDump, SQLDump)
+	core.TestErr(t, err, "cannot export SQL dump: %v")
+	core.Assert(t, strings.Contains(sqlDump.String(), `INSERT INTO "notes" ("id", "title", "body") VALUES (1, 'it''s; quoted', NULL);`),
+		"unexpected SQL dump %s", sqlDump.String())
+	core.Assert(t, strings.Contains(sqlDump.String(), `X'0102'`), "unexpected SQL dump %s", sqlDump.String())
+	err = r1.Export(&jsonl, JSONLines, "notes")
+	core.TestErr(t, err, "cannot export JSON Lines: %v")
+	err = r1.Export(&csv, CSV, "notes")
+	core.TestErr(t, err, "cannot export CSV: %v")
+	core.Assert(t, csv.String() == "id,title,body\n1,it's; quoted,\n", "unexpected CSV %q", csv.String())
+	err = r1.Export(&csv, CSV, "notes", "db_test")
+	core.Assert(t, err != nil, "CSV export of two tables must fail")
+
+	// each format imports in its own chunks of transactions
+	var many strings.Builder
+	for i := 0; i < importChunk+1; i++ {
+		fmt.Fprintf(&many, "{\"id\": %d, \"title\": \"note %d\"}\n", i+10, i)
+	}
+	n, err := r2.Import(strings.NewReader(many.String()), JSONLines, "notes")
+	core.TestErr(t, err, "cannot import JSON Lines: %v")
+	core.Assert(t, n == importChunk+1 && r2.Pending() == 1, "expected the full chunk synced, got %d rows, %d pending",
+		n, r2.Pending())
+	n, err = r2.Import(strings.NewReader(strings.ReplaceAll(csv.String(), "1,", "2,")), CSV, "notes")
+	core.TestErr(t, err, "cannot import CSV: %v")
+	core.Assert(t, n == 1, "expected 1 row, got %d", n)
+	n, err = r2.Import(&sqlDump, SQLDump, "db_test")
+	core.Assert(t, err != nil, "importing a dump with other tables must fail")
+	core.Assert(t, n == 0, "expected no rows, got %d", n)
+	n, err = r2.Import(strings.NewReader(strings.ReplaceAll(jsonl.String(), `"id":1`, `"id":3`)), JSONLines, "notes")
+	core.TestErr(t, err, "cannot import JSON Lines: %v")
+	core.Assert(t, n == 1, "expected 1 row, got %d", n)
+
+	// BLOBs, NULL and empty strings round trip through JSON Lines and CSV
+	var dataJSON, dataCSV, notesCSV bytes.Buffer
+	err = r1.Export(&dataJSON, JSONLines, "db_test")
+	core.TestErr(t, err, "cannot export JSON Lines: %v")
+	err = r1.Export(&dataCSV, CSV, "db_test")
+	core.TestErr(t, err, "cannot export CSV: %v")
+	core.Assert(t, dataCSV.String() == "msg,cnt,ratio,bin\nx,1,0.5,AQI=\n", "unexpected CSV %q", dataCSV.String())
+	_, err = r1.Exec("INSERT_NOTE", sqlx.Args{"id": 5, "title": "", "body": nil})
+	core.TestErr(t, err, "cannot insert note: %v")
+	err = r1.Export(&notesCSV, CSV, "notes")
+	core.TestErr(t, err, "cannot export CSV: %v")
+	core.Assert(t, strings.Contains(notesCSV.String(), "\n5,\"\",\n"), "unexpected CSV %q", notesCSV.String())
+	_, err = r2.Import(strings.NewReader(strings.ReplaceAll(dataJSON.String(), `"msg":"x"`, `"msg":"json"`)),
+		JSONLines, "db_test")
+	core.TestErr(t, err, "cannot import JSON Lines: %v")
+	_, err = r2.Import(strings.NewReader(strings.ReplaceAll(dataCSV.String(), "\nx,", "\ncsv,")), CSV, "db_test")
+	core.TestErr(t, err, "cannot import CSV: %v")
+	_, err = r2.Import(strings.NewReader("id,title,body\n6,\"\",\n"), CSV, "notes")
+	core.TestErr(t, err, "cannot import CSV: %v")
+
+	_, err = r2.Sync()
+	core.TestErr(t, err, "cannot sync: %v")
+	_, err = r1.Sync()
+	core.TestErr(t, err, "cannot sync: %v")
+	rows, err := r1.Fetch("SQL:SELECT id, title, body FROM notes WHERE id < 10 ORDER BY id", sqlx.Args{}, 100)
+	core.TestErr(t, err, "cannot select notes: %v")
+	core.Assert(t, len(rows) == 5 && rows[1][1] == "it's; quoted" && rows[1][2] == nil && rows[2][1] == "it's; quoted",
+		"unexpected notes %v", rows)
+	core.Assert(t, rows[4][0] == int64(6) && rows[4][1] == "" && rows[4][2] == nil, "unexpected note %v", rows[4])
+	rows, err = r1.Fetch("SQL:SELECT COUNT(*) FROM notes", sqlx.Args{}, 1)
+	core.TestErr(t, err, "cannot count notes: %v")
+	core.Assert(t, rows[0][0] == int64(importChunk+6), "unexpected count %v", rows)
+	rows, err = r1.Fetch("SQL:SELECT msg, bin FROM db_test ORDER BY msg", sqlx.Args{}, 100)
+	core.TestErr(t, err, "cannot select test data: %v")
+	core.Assert(t, len(rows) == 3, "unexpected test data %v", rows)
+	for _, row := range rows {
+		core.Assert(t, bytes.Equal(row[1].([]byte), []byte{1, 2}), "unexpected BLOB in %v", row)
+	}
+}
@@ -0,0 +1,349 @@
+package replica
+
+import (
+	"os"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/stregato/bao/lib/core"
+	"github.com/stregato/bao/lib/security"
+	"github.com/stregato/bao/lib/sqlx"
+	"github.com/stregato/bao/lib/vault"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+// Schemas are the migrations of the replicated tables published in the vault, so that all peers run the same DDL
+// in the same order whatever version of the app they ship. A schema is a DDL in the format of sqlx.Define: INIT
+// blocks change the tables and keyed statements define the statements used by the transactions. Each schema has a
+// version and every transaction carries the version of the replica that wrote it; a replica defers the transactions
+// written with a version it has not applied yet and applies them once the schema arrives. Only the schemas that
+// admins publish are applied.
+//
+// A schema changes the tables in place, so the base moves to the last applied transaction and the transactions
+// before the migration are not replayed again.
+var schemaDir = path.Join(replicaDir, "schemas")
+
+type schema struct {
+	Version float32
+	Ddl     string
+}
+
+// deferredTransaction is a deferred transaction with its author, which is not marshaled with the transaction.
+type deferredTransaction struct {
+	Transaction transaction
+	Author      security.PublicID
+}
+
+// Migrate publishes a schema with the given version in the vault and applies it. Only admins can migrate the
+// replica. The version must be higher than the current version of the replica and Migrate must be called when the
+// replica has no pending changes. When the version is already published, Migrate applies it if the DDL is the same
+// and fails otherwise, as it does when another admin publishes a different DDL for the same version first.
+func (ds *Replica) Migrate(version float32, ddl string) error {
+	core.Start("version %g", version)
+	ds.syncLock.Lock()
+	defer ds.syncLock.Unlock()
+
+	admin, err := ds.isAdmin(ds.vault.UserID)
+	if err != nil {
+		return err
+	}
+	if !admin {
+		return core.Error(core.AccessDenied, "only admins can migrate the replica")
+	}
+	ds.execLock.Lock()
+	pending := ds.transaction != nil
+	ds.execLock.Unlock()
+	if pending {
+		return core.Error(core.GenericError, "cannot migrate replica to version %g with pending changes", version)
+	}
+	if version <= ds.schema {
+		return core.Error(core.GenericError, "cannot migrate replica to version %g, current version is %g", version,
+			ds.schema)
+	}
+
+	published, err := ds.publishedSchemas()
+	if err != nil {
+		return err
+	}
+	if file, ok := published[version]; ok {
+		current, err := ds.readSchema(file.Name)
+		if err != nil {
+			return err
+		}
+		if current != ddl {
+			return core.Error(core.GenericError, "schema %g is already published with a different DDL", version)
+		}
+	} else {
+		f, err := os.CreateTemp("", "bao-schema")
+		if err != nil {
+			return core.Error(core.FileError, "cannot create temporary file for schema", err)
+		}
+		defer os.Remove(f.Name())
+		_, err = f.WriteString(ddl)
+		f.Close()
+		if err != nil {
+			return core.Error(core.FileError, "cannot write schema to %s", f.Name(), err)
+		}
+		name := path.Join(schemaDir, strconv.FormatFloat(float64(version), 'g', -1, 32)+"-"+core.SnowIDString())
+		_, err = ds.vault.Write(name, f.Name(), nil, vault.IOOption{})
+		if err != nil {
+			return core.Error(core.FileError, "cannot write schema %s", name, err)
+		}
+	}
+
+	err = ds.syncSchemas()
+	if err != nil {
+		return err
+	}
+	schemas, err := ds.readSchemas()
+	if err != nil {
+		return err
+	}
+	for _, s := range schemas {
+		if s.Version == version && s.Ddl != ddl {
+			return core.Error(core.GenericError, "schema %g was published first with a different DDL", version)
+		}
+	}
+	core.End("version %g", ds.schema)
+	return nil
+}
+
+// SchemaVersion returns the version of the last schema applied to the replica.
+func (ds *Replica) SchemaVersion() float32 {
+	return ds.schema
+}
+
+// initSchemas creates the tables of the schemas and defines the statements of the schemas already applied.
+func (ds *Replica) initSchemas() error {
+	for _, key := range []string{"CREATE_REPLICA_SCHEMAS", "CREATE_REPLICA_DEFERRED"} {
+		if _, err := ds.db.Exec(key, sqlx.Args{}); err != nil {
+			return core.Error(core.DbError, "cannot create replica tables", err)
+		}
+	}
+	schemas, err := ds.readSchemas()
+	if err != nil {
+		return err
+	}
+	for _, s := range schemas {
+		if err := ds.db.Define(s.Ddl); err != nil {
+			return core.Error(core.DbError, "cannot define schema %g", s.Version, err)
+		}
+		ds.schema = s.Version
+	}
+	return nil
+}
+
+// readSchemas returns the schemas applied to the replica in order.
+func (ds *Replica) readSchemas() ([]schema, error) {
+	rows, err := ds.db.Query("GET_REPLICA_SCHEMAS", sqlx.Args{})
+	if err != nil {
+		return nil, core.Error(core.DbError, "cannot read replica schemas", err)
+	}
+	defer rows.Close()
+	var schemas []schema
+	for rows.Next() {
+		var s schema
+		if err := rows.Scan(&s.Version, &s.Ddl); err != nil {
+			return nil, core.Error(core.DbError, "cannot scan replica schema", err)
+		}
+		schemas = append(schemas, s)
+	}
+	return schemas, nil
+}
+
+// syncSchemas applies the schemas in the vault with a version higher than the version of the replica.
+func (ds *Replica) syncSchemas() error {
+	core.Start("")
+	published, err := ds.publishedSchemas()
+	if err != nil {
+		return err
+	}
+	var versions []float32
+	for version := range published {
+		if version > ds.schema {
+			versions = append(versions, version)
+		}
+	}
+	slices.Sort(versions)
+
+	for _, version := range versions {
+		ddl, err := ds.readSchema(published[version].Name)
+		if err != nil {
+			return err
+		}
+		err = ds.applySchema(schema{Version: version, Ddl: ddl})
+		if err != nil {
+			return err
+		}
+	}
+	core.End("%d schemas applied, version %g", len(versions), ds.schema)
+	return nil
+}
+
+// publishedSchemas returns the schema file of each version published in the vault. Each publication has a unique
+// name made of the version and an id. Only the publications of admins count, and when two admins publish the same
+// version, all peers take the first in the store so that they run the same DDL.
+func (ds *Replica) publishedSchemas() (map[float32]vault.File, error) {
+	files, err := ds.vault.ReadDir(schemaDir, time.Time{}, 0, 0)
+	if err != nil && err != sqlx.ErrNoRows {
+		return nil, core.Error(core.FileError, "cannot list schemas", err)
+	}
+	published := map[float32]vault.File{}
+	storeTimes := map[string]time.Time{}
+	for _, f := range files {
+		if f.IsDir {
+			continue
+		}
+		f.Name = path.Join(schemaDir, path.Base(f.Name))
+		name, _, _ := strings.Cut(path.Base(f.Name), "-")
+		v, err := strconv.ParseFloat(name, 32)
+		if err != nil {
+			core.LogError("invalid schema %s", f.Name, err)
+			continue
+		}
+		admin, err := ds.isAdmin(f.AuthorId)
+		if err != nil {
+			return nil, err
+		}
+		if !admin {
+			core.Info("ignoring schema %s by %s, who is not an admin", f.Name, f.AuthorId)
+			continue
+		}
+		version := float32(v)
+		first, ok := published[version]
+		if !ok {
+			published[version] = f
+			continue
+		}
+		for _, c := range []vault.File{first, f} {
+			if _, ok := storeTimes[c.Name]; !ok {
+				storeTimes[c.Name], err = ds.vault.StoreTime(c)
+				if err != nil {
+					return nil, err
+				}
+			}
+		}
+		t, firstTime := storeTimes[f.Name], storeTimes[first.Name]
+		if t.Before(firstTime) || t.Equal(firstTime) && f.Name < first.Name {
+			first, f = f, first
+			published[version] = first
+		}
+		core.Info("ignoring schema %s, version %g was published first in %s", f.Name, version, first.Name)
+	}
+	return published, nil
+}
+
+// readSchema returns the DDL in the schema file with the given name.
+func (ds *Replica) readSchema(name string) (string, error) {
+	f, err := os.CreateTemp("", "bao-schema")
+	if err != nil {
+		return "", core.Error(core.FileError, "cannot create temporary file for schema", err)
+	}
+	f.Close()
+	defer os.Remove(f.Name())
+	_, err = ds.vault.Read(name, f.Name(), vault.IOOption{}, nil)
+	if err != nil {
+		return "", core.Error(core.FileError, "cannot read schema %s", name, err)
+	}
+	ddl, err := os.ReadFile(f.Name())
+	if err != nil {
+		return "", core.Error(core.FileError, "cannot read schema %s", name, err)
+	}
+	return string(ddl), nil
+}
+
+// applySchema runs the DDL of the schema, refreshes the capture of the merged tables and moves the base to the last
+// applied transaction.
+func (ds *Replica) applySchema(s schema) error {
+	core.Start("version %g", s.Version)
+	ds.queryLock.Lock()
+	defer ds.queryLock.Unlock()
+
+	err := ds.db.Define(s.Ddl)
+	if err != nil {
+		return core.Error(core.DbError, "cannot apply schema %g", s.Version, err)
+	}
+	_, err = ds.db.Exec("INSERT_REPLICA_SCHEMA", sqlx.Args{"version": s.Version, "ddl": s.Ddl})
+	if err != nil {
+		return core.Error(core.DbError, "cannot store schema %g", s.Version, err)
+	}
+	for table, m := range ds.merged {
+		if err := ds.merge(table, m.mode); err != nil {
+			return err
+		}
+	}
+
+	last, err := ds.lastApplied()
+	if err != nil {
+		return err
+	}
+	tx, err := ds.db.Begin()
+	if err != nil {
+		return core.Error(core.DbError, "cannot start transaction", err)
+	}
+	err = ds.saveBase(tx, last)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	err = tx.Commit()
+	if err != nil {
+		return core.Error(core.DbError, "cannot commit base of replica", err)
+	}
+	ds.schema = s.Version
+	core.End("")
+	return nil
+}
+
+// deferTransactions stores the transactions written with a schema the replica has not applied yet, and returns the
+// transactions to apply, including the ones deferred before that the current schema supports.
+func (ds *Replica) deferTransactions(transactions []transaction) ([]transaction, error) {
+	var ready []transaction
+	for _, t := range transactions {
+		if t.Version <= ds.schema {
+			ready = append(ready, t)
+			continue
+		}
+		data, err := msgpack.Marshal(deferredTransaction{Transaction: t, Author: t.Author})
+		if err != nil {
+			return nil, core.Error(core.EncodeError, "cannot marshal transaction %d", t.Id, err)
+		}
+		_, err = ds.db.Exec("INSERT_REPLICA_DEFERRED", sqlx.Args{"hlc": t.Hlc, "origin": t.Origin,
+			"version": t.Version, "data": data})
+		if err != nil {
+			return nil, core.Error(core.DbError, "cannot defer transaction %d", t.Id, err)
+		}
+		core.Info("transaction %d requires schema %g, replica has %g", t.Id, t.Version, ds.schema)
+	}
+
+	rows, err := ds.db.Query("GET_REPLICA_DEFERRED", sqlx.Args{"version": ds.schema})
+	if err != nil {
+		return nil, core.Error(core.DbError, "cannot read deferred transactions", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var data []byte
+		if err := rows.Scan(&data); err != nil {
+			return nil, core.Error(core.DbError, "cannot scan deferred transaction", err)
+		}
+		var d deferredTransaction
+		if err := msgpack.Unmarshal(data, &d); err != nil {
+			return nil, core.Error(core.ParseError, "cannot unmarshal deferred transaction", err)
+		}
+		d.Transaction.Author = d.Author
+		ready = append(ready, d.Transaction)
+	}
+	return ready, nil
+}
+
+// clearDeferred removes the deferred transactions that the current schema supports, once they are applied.
+func (ds *Replica) clearDeferred() error {
+	_, err := ds.db.Exec("DELETE_REPLICA_DEFERRED", sqlx.Args{"version": ds.schema})
+	if err != nil {
+		return core.Error(core.DbError, "cannot delete deferred transactions", err)
+	}
+	return nil
+}
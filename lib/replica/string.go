@@ -13,6 +13,8 @@ func (transaction *transaction) MarshalYAML() (any, error) {
 		"id":      transaction.Id,
 		"version": transaction.Version,
 		"tm":      transaction.Tm,
+		"hlc":     transaction.Hlc,
+		"origin":  transaction.Origin,
 		"updates": transaction.Updates,
 	}, nil
 }
@@ -7,9 +7,48 @@ CREATE TABLE db_test (
   PRIMARY KEY (msg)
 )
 
+-- INIT 1.0
+CREATE TABLE notes (
+  id INTEGER NOT NULL,
+  title VARCHAR(255),
+  body VARCHAR(4096),
+  PRIMARY KEY (id)
+)
+
+-- INIT 1.0
+CREATE TABLE note_tags (
+  note INTEGER NOT NULL,
+  tag VARCHAR(64) NOT NULL,
+  PRIMARY KEY (note, tag)
+)
+
 -- INSERT_TEST_DATA 1.0
 INSERT INTO db_test(msg, cnt, ratio, bin) VALUES (:msg, :cnt, :ratio, :bin)
 
 -- SELECT_TEST_DATA 1.0
 SELECT msg, cnt, ratio, bin FROM db_test
 
+
+-- UPDATE_TEST_DATA 1.0
+UPDATE db_test SET cnt = :cnt WHERE msg = :msg
+
+-- INSERT_NOTE 1.0
+INSERT INTO notes(id, title, body) VALUES (:id, :title, :body)
+
+-- UPDATE_NOTE_TITLE 1.0
+UPDATE notes SET title = :title WHERE id = :id
+
+-- UPDATE_NOTE_BODY 1.0
+UPDATE notes SET body = :body WHERE id = :id
+
+-- SELECT_NOTES 1.0
+SELECT id, title, body FROM notes ORDER BY id
+
+-- ADD_NOTE_TAG 1.0
+INSERT OR REPLACE INTO note_tags(note, tag) VALUES (:note, :tag)
+
+-- DELETE_NOTE_TAG 1.0
+DELETE FROM note_tags WHERE note = :note AND tag = :tag
+
+-- SELECT_NOTE_TAGS 1.0
+SELECT note, tag FROM note_tags ORDER BY note, tag
@@ -31,7 +31,7 @@ func (ds *Replica) beginTransaction() error {
 	ds.transaction = &transaction{
 		tx:      tx,
 		Updates: make([]Update, 0),
-		Version: 0.0, // initial version
+		Version: ds.schema, // the updates use the statements of the current schema
 		//		Id:      core.SnowID(), // generate a new transaction ID
 		Tm: core.Now(), // set the current time
 	}
@@ -45,13 +45,26 @@ func (ds *Replica) Exec(key string, args sqlx.Args) (sql.Result, error) {
 	ds.execLock.Lock()
 	defer ds.execLock.Unlock()
 
+	err := ds.checkGrant(key)
+	if err != nil {
+		return nil, err
+	}
+	if ds.open != nil {
+		return nil, core.Error(core.GenericError, "cannot exec %s in replica of vault %s while a transaction is open",
+			key, ds.vault.ID)
+	}
 	if ds.transaction == nil {
 		err := ds.beginTransaction()
 		if err != nil {
 			return nil, err
 		}
 	}
+	return ds.exec(ds.transaction, key, args)
+}
 
+// exec runs a statement in the current transaction and adds it to the updates of t, unless it changes a merged
+// table. It must be called with execLock held.
+func (ds *Replica) exec(t *transaction, key string, args sqlx.Args) (sql.Result, error) {
 	res, err := ds.transaction.tx.Exec(key, args)
 	if err != nil {
 		return nil, err
@@ -61,7 +74,19 @@ func (ds *Replica) Exec(key string, args sqlx.Args) (sql.Result, error) {
 		core.End("exec completed: row affected %d, key %s", rowsAffected, key)
 	}
 
-	ds.transaction.Updates = append(ds.transaction.Updates, Update{key, args})
+	if len(ds.merged) > 0 {
+		var capture int
+		err = ds.transaction.tx.QueryRow("COUNT_REPLICA_CAPTURE", sqlx.Args{}, &capture)
+		if err != nil {
+			return nil, core.Error(core.DbError, "cannot count captured changes", err)
+		}
+		merged := capture > ds.transaction.capture
+		ds.transaction.capture = capture
+		if merged {
+			return res, nil // the changes travel as cells
+		}
+	}
+	t.Updates = append(t.Updates, Update{key, args})
 	return res, nil
 }
 
@@ -87,6 +112,9 @@ func (ds *Replica) Sync(dests ...security.PublicID) (int, error) {
 	if err != nil {
 		return 0, core.Error(core.GenericError, "cannot read transactions", err)
 	}
+	for _, t := range transactions {
+		ds.clock.observe(t.Hlc) // the current transaction must sort after the ones read
+	}
 
 	// Add current transaction to replica dir.
 	// If destinations are provided, write one EC-encrypted copy per recipient.
@@ -95,20 +123,43 @@ func (ds *Replica) Sync(dests ...security.PublicID) (int, error) {
 		return 0, core.Error(core.DbError, "cannot write current transaction in replica", err)
 	}
 
+	// Apply the schemas published by other peers
+	err = ds.syncSchemas()
+	if err != nil {
+		return 0, core.Error(core.GenericError, "cannot sync schemas", err)
+	}
+
+	// Restore the latest checkpoint when the replica is behind it
+	err = ds.restoreLatestCheckpoint()
+	if err != nil {
+		return 0, core.Error(core.GenericError, "cannot restore checkpoint", err)
+	}
+
 	// Process all transactions
 	updates, err := ds.processTransactions(transactions)
 	if err != nil {
 		return 0, core.Error(core.GenericError, "cannot process transactions", err)
 	}
 
+	err = ds.checkpointIfDue()
+	if err != nil {
+		return 0, core.Error(core.GenericError, "cannot write checkpoint", err)
+	}
+
 	core.End("elapsed %s", time.Since(now))
-	return len(updates), nil
+	return updates, nil
 }
 
+// addCurrentTransactionToAll writes the committed transactions and the current transaction to the replica dir and
+// returns them appended to transactions.
 func (ds *Replica) addCurrentTransactionToAll(dir string, dests []security.PublicID, transactions []transaction) ([]transaction, error) {
-	core.Start("transaction %p", ds.transaction)
+	core.Start("transaction %p, %d pending", ds.transaction, len(ds.pending))
 	now := time.Now()
 	ds.execLock.Lock()
+	if ds.open != nil {
+		ds.execLock.Unlock()
+		return nil, core.Error(core.GenericError, "cannot sync replica of vault %s while a transaction is open", ds.vault.ID)
+	}
 	if ds.transaction == nil {
 		ds.execLock.Unlock()
 		core.End("ds.transaction == nil")
@@ -116,31 +167,62 @@ func (ds *Replica) addCurrentTransactionToAll(dir string, dests []security.Publi
 	}
 
 	t := *ds.transaction
+	local := ds.pending
 	ds.transaction = nil // reset the current transaction to nil before writing
+	ds.pending = nil
 	ds.execLock.Unlock()
 
-	err := t.tx.Rollback() // rollback the transaction to ensure it is not committed yet
+	cells, err := ds.readCapture(t.tx)
+	if err != nil {
+		t.tx.Rollback()
+		return nil, err
+	}
+	t.Cells = cells
+	if len(t.Updates) > 0 || len(t.Cells) > 0 {
+		local = append(local, t)
+	}
+
+	err = t.tx.Rollback() // rollback the transaction to ensure it is not committed yet
 	if err != nil {
 		return nil, core.Error(core.GenericError, "cannot rollback transaction", err)
 	}
 
+	for _, t := range local {
+		t, err = ds.writeTransaction(dir, dests, t)
+		if err != nil {
+			return nil, err
+		}
+		transactions = append(transactions, t)
+	}
+	core.End("elapsed %s, %d transactions, recipients %d", core.Since(now), len(local), len(dests))
+	return transactions, nil
+}
+
+// writeTransaction stamps a local transaction and writes it to the replica dir, once for each recipient when
+// recipients are provided.
+func (ds *Replica) writeTransaction(dir string, dests []security.PublicID, t transaction) (transaction, error) {
+	core.Start("%d updates, %d cells", len(t.Updates), len(t.Cells))
+	name := strconv.FormatUint(core.SnowID(), 16) // base logical tx name
+	t.Hlc = ds.clock.now()
+	t.Origin = name
+	t.Author = ds.vault.UserID
+
 	// Marshal and compress once
 	attrs, err := msgpack.Marshal(t)
 	if err != nil {
-		return nil, core.Error(core.DbError, "cannot marshal transaction %d", t.Id, err)
+		return transaction{}, core.Error(core.DbError, "cannot marshal transaction %d", t.Id, err)
 	}
 	attrs, err = core.GzipCompress(attrs)
 	if err != nil {
-		return nil, core.Error(core.DbError, "cannot compress transaction %d", t.Id, err)
+		return transaction{}, core.Error(core.DbError, "cannot compress transaction %d", t.Id, err)
 	}
 
 	// Write transaction file(s)
-	name := strconv.FormatUint(core.SnowID(), 16) // base logical tx name
 	var maxWrittenID vault.FileId
 	if len(dests) == 0 {
 		file, err := ds.vault.Write(path.Join(dir, name), "", attrs, vault.IOOption{})
 		if err != nil {
-			return nil, core.Error(core.DbError, "cannot write transaction %d to %s", t.Id, dir, err)
+			return transaction{}, core.Error(core.DbError, "cannot write transaction %d to %s", t.Id, dir, err)
 		}
 		maxWrittenID = file.Id
 	} else {
@@ -148,7 +230,7 @@ func (ds *Replica) addCurrentTransactionToAll(dir string, dests []security.Publi
 			txName := fmt.Sprintf("%s-%x,ec=%s", name, dest.Hash(), dest)
 			file, err := ds.vault.Write(path.Join(dir, txName), "", attrs, vault.IOOption{})
 			if err != nil {
-				return nil, core.Error(core.DbError, "cannot write transaction %d to %s for recipient %s", t.Id, dir, dest, err)
+				return transaction{}, core.Error(core.DbError, "cannot write transaction %d to %s for recipient %s", t.Id, dir, dest, err)
 			}
 			if file.Id > maxWrittenID {
 				maxWrittenID = file.Id
@@ -157,10 +239,12 @@ func (ds *Replica) addCurrentTransactionToAll(dir string, dests []security.Publi
 	}
 	t.Id = maxWrittenID
 
-	core.End("name %s, elapsed %s, updates %d, recipients %d", name, core.Since(now), len(t.Updates), len(dests))
-	return append(transactions, t), nil
+	core.End("name %s, id %d", name, t.Id)
+	return t, nil
 }
 
+// Cancel discards the changes not yet synced: the current transaction, the committed transactions waiting for Sync
+// and the open transaction, if any.
 func (ds *Replica) Cancel() error {
 	core.Start("")
 	ds.execLock.Lock()
@@ -175,6 +259,8 @@ func (ds *Replica) Cancel() error {
 		return core.Error(core.GenericError, "cannot rollback transaction", err)
 	}
 	ds.transaction = nil
+	ds.pending = nil
+	ds.open = nil
 
 	core.End("")
 	return nil
@@ -191,6 +277,9 @@ func (ds *Replica) listUnreadTransactions(dir string) (ls []vault.File, err erro
 		return nil, core.Error(core.FileError, "cannot read files in replica", err)
 	}
 
+	files = slices.DeleteFunc(files, func(f vault.File) bool {
+		return f.IsDir // checkpoints live in a subfolder
+	})
 	slices.SortFunc(files, func(a, b vault.File) int {
 		return strings.Compare(a.Name, b.Name) // sort by file name
 	})
@@ -208,7 +297,15 @@ func (ds *Replica) readTransactionFiles(ls []vault.File) (transactions []transac
 			core.Error(core.GenericError, "cannot read transaction in replica", err)
 			continue
 		}
-		transaction.Id = fi.Id // set the transaction Id from the file Id
+		transaction.Id = fi.Id           // set the transaction Id from the file Id
+		transaction.Author = fi.AuthorId // the author is the signer of the file, not a field in the transaction
+		if transaction.Origin == "" {
+			transaction.Origin = fi.Name // transactions without a stamp keep the order of their names
+		}
+		transaction.Hlc, err = ds.transactionStamp(fi, transaction.Hlc)
+		if err != nil {
+			return nil, err // the transaction is read again on the next sync
+		}
 		transactions = append(transactions, transaction)
 		n_updates += len(transaction.Updates)
 	}
@@ -216,20 +313,31 @@ func (ds *Replica) readTransactionFiles(ls []vault.File) (transactions []transac
 	return transactions, nil
 }
 
-func (ds *Replica) processTransactions(t []transaction) (updates []Update, err error) {
+// processTransactions applies the transactions and returns the number of updates and cells they hold. The
+// transactions written with a newer schema are deferred.
+func (ds *Replica) processTransactions(t []transaction) (updates int, err error) {
 	core.Start("%d transactions", len(t))
-	updates = make([]Update, 0)
+	ready, err := ds.deferTransactions(t)
+	if err != nil {
+		return 0, err
+	}
+	err = ds.applyTransactions(ready)
+	if err != nil {
+		return 0, core.Error(core.GenericError, "cannot apply transactions", err)
+	}
+	err = ds.clearDeferred()
+	if err != nil {
+		return 0, err
+	}
+	for _, transaction := range ready {
+		updates += len(transaction.Updates) + len(transaction.Cells)
+	}
 	for _, transaction := range t {
-		err = ds.processTransaction(transaction)
-		if err != nil {
-			return nil, core.Error(core.GenericError, "cannot process transaction %d", transaction.Id, err)
-		}
-		updates = append(updates, transaction.Updates...)
 		if transaction.Id > ds.lastId {
 			ds.lastId = transaction.Id // keep high-watermark over all processed transactions
 		}
 	}
-	core.End("%d updates, lastId %d", len(updates), ds.lastId)
+	core.End("%d updates, lastId %d", updates, ds.lastId)
 	return updates, nil
 }
 
@@ -251,29 +359,3 @@ func (ds *Replica) readTransaction(fi vault.File) (transaction, error) {
 	core.End("%d updates", len(t.Updates))
 	return t, nil
 }
-
-func (ds *Replica) processTransaction(t transaction) error {
-	core.Start("id %d, %d updates", t.Id, len(t.Updates))
-
-	ds.queryLock.Lock()
-	for _, u := range t.Updates {
-		_, err := ds.db.Exec(u.Key, u.Args)
-		if err != nil {
-			ds.queryLock.Unlock()
-			return core.Error(core.GenericError, "cannot execute transaction %s", u.Key, err)
-		}
-	}
-	ds.queryLock.Unlock()
-
-	if t.Id > ds.lastId {
-		ds.lastId = t.Id
-	}
-	_, err := ds.vault.DB.Exec("INSERT_TRANSACTION_METADATA", sqlx.Args{"vault": ds.vault.ID, "id": t.Id,
-		"tm": t.Tm, "success": true})
-	if err != nil {
-		return core.Error(core.DbError, "cannot insert transaction metadata %d for %d updates", t.Id, len(t.Updates), err)
-	}
-
-	core.End("")
-	return nil
-}
@@ -0,0 +1,244 @@
+package replica
+
+import (
+	"database/sql"
+	"fmt"
+	"slices"
+
+	"github.com/stregato/bao/lib/core"
+	"github.com/stregato/bao/lib/sqlx"
+)
+
+// An explicit transaction groups statements in a unit that is published on its own. Begin opens a savepoint in the
+// current transaction of the replica, so the statements are visible to the local queries. Commit queues an
+// immutable transaction for the next Sync, and Rollback undoes the statements since Begin. Only one explicit
+// transaction can be open at a time, and Exec and Sync fail while it is open.
+
+// txSavepoint is the savepoint that Begin opens in the current transaction.
+const txSavepoint = "replica_tx"
+
+// Tx is an explicit transaction on a replica.
+type Tx struct {
+	r          *Replica
+	t          transaction
+	savepoints []savepoint
+	seq        int // seq numbers the savepoints in the database
+}
+
+// savepoint is a named position in an explicit transaction.
+type savepoint struct {
+	name    string
+	sqlName string // sqlName is the name in the database, so that the names chosen by the user never reach the SQL
+	updates int    // updates is the number of updates in the transaction when the savepoint is set
+}
+
+// Begin starts an explicit transaction. The statements executed with Exec before Begin are queued as a transaction
+// on their own.
+func (ds *Replica) Begin() (*Tx, error) {
+	core.Start("")
+	ds.execLock.Lock()
+	defer ds.execLock.Unlock()
+
+	if ds.open != nil {
+		return nil, core.Error(core.GenericError, "a transaction is already open in replica of vault %s", ds.vault.ID)
+	}
+	if ds.transaction == nil {
+		err := ds.beginTransaction()
+		if err != nil {
+			return nil, err
+		}
+	}
+	err := ds.queueCurrent(ds.transaction)
+	if err != nil {
+		return nil, err
+	}
+	_, err = ds.transaction.tx.Exec("SET_REPLICA_TX_SAVEPOINT", sqlx.Args{"#savepoint": txSavepoint})
+	if err != nil {
+		return nil, core.Error(core.DbError, "cannot open savepoint in replica of vault %s", ds.vault.ID, err)
+	}
+
+	tx := &Tx{
+		r: ds,
+		t: transaction{Updates: make([]Update, 0), Version: ds.schema, Tm: core.Now()},
+	}
+	ds.open = tx
+	core.End("")
+	return tx, nil
+}
+
+// Pending returns the number of committed transactions waiting for the next Sync.
+func (ds *Replica) Pending() int {
+	ds.execLock.Lock()
+	defer ds.execLock.Unlock()
+	return len(ds.pending)
+}
+
+// queueCurrent moves the updates of t and the changes captured in merged tables to the pending transactions. It
+// must be called with execLock held.
+func (ds *Replica) queueCurrent(t *transaction) error {
+	cells, err := ds.readCapture(ds.transaction.tx)
+	if err != nil {
+		return err
+	}
+	if len(cells) > 0 {
+		_, err = ds.transaction.tx.Exec("CLEAR_REPLICA_CAPTURE", sqlx.Args{})
+		if err != nil {
+			return core.Error(core.DbError, "cannot clear captured changes", err)
+		}
+		ds.transaction.capture = 0
+	}
+	if len(t.Updates) == 0 && len(cells) == 0 {
+		return nil
+	}
+
+	ds.pending = append(ds.pending, transaction{
+		Updates: t.Updates,
+		Cells:   cells,
+		Version: t.Version,
+		Tm:      t.Tm,
+	})
+	t.Updates = make([]Update, 0)
+	t.Tm = core.Now()
+	return nil
+}
+
+// checkOpen returns an error when the transaction is no longer open. It must be called with execLock held.
+func (tx *Tx) checkOpen() error {
+	if tx.r.open != tx {
+		return core.Error(core.GenericError, "transaction in replica of vault %s is closed", tx.r.vault.ID)
+	}
+	return nil
+}
+
+// Exec executes a statement in the transaction.
+func (tx *Tx) Exec(key string, args sqlx.Args) (sql.Result, error) {
+	core.Start("key %s, args %v", key, args)
+	ds := tx.r
+	ds.execLock.Lock()
+	defer ds.execLock.Unlock()
+
+	err := tx.checkOpen()
+	if err != nil {
+		return nil, err
+	}
+	err = ds.checkGrant(key)
+	if err != nil {
+		return nil, err
+	}
+	return ds.exec(&tx.t, key, args)
+}
+
+// Savepoint sets a savepoint with the given name. A savepoint with the same name replaces the previous one.
+func (tx *Tx) Savepoint(name string) error {
+	core.Start("name %s", name)
+	ds := tx.r
+	ds.execLock.Lock()
+	defer ds.execLock.Unlock()
+
+	err := tx.checkOpen()
+	if err != nil {
+		return err
+	}
+	tx.seq++
+	sp := savepoint{name: name, sqlName: fmt.Sprintf("%s_%d", txSavepoint, tx.seq), updates: len(tx.t.Updates)}
+	_, err = ds.transaction.tx.Exec("SET_REPLICA_TX_SAVEPOINT", sqlx.Args{"#savepoint": sp.sqlName})
+	if err != nil {
+		return core.Error(core.DbError, "cannot set savepoint %s", name, err)
+	}
+	tx.savepoints = slices.DeleteFunc(tx.savepoints, func(s savepoint) bool { return s.name == name })
+	tx.savepoints = append(tx.savepoints, sp)
+	core.End("")
+	return nil
+}
+
+// RollbackTo undoes the statements executed after the savepoint with the given name. The savepoint stays set, and the
+// savepoints set after it are removed.
+func (tx *Tx) RollbackTo(name string) error {
+	core.Start("name %s", name)
+	ds := tx.r
+	ds.execLock.Lock()
+	defer ds.execLock.Unlock()
+
+	err := tx.checkOpen()
+	if err != nil {
+		return err
+	}
+	i := slices.IndexFunc(tx.savepoints, func(s savepoint) bool { return s.name == name })
+	if i < 0 {
+		return core.Error(core.GenericError, "no savepoint %s in transaction", name)
+	}
+	_, err = ds.transaction.tx.Exec("ROLLBACK_REPLICA_TX_SAVEPOINT", sqlx.Args{"#savepoint": tx.savepoints[i].sqlName})
+	if err != nil {
+		return core.Error(core.DbError, "cannot rollback to savepoint %s", name, err)
+	}
+	tx.t.Updates = tx.t.Updates[:tx.savepoints[i].updates]
+	tx.savepoints = tx.savepoints[:i+1]
+	err = ds.recountCapture()
+	if err != nil {
+		return err
+	}
+	core.End("%d updates", len(tx.t.Updates))
+	return nil
+}
+
+// Commit ends the transaction and queues it for the next Sync. Its changes stay visible to the local queries.
+func (tx *Tx) Commit() error {
+	core.Start("%d updates", len(tx.t.Updates))
+	ds := tx.r
+	ds.execLock.Lock()
+	defer ds.execLock.Unlock()
+
+	err := tx.checkOpen()
+	if err != nil {
+		return err
+	}
+	err = ds.queueCurrent(&tx.t)
+	if err != nil {
+		return err
+	}
+	_, err = ds.transaction.tx.Exec("RELEASE_REPLICA_TX_SAVEPOINT", sqlx.Args{"#savepoint": txSavepoint})
+	if err != nil {
+		return core.Error(core.DbError, "cannot release savepoint in replica of vault %s", ds.vault.ID, err)
+	}
+	ds.open = nil
+	core.End("%d pending", len(ds.pending))
+	return nil
+}
+
+// Rollback ends the transaction and undoes its statements.
+func (tx *Tx) Rollback() error {
+	core.Start("")
+	ds := tx.r
+	ds.execLock.Lock()
+	defer ds.execLock.Unlock()
+
+	err := tx.checkOpen()
+	if err != nil {
+		return err
+	}
+	for _, key := range []string{"ROLLBACK_REPLICA_TX_SAVEPOINT", "RELEASE_REPLICA_TX_SAVEPOINT"} {
+		_, err = ds.transaction.tx.Exec(key, sqlx.Args{"#savepoint": txSavepoint})
+		if err != nil {
+			return core.Error(core.DbError, "cannot rollback transaction in replica of vault %s", ds.vault.ID, err)
+		}
+	}
+	ds.open = nil
+	err = ds.recountCapture()
+	if err != nil {
+		return err
+	}
+	core.End("")
+	return nil
+}
+
+// recountCapture updates the count of the captured changes after a rollback. It must be called with execLock held.
+func (ds *Replica) recountCapture() error {
+	if len(ds.merged) == 0 {
+		return nil
+	}
+	err := ds.transaction.tx.QueryRow("COUNT_REPLICA_CAPTURE", sqlx.Args{}, &ds.transaction.capture)
+	if err != nil {
+		return core.Error(core.DbError, "cannot count captured changes", err)
+	}
+	return nil
+}
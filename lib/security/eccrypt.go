@@ -1,22 +1,54 @@
 package security
 
 import (
+	"crypto/aes"
+	"crypto/cipher"
 	"io"
 
+	"github.com/cloudflare/circl/kem/mlkem/mlkem768"
 	eciesgo "github.com/ecies/go/v2"
 	"github.com/stregato/bao/lib/core"
+	"golang.org/x/crypto/blake2b"
 )
 
+// ecOverhead is the size added by secp256k1 ECIES: ephemeral public key (65), nonce (16) and tag (16).
+const ecOverhead = 97
+
+// Hybrid ciphertexts start with hybridMarker, which cannot collide with the 0x04 prefix of the
+// uncompressed ephemeral key ECIES puts at the beginning of classic ciphertexts. The layout is
+// marker | ML-KEM ciphertext | ECIES(ec secret) | GCM nonce | GCM ciphertext.
+const (
+	hybridMarker   = 0x01
+	hybridOverhead = 1 + mlkem768.CiphertextSize + ecOverhead + 32 + 12 + 16
+)
+
+// EcReaderOverhead returns the size of the wrapped key EcEncryptReader puts before the encrypted stream.
+func EcReaderOverhead(publicID PublicID) int64 {
+	if publicID.IsHybrid() {
+		return hybridOverhead + 32
+	}
+	return ecOverhead + 32
+}
+
+// EcEncrypt encrypts data for the given public ID. Classic public IDs use secp256k1 ECIES, while
+// hybrid public IDs combine ECIES and ML-KEM-768, so the data stays protected if either is broken.
 func EcEncrypt(publicID PublicID, data []byte) ([]byte, error) {
 	cryptKey, _, err := publicID.Decode()
 	if err != nil {
 		return nil, core.Error(core.ParseError, "cannot decode keys", err)
 	}
+	kemKey, err := publicID.KemKey()
+	if err != nil {
+		return nil, core.Error(core.ParseError, "cannot decode kem key", err)
+	}
 
 	pk, err := eciesgo.NewPublicKeyFromBytes(cryptKey)
 	if err != nil {
 		return nil, core.Error(core.GenericError, "cannot convert bytes to secp256k1 public key", err)
 	}
+	if kemKey != nil {
+		return hybridEncrypt(pk, kemKey, data)
+	}
 	data, err = eciesgo.Encrypt(pk, data)
 	if err != nil {
 		return nil, core.Error(core.EncodeError, "cannot encrypt with secp256k1", err)
@@ -24,19 +56,109 @@ func EcEncrypt(publicID PublicID, data []byte) ([]byte, error) {
 	return data, err
 }
 
+// EcDecrypt decrypts data produced by EcEncrypt. Both classic and hybrid ciphertexts are accepted;
+// hybrid ciphertexts require a hybrid private ID.
 func EcDecrypt(privateID PrivateID, data []byte) ([]byte, error) {
 	cryptKey, _, err := privateID.Decode()
 	if core.IsWarn(err, "cannot decode keys: %v") {
 		return nil, err
 	}
 
-	data, err = eciesgo.Decrypt(eciesgo.NewPrivateKeyFromBytes(cryptKey), data)
+	sk := eciesgo.NewPrivateKeyFromBytes(cryptKey)
+	if len(data) > 0 && data[0] == hybridMarker {
+		kemSeed, err := privateID.KemKey()
+		if err != nil {
+			return nil, err
+		}
+		if kemSeed == nil {
+			return nil, core.Error(core.AccessDenied, "hybrid ciphertext requires a hybrid private ID")
+		}
+		return hybridDecrypt(sk, kemSeed, data)
+	}
+
+	data, err = eciesgo.Decrypt(sk, data)
 	if err != nil {
 		return nil, err
 	}
 	return data, nil
 }
 
+func hybridKey(kemSecret, ecSecret, kemCiphertext []byte) []byte {
+	h, _ := blake2b.New256(nil)
+	h.Write([]byte(MLKEM768))
+	h.Write(kemSecret)
+	h.Write(ecSecret)
+	h.Write(kemCiphertext)
+	return h.Sum(nil)
+}
+
+func hybridEncrypt(pk *eciesgo.PublicKey, kemKey []byte, data []byte) ([]byte, error) {
+	var kemPk mlkem768.PublicKey
+	err := kemPk.Unpack(kemKey)
+	if err != nil {
+		return nil, core.Error(core.ParseError, "cannot unpack ML-KEM public key", err)
+	}
+	kemCiphertext := make([]byte, mlkem768.CiphertextSize)
+	kemSecret := make([]byte, mlkem768.SharedKeySize)
+	kemPk.EncapsulateTo(kemCiphertext, kemSecret, nil)
+
+	ecSecret := core.GenerateRandomBytes(32)
+	ecCiphertext, err := eciesgo.Encrypt(pk, ecSecret)
+	if err != nil {
+		return nil, core.Error(core.EncodeError, "cannot encrypt with secp256k1", err)
+	}
+
+	gcm, err := newHybridGCM(hybridKey(kemSecret, ecSecret, kemCiphertext))
+	if err != nil {
+		return nil, err
+	}
+	nonce := core.GenerateRandomBytes(gcm.NonceSize())
+
+	out := make([]byte, 0, hybridOverhead+len(data))
+	out = append(out, hybridMarker)
+	out = append(out, kemCiphertext...)
+	out = append(out, ecCiphertext...)
+	out = append(out, nonce...)
+	return gcm.Seal(out, nonce, data, out[:1]), nil
+}
+
+func hybridDecrypt(sk *eciesgo.PrivateKey, kemSeed []byte, data []byte) ([]byte, error) {
+	if len(data) < hybridOverhead {
+		return nil, core.Error(core.ParseError, "hybrid ciphertext too short: %d bytes", len(data))
+	}
+	kemCiphertext := data[1 : 1+mlkem768.CiphertextSize]
+	ecCiphertext := data[1+mlkem768.CiphertextSize : 1+mlkem768.CiphertextSize+ecOverhead+32]
+	nonce := data[1+mlkem768.CiphertextSize+ecOverhead+32 : 1+mlkem768.CiphertextSize+ecOverhead+32+12]
+	body := data[1+mlkem768.CiphertextSize+ecOverhead+32+12:]
+
+	_, kemSk := mlkem768.NewKeyFromSeed(kemSeed)
+	kemSecret := make([]byte, mlkem768.SharedKeySize)
+	kemSk.DecapsulateTo(kemSecret, kemCiphertext)
+
+	ecSecret, err := eciesgo.Decrypt(sk, ecCiphertext)
+	if err != nil {
+		return nil, core.Error(core.AccessDenied, "cannot decrypt secp256k1 part of hybrid ciphertext", err)
+	}
+
+	gcm, err := newHybridGCM(hybridKey(kemSecret, ecSecret, kemCiphertext))
+	if err != nil {
+		return nil, err
+	}
+	plain, err := gcm.Open(nil, nonce, body, data[:1])
+	if err != nil {
+		return nil, core.Error(core.AccessDenied, "cannot decrypt hybrid ciphertext", err)
+	}
+	return plain, nil
+}
+
+func newHybridGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, core.Error(core.EncodeError, "cannot create AES cipher", err)
+	}
+	return cipher.NewGCM(block)
+}
+
 type EcEncryptingReadSeeker struct {
 	pos int64
 	key []byte
@@ -44,7 +166,12 @@ type EcEncryptingReadSeeker struct {
 }
 
 func EcEncryptReader(publicID PublicID, r io.ReadSeeker, iv []byte) (io.ReadSeeker, error) {
-	key := core.GenerateRandomBytes(32)
+	return EcEncryptReaderWithKey(publicID, core.GenerateRandomBytes(32), r, iv)
+}
+
+// EcEncryptReaderWithKey is like EcEncryptReader but uses the provided 32 bytes key for the stream, so that the
+// caller can wrap the same key for additional recipients.
+func EcEncryptReaderWithKey(publicID PublicID, key []byte, r io.ReadSeeker, iv []byte) (io.ReadSeeker, error) {
 	r, err := EncryptReader(r, key, iv)
 	if err != nil {
 		return nil, err
@@ -79,8 +206,10 @@ type EcDecryptingWriter struct {
 	w         io.Writer
 	dw        io.Writer
 	key       []byte
+	keySize   int
 	iv        []byte
 	privateID PrivateID
+	plainKey  []byte
 }
 
 func EcDecryptWriter(privateID PrivateID, w io.Writer, iv []byte) (io.Writer, error) {
@@ -91,19 +220,40 @@ func EcDecryptWriter(privateID PrivateID, w io.Writer, iv []byte) (io.Writer, er
 	}, nil
 }
 
+// EcDecryptWriterWithKey decrypts a stream produced by EcEncryptReader when the stream key is already known,
+// e.g. because it was wrapped for an escrow identity. The wrapped key at the beginning of the stream is skipped.
+func EcDecryptWriterWithKey(key []byte, w io.Writer, iv []byte) (io.Writer, error) {
+	return &EcDecryptingWriter{
+		w:        w,
+		iv:       iv,
+		plainKey: key,
+	}, nil
+}
+
 func (w *EcDecryptingWriter) Write(p []byte) (n int, err error) {
 	if w.dw != nil {
 		return w.dw.Write(p)
 	}
-	if len(w.key) < 129 {
-		n = min(129-len(w.key), len(p))
+	if w.keySize == 0 && len(p) > 0 {
+		// The first byte tells whether the key is wrapped with classic ECIES or the hybrid KEM
+		w.keySize = ecOverhead + 32
+		if p[0] == hybridMarker {
+			w.keySize = hybridOverhead + 32
+		}
+	}
+	if len(w.key) < w.keySize {
+		n = min(w.keySize-len(w.key), len(p))
 		w.key = append(w.key, p[:n]...)
 		p = p[n:]
 	}
-	if len(w.key) == 129 {
-		w.key, err = EcDecrypt(w.privateID, w.key)
-		if err != nil {
-			return n, err
+	if w.keySize > 0 && len(w.key) == w.keySize {
+		if w.plainKey != nil {
+			w.key = w.plainKey
+		} else {
+			w.key, err = EcDecrypt(w.privateID, w.key)
+			if err != nil {
+				return n, err
+			}
 		}
 		w.dw, err = DecryptWriter(w.w, w.key, w.iv)
 		if err != nil {
@@ -1,6 +1,8 @@
 package security
 
 import (
+	"bytes"
+	"io"
 	"testing"
 
 	"github.com/stregato/bao/lib/core"
@@ -19,3 +21,65 @@ func TestEccrypt(t *testing.T) {
 
 	assert.Equal(t, data, decrypted)
 }
+
+func TestEccryptHybrid(t *testing.T) {
+	alice, err := NewHybridPrivateID()
+	assert.NoError(t, err)
+	assert.True(t, alice.IsHybrid())
+	assert.True(t, alice.PublicIDMust().IsHybrid())
+	data := core.GenerateRandomBytes(32)
+
+	encrypted, err := EcEncrypt(alice.PublicIDMust(), data)
+	assert.NoError(t, err)
+	assert.Equal(t, len(data)+hybridOverhead, len(encrypted))
+
+	decrypted, err := EcDecrypt(alice, encrypted)
+	assert.NoError(t, err)
+	assert.Equal(t, data, decrypted)
+
+	encrypted[len(encrypted)-1] ^= 0xff
+	_, err = EcDecrypt(alice, encrypted)
+	assert.Error(t, err)
+}
+
+func TestEccryptHybridMigration(t *testing.T) {
+	classic := NewPrivateIDMust()
+	hybrid, err := classic.Hybrid()
+	assert.NoError(t, err)
+	data := core.GenerateRandomBytes(64)
+
+	// data encrypted for the classic identity is still readable after the upgrade
+	encrypted, err := EcEncrypt(classic.PublicIDMust(), data)
+	assert.NoError(t, err)
+	decrypted, err := EcDecrypt(hybrid, encrypted)
+	assert.NoError(t, err)
+	assert.Equal(t, data, decrypted)
+
+	// hybrid ciphertexts cannot be opened with the classic identity
+	encrypted, err = EcEncrypt(hybrid.PublicIDMust(), data)
+	assert.NoError(t, err)
+	_, err = EcDecrypt(classic, encrypted)
+	assert.Error(t, err)
+}
+
+func TestEcEncryptReaderHybrid(t *testing.T) {
+	alice, err := NewHybridPrivateID()
+	assert.NoError(t, err)
+	data := core.GenerateRandomBytes(4096)
+	iv := core.GenerateRandomBytes(16)
+
+	r, err := EcEncryptReader(alice.PublicIDMust(), bytes.NewReader(data), iv)
+	assert.NoError(t, err)
+	encrypted, err := io.ReadAll(r)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(len(data))+EcReaderOverhead(alice.PublicIDMust()), int64(len(encrypted)))
+
+	var out bytes.Buffer
+	w, err := EcDecryptWriter(alice, &out, iv)
+	assert.NoError(t, err)
+	for i := 0; i < len(encrypted); i += 100 {
+		_, err = w.Write(encrypted[i:min(i+100, len(encrypted))])
+		assert.NoError(t, err)
+	}
+	assert.Equal(t, data, out.Bytes())
+}
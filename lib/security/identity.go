@@ -7,6 +7,7 @@ import (
 	"errors"
 	"fmt"
 
+	"github.com/cloudflare/circl/kem/mlkem/mlkem768"
 	eciesgo "github.com/ecies/go/v2"
 	"github.com/stregato/bao/lib/core"
 )
@@ -20,6 +21,8 @@ const (
 	secp256k1PrivateKeySize = 32
 
 	Ed25519 = "ed25519"
+
+	MLKEM768 = "ml-kem-768"
 )
 
 type Key struct {
@@ -33,6 +36,11 @@ type PrivateID string
 const PublicIDLenght = 65
 const PrivateIDLenght = 64
 
+// Hybrid identities append an ML-KEM-768 key to the classic secp256k1 and ed25519 keys.
+// The private part stores the 64 bytes seed, the public part the encapsulation key.
+const HybridPublicIDLenght = PublicIDLenght + mlkem768.PublicKeySize
+const HybridPrivateIDLenght = PrivateIDLenght + mlkem768.KeySeedSize
+
 func (p *PrivateID) Hash() uint64 {
 	return core.SipHash(p.Bytes())
 }
@@ -53,11 +61,49 @@ func NewPrivateID() (PrivateID, error) {
 		return "", err
 	}
 	privateSign := signKey[:ed25519.PrivateKeySize-ed25519.PublicKeySize]
-	id := PrivateID(base64.URLEncoding.EncodeToString(append(privateCrypt.Bytes(), privateSign...)))
+	// the scalar is padded because Bytes drops its leading zeros
+	cryptKey := make([]byte, secp256k1PrivateKeySize)
+	privateCrypt.D.FillBytes(cryptKey)
+	id := PrivateID(base64.URLEncoding.EncodeToString(append(cryptKey, privateSign...)))
 	core.End("")
 	return id, nil
 }
 
+// NewHybridPrivateID generates a private ID that includes an ML-KEM-768 seed next to the classic keys.
+// Data encrypted for the matching public ID is protected by both secp256k1 and ML-KEM.
+func NewHybridPrivateID() (PrivateID, error) {
+	core.Start("generating new hybrid private ID")
+	privateID, err := NewPrivateID()
+	if err != nil {
+		return "", err
+	}
+	privateID, err = privateID.Hybrid()
+	if err != nil {
+		return "", err
+	}
+	core.End("")
+	return privateID, nil
+}
+
+// Hybrid upgrades a classic private ID to a hybrid one by adding a fresh ML-KEM-768 seed.
+// The secp256k1 and ed25519 keys are kept, so data encrypted for the classic ID can still be decrypted.
+// A hybrid private ID is returned unchanged.
+func (privateID PrivateID) Hybrid() (PrivateID, error) {
+	data, err := base64.URLEncoding.DecodeString(privateID.String())
+	if core.IsErr(err, "cannot decode base64: %v") {
+		return "", err
+	}
+	switch len(data) {
+	case HybridPrivateIDLenght:
+		return privateID, nil
+	case PrivateIDLenght:
+		seed := core.GenerateRandomBytes(mlkem768.KeySeedSize)
+		return PrivateID(base64.URLEncoding.EncodeToString(append(data, seed...))), nil
+	default:
+		return "", core.Error(core.ParseError, "invalid private ID with length %d", len(data), ErrInvalidID)
+	}
+}
+
 func NewPrivateIDMust() PrivateID {
 	privateID, err := NewPrivateID()
 	if err != nil {
@@ -86,15 +132,27 @@ func NewKeyPairMust() (PublicID, PrivateID) {
 	return publicID, privateID
 }
 
+func NewHybridKeyPair() (PublicID, PrivateID, error) {
+	privateID, err := NewHybridPrivateID()
+	if err != nil {
+		return "", "", err
+	}
+	publicID, err := privateID.PublicID()
+	if err != nil {
+		return "", "", err
+	}
+	return publicID, privateID, nil
+}
+
 func PrivateIDFromBytes(data []byte) (PrivateID, error) {
-	if len(data) != secp256k1PrivateKeySize+ed25519.PrivateKeySize-ed25519.PublicKeySize {
+	if len(data) != PrivateIDLenght && len(data) != HybridPrivateIDLenght {
 		return "", fmt.Errorf("invalid private ID length")
 	}
 	return PrivateID(base64.URLEncoding.EncodeToString(data)), nil
 }
 
 func PublicIDFromBytes(data []byte) (PublicID, error) {
-	if len(data) != secp256k1PublicKeySize+ed25519.PublicKeySize {
+	if len(data) != PublicIDLenght && len(data) != HybridPublicIDLenght {
 		return "", fmt.Errorf("invalid public ID length")
 	}
 	return PublicID(base64.URLEncoding.EncodeToString(data)), nil
@@ -108,8 +166,19 @@ func (privateID PrivateID) PublicID() (PublicID, error) {
 
 	privateCrypt := eciesgo.NewPrivateKeyFromBytes(cryptKey)
 	publicSign := ed25519.NewKeyFromSeed(privateSign)[ed25519.PrivateKeySize-ed25519.PublicKeySize:]
-	return PublicID(base64.URLEncoding.EncodeToString(
-		append(privateCrypt.PublicKey.Bytes(true), publicSign...))), nil
+	data := append(privateCrypt.PublicKey.Bytes(true), publicSign...)
+
+	kemSeed, err := privateID.KemKey()
+	if err != nil {
+		return "", err
+	}
+	if kemSeed != nil {
+		pk, _ := mlkem768.NewKeyFromSeed(kemSeed)
+		kemKey := make([]byte, mlkem768.PublicKeySize)
+		pk.Pack(kemKey)
+		data = append(data, kemKey...)
+	}
+	return PublicID(base64.URLEncoding.EncodeToString(data)), nil
 }
 
 func (privateID PrivateID) PublicIDMust() PublicID {
@@ -140,11 +209,33 @@ func (publicID PublicID) Decode() (cryptKey []byte, signKey []byte, err error) {
 	if core.IsErr(err, "cannot decode base64: %v") {
 		return nil, nil, err
 	}
-	if len(data) != secp256k1PublicKeySize+ed25519.PublicKeySize {
+	if len(data) != PublicIDLenght && len(data) != HybridPublicIDLenght {
 		core.IsErr(ErrInvalidID, "invalid public ID %s with length %d", publicID, len(data))
 		return nil, nil, ErrInvalidID
 	}
-	return data[:secp256k1PublicKeySize], data[secp256k1PublicKeySize:], nil
+	return data[:secp256k1PublicKeySize], data[secp256k1PublicKeySize:PublicIDLenght], nil
+}
+
+// KemKey returns the ML-KEM-768 encapsulation key of a hybrid public ID, or nil for a classic public ID.
+func (publicID PublicID) KemKey() ([]byte, error) {
+	data, err := base64.URLEncoding.DecodeString(publicID.String())
+	if core.IsErr(err, "cannot decode base64: %v") {
+		return nil, err
+	}
+	switch len(data) {
+	case PublicIDLenght:
+		return nil, nil
+	case HybridPublicIDLenght:
+		return data[PublicIDLenght:], nil
+	default:
+		return nil, ErrInvalidID
+	}
+}
+
+// IsHybrid returns true when the public ID carries an ML-KEM key.
+func (publicID PublicID) IsHybrid() bool {
+	kemKey, err := publicID.KemKey()
+	return err == nil && kemKey != nil
 }
 
 func (privateID PrivateID) Bytes() []byte {
@@ -160,9 +251,31 @@ func (privateID PrivateID) Decode() (cryptKey []byte, signKey []byte, err error)
 	if core.IsErr(err, "cannot decode base64: %v") {
 		return nil, nil, err
 	}
-	if len(data) != secp256k1PrivateKeySize+ed25519.PrivateKeySize-ed25519.PublicKeySize {
+	if len(data) != PrivateIDLenght && len(data) != HybridPrivateIDLenght {
 		core.IsErr(ErrInvalidID, "invalid private ID %s with length %d", privateID, len(data))
 		return nil, nil, ErrInvalidID
 	}
-	return data[:secp256k1PrivateKeySize], data[secp256k1PrivateKeySize:], nil
+	return data[:secp256k1PrivateKeySize], data[secp256k1PrivateKeySize:PrivateIDLenght], nil
+}
+
+// KemKey returns the ML-KEM-768 seed of a hybrid private ID, or nil for a classic private ID.
+func (privateID PrivateID) KemKey() ([]byte, error) {
+	data, err := base64.URLEncoding.DecodeString(privateID.String())
+	if core.IsErr(err, "cannot decode base64: %v") {
+		return nil, err
+	}
+	switch len(data) {
+	case PrivateIDLenght:
+		return nil, nil
+	case HybridPrivateIDLenght:
+		return data[PrivateIDLenght:], nil
+	default:
+		return nil, ErrInvalidID
+	}
+}
+
+// IsHybrid returns true when the private ID carries an ML-KEM seed.
+func (privateID PrivateID) IsHybrid() bool {
+	kemSeed, err := privateID.KemKey()
+	return err == nil && kemSeed != nil
 }
@@ -135,6 +135,20 @@ func (db *DB) queryStatement(header, query string, line int) error {
 	return nil
 }
 
+// Statement returns the SQL of the statement defined with the given key.
+func (db *DB) Statement(key string) (string, bool) {
+	query, ok := db.queries[key]
+	return query, ok
+}
+
+// CopyStatements defines in db the statements defined in src.
+func (db *DB) CopyStatements(src *DB) {
+	for key, query := range src.queries {
+		db.queries[key] = query
+		db.versions[key] = src.versions[key]
+	}
+}
+
 func (db *DB) Keys() []string {
 	var keys []string
 
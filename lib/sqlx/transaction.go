@@ -146,7 +146,7 @@ func (tx *TxX) getStatement(sql string, args Args) (*Stmt, error) {
 		core.Trace("SQL statement found in transaction cache: '%s'", sql)
 		return stmt, nil
 	} else if strings.HasPrefix(sql, "SQL:") {
-		sql = strings.TrimLeft(sql, "SQL:")
+		sql = strings.TrimPrefix(sql, "SQL:")
 	} else {
 		return nil, core.Error(core.GenericError, "statement not found '%s'", sql)
 	}
@@ -49,20 +49,9 @@ func (l *Local) Read(name string, rang *Range, dest io.Writer, progress chan int
 	if rang == nil {
 		_, err = io.Copy(dest, f)
 	} else {
-		left := rang.To - rang.From
-		f.Seek(rang.From, 0)
-		var b [4096]byte
-
-		for left > 0 && err == nil {
-			var sz int64
-			if rang.From-rang.To > 4096 {
-				sz = 4096
-			} else {
-				sz = rang.From - rang.To
-			}
-			_, err = f.Read(b[0:sz])
-			dest.Write(b[0:sz])
-			left -= sz
+		_, err = f.Seek(rang.From, io.SeekStart)
+		if err == nil {
+			_, err = io.CopyN(dest, f, rang.To-rang.From)
 		}
 	}
 	if err != nil {
@@ -162,10 +162,14 @@ func (s *S3) Read(name string, rang *Range, dest io.Writer, progress chan int64)
 	core.Start("name %s, rang %v", name, rang)
 	name = path.Join(s.prefix, name)
 
+	var r *string
+	if rang != nil && rang.To > rang.From {
+		r = aws.String(fmt.Sprintf("bytes=%d-%d", rang.From, rang.To-1)) // HTTP ranges include the last byte
+	}
 	rawObject, err := s.client.GetObject(context.TODO(), &s3.GetObjectInput{
 		Bucket: &s.bucket,
 		Key:    &name,
-		//		Range:  r,
+		Range:  r,
 	})
 	if err != nil {
 		err = s.mapError(err)
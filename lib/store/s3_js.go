@@ -110,7 +110,7 @@ func (s *S3) Read(name string, rang *Range, dest io.Writer, progress chan int64)
 	headers := map[string]string{}
 	if rang != nil {
 		if rang.To > 0 {
-			headers["Range"] = fmt.Sprintf("bytes=%d-%d", rang.From, rang.To)
+			headers["Range"] = fmt.Sprintf("bytes=%d-%d", rang.From, rang.To-1) // HTTP ranges include the last byte
 		} else {
 			headers["Range"] = fmt.Sprintf("bytes=%d-", rang.From)
 		}
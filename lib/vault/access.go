@@ -140,6 +140,9 @@ func (v *Vault) createAddKey(ids []security.PublicID, keyId uint64, key security
 		EncryptedKeys: make(map[security.PublicID][]byte),
 	}
 	// Populate the EncodedKeys map with the new access rights
+	if v.Config.EscrowPublicID != "" && !core.Contains(ids, v.Config.EscrowPublicID) {
+		ids = append(ids, v.Config.EscrowPublicID) // The escrow identity always gets a copy of the key
+	}
 	for _, id := range ids {
 		ekey, err := security.EcEncrypt(id, key)
 		if err != nil {
@@ -394,7 +394,7 @@ func (v *Vault) exportBlocksToStorage(hash []byte) (retry bool, err error) {
 		core.Info("data mismatch on %s, retrying read %d", blockPath, i+1)
 		time.Sleep(100 * time.Millisecond)
 	}
-	v.notifyChange(blockPath)
+	v.notifyChange(blockPath, nil)
 	if err := v.touchChangeFile(v.blockChainRoot()); err != nil {
 		core.Info("cannot update blockchain guard file for %s: %v", blockPath, err)
 	}
@@ -475,6 +475,7 @@ func (v *Vault) syncBlockChain(force bool) error {
 	if err := v.markChangedAsSeen(baseDir); err != nil {
 		core.Info("cannot mark blockchain guard file as seen for %s: %v", baseDir, err)
 	}
+	v.publishRelayMembers()
 
 	core.End("done in %v", core.Now().Sub(now))
 	return nil
@@ -0,0 +1,99 @@
+package vault
+
+import (
+	"io"
+	"math/bits"
+)
+
+// The chunker splits a stream into content-defined chunks with FastCDC. A gear hash rolls over the input and a chunk
+// ends where the hash matches a mask, so an edit changes only the chunks around it and the others keep their
+// content and address. Normalized chunking uses a stricter mask before the average size and a looser one after it,
+// which keeps most chunks close to the average.
+const (
+	minChunkSize = 256 // Smallest average chunk size accepted in the config
+	gearSeed     = 0x62616f2d63646321
+)
+
+var gear = func() (table [256]uint64) {
+	// splitmix64, so that every instance cuts the same content at the same points
+	x := uint64(gearSeed)
+	for i := range table {
+		x += 0x9e3779b97f4a7c15
+		z := x
+		z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+		z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+		table[i] = z ^ (z >> 31)
+	}
+	return table
+}()
+
+type chunker struct {
+	r            io.Reader
+	buf          []byte // Data read and not returned yet
+	eof          bool
+	min, avg     int
+	max          int
+	maskS, maskL uint64
+}
+
+// newChunker returns a chunker that cuts r in chunks of avg bytes on average, between avg/4 and avg*8.
+func newChunker(r io.Reader, avg int) *chunker {
+	n := bits.Len(uint(avg)) - 1 // log2 of the average size
+	return &chunker{
+		r:     r,
+		min:   avg / 4,
+		avg:   avg,
+		max:   avg * 8,
+		maskS: ^uint64(0) << (64 - (n + 2)),
+		maskL: ^uint64(0) << (64 - (n - 2)),
+	}
+}
+
+// next returns the next chunk, or io.EOF after the last one. Later calls never modify the chunks returned before.
+func (c *chunker) next() ([]byte, error) {
+	if !c.eof && len(c.buf) < c.max {
+		data := make([]byte, c.max)
+		n := copy(data, c.buf)
+		m, err := io.ReadFull(c.r, data[n:])
+		switch err {
+		case nil:
+		case io.EOF, io.ErrUnexpectedEOF:
+			c.eof = true
+		default:
+			return nil, err
+		}
+		c.buf = data[:n+m]
+	}
+	if len(c.buf) == 0 {
+		return nil, io.EOF
+	}
+	cut := c.cutPoint(c.buf)
+	chunk := c.buf[:cut:cut] // appends to the chunk must not overwrite the next one
+	c.buf = c.buf[cut:]
+	return chunk, nil
+}
+
+func (c *chunker) cutPoint(data []byte) int {
+	n := len(data)
+	if n <= c.min {
+		return n
+	}
+	n = min(n, c.max)
+	normal := min(c.avg, n)
+
+	var h uint64
+	i := c.min
+	for ; i < normal; i++ {
+		h = (h << 1) + gear[data[i]]
+		if h&c.maskS == 0 {
+			return i + 1
+		}
+	}
+	for ; i < n; i++ {
+		h = (h << 1) + gear[data[i]]
+		if h&c.maskL == 0 {
+			return i + 1
+		}
+	}
+	return n
+}
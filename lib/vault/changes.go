@@ -14,11 +14,15 @@ import (
 type ChangeType uint8
 
 const (
-	config       ChangeType = iota // Changing settings for the vault
-	activeKeySet                   // Active key set for a specific group
-	changeAccess                   // Change access for all users in the group
-	addKey                         // Add a new key for a specific group
-	addAttribute                   // Add a new attribute to the vault
+	config             ChangeType = iota // Changing settings for the vault
+	activeKeySet                         // Active key set for a specific group
+	changeAccess                         // Change access for all users in the group
+	addKey                               // Add a new key for a specific group
+	addAttribute                         // Add a new attribute to the vault
+	setQuota                             // Set a storage quota for a user or a role
+	setHold                              // Set a legal-hold/WORM rule on a path prefix
+	setRetentionPolicy                   // Set a retention or version-count policy on a path prefix
+	setReplicaGrant                      // Grant or revoke the write of a replica table or statement
 )
 
 var changeTypeLabels = []string{
@@ -27,6 +31,10 @@ var changeTypeLabels = []string{
 	"changeAccess",
 	"addKey",
 	"addAttribute",
+	"setQuota",
+	"setHold",
+	"setRetentionPolicy",
+	"setReplicaGrant",
 }
 
 type Change interface {
@@ -61,7 +69,7 @@ func (c Config) Apply(v *Vault, author security.PublicID) error {
 }
 
 func (c Config) String() string {
-	return fmt.Sprintf("Config: retention=%v, maxStorage=%d, segmentInterval=%v, syncCooldown=%v, waitTimeout=%v, filesSyncPeriod=%v, cleanupPeriod=%v, blockChainSyncPeriod=%v, blockSyncOverlap=%v, bodyReadyCheckThreshold=%d, ioThrottle=%d",
+	return fmt.Sprintf("Config: retention=%v, maxStorage=%d, segmentInterval=%v, syncCooldown=%v, waitTimeout=%v, filesSyncPeriod=%v, cleanupPeriod=%v, blockChainSyncPeriod=%v, blockSyncOverlap=%v, bodyReadyCheckThreshold=%d, ioThrottle=%d, escrow=%t, relayHeadLimit=%d, segmentLookback=%v, chunkSize=%d",
 		c.Retention,
 		c.MaxStorage,
 		c.SegmentInterval,
@@ -72,7 +80,11 @@ func (c Config) String() string {
 		c.BlockChainSyncPeriod,
 		c.BlockSyncOverlap,
 		c.BodyReadyCheckThreshold,
-		c.IoThrottle)
+		c.IoThrottle,
+		c.EscrowPublicID != "",
+		c.RelayHeadLimit,
+		c.SegmentLookback,
+		c.ChunkSize)
 }
 
 // AddKey represents a new key to be added to a specific group.
@@ -148,6 +160,22 @@ func unmarshalChange(blockChange BlockChange) (Change, error) {
 		var c Config
 		err = msgpack.Unmarshal(blockChange.Payload, &c)
 		change = &c
+	case setQuota:
+		var q Quota
+		err = msgpack.Unmarshal(blockChange.Payload, &q)
+		change = &q
+	case setHold:
+		var h Hold
+		err = msgpack.Unmarshal(blockChange.Payload, &h)
+		change = &h
+	case setRetentionPolicy:
+		var rp RetentionPolicy
+		err = msgpack.Unmarshal(blockChange.Payload, &rp)
+		change = &rp
+	case setReplicaGrant:
+		var rg ReplicaGrant
+		err = msgpack.Unmarshal(blockChange.Payload, &rg)
+		change = &rg
 	default:
 		return nil, core.Error(core.GenericError, "unknown change type: %d", blockChange.Type)
 	}
@@ -177,6 +205,14 @@ func marshalChange(change Change) (BlockChange, error) {
 		return BlockChange{addAttribute, payload}, nil
 	case *Config:
 		return BlockChange{config, payload}, nil
+	case *Quota:
+		return BlockChange{setQuota, payload}, nil
+	case *Hold:
+		return BlockChange{setHold, payload}, nil
+	case *RetentionPolicy:
+		return BlockChange{setRetentionPolicy, payload}, nil
+	case *ReplicaGrant:
+		return BlockChange{setReplicaGrant, payload}, nil
 	default:
 		return BlockChange{}, core.Error(core.GenericError, "unknown change type: %T", change)
 	}
@@ -234,6 +270,12 @@ func (a *AddKey) Apply(v *Vault, author security.PublicID) error {
 
 	var foundKeyForMe bool
 	for publicId, encodedKey := range a.EncryptedKeys {
+		if v.Config.EscrowPublicID != "" && publicId == v.Config.EscrowPublicID {
+			err = v.setEscrowKey(a.KeyId, encodedKey)
+			if err != nil {
+				return core.Error(core.GenericError, "cannot store escrow key %d in vault %s", a.KeyId, v.ID, err)
+			}
+		}
 		if publicId == v.UserID {
 			err = v.addKey(a.KeyId, encodedKey)
 			if err != nil {
@@ -0,0 +1,281 @@
+package vault
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"io"
+	"os"
+	"path"
+	"sync"
+	"time"
+
+	"github.com/stregato/bao/lib/core"
+	"github.com/stregato/bao/lib/security"
+	"github.com/stregato/bao/lib/sqlx"
+	"github.com/stregato/bao/lib/store"
+	"golang.org/x/crypto/blake2b"
+)
+
+// Chunked bodies are split with content-defined chunking (see cdc.go). Each chunk is encrypted with the key of the
+// file and stored once in the chunks folder, named by a hash of its content keyed with the same key, so versions of
+// a file that share content share the chunks and a writer uploads only the chunks that are missing. The head
+// carries the list of chunks. Retention removes the chunks that no live file references, but only after
+// chunkGracePeriod from their last use and from their last write in the store, which gives other instances time to
+// import the heads that reuse them. A writer rewrites the chunks it reuses once they are older than chunkRefreshAge,
+// so the store time of a chunk tells any instance that a recent head may need it.
+const (
+	chunksFolder     = "chunks"
+	chunkHashSize    = 32
+	chunkGracePeriod = 24 * time.Hour
+	chunkRefreshAge  = chunkGracePeriod / 2
+	chunkParallelism = 8 // Chunks uploaded in parallel
+)
+
+// Chunk is a piece of a chunked body.
+type Chunk struct {
+	Hash string `json:"hash"` // Keyed hash of the content in hex, which is also the name of the chunk in the store
+	Size int64  `json:"size"` // Size of the content
+}
+
+func appendChunks(buf []byte, chunks []Chunk) []byte {
+	buf = binary.LittleEndian.AppendUint32(buf, uint32(len(chunks)))
+	for _, c := range chunks {
+		hash, _ := hex.DecodeString(c.Hash)
+		buf = append(buf, hash...)
+		buf = binary.LittleEndian.AppendUint32(buf, uint32(c.Size))
+	}
+	return buf
+}
+
+func parseChunks(data []byte) ([]Chunk, error) {
+	if len(data) < 4 {
+		return nil, core.Error(core.ParseError, "invalid chunk list length: %d", len(data))
+	}
+	count := int(binary.LittleEndian.Uint32(data[:4]))
+	data = data[4:]
+	if len(data) < count*(chunkHashSize+4) {
+		return nil, core.Error(core.ParseError, "invalid chunk list length: %d for %d chunks", len(data), count)
+	}
+	chunks := make([]Chunk, count)
+	for i := range chunks {
+		chunks[i].Hash = hex.EncodeToString(data[:chunkHashSize])
+		chunks[i].Size = int64(binary.LittleEndian.Uint32(data[chunkHashSize:]))
+		data = data[chunkHashSize+4:]
+	}
+	return chunks, nil
+}
+
+// chunkHash returns the address of a chunk, keyed with a key derived from the key of the file, so that the store
+// cannot tell which content a chunk holds.
+func chunkHash(key security.AESKey, data []byte) string {
+	hashKey := blake2b.Sum256(append([]byte("bao-chunk:"), key...))
+	h, _ := blake2b.New256(hashKey[:])
+	h.Write(data)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// useChunks returns true when the body of the file is written in chunks.
+func (v *Vault) useChunks(file File, encMethod string) bool {
+	return v.Config.ChunkSize > 0 && encMethod == "aes" && file.LocalCopy != "" && file.Size > v.Config.ChunkSize
+}
+
+// writeChunks splits the local copy of the file in chunks and uploads the chunks missing in the store or older
+// than chunkRefreshAge.
+func (v *Vault) writeChunks(file File) ([]Chunk, error) {
+	core.Start("file %s", file.Name)
+	key, err := v.getKey(file.KeyId)
+	if err != nil || key == nil {
+		return nil, core.Error(core.DbError, "cannot get key for key id %d in writeChunks", file.KeyId, err)
+	}
+	f, err := openLocalSourceReader(file.LocalCopy)
+	if err != nil {
+		return nil, core.Error(core.FileError, "cannot open local file %s in Bao.Write, name %v", file.LocalCopy, file.Name, err)
+	}
+	defer f.Close()
+
+	var chunks []Chunk
+	var uploaded int
+	var errX error // errX is the first error, which stops the loop
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	fail := func(err error) {
+		mu.Lock()
+		defer mu.Unlock()
+		if errX == nil {
+			errX = err
+		}
+	}
+	failed := func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return errX != nil
+	}
+	sem := make(chan struct{}, chunkParallelism)
+	seen := map[string]bool{}
+	c := newChunker(f, int(v.Config.ChunkSize))
+	for !failed() {
+		data, err := c.next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			fail(core.Error(core.FileError, "cannot read local file %s", file.LocalCopy, err))
+			break
+		}
+		hash := chunkHash(key, data)
+		chunks = append(chunks, Chunk{Hash: hash, Size: int64(len(data))})
+		if seen[hash] {
+			continue
+		}
+		seen[hash] = true
+
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(hash string, data []byte) {
+			defer func() { <-sem; wg.Done() }()
+			name := path.Join(v.chunksRoot(), hash)
+			if info, err := v.store.Stat(name); err == nil && core.Since(info.ModTime()) < chunkRefreshAge {
+				return // already in the store, e.g. from a previous version
+			}
+			encrypted, err := security.EncryptAES(data, key)
+			if err == nil {
+				err = store.WriteFile(v.store, name, encrypted)
+			}
+			if err != nil {
+				fail(core.Error(core.FileError, "cannot write chunk %s of file %s", hash, file.Name, err))
+				return
+			}
+			mu.Lock()
+			uploaded++
+			mu.Unlock()
+		}(hash, data)
+	}
+	wg.Wait() // the uploads use the file and the key, so they end before writeChunks returns
+	if errX != nil {
+		return nil, errX
+	}
+
+	core.End("%d chunks, %d uploaded", len(chunks), uploaded)
+	return chunks, nil
+}
+
+// readChunks reads and decrypts the chunks of the file into w.
+func (v *Vault) readChunks(file File, w io.Writer, progress chan int64) error {
+	chunks := file.Chunks
+	if chunks == nil {
+		var err error
+		chunks, err = v.getFileChunks(file.StoreDir, file.StoreName)
+		if err != nil {
+			return err
+		}
+	}
+	key, err := v.getKey(file.KeyId)
+	if err != nil || key == nil {
+		return core.Error(core.AccessDenied, "no key found for id %d", file.KeyId, err)
+	}
+
+	for _, c := range chunks {
+		name := path.Join(v.chunksRoot(), c.Hash)
+		encrypted, err := store.ReadFile(v.store, name)
+		if err != nil {
+			return core.Error(core.FileError, "cannot read chunk %s of file %s", c.Hash, file.Name, err)
+		}
+		data, err := security.DecryptAES(encrypted, key)
+		if err != nil {
+			return core.Error(core.EncodeError, "cannot decrypt chunk %s of file %s", c.Hash, file.Name, err)
+		}
+		if int64(len(data)) != c.Size || chunkHash(key, data) != c.Hash {
+			return core.Error(core.FileError, "chunk %s of file %s is corrupted", c.Hash, file.Name)
+		}
+		_, err = io.Copy(w, bytes.NewReader(data))
+		if err != nil {
+			return core.Error(core.FileError, "cannot write chunk %s of file %s", c.Hash, file.Name, err)
+		}
+		if progress != nil {
+			progress <- c.Size
+		}
+	}
+	return nil
+}
+
+// setFileChunks records the chunks of a file, so that retention keeps them while the file is live.
+func (v *Vault) setFileChunks(storeDir, storeName string, chunks []Chunk) error {
+	now := core.Now().Unix()
+	for i, c := range chunks {
+		_, err := v.DB.Exec("SET_FILE_CHUNK", sqlx.Args{"vault": v.ID, "storeDir": storeDir, "storeName": storeName,
+			"idx": i, "hash": c.Hash, "size": c.Size})
+		if err != nil {
+			return core.Error(core.DbError, "cannot set chunk %d of %s/%s", i, storeDir, storeName, err)
+		}
+		_, err = v.DB.Exec("SET_CHUNK", sqlx.Args{"vault": v.ID, "hash": c.Hash, "lastRef": now})
+		if err != nil {
+			return core.Error(core.DbError, "cannot set chunk %s", c.Hash, err)
+		}
+	}
+	return nil
+}
+
+func (v *Vault) getFileChunks(storeDir, storeName string) ([]Chunk, error) {
+	rows, err := v.DB.Query("GET_FILE_CHUNKS", sqlx.Args{"vault": v.ID, "storeDir": storeDir, "storeName": storeName})
+	if err != nil {
+		return nil, core.Error(core.DbError, "cannot get chunks of %s/%s", storeDir, storeName, err)
+	}
+	defer rows.Close()
+	var chunks []Chunk
+	for rows.Next() {
+		var c Chunk
+		if err := rows.Scan(&c.Hash, &c.Size); err != nil {
+			return nil, core.Error(core.DbError, "cannot scan chunk of %s/%s", storeDir, storeName, err)
+		}
+		chunks = append(chunks, c)
+	}
+	return chunks, nil
+}
+
+// collectChunks deletes the chunks that no live file references and were neither used nor written in the store in
+// the grace period before now. A chunk written recently may be reused by a head this instance has not imported yet.
+func (v *Vault) collectChunks(now time.Time) (int64, error) {
+	before := now.Add(-chunkGracePeriod)
+	rows, err := v.DB.Query("GET_UNREFERENCED_CHUNKS", sqlx.Args{
+		"vault":  v.ID,
+		"before": before.Unix(),
+		"limit":  5000,
+	})
+	if err != nil {
+		return 0, core.Error(core.DbError, "cannot query unreferenced chunks", err)
+	}
+	var hashes []string
+	for rows.Next() {
+		var hash string
+		if err := rows.Scan(&hash); err != nil {
+			rows.Close()
+			return 0, core.Error(core.DbError, "cannot scan unreferenced chunk", err)
+		}
+		hashes = append(hashes, hash)
+	}
+	rows.Close()
+
+	var collected int64
+	for _, hash := range hashes {
+		info, err := v.store.Stat(path.Join(v.chunksRoot(), hash))
+		if err == nil && info.ModTime().After(before) {
+			// refreshed by another instance: wait for the grace period from the last write
+			_, err = v.DB.Exec("SET_CHUNK", sqlx.Args{"vault": v.ID, "hash": hash, "lastRef": info.ModTime().Unix()})
+			if err != nil {
+				return collected, core.Error(core.DbError, "cannot set chunk %s", hash, err)
+			}
+			continue
+		}
+		err = v.store.Delete(path.Join(v.chunksRoot(), hash))
+		if err != nil && !os.IsNotExist(err) {
+			return collected, core.Error(core.FileError, "cannot delete chunk %s", hash, err)
+		}
+		_, err = v.DB.Exec("DELETE_CHUNK", sqlx.Args{"vault": v.ID, "hash": hash})
+		if err != nil {
+			return collected, core.Error(core.DbError, "cannot delete chunk %s", hash, err)
+		}
+		collected++
+	}
+	return collected, nil
+}
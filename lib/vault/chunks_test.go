@@ -0,0 +1,95 @@
+package vault
+
+import (
+	"bytes"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stregato/bao/lib/core"
+	"github.com/stregato/bao/lib/security"
+	"github.com/stregato/bao/lib/sqlx"
+	"github.com/stregato/bao/lib/store"
+)
+
+func TestChunkedWrite(t *testing.T) {
+	alice, aliceSecret := security.NewKeyPairMust()
+	bob, bobSecret := security.NewKeyPairMust()
+
+	db1 := sqlx.NewTestDB(t, "vault_alice.db", "")
+	st := store.LoadTestStore(t, "test")
+	defer st.Close()
+
+	va, err := Create(aliceSecret, st, db1, Config{ChunkSize: 1024})
+	core.TestErr(t, err, "Create failed: %v")
+	defer va.Close()
+	err = va.SyncAccess(IOOption{}, AccessChange{UserId: bob, Access: Read})
+	core.TestErr(t, err, "SyncAccess failed: %v")
+
+	countChunks := func() int {
+		ls, _ := st.ReadDir(chunksFolder, store.Filter{})
+		return len(ls)
+	}
+
+	content := make([]byte, 64*1024)
+	rand.New(rand.NewSource(1)).Read(content)
+	source := filepath.Join(t.TempDir(), "data.bin")
+	err = os.WriteFile(source, content, 0644)
+	core.TestErr(t, err, "cannot write source: %v")
+	v1, err := va.Write("data.bin", source, nil, IOOption{})
+	core.TestErr(t, err, "Write failed: %v")
+	first := countChunks()
+	core.Assert(t, first > 8, "expected the body in many chunks, got %d", first)
+
+	// an edit in the middle uploads only the chunks around it
+	time.Sleep(1100 * time.Millisecond)
+	content = append(content[:30000:30000], append([]byte("a small edit"), content[30000:]...)...)
+	err = os.WriteFile(source, content, 0644)
+	core.TestErr(t, err, "cannot write source: %v")
+	v2, err := va.Write("data.bin", source, nil, IOOption{})
+	core.TestErr(t, err, "Write failed: %v")
+	added := countChunks() - first
+	core.Assert(t, added > 0 && added <= first/8, "expected only the chunks around the edit, got %d new of %d", added, first)
+
+	db2 := sqlx.NewTestDB(t, "vault_bob.db", "")
+	vb, err := Open(bobSecret, alice, st, db2)
+	core.TestErr(t, err, "Open failed: %v")
+	defer vb.Close()
+	_, err = vb.Sync()
+	core.TestErr(t, err, "Sync failed: %v")
+	dest := filepath.Join(t.TempDir(), "read.bin")
+	file, err := vb.Read("data.bin:1", dest, IOOption{}, nil)
+	core.TestErr(t, err, "Read failed: %v")
+	core.Assert(t, file.Flags&Chunked != 0, "file should be chunked")
+	data, err := os.ReadFile(dest)
+	core.TestErr(t, err, "cannot read local copy: %v")
+	core.Assert(t, bytes.Equal(data, content), "content mismatch")
+
+	// chunks are collected only when no live file uses them
+	err = va.deleteStoreObject(v1.StoreDir, v1.StoreName)
+	core.TestErr(t, err, "deleteStoreObject failed: %v")
+	_, err = va.collectChunks(core.Now().Add(2 * chunkGracePeriod))
+	core.TestErr(t, err, "collectChunks failed: %v")
+	left := countChunks()
+	core.Assert(t, left < first+added && left >= first, "only the chunks of the first version should be collected, %d left", left)
+
+	err = va.deleteStoreObject(v2.StoreDir, v2.StoreName)
+	core.TestErr(t, err, "deleteStoreObject failed: %v")
+	_, err = va.collectChunks(core.Now().Add(2 * chunkGracePeriod))
+	core.TestErr(t, err, "collectChunks failed: %v")
+	core.Assert(t, countChunks() == 0, "all chunks should be collected, %d left", countChunks())
+
+	// chunks recently written in the store are kept, even when this instance last used them long ago
+	core.ClockOffset -= 2 * chunkGracePeriod
+	v3, err := va.Write("data.bin", source, nil, IOOption{})
+	core.ClockOffset += 2 * chunkGracePeriod
+	core.TestErr(t, err, "Write failed: %v")
+	written := countChunks()
+	err = va.deleteStoreObject(v3.StoreDir, v3.StoreName)
+	core.TestErr(t, err, "deleteStoreObject failed: %v")
+	_, err = va.collectChunks(core.Now())
+	core.TestErr(t, err, "collectChunks failed: %v")
+	core.Assert(t, countChunks() == written, "chunks written in the grace period should be kept, %d of %d left", countChunks(), written)
+}
@@ -9,6 +9,9 @@ func (v *Vault) Close() error {
 	if v.housekeepingTicker != nil {
 		v.housekeepingTicker.Stop()
 	}
+	if err := v.flushManifests(); err != nil {
+		core.LogError("cannot flush manifests of vault %s: %v", v.ID, err)
+	}
 	v.stopSyncRelay()
 
 	openedStashesMu.Lock()
@@ -28,8 +28,16 @@ func Create(userSecret security.PrivateID, store store.Store, db *sqlx.DB, confi
 		return nil, core.Error(core.DbError, "Cannot define SQLite db in %s: %v", db.DbPath, err, err)
 	}
 
-	if config.SyncRelay != "" && !strings.HasPrefix(config.SyncRelay, "ws") {
-		return nil, core.Error(core.ConfigError, "Invalid watch service URL %s, must start with ws:// or wss://", config.SyncRelay)
+	if config.SyncRelay != "" && !strings.HasPrefix(config.SyncRelay, "ws") && !strings.HasPrefix(config.SyncRelay, "http") {
+		return nil, core.Error(core.ConfigError, "Invalid watch service URL %s, must start with ws://, wss://, http:// or https://", config.SyncRelay)
+	}
+	if config.ChunkSize != 0 && config.ChunkSize < minChunkSize {
+		return nil, core.Error(core.ConfigError, "Invalid chunk size %d, must be at least %d", config.ChunkSize, minChunkSize)
+	}
+	if config.EscrowPublicID != "" {
+		if _, _, err := config.EscrowPublicID.Decode(); err != nil {
+			return nil, core.Error(core.ConfigError, "Invalid escrow public ID %s", config.EscrowPublicID, err)
+		}
 	}
 
 	userID, err := userSecret.PublicID()
@@ -45,6 +53,10 @@ func Create(userSecret security.PrivateID, store store.Store, db *sqlx.DB, confi
 	if err != nil {
 		return nil, core.Error(core.GenericError, "cannot wipe blockchain in store %s", store.ID(), err)
 	}
+	err = Wipe(store, chunksFolder)
+	if err != nil {
+		return nil, core.Error(core.GenericError, "cannot wipe chunks in store %s", store.ID(), err)
+	}
 	userIDHash := core.Int64Hash(userID.Bytes())
 	ioThrottle := core.DefaultIfZero(config.IoThrottle, 10) // Default to 10 concurrent I/O operations
 
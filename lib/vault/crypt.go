@@ -40,6 +40,15 @@ func encodeFile(file File, authorPrivateID security.PrivateID) ([]byte, error) {
 	nameBytes := []byte(file.Name)
 	buf = append(buf, nameBytes...)
 	buf = append(buf, file.Attrs...)
+	if file.Flags&Packed != 0 {
+		if file.Pack == nil {
+			return nil, core.Error(core.EncodeError, "missing pack reference for packed file %s", file.Name)
+		}
+		buf = appendPackRef(buf, *file.Pack)
+	}
+	if file.Flags&Chunked != 0 {
+		buf = appendChunks(buf, file.Chunks)
+	}
 
 	sign, err := security.Sign(authorPrivateID, buf)
 	if err != nil {
@@ -88,6 +97,19 @@ func decodeFile(data []byte, myShortID uint64, getUserId func(shortID uint64) (u
 		file.Attrs = make([]byte, attrsLen)
 		copy(file.Attrs, data[34+nameLen:34+nameLen+attrsLen])
 	}
+	if file.Flags&Packed != 0 {
+		ref, err := parsePackRef(data[34+nameLen+attrsLen:])
+		if err != nil {
+			return File{}, false, err
+		}
+		file.Pack = &ref
+	}
+	if file.Flags&Chunked != 0 {
+		file.Chunks, err = parseChunks(data[34+nameLen+attrsLen:])
+		if err != nil {
+			return File{}, false, err
+		}
+	}
 
 	userID, err := getUserId(shortID)
 	if err != nil {
@@ -113,6 +135,9 @@ func encodeHead(encMethod string, file File, ecRecipient security.PublicID, auth
 	core.Start("file name %s, keyId %d", file.Name, file.KeyId)
 
 	data, err := encodeFile(file, authorPrivateID)
+	if err != nil {
+		return nil, err
+	}
 
 	var method byte
 	var ref uint64
@@ -245,7 +270,9 @@ func decodeHead(data []byte, userPrivateID security.PrivateID,
 	return file, false, false, nil
 }
 
-func encryptReader(encMethod string, file File, ecRecipient security.PublicID, r io.ReadSeeker,
+// encryptReader returns a reader that encrypts the file body. For ec files, ecKey is used as stream key when set,
+// so that the same key can be wrapped for the escrow identity.
+func encryptReader(encMethod string, file File, ecRecipient security.PublicID, ecKey []byte, r io.ReadSeeker,
 	getKey func(keyId uint64) (key security.AESKey, err error)) (io.ReadSeeker, error) {
 	core.Start("file name %s, keyId %d", file.Name, file.KeyId)
 
@@ -262,7 +289,11 @@ func encryptReader(encMethod string, file File, ecRecipient security.PublicID, r
 		if userID == "" {
 			return nil, core.Error(core.ParseError, "missing ec recipient for file %s", file.Name)
 		}
-		r, err = security.EcEncryptReader(userID, r, iv)
+		if ecKey != nil {
+			r, err = security.EcEncryptReaderWithKey(userID, ecKey, r, iv)
+		} else {
+			r, err = security.EcEncryptReader(userID, r, iv)
+		}
 		if err != nil {
 			return nil, core.Error(core.FileError, "cannot encrypt reader for file %s", file.Name, err)
 		}
@@ -40,6 +40,9 @@ SELECT name, hash, payload FROM blocks WHERE vault=:vault ORDER BY showId ASC
 -- GET_LAST_HASH 1.0
 SELECT hash FROM blocks WHERE vault=:vault ORDER BY showId DESC LIMIT 1
 
+-- COUNT_BLOCKS 1.0
+SELECT COUNT(*) FROM blocks WHERE vault=:vault
+
 -- GET_BLOCK_NAMES_AND_SHOW_IDS 1.0
 SELECT name, showId FROM blocks WHERE vault=:vault ORDER BY showId ASC
 
@@ -337,3 +340,311 @@ SELECT COALESCE(MAX(id), 0) FROM transaction_metadata WHERE vault=:vault;
 
 -- DELETE_TRANSACTION_METADATA 1.0
 DELETE FROM transaction_metadata WHERE vault=:vault AND tm < :tm;
+
+-- INIT 1.8
+CREATE TABLE IF NOT EXISTS escrow_keys (
+    vault VARCHAR(1024) NOT NULL,
+    id INTEGER NOT NULL,
+    encryptedKey BLOB NOT NULL,
+    PRIMARY KEY(vault, id)
+);
+
+-- SET_ESCROW_KEY 1.8
+INSERT OR REPLACE INTO escrow_keys (vault, id, encryptedKey) VALUES (:vault, :id, :encryptedKey)
+
+-- GET_ESCROW_KEYS 1.8
+SELECT id, encryptedKey FROM escrow_keys WHERE vault=:vault ORDER BY id ASC
+
+-- INIT 1.9
+CREATE TABLE IF NOT EXISTS quotas (
+    vault VARCHAR(1024) NOT NULL,
+    userId VARCHAR(100) NOT NULL,
+    access INTEGER NOT NULL,
+    maxStorage INTEGER NOT NULL,
+    PRIMARY KEY(vault, userId, access)
+);
+
+-- SET_QUOTA 1.9
+INSERT INTO quotas (vault, userId, access, maxStorage) VALUES (:vault, :userId, :access, :maxStorage)
+ON CONFLICT(vault, userId, access) DO UPDATE SET maxStorage = excluded.maxStorage;
+
+-- DELETE_QUOTA 1.9
+DELETE FROM quotas WHERE vault = :vault AND userId = :userId AND access = :access;
+
+-- GET_QUOTAS 1.9
+SELECT userId, access, maxStorage FROM quotas WHERE vault = :vault ORDER BY userId, access;
+
+-- GET_USER_QUOTA 1.9
+SELECT maxStorage FROM quotas WHERE vault = :vault AND userId = :userId AND userId <> '';
+
+-- GET_ACCESS_QUOTA 1.9
+SELECT maxStorage FROM quotas WHERE vault = :vault AND userId = '' AND access = :access;
+
+-- GET_AUTHOR_USAGE 1.9
+SELECT COALESCE(SUM(allocatedSize), 0) FROM files WHERE vault = :vault AND authorId = :authorId AND modTime > 0 AND (flags & 4) = 0;
+
+-- GET_USAGE 1.9
+SELECT authorId, dir, COUNT(*), COALESCE(SUM(allocatedSize), 0) FROM files
+WHERE vault = :vault AND modTime > 0 AND (flags & 4) = 0
+GROUP BY authorId, dir;
+
+-- INIT 2.0
+CREATE TABLE IF NOT EXISTS holds (
+    vault VARCHAR(1024) NOT NULL,
+    prefix VARCHAR(4096) NOT NULL,
+    until INTEGER NOT NULL,
+    PRIMARY KEY(vault, prefix)
+);
+
+-- INIT 2.6
+ALTER TABLE holds ADD COLUMN since INTEGER NOT NULL DEFAULT 0;
+
+-- SET_HOLD 2.0
+INSERT INTO holds (vault, prefix, since, until) VALUES (:vault, :prefix, :since, :until)
+ON CONFLICT(vault, prefix) DO UPDATE SET
+  since = CASE WHEN until * 1000 >= excluded.since THEN MIN(since, excluded.since) ELSE excluded.since END,
+  until = MAX(until, excluded.until);
+
+-- GET_HOLDS 2.0
+SELECT prefix, since, until FROM holds WHERE vault = :vault AND until > :now ORDER BY prefix;
+
+-- GET_HOLD_FOR_NAME 2.0
+SELECT COALESCE(MAX(until), 0) FROM holds
+WHERE vault = :vault AND until > :now AND since <= :at
+  AND (prefix = '' OR :name = prefix OR substr(:name, 1, length(prefix) + 1) = prefix || '/');
+
+-- COUNT_HELD_FILES_IN_STORE_DIR 2.0
+SELECT COUNT(*) FROM files f
+WHERE f.vault = :vault AND f.storeDir = :storeDir AND f.modTime > 0
+  AND EXISTS (SELECT 1 FROM file_rules r WHERE r.id = f.id AND r.kind = 'hold' AND r.until > :now);
+
+-- GET_EXPIRED_FILE_EXPIRATIONS 2.0
+SELECT e.storeDir, e.storeName
+FROM file_expirations e
+WHERE e.vault = :vault AND e.expiresAt > 0 AND e.expiresAt <= :expiresAt
+  AND NOT EXISTS (
+    SELECT 1 FROM files f JOIN file_rules r ON r.id = f.id
+    WHERE f.vault = e.vault AND f.storeDir = e.storeDir AND f.storeName = e.storeName
+      AND r.kind = 'hold' AND r.until > :expiresAt
+  )
+ORDER BY e.expiresAt ASC
+LIMIT :limit;
+
+-- INIT 2.1
+CREATE TABLE IF NOT EXISTS retention_policies (
+    vault VARCHAR(1024) NOT NULL,
+    prefix VARCHAR(4096) NOT NULL,
+    retention INTEGER NOT NULL,
+    maxVersions INTEGER NOT NULL,
+    PRIMARY KEY(vault, prefix)
+);
+
+-- SET_RETENTION_POLICY 2.1
+INSERT INTO retention_policies (vault, prefix, retention, maxVersions) VALUES (:vault, :prefix, :retention, :maxVersions)
+ON CONFLICT(vault, prefix) DO UPDATE SET retention = excluded.retention, maxVersions = excluded.maxVersions;
+
+-- DELETE_RETENTION_POLICY 2.1
+DELETE FROM retention_policies WHERE vault = :vault AND prefix = :prefix;
+
+-- GET_RETENTION_POLICIES 2.1
+SELECT prefix, retention, maxVersions FROM retention_policies WHERE vault = :vault ORDER BY prefix;
+
+-- GET_RETENTION_POLICY_FOR_NAME 2.1
+SELECT retention, maxVersions FROM retention_policies
+WHERE vault = :vault AND (prefix = '' OR :name = prefix OR substr(:name, 1, length(prefix) + 1) = prefix || '/')
+ORDER BY length(prefix) DESC LIMIT 1;
+
+-- INIT 2.7
+CREATE VIEW IF NOT EXISTS file_paths AS
+SELECT *, CASE WHEN dir = '.' THEN name ELSE dir || '/' || name END AS path FROM files;
+
+CREATE VIEW IF NOT EXISTS file_rules AS
+SELECT f.id, r.kind, r.prefix, r.until, r.retention, r.maxVersions
+FROM file_paths f JOIN (
+  SELECT vault, prefix, 'hold' AS kind, until, NULL AS retention, NULL AS maxVersions FROM holds
+  UNION ALL
+  SELECT vault, prefix, 'policy' AS kind, NULL AS until, retention, maxVersions FROM retention_policies
+) AS r ON r.vault = f.vault
+WHERE r.prefix = '' OR f.path = r.prefix OR substr(f.path, 1, length(r.prefix) + 1) = r.prefix || '/';
+
+-- UPDATE_POLICY_EXPIRATIONS 2.1
+UPDATE file_expirations SET expiresAt = CASE WHEN t.retention < 0 THEN 0 ELSE t.modTime / 1000 + t.retention END
+FROM (
+  SELECT f.storeDir, f.storeName, MAX(f.modTime) AS modTime,
+    COALESCE(NULLIF((
+      SELECT r.retention FROM file_rules r
+      WHERE r.id = f.id AND r.kind = 'policy'
+      ORDER BY length(r.prefix) DESC LIMIT 1), 0), :retention) AS retention
+  FROM file_paths f
+  WHERE f.vault = :vault AND f.modTime > 0
+    AND (:prefix = '' OR f.path = :prefix OR substr(f.path, 1, length(:prefix) + 1) = :prefix || '/')
+  GROUP BY f.storeDir, f.storeName
+) AS t
+WHERE file_expirations.vault = :vault AND file_expirations.storeDir = t.storeDir AND file_expirations.storeName = t.storeName;
+
+-- COUNT_RETAINED_FILES_IN_STORE_DIR 2.1
+SELECT COUNT(*) FROM (
+  SELECT f.modTime, (
+    SELECT r.retention FROM file_rules r
+    WHERE r.id = f.id AND r.kind = 'policy'
+    ORDER BY length(r.prefix) DESC LIMIT 1) AS retention
+  FROM files f
+  WHERE f.vault = :vault AND f.storeDir = :storeDir AND f.modTime > 0 AND (f.flags & 4) = 0
+) WHERE retention < 0 OR (retention > 0 AND modTime / 1000 + retention > :now);
+
+-- DELETE_FILES_BEFORE_MODTIME 2.1
+UPDATE files SET flags = (flags | 4) WHERE vault = :vault AND modTime > 0 AND modTime < :modTime
+  AND NOT EXISTS (
+    SELECT 1 FROM file_rules r WHERE r.id = files.id AND r.kind = 'hold' AND r.until > :now
+  )
+  AND COALESCE((
+    SELECT CASE WHEN r.retention < 0 OR (r.retention > 0 AND files.modTime / 1000 + r.retention > :now) THEN 1 ELSE 0 END
+    FROM file_rules r
+    WHERE r.id = files.id AND r.kind = 'policy'
+    ORDER BY length(r.prefix) DESC LIMIT 1), 0) = 0;
+
+-- GET_VERSIONS_TO_PRUNE 2.1
+SELECT storeDir, storeName FROM (
+  SELECT f.id, f.storeDir, f.storeName,
+    ROW_NUMBER() OVER (PARTITION BY f.path ORDER BY f.modTime DESC, f.id DESC) AS version,
+    (SELECT r.maxVersions FROM file_rules r
+     WHERE r.id = f.id AND r.kind = 'policy'
+     ORDER BY length(r.prefix) DESC LIMIT 1) AS maxVersions
+  FROM file_paths f
+  WHERE f.vault = :vault AND f.modTime > 0 AND (f.flags & 4) = 0
+) AS v
+WHERE maxVersions > 0 AND version > maxVersions
+  AND NOT EXISTS (
+    SELECT 1 FROM file_rules r WHERE r.id = v.id AND r.kind = 'hold' AND r.until > :now
+  )
+LIMIT :limit;
+
+-- INIT 2.2
+CREATE TABLE IF NOT EXISTS segment_watermarks (
+    vault VARCHAR(1024) NOT NULL,
+    storeDir VARCHAR(4096) NOT NULL,
+    watermark INTEGER NOT NULL,
+    PRIMARY KEY(vault, storeDir)
+);
+
+-- SET_SEGMENT_WATERMARK 2.2
+INSERT INTO segment_watermarks (vault, storeDir, watermark) VALUES (:vault, :storeDir, :watermark)
+ON CONFLICT(vault, storeDir) DO UPDATE SET watermark = excluded.watermark;
+
+-- GET_SEGMENT_WATERMARK 2.2
+SELECT watermark FROM segment_watermarks WHERE vault = :vault AND storeDir = :storeDir;
+
+-- DELETE_SEGMENT_WATERMARKS_BEFORE 2.2
+DELETE FROM segment_watermarks WHERE vault = :vault AND storeDir < :storeDir;
+
+-- INIT 2.3
+CREATE TABLE IF NOT EXISTS file_packs (
+    vault VARCHAR(1024) NOT NULL,
+    storeDir VARCHAR(4096) NOT NULL,
+    storeName VARCHAR(32) NOT NULL,
+    pack VARCHAR(32) NOT NULL,
+    packOffset INTEGER NOT NULL,
+    packLength INTEGER NOT NULL,
+    PRIMARY KEY(vault, storeDir, storeName)
+);
+
+-- INIT 2.3
+CREATE INDEX IF NOT EXISTS idx_file_packs_vault_storeDir_pack ON file_packs (vault, storeDir, pack);
+
+-- SET_FILE_PACK 2.3
+INSERT INTO file_packs (vault, storeDir, storeName, pack, packOffset, packLength)
+VALUES (:vault, :storeDir, :storeName, :pack, :offset, :length)
+ON CONFLICT(vault, storeDir, storeName) DO UPDATE SET pack = excluded.pack, packOffset = excluded.packOffset, packLength = excluded.packLength;
+
+-- GET_FILE_PACK 2.3
+SELECT pack, packOffset, packLength FROM file_packs WHERE vault = :vault AND storeDir = :storeDir AND storeName = :storeName;
+
+-- DELETE_FILE_PACK 2.3
+DELETE FROM file_packs WHERE vault = :vault AND storeDir = :storeDir AND storeName = :storeName;
+
+-- INIT 2.4
+CREATE TABLE IF NOT EXISTS chunks (
+    vault VARCHAR(1024) NOT NULL,
+    hash VARCHAR(64) NOT NULL,
+    lastRef INTEGER NOT NULL,
+    PRIMARY KEY(vault, hash)
+);
+
+-- INIT 2.4
+CREATE TABLE IF NOT EXISTS file_chunks (
+    vault VARCHAR(1024) NOT NULL,
+    storeDir VARCHAR(4096) NOT NULL,
+    storeName VARCHAR(32) NOT NULL,
+    idx INTEGER NOT NULL,
+    hash VARCHAR(64) NOT NULL,
+    size INTEGER NOT NULL,
+    PRIMARY KEY(vault, storeDir, storeName, idx)
+);
+
+-- INIT 2.4
+CREATE INDEX IF NOT EXISTS idx_file_chunks_vault_hash ON file_chunks (vault, hash);
+
+-- SET_CHUNK 2.4
+INSERT INTO chunks (vault, hash, lastRef) VALUES (:vault, :hash, :lastRef)
+ON CONFLICT(vault, hash) DO UPDATE SET lastRef = MAX(lastRef, excluded.lastRef);
+
+-- SET_FILE_CHUNK 2.4
+INSERT INTO file_chunks (vault, storeDir, storeName, idx, hash, size)
+VALUES (:vault, :storeDir, :storeName, :idx, :hash, :size)
+ON CONFLICT(vault, storeDir, storeName, idx) DO UPDATE SET hash = excluded.hash, size = excluded.size;
+
+-- GET_FILE_CHUNKS 2.4
+SELECT hash, size FROM file_chunks WHERE vault = :vault AND storeDir = :storeDir AND storeName = :storeName ORDER BY idx;
+
+-- DELETE_FILE_CHUNKS 2.4
+DELETE FROM file_chunks WHERE vault = :vault AND storeDir = :storeDir AND storeName = :storeName;
+
+-- GET_UNREFERENCED_CHUNKS 2.4
+SELECT c.hash FROM chunks c
+WHERE c.vault = :vault AND c.lastRef < :before
+  AND NOT EXISTS (
+    SELECT 1 FROM file_chunks fc JOIN files f
+      ON f.vault = fc.vault AND f.storeDir = fc.storeDir AND f.storeName = fc.storeName
+    WHERE fc.vault = c.vault AND fc.hash = c.hash AND (f.flags & 4) = 0
+  )
+LIMIT :limit;
+
+-- DELETE_CHUNK 2.4
+DELETE FROM chunks WHERE vault = :vault AND hash = :hash;
+
+-- INIT 2.5
+CREATE TABLE IF NOT EXISTS replica_grants (
+    vault VARCHAR(1024) NOT NULL,
+    target VARCHAR(256) NOT NULL,
+    userId VARCHAR(100) NOT NULL,
+    access INTEGER NOT NULL,
+    PRIMARY KEY(vault, target, userId, access)
+);
+
+-- SET_REPLICA_GRANT 2.5
+INSERT OR IGNORE INTO replica_grants (vault, target, userId, access) VALUES (:vault, :target, :userId, :access);
+
+-- DELETE_REPLICA_GRANT 2.5
+DELETE FROM replica_grants WHERE vault = :vault AND target = :target AND userId = :userId AND access = :access;
+
+-- GET_REPLICA_GRANTS 2.5
+SELECT target, userId, access FROM replica_grants WHERE vault = :vault ORDER BY target, userId, access;
+
+-- INIT 2.8
+CREATE TABLE IF NOT EXISTS manifest_positions (
+    vault VARCHAR(1024) NOT NULL,
+    storeDir VARCHAR(4096) NOT NULL,
+    part VARCHAR(256) NOT NULL,
+    head VARCHAR(32) NOT NULL,
+    PRIMARY KEY(vault, storeDir)
+);
+
+-- SET_MANIFEST_POSITION 2.8
+INSERT INTO manifest_positions (vault, storeDir, part, head) VALUES (:vault, :storeDir, :part, :head)
+ON CONFLICT(vault, storeDir) DO UPDATE SET part = excluded.part, head = excluded.head;
+
+-- GET_MANIFEST_POSITION 2.8
+SELECT part, head FROM manifest_positions WHERE vault = :vault AND storeDir = :storeDir;
+
+-- DELETE_MANIFEST_POSITIONS_BEFORE 2.8
+DELETE FROM manifest_positions WHERE vault = :vault AND storeDir < :storeDir;
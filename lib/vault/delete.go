@@ -18,6 +18,10 @@ func (v *Vault) Delete(name string, options IOOption) error {
 	if !found {
 		return nil // File does not exist, nothing to delete
 	}
+	err = v.checkNotHeld(file.Name)
+	if err != nil {
+		return err
+	}
 
 	baseFolder := v.dataRoot()
 	storeDir := path.Join(baseFolder, getSegmentDir(v.Config.SegmentInterval))
@@ -30,9 +34,11 @@ func (v *Vault) Delete(name string, options IOOption) error {
 	tombstone.StoreName = storeName
 	tombstone.ModTime = now
 	retention := effectiveRetention(v.Config.Retention, options.Retention)
-	tombstone.ExpiresAt = truncateToSecond(now.Add(retention))
+	tombstone.ExpiresAt = v.policyExpiresAt(tombstone.Name, now, truncateToSecond(now.Add(retention)))
 	tombstone.Flags |= PendingWrite | Deleted
-	tombstone.Flags &^= PendingRead
+	tombstone.Flags &^= PendingRead | Packed | Chunked
+	tombstone.Pack = nil
+	tombstone.Chunks = nil
 
 	tombstone, err = v.writeFileHeadToDB(tombstone)
 	if err != nil {
@@ -54,6 +60,7 @@ func (v *Vault) Delete(name string, options IOOption) error {
 	if err != nil {
 		return core.Error(core.FileError, "cannot write head for file %s", name, err)
 	}
+	v.addToManifest(storeDir, storeName, head)
 
 	switch {
 	case options.Async:
@@ -73,6 +80,19 @@ func (v *Vault) Delete(name string, options IOOption) error {
 func (v *Vault) wipe(file File) error {
 	core.Start("wiping file %s", file.Name)
 
+	if file.Flags&Chunked != 0 {
+		core.End("chunks of file %s are collected by retention", file.Name)
+		return nil
+	}
+	if file.Flags&Packed != 0 {
+		err := v.releasePack(file.StoreDir, file.StoreName)
+		if err != nil {
+			return core.Error(core.DbError, "cannot release pack of file %s", file.Name, err)
+		}
+		core.End("released pack of file %s", file.Name)
+		return nil
+	}
+
 	ph := path.Join(file.StoreDir, "/b", file.StoreName)
 	err := v.store.Delete(ph)
 	if err != nil {
@@ -0,0 +1,221 @@
+package vault
+
+import (
+	"bytes"
+	"encoding/binary"
+	"os"
+	"path"
+	"path/filepath"
+
+	"github.com/stregato/bao/lib/core"
+	"github.com/stregato/bao/lib/security"
+	"github.com/stregato/bao/lib/sqlx"
+	"github.com/stregato/bao/lib/store"
+)
+
+// EscrowRecovery reports what RecoverWithEscrow restored.
+type EscrowRecovery struct {
+	Keys  int    `json:"keys"`  // Number of keys restored into the local key store
+	Files []File `json:"files"` // EC-encrypted files restored in the destination folder
+}
+
+// writeEscrowCopy stores next to the file head an escrow object at <storeDir>/e/<storeName>. The object contains
+// the head encrypted for the escrow identity followed by the body key wrapped for the same identity.
+func (v *Vault) writeEscrowCopy(file File, ecKey []byte) error {
+	core.Start("file %s", file.Name)
+	head, err := encodeHead("ec", file, v.Config.EscrowPublicID, v.UserSecret, v.getKey)
+	if err != nil {
+		return core.Error(core.EncodeError, "cannot encode escrow head for file %s", file.Name, err)
+	}
+	wrappedKey, err := security.EcEncrypt(v.Config.EscrowPublicID, ecKey)
+	if err != nil {
+		return core.Error(core.EncodeError, "cannot wrap key for escrow for file %s", file.Name, err)
+	}
+
+	data := make([]byte, 4, 4+len(head)+len(wrappedKey))
+	binary.LittleEndian.PutUint32(data, uint32(len(head)))
+	data = append(data, head...)
+	data = append(data, wrappedKey...)
+
+	storePath := path.Join(file.StoreDir, "e", file.StoreName)
+	err = store.WriteFile(v.store, storePath, data)
+	if err != nil {
+		return core.Error(core.FileError, "cannot write escrow copy for file %s", file.Name, err)
+	}
+	core.End("")
+	return nil
+}
+
+func (v *Vault) setEscrowKey(keyId uint64, encryptedKey []byte) error {
+	core.Start("key %d", keyId)
+	_, err := v.DB.Exec("SET_ESCROW_KEY", sqlx.Args{"vault": v.ID, "id": keyId, "encryptedKey": encryptedKey})
+	if err != nil {
+		return core.Error(core.DbError, "cannot set escrow key %d for vault %s", keyId, v.ID, err)
+	}
+	core.End("")
+	return nil
+}
+
+// RecoverWithEscrow uses the escrow identity to restore data that would otherwise be lost, e.g. when a user
+// leaves or a device is wiped. All the keys distributed in the vault are restored into the local key store,
+// and all EC-encrypted files with an escrow copy are decrypted into destDir. Only admins can recover and
+// the escrow identity must match the one set in the vault configuration.
+func (v *Vault) RecoverWithEscrow(escrowSecret security.PrivateID, destDir string) (EscrowRecovery, error) {
+	core.Start("vault %s, destDir %s", v.ID, destDir)
+	var recovery EscrowRecovery
+
+	adminRight, err := v.hasAdminRight(v.UserID)
+	if err != nil {
+		return recovery, core.Error(core.DbError, "cannot get access for user %s", v.UserID, err)
+	}
+	if !adminRight {
+		return recovery, core.Error(core.AccessDenied, "only an admin can recover with escrow in vault %s", v.ID)
+	}
+	if v.Config.EscrowPublicID == "" {
+		return recovery, core.Error(core.ConfigError, "no escrow identity is configured in vault %s", v.ID)
+	}
+	escrowID, err := escrowSecret.PublicID()
+	if err != nil {
+		return recovery, core.Error(core.ParseError, "invalid escrow private ID", err)
+	}
+	if escrowID != v.Config.EscrowPublicID {
+		return recovery, core.Error(core.AuthError, "escrow private ID does not match the vault escrow identity")
+	}
+
+	err = v.syncBlockChain(false)
+	if err != nil {
+		return recovery, core.Error(core.GenericError, "cannot sync blockchain before escrow recovery", err)
+	}
+
+	recovery.Keys, err = v.recoverEscrowKeys(escrowSecret)
+	if err != nil {
+		return recovery, err
+	}
+	if destDir != "" {
+		recovery.Files, err = v.recoverEscrowFiles(escrowSecret, destDir)
+		if err != nil {
+			return recovery, err
+		}
+	}
+
+	core.End("%d keys, %d files", recovery.Keys, len(recovery.Files))
+	return recovery, nil
+}
+
+func (v *Vault) recoverEscrowKeys(escrowSecret security.PrivateID) (int, error) {
+	core.Start("vault %s", v.ID)
+	rows, err := v.DB.Query("GET_ESCROW_KEYS", sqlx.Args{"vault": v.ID})
+	if err != nil {
+		return 0, core.Error(core.DbError, "cannot get escrow keys for vault %s", v.ID, err)
+	}
+	encryptedKeys := map[uint64][]byte{}
+	for rows.Next() {
+		var keyId uint64
+		var encryptedKey []byte
+		err = rows.Scan(&keyId, &encryptedKey)
+		if err != nil {
+			rows.Close()
+			return 0, core.Error(core.DbError, "cannot scan escrow key", err)
+		}
+		encryptedKeys[keyId] = encryptedKey
+	}
+	rows.Close()
+
+	for keyId, encryptedKey := range encryptedKeys {
+		key, err := security.EcDecrypt(escrowSecret, encryptedKey)
+		if err != nil {
+			return 0, core.Error(core.EncodeError, "cannot decrypt escrow key %d", keyId, err)
+		}
+		err = v.setKeyToDB(keyId, key)
+		if err != nil {
+			return 0, err
+		}
+	}
+	core.End("%d keys", len(encryptedKeys))
+	return len(encryptedKeys), nil
+}
+
+func (v *Vault) recoverEscrowFiles(escrowSecret security.PrivateID, destDir string) ([]File, error) {
+	core.Start("vault %s, destDir %s", v.ID, destDir)
+	var files []File
+
+	baseDir := v.dataRoot()
+	for _, segment := range v.listDirs(baseDir, "", getSegmentDir(v.Config.SegmentInterval)) {
+		storeDir := path.Join(baseDir, segment)
+		ls, err := v.store.ReadDir(path.Join(storeDir, "e"), store.Filter{})
+		if err != nil {
+			continue // no escrow copies in this segment
+		}
+		for _, entry := range ls {
+			file, err := v.recoverEscrowFile(escrowSecret, storeDir, entry.Name(), destDir)
+			if err != nil {
+				core.LogError("cannot recover escrow copy %s/%s", storeDir, entry.Name(), err)
+				continue
+			}
+			files = append(files, file)
+		}
+	}
+	core.End("%d files", len(files))
+	return files, nil
+}
+
+func (v *Vault) recoverEscrowFile(escrowSecret security.PrivateID, storeDir, storeName, destDir string) (File, error) {
+	core.Start("storeDir %s, storeName %s", storeDir, storeName)
+	data, err := store.ReadFile(v.store, path.Join(storeDir, "e", storeName))
+	if err != nil {
+		return File{}, core.Error(core.FileError, "cannot read escrow copy %s/%s", storeDir, storeName, err)
+	}
+	if len(data) < 4 || int(binary.LittleEndian.Uint32(data))+4 > len(data) {
+		return File{}, core.Error(core.ParseError, "invalid escrow copy %s/%s", storeDir, storeName)
+	}
+	headLen := int(binary.LittleEndian.Uint32(data))
+	head, wrappedKey := data[4:4+headLen], data[4+headLen:]
+
+	file, notForMe, _, err := decodeHead(head, escrowSecret, v.getKey, v.getUserByShortId)
+	if err != nil {
+		return File{}, core.Error(core.FileError, "cannot decode escrow head %s/%s", storeDir, storeName, err)
+	}
+	if notForMe {
+		return File{}, core.Error(core.AuthError, "escrow copy %s/%s is not for the escrow identity", storeDir, storeName)
+	}
+	ecKey, err := security.EcDecrypt(escrowSecret, wrappedKey)
+	if err != nil {
+		return File{}, core.Error(core.EncodeError, "cannot unwrap escrow key for %s", file.Name, err)
+	}
+	file.StoreDir = storeDir
+	file.StoreName = storeName
+
+	iv, err := getIv(file.Name)
+	if err != nil {
+		return File{}, core.Error(core.GenericError, "cannot get iv for file %s", file.Name, err)
+	}
+	var buf bytes.Buffer
+	if file.Size > 0 {
+		w, err := security.EcDecryptWriterWithKey(ecKey, &buf, iv)
+		if err != nil {
+			return File{}, core.Error(core.EncodeError, "cannot create decrypt writer for %s", file.Name, err)
+		}
+		if file.Flags&Packed != 0 {
+			err = v.readPackedBody(file, w, nil)
+		} else {
+			err = v.store.Read(path.Join(storeDir, "b", storeName), nil, w, nil)
+		}
+		if err != nil {
+			return File{}, core.Error(core.FileError, "cannot read body of %s", file.Name, err)
+		}
+	}
+
+	localPath := filepath.Join(destDir, filepath.FromSlash(file.Name))
+	err = os.MkdirAll(filepath.Dir(localPath), 0755)
+	if err != nil {
+		return File{}, core.Error(core.FileError, "cannot create folder for %s", localPath, err)
+	}
+	err = os.WriteFile(localPath, buf.Bytes(), 0644)
+	if err != nil {
+		return File{}, core.Error(core.FileError, "cannot write recovered file %s", localPath, err)
+	}
+	file.LocalCopy = localPath
+
+	core.End("recovered %s", file.Name)
+	return file, nil
+}
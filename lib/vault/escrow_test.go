@@ -0,0 +1,64 @@
+package vault
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stregato/bao/lib/core"
+	"github.com/stregato/bao/lib/security"
+	"github.com/stregato/bao/lib/sqlx"
+	"github.com/stregato/bao/lib/store"
+)
+
+func TestRecoverWithEscrow(t *testing.T) {
+	alice, aliceSecret := security.NewKeyPairMust()
+	bob, bobSecret := security.NewKeyPairMust()
+	escrow, escrowSecret := security.NewKeyPairMust()
+
+	db := sqlx.NewTestDB(t, "vault.db", "")
+	store := store.LoadTestStore(t, "test")
+	defer store.Close()
+
+	va, err := Create(aliceSecret, store, db, Config{EscrowPublicID: escrow})
+	core.TestErr(t, err, "Create failed: %v")
+	err = va.SyncAccess(IOOption{}, AccessChange{Access: ReadWrite, UserId: bob})
+	core.TestErr(t, err, "SyncAccess failed: %v")
+	va.Close()
+
+	dbb := sqlx.NewTestDB(t, "vault2.db", "")
+	vb, err := Open(bobSecret, alice, store, dbb)
+	core.TestErr(t, err, "Open failed: %v")
+	core.Assert(t, vb.Config.EscrowPublicID == escrow, "escrow identity should be read from the blockchain")
+
+	tmpFile := t.TempDir() + "/private.txt"
+	err = os.WriteFile(tmpFile, []byte("Only for Bob"), 0644)
+	core.TestErr(t, err, "WriteFile failed: %v")
+	file, err := vb.Write("bob/private.txt,ec="+bob.String(), tmpFile, nil, IOOption{})
+	core.TestErr(t, err, "Write failed: %v")
+	_, err = vb.WaitFiles(context.Background(), file.Id)
+	core.TestErr(t, err, "WaitFiles failed: %v")
+
+	_, err = vb.RecoverWithEscrow(escrowSecret, t.TempDir())
+	core.Assert(t, core.ErrorCode(err) == core.AccessDenied, "non admin users cannot recover with escrow")
+	vb.Close()
+
+	dba := sqlx.NewTestDB(t, "vault3.db", "")
+	va, err = Open(aliceSecret, alice, store, dba)
+	core.TestErr(t, err, "Open failed: %v")
+	defer va.Close()
+
+	_, err = va.RecoverWithEscrow(bobSecret, t.TempDir())
+	core.Assert(t, err != nil, "recovery must fail with a wrong escrow identity")
+
+	destDir := t.TempDir()
+	recovery, err := va.RecoverWithEscrow(escrowSecret, destDir)
+	core.TestErr(t, err, "RecoverWithEscrow failed: %v")
+	core.Assert(t, recovery.Keys > 0, "expected recovered keys")
+	core.Assert(t, len(recovery.Files) == 1, "expected one recovered file, got %d", len(recovery.Files))
+
+	content, err := os.ReadFile(filepath.Join(destDir, "bob", "private.txt"))
+	core.TestErr(t, err, "ReadFile failed: %v")
+	core.Assert(t, string(content) == "Only for Bob", "unexpected recovered content %s", content)
+}
@@ -1,7 +1,6 @@
 package vault
 
 import (
-	"path"
 	"time"
 
 	"github.com/stregato/bao/lib/core"
@@ -70,24 +69,8 @@ func (v *Vault) cleanupExpiredFiles(now time.Time) (int64, error) {
 			return deleted, core.Error(core.DbError, "cannot scan expired file entry", err)
 		}
 
-		// Best-effort store cleanup for both head and body.
-		_ = v.store.Delete(path.Join(storeDir, "h", storeName))
-		_ = v.store.Delete(path.Join(storeDir, "b", storeName))
-
-		if _, err := v.DB.Exec("DELETE_FILES_BY_STORE_OBJECT", sqlx.Args{
-			"vault":     v.ID,
-			"storeDir":  storeDir,
-			"storeName": storeName,
-		}); err != nil {
-			return deleted, core.Error(core.DbError, "cannot delete file rows for %s/%s", storeDir, storeName, err)
-		}
-
-		if _, err := v.DB.Exec("DELETE_FILE_EXPIRATION", sqlx.Args{
-			"vault":     v.ID,
-			"storeDir":  storeDir,
-			"storeName": storeName,
-		}); err != nil {
-			return deleted, core.Error(core.DbError, "cannot delete expiration row for %s/%s", storeDir, storeName, err)
+		if err := v.deleteStoreObject(storeDir, storeName); err != nil {
+			return deleted, err
 		}
 		deleted++
 	}
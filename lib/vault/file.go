@@ -19,26 +19,31 @@ const (
 	Deleted                         // File is marked as deleted
 	AESEncryption                   // File is encrypted with AES
 	EcEncryption                    // File is encrypted with EC
+	OverQuota                       // File was written while the author was over quota
+	Packed                          // File body is stored in a pack object
+	Chunked                         // File body is stored in content-defined chunks
 )
 
 type FileId int64
 
 type File struct {
-	Id            FileId            `json:"id"`              // Unique identifier for the file in the database
-	Name          string            `json:"name"`            // Name of the file
-	Size          int64             `json:"size"`            // Size of the file in bytes
-	AllocatedSize int64             `json:"allocatedSize"`   // Space allocated for the file in storage
-	ModTime       time.Time         `json:"modTime"`         // Modification time of the file
-	ExpiresAt     time.Time         `json:"expiresAt"`       // Expiration time (second precision), tracked in clear header and expiration table
-	IsDir         bool              `json:"isDir"`           // Indicates if the file is a directory
-	Flags         Flags             `json:"flags"`           // Flags for the file, e.g., Pending, Deleted
-	Attrs         []byte            `json:"attrs,omitempty"` // Optional attrs data, e.g., encryption info
-	LocalCopy     string            `json:"local,omitempty"` // Local copy of the file, if any
-	KeyId         uint64            `json:"keyId"`           // Key ID for encryption, 0 for public files
-	StoreDir      string            `json:"storeDir"`        // Directory in the store.where the file is located
-	StoreName     string            `json:"storeName"`       // Name of the file in the storage
-	AuthorId      security.PublicID `json:"authorId"`        // Author ID of the file
-	EcRecipient   security.PublicID `json:"ecRecipient"`     // Optional EC recipient public ID
+	Id            FileId            `json:"id"`               // Unique identifier for the file in the database
+	Name          string            `json:"name"`             // Name of the file
+	Size          int64             `json:"size"`             // Size of the file in bytes
+	AllocatedSize int64             `json:"allocatedSize"`    // Space allocated for the file in storage
+	ModTime       time.Time         `json:"modTime"`          // Modification time of the file
+	ExpiresAt     time.Time         `json:"expiresAt"`        // Expiration time (second precision), tracked in clear header and expiration table
+	IsDir         bool              `json:"isDir"`            // Indicates if the file is a directory
+	Flags         Flags             `json:"flags"`            // Flags for the file, e.g., Pending, Deleted
+	Attrs         []byte            `json:"attrs,omitempty"`  // Optional attrs data, e.g., encryption info
+	LocalCopy     string            `json:"local,omitempty"`  // Local copy of the file, if any
+	KeyId         uint64            `json:"keyId"`            // Key ID for encryption, 0 for public files
+	StoreDir      string            `json:"storeDir"`         // Directory in the store.where the file is located
+	StoreName     string            `json:"storeName"`        // Name of the file in the storage
+	AuthorId      security.PublicID `json:"authorId"`         // Author ID of the file
+	EcRecipient   security.PublicID `json:"ecRecipient"`      // Optional EC recipient public ID
+	Pack          *PackRef          `json:"pack,omitempty"`   // Location of the body when the file is packed
+	Chunks        []Chunk           `json:"chunks,omitempty"` // Chunks of the body when the file is chunked
 }
 
 // queryFileById retrieves a file by its ID from the database.
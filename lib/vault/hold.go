@@ -0,0 +1,178 @@
+package vault
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/stregato/bao/lib/core"
+	"github.com/stregato/bao/lib/security"
+	"github.com/stregato/bao/lib/sqlx"
+)
+
+// Hold makes the files under a path prefix immutable (write-once) until a date. Held files cannot be deleted,
+// overwritten or removed by retention on any replica. New files can still be written under a held prefix.
+// A hold can be extended but never shortened, so that it is not possible to release data under legal hold early.
+type Hold struct {
+	Prefix string    `json:"prefix"` // Path prefix the hold applies to. Empty for the whole vault
+	Since  time.Time `json:"since"`  // Time the hold was set. Versions written before are not violations
+	Until  time.Time `json:"until"`  // Files are immutable until this time
+}
+
+func normalizePrefix(prefix string) string {
+	prefix = path.Clean(strings.Trim(prefix, "/"))
+	if prefix == "." {
+		return ""
+	}
+	return prefix
+}
+
+func (h *Hold) Apply(v *Vault, author security.PublicID) error {
+	core.Start("applying Hold by author %s", author)
+
+	adminRight, err := v.hasAdminRight(author)
+	if err != nil {
+		return core.Error(core.DbError, "cannot get access for author %s: %s", author, err.Error(), err)
+	}
+	if !adminRight {
+		return core.Error(core.AuthError, "author %s does not have admin rights to set holds in vault %s", author, v.ID)
+	}
+
+	_, err = v.DB.Exec("SET_HOLD", sqlx.Args{
+		"vault":  v.ID,
+		"prefix": normalizePrefix(h.Prefix),
+		"since":  core.If(h.Since.IsZero(), 0, h.Since.UnixMilli()),
+		"until":  h.Until.Unix(),
+	})
+	if err != nil {
+		return core.Error(core.DbError, "cannot set hold on %s in vault %s", h.Prefix, v.ID, err)
+	}
+	core.End("")
+	return nil
+}
+
+func (h *Hold) String() string {
+	return fmt.Sprintf("Hold: prefix=%s, until=%s", h.Prefix, h.Until.Format(time.RFC3339))
+}
+
+// SetHold records legal-hold/WORM rules in the blockchain. Only admins can set holds.
+func (v *Vault) SetHold(options IOOption, holds ...Hold) error {
+	core.Start("%d holds", len(holds))
+
+	adminRight, err := v.hasAdminRight(v.UserID)
+	if err != nil {
+		return core.Error(core.DbError, "cannot get access for user %s", v.UserID, err)
+	}
+	if !adminRight {
+		return core.Error(core.AuthError, "only the vault creator or an admin can set holds")
+	}
+
+	for _, h := range holds {
+		h.Prefix = normalizePrefix(h.Prefix)
+		h.Since = core.Now()
+		bc, err := marshalChange(&h)
+		if err != nil {
+			return core.Error(core.ParseError, "cannot marshal hold change for vault %s", v.ID, err)
+		}
+		err = v.stageBlockChange(bc)
+		if err != nil {
+			return core.Error(core.GenericError, "cannot stage hold change for vault %s", v.ID, err)
+		}
+	}
+
+	switch {
+	case options.Async:
+		go v.syncBlockChain(false)
+	case options.Scheduled:
+		// Do nothing, sync will be done later
+	default:
+		err = v.syncBlockChain(false)
+		if err != nil {
+			return core.Error(core.GenericError, "cannot synchronize blockchain for hold change", err)
+		}
+	}
+
+	core.End("")
+	return nil
+}
+
+// GetHolds returns the holds that are still active.
+func (v *Vault) GetHolds() ([]Hold, error) {
+	core.Start("vault %s", v.ID)
+	rows, err := v.DB.Query("GET_HOLDS", sqlx.Args{"vault": v.ID, "now": core.Now().Unix()})
+	if err != nil {
+		return nil, core.Error(core.DbError, "cannot get holds for vault %s", v.ID, err)
+	}
+	defer rows.Close()
+
+	var holds []Hold
+	for rows.Next() {
+		var h Hold
+		var since, until int64
+		err = rows.Scan(&h.Prefix, &since, &until)
+		if err != nil {
+			return nil, core.Error(core.DbError, "cannot scan hold", err)
+		}
+		h.Since = time.UnixMilli(since)
+		h.Until = time.Unix(until, 0)
+		holds = append(holds, h)
+	}
+	core.End("%d holds", len(holds))
+	return holds, nil
+}
+
+// heldUntil returns the time until the file with the given name is held by the holds set at or before the given
+// time, or zero if the file is not held.
+func (v *Vault) heldUntil(name string, at time.Time) (time.Time, error) {
+	var until int64
+	err := v.DB.QueryRow("GET_HOLD_FOR_NAME", sqlx.Args{
+		"vault": v.ID,
+		"name":  strings.Trim(nameWithoutEncryptionToken(name), "/"),
+		"now":   core.Now().Unix(),
+		"at":    at.UnixMilli(),
+	}, &until)
+	if err != nil {
+		return time.Time{}, core.Error(core.DbError, "cannot get hold for %s", name, err)
+	}
+	if until == 0 {
+		return time.Time{}, nil
+	}
+	return time.Unix(until, 0), nil
+}
+
+// violatesHold returns true when a file received during sync deletes or overwrites a held file. This happens
+// only when the author's client does not enforce holds. A version written before the hold was set is legitimate,
+// even when it arrives after the hold. The time a version was written is the time the store received its head,
+// since the modification time in the head is set by the author.
+func (v *Vault) violatesHold(file File, storeDir, storeName string) bool {
+	until, err := v.heldUntil(file.Name, core.Now())
+	if err != nil || until.IsZero() {
+		return false
+	}
+	if file.Flags&Deleted == 0 {
+		if _, err := v.Stat(file.Name); err != nil {
+			return false
+		}
+	}
+
+	writtenAt := core.Now() // e.g. a head from a relay notification that is no longer in the store
+	if info, err := v.store.Stat(path.Join(storeDir, "h", storeName)); err == nil {
+		writtenAt = info.ModTime()
+	}
+	until, err = v.heldUntil(file.Name, writtenAt)
+	return err == nil && !until.IsZero()
+}
+
+// checkNotHeld returns an AccessDenied error when the file with the given name is held.
+func (v *Vault) checkNotHeld(name string) error {
+	until, err := v.heldUntil(name, core.Now())
+	if err != nil {
+		return err
+	}
+	if !until.IsZero() {
+		return core.Error(core.AccessDenied, "file %s is on hold until %s", name, until.Format(time.RFC3339), os.ErrPermission)
+	}
+	return nil
+}
@@ -0,0 +1,110 @@
+package vault
+
+import (
+	"context"
+	"errors"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stregato/bao/lib/core"
+	"github.com/stregato/bao/lib/security"
+	"github.com/stregato/bao/lib/sqlx"
+	"github.com/stregato/bao/lib/store"
+)
+
+func TestHold(t *testing.T) {
+	alice, aliceSecret := security.NewKeyPairMust()
+	bob, bobSecret := security.NewKeyPairMust()
+
+	db := sqlx.NewTestDB(t, "vault.db", "")
+	store := store.LoadTestStore(t, "test")
+	defer store.Close()
+
+	va, err := Create(aliceSecret, store, db, Config{})
+	core.TestErr(t, err, "Create failed: %v")
+	defer va.Close()
+	err = va.SyncAccess(IOOption{}, AccessChange{Access: ReadWrite, UserId: bob})
+	core.TestErr(t, err, "SyncAccess failed: %v")
+
+	for _, name := range []string{"legal/a.txt", "other/b.txt"} {
+		file, err := va.Write(name, "", nil, IOOption{Retention: time.Second})
+		core.TestErr(t, err, "Write failed: %v")
+		_, err = va.WaitFiles(context.Background(), file.Id)
+		core.TestErr(t, err, "WaitFiles failed: %v")
+	}
+
+	dbb := sqlx.NewTestDB(t, "vault2.db", "")
+	vb, err := Open(bobSecret, alice, store, dbb)
+	core.TestErr(t, err, "Open failed: %v")
+	defer vb.Close()
+
+	// bob overwrites a file before the hold, but alice receives the version only after it
+	time.Sleep(1100 * time.Millisecond) // change detection has 1 second resolution
+	_, err = vb.Write("legal/a.txt", "", []byte("bob"), IOOption{})
+	core.TestErr(t, err, "Write failed: %v")
+
+	heldAt := core.Now()
+	until := heldAt.Add(time.Hour).Truncate(time.Second)
+	err = vb.SetHold(IOOption{}, Hold{Prefix: "legal", Until: until})
+	core.Assert(t, err != nil, "only admins can set holds")
+	err = va.SetHold(IOOption{}, Hold{Prefix: "/legal/", Until: until})
+	core.TestErr(t, err, "SetHold failed: %v")
+	err = va.SetHold(IOOption{}, Hold{Prefix: "legal", Until: until.Add(-30 * time.Minute)})
+	core.TestErr(t, err, "SetHold failed: %v")
+
+	holds, err := va.GetHolds()
+	core.TestErr(t, err, "GetHolds failed: %v")
+	core.Assert(t, len(holds) == 1, "expected 1 hold, got %d", len(holds))
+	core.Assert(t, holds[0].Prefix == "legal", "unexpected prefix %s", holds[0].Prefix)
+	core.Assert(t, holds[0].Until.Equal(until), "hold must not be shortened: %s", holds[0].Until)
+
+	_, err = va.Sync()
+	core.TestErr(t, err, "Sync failed: %v")
+	file, err := va.Stat("legal/a.txt")
+	core.TestErr(t, err, "Stat failed: %v")
+	core.Assert(t, file.AuthorId == bob, "a version written before the hold should be accepted")
+
+	err = va.Delete("legal/a.txt", IOOption{})
+	core.Assert(t, core.ErrorCode(err) == core.AccessDenied, "delete of a held file should be denied: %v", err)
+	_, err = va.Write("legal/a.txt", "", nil, IOOption{})
+	core.Assert(t, errors.Is(err, os.ErrPermission), "overwrite of a held file should be denied: %v", err)
+	_, err = va.Write("legal/c.txt", "", nil, IOOption{})
+	core.TestErr(t, err, "new files can be written under a held prefix: %v")
+	err = va.Delete("other/b.txt", IOOption{})
+	core.TestErr(t, err, "Delete of a file that is not held failed: %v")
+
+	// a client that does not enforce holds deletes the file; other replicas ignore the tombstone
+	_, err = vb.Sync()
+	core.TestErr(t, err, "Sync failed: %v")
+	_, err = vb.DB.Exec("SQL:DELETE FROM holds", sqlx.Args{})
+	core.TestErr(t, err, "cannot clear holds: %v")
+	time.Sleep(1100 * time.Millisecond) // change detection has 1 second resolution
+	err = vb.Delete("legal/a.txt", IOOption{})
+	core.TestErr(t, err, "Delete failed: %v")
+	_, err = va.Sync()
+	core.TestErr(t, err, "Sync failed: %v")
+	_, err = va.Stat("legal/a.txt")
+	core.TestErr(t, err, "held file should survive a foreign delete: %v")
+
+	// a version backdated by its author before the hold is still an overwrite
+	versions, err := va.Versions("legal/a.txt")
+	core.TestErr(t, err, "Versions failed: %v")
+	time.Sleep(1100 * time.Millisecond) // change detection has 1 second resolution
+	backdate := core.Since(heldAt) + time.Second
+	core.ClockOffset -= backdate
+	_, err = vb.Write("legal/a.txt", "", []byte("backdated"), IOOption{})
+	core.ClockOffset += backdate
+	core.TestErr(t, err, "Write failed: %v")
+	_, err = va.Sync()
+	core.TestErr(t, err, "Sync failed: %v")
+	backdated, err := va.Versions("legal/a.txt")
+	core.TestErr(t, err, "Versions failed: %v")
+	core.Assert(t, len(backdated) == len(versions), "a backdated overwrite of a held file should be ignored")
+
+	// retention does not remove held files
+	_, err = va.cleanupExpiredFiles(core.Now().Add(time.Minute))
+	core.TestErr(t, err, "cleanupExpiredFiles failed: %v")
+	_, err = va.Stat("legal/a.txt")
+	core.TestErr(t, err, "held file should survive retention: %v")
+}
@@ -10,8 +10,8 @@ import (
 	"github.com/stregato/bao/lib/store"
 )
 
-func (v *Vault) deleteFilesBeforeModTime(threshold time.Time) (int64, error) {
-	result, err := v.DB.Exec("DELETE_FILES_BEFORE_MODTIME", sqlx.Args{"vault": v.ID, "modTime": threshold.UnixMilli()})
+func (v *Vault) deleteFilesBeforeModTime(threshold time.Time, now time.Time) (int64, error) {
+	result, err := v.DB.Exec("DELETE_FILES_BEFORE_MODTIME", sqlx.Args{"vault": v.ID, "modTime": threshold.UnixMilli(), "now": now.Unix()})
 	if err != nil {
 		return 0, core.Error(core.DbError, "cannot delete files before modTime %s", threshold, err)
 	}
@@ -22,6 +22,16 @@ func (v *Vault) deleteFilesBeforeModTime(threshold time.Time) (int64, error) {
 	return rows, nil
 }
 
+func (v *Vault) hasHeldFiles(storeDir string, now time.Time) bool {
+	var count int
+	err := v.DB.QueryRow("COUNT_HELD_FILES_IN_STORE_DIR", sqlx.Args{"vault": v.ID, "storeDir": storeDir, "now": now.Unix()}, &count)
+	if err != nil {
+		core.LogError("cannot count held files in %s: %v", storeDir, err)
+		return true // be conservative and keep the segment
+	}
+	return count > 0
+}
+
 func (v *Vault) calculateAllocatedSize() (int64, error) {
 	var total int64
 	err := v.DB.QueryRow("CALCULATE_ALLOCATED_SIZE", sqlx.Args{"vault": v.ID}, &total)
@@ -39,6 +49,14 @@ func (v *Vault) retentionCleanup() {
 	if err != nil {
 		core.LogError("cannot cleanup expired files: %v", err)
 	}
+	prunedVersions, err := v.pruneVersions(now)
+	if err != nil {
+		core.LogError("cannot prune versions: %v", err)
+	}
+	collectedChunks, err := v.collectChunks(now)
+	if err != nil {
+		core.LogError("cannot collect chunks: %v", err)
+	}
 
 	// Secondary safety net: legacy time-segment folder sweep.
 	retention := v.Config.Retention
@@ -61,13 +79,21 @@ func (v *Vault) retentionCleanup() {
 			continue
 		}
 		if timestamp.Before(retentionThreshold) {
+			if v.hasHeldFiles(path.Join(baseDir, l.Name()), now) {
+				core.Info("segment %s contains files on hold, skipping retention", l.Name())
+				continue
+			}
+			if v.hasRetainedFiles(path.Join(baseDir, l.Name()), now) {
+				core.Info("segment %s contains files kept by a retention policy, skipping retention", l.Name())
+				continue
+			}
 			_ = store.DeleteDir(v.store, path.Join(baseDir, l.Name()))
 			deletedDirs++
 		}
 	}
 
 	// Secondary DB safety net for stale rows.
-	deletedByModTime, err := v.deleteFilesBeforeModTime(retentionThreshold)
+	deletedByModTime, err := v.deleteFilesBeforeModTime(retentionThreshold, now)
 	if err != nil {
 		core.LogError("cannot delete files before retention threshold: %v", err)
 	}
@@ -78,11 +104,18 @@ func (v *Vault) retentionCleanup() {
 		v.allocatedSize = total
 	}
 
-	core.Info("housekeeping: deleted %d by expiration table, %d old dirs, %d stale DB rows", deletedByExpiration, deletedDirs, deletedByModTime)
+	core.Info("housekeeping: deleted %d by expiration table, %d pruned versions, %d collected chunks, %d old dirs, %d stale DB rows",
+		deletedByExpiration, prunedVersions, collectedChunks, deletedDirs, deletedByModTime)
 }
 
 func (v *Vault) housekeeping() error {
 	core.Start("starting housekeeping")
+	if err := v.flushManifests(); err != nil {
+		core.LogError("cannot flush manifests: %v", err)
+	}
+	if err := v.compactManifests(); err != nil {
+		core.LogError("cannot compact manifests: %v", err)
+	}
 	if time.Since(v.lastBlockChainSyncAt) > core.DefaultIfZero(v.Config.BlockChainSyncPeriod, time.Hour) {
 		v.syncBlockChain(false)
 		v.lastBlockChainSyncAt = time.Now()
@@ -91,6 +124,10 @@ func (v *Vault) housekeeping() error {
 		v.waitFiles()
 		v.lastWaitFilesAt = time.Now()
 	}
+	if v.Config.SegmentLookback > 0 && time.Since(v.lastRescanAt) > core.DefaultIfZero(v.Config.FilesSyncPeriod, 10*time.Minute) {
+		v.rescanSegments()
+		v.lastRescanAt = time.Now()
+	}
 	if time.Since(v.lastCleanupAt) > core.DefaultIfZero(v.Config.CleanupPeriod, 24*time.Hour) {
 		v.retentionCleanup()
 		v.lastCleanupAt = time.Now()
@@ -0,0 +1,358 @@
+package vault
+
+import (
+	"database/sql"
+	"encoding/hex"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/stregato/bao/lib/core"
+	"github.com/stregato/bao/lib/security"
+	"github.com/stregato/bao/lib/sqlx"
+	"github.com/stregato/bao/lib/store"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+// Manifests list the heads appended to a segment, so readers fetch one object per flush instead of one per head.
+// Each vault instance writes parts <time>-<id> in <segment>/m with the entries added since its last flush, so
+// concurrent writers never overwrite each other and the parts sort by the time they were written. Readers keep in
+// the database the last part they read and the last head listed in the parts, and list only the parts and the heads after
+// them; heads that are not in a manifest yet are found by that listing. Once a segment is closed, a writer compacts
+// its manifests into one. Entries whose head left the store later are imported anyway, and the file is dropped when
+// a read of its body fails.
+const (
+	manifestFolder     = "m"
+	manifestFlushSize  = 64                       // Pending entries that trigger a flush before the next housekeeping
+	manifestCompacted  = "~"                      // Suffix of a compacted manifest, which sorts after the last part it merges
+	manifestTimeFormat = "20060102T150405.000000" // UTC time at the start of the part names
+)
+
+type manifestEntry struct {
+	Name string `msgpack:"n"`
+	Head []byte `msgpack:"h"`
+}
+
+// manifestObject is the content of a manifest in the store. The entries are encrypted with a vault key and signed
+// by the author.
+type manifestObject struct {
+	KeyId  uint64            `msgpack:"k"`
+	Author security.PublicID `msgpack:"a"`
+	Data   []byte            `msgpack:"d"`
+	Sig    []byte            `msgpack:"s"`
+}
+
+// manifests keeps the manifest entries written by this instance that are not flushed yet. The zero value is ready
+// to use.
+type manifests struct {
+	mu      sync.Mutex
+	id      string                     // Name suffix of the manifest parts of this instance
+	entries map[string][]manifestEntry // Entries not flushed yet by store dir
+	pending int                        // Entries not flushed yet
+}
+
+func manifestSignedData(storeDir string, data []byte) []byte {
+	return append([]byte("bao-manifest:"+storeDir+":"), data...)
+}
+
+// addToManifest records a head written by this instance. The manifest is written in the store on flush.
+func (v *Vault) addToManifest(storeDir, storeName string, head []byte) {
+	m := &v.manifests
+	m.mu.Lock()
+	if m.entries == nil {
+		m.id = hex.EncodeToString(core.GenerateRandomBytes(8))
+		m.entries = map[string][]manifestEntry{}
+	}
+	m.entries[storeDir] = append(m.entries[storeDir], manifestEntry{Name: storeName, Head: head})
+	m.pending++
+	flush := m.pending >= manifestFlushSize
+	m.mu.Unlock()
+
+	if flush {
+		go v.flushManifests()
+	}
+}
+
+// flushManifests writes a new manifest part with the pending entries of each store dir.
+func (v *Vault) flushManifests() error {
+	m := &v.manifests
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.pending == 0 {
+		return nil
+	}
+	core.Start("flushing %d entries", m.pending)
+
+	var errX error
+	name := core.Now().UTC().Format(manifestTimeFormat) + "-" + m.id
+	for storeDir, entries := range m.entries {
+		err := v.writeManifest(storeDir, name, entries)
+		if err != nil {
+			errX = err
+			continue
+		}
+		m.pending -= len(entries)
+		delete(m.entries, storeDir)
+	}
+	if errX != nil {
+		return core.Error(core.FileError, "cannot flush manifests", errX)
+	}
+	core.End("")
+	return nil
+}
+
+func (v *Vault) writeManifest(storeDir, id string, entries []manifestEntry) error {
+	keyId, key, err := v.getLastKeyFromDB()
+	if err != nil {
+		return err
+	}
+	data, err := msgpack.Marshal(entries)
+	if err != nil {
+		return core.Error(core.EncodeError, "cannot marshal manifest of %s", storeDir, err)
+	}
+	sig, err := security.Sign(v.UserSecret, manifestSignedData(storeDir, data))
+	if err != nil {
+		return core.Error(core.GenericError, "cannot sign manifest of %s", storeDir, err)
+	}
+	encrypted, err := security.EncryptAES(data, key)
+	if err != nil {
+		return core.Error(core.EncodeError, "cannot encrypt manifest of %s", storeDir, err)
+	}
+	object, err := msgpack.Marshal(manifestObject{KeyId: keyId, Author: v.UserID, Data: encrypted, Sig: sig})
+	if err != nil {
+		return core.Error(core.EncodeError, "cannot marshal manifest of %s", storeDir, err)
+	}
+	name := path.Join(storeDir, manifestFolder, id)
+	err = store.WriteFile(v.store, name, object)
+	if err != nil {
+		return core.Error(core.FileError, "cannot write manifest %s", name, err)
+	}
+	core.Info("wrote manifest %s with %d entries", name, len(entries))
+	return nil
+}
+
+// readManifest reads and verifies a manifest in the store.
+func (v *Vault) readManifest(storeDir, id string) ([]manifestEntry, error) {
+	name := path.Join(storeDir, manifestFolder, id)
+	data, err := store.ReadFile(v.store, name)
+	if err != nil {
+		return nil, core.Error(core.FileError, "cannot read manifest %s", name, err)
+	}
+	var object manifestObject
+	err = msgpack.Unmarshal(data, &object)
+	if err != nil {
+		return nil, core.Error(core.ParseError, "cannot unmarshal manifest %s", name, err)
+	}
+	key, err := v.getKey(object.KeyId)
+	if err != nil || key == nil {
+		return nil, core.Error(core.AuthError, "manifest %s uses unknown key %d", name, object.KeyId, err)
+	}
+	data, err = security.DecryptAES(object.Data, key)
+	if err != nil {
+		return nil, core.Error(core.AuthError, "cannot decrypt manifest %s", name, err)
+	}
+	if !security.Verify(object.Author, manifestSignedData(storeDir, data), object.Sig) {
+		return nil, core.Error(core.AuthError, "manifest %s has an invalid signature", name)
+	}
+	member, err := v.isMember(object.Author)
+	if err != nil {
+		return nil, err
+	}
+	if !member {
+		return nil, core.Error(core.AuthError, "manifest %s comes from %s, who is not a member", name, object.Author)
+	}
+
+	var entries []manifestEntry
+	err = msgpack.Unmarshal(data, &entries)
+	if err != nil {
+		return nil, core.Error(core.ParseError, "cannot unmarshal entries of manifest %s", name, err)
+	}
+	return entries, nil
+}
+
+// isManifestName returns true when the name starts with the time of the manifest, so that it sorts with the
+// others. Other objects in the folder are ignored, since they would move the position of readers past the parts.
+func isManifestName(name string) bool {
+	if len(name) <= len(manifestTimeFormat) {
+		return false
+	}
+	_, err := time.Parse(manifestTimeFormat, name[:len(manifestTimeFormat)])
+	return err == nil
+}
+
+// getManifestPosition returns the last manifest read in the segment and the last head it lists.
+func (v *Vault) getManifestPosition(storeDir string) (part, head string) {
+	err := v.DB.QueryRow("GET_MANIFEST_POSITION", sqlx.Args{"vault": v.ID, "storeDir": storeDir}, &part, &head)
+	if err != nil && err != sql.ErrNoRows {
+		core.LogError("cannot get manifest position of %s: %v", storeDir, err)
+	}
+	return part, head
+}
+
+func (v *Vault) setManifestPosition(storeDir, part, head string) {
+	_, err := v.DB.Exec("SET_MANIFEST_POSITION", sqlx.Args{"vault": v.ID, "storeDir": storeDir, "part": part, "head": head})
+	if err != nil {
+		core.LogError("cannot set manifest position of %s: %v", storeDir, err)
+	}
+}
+
+// syncManifests returns the heads listed in the manifests of the segment after the last one read that are not in
+// knowns, and the position after them, which the caller saves once the heads are imported. The parts written by
+// this instance are skipped. Manifests that cannot be read are skipped as well; their heads are found by listing.
+// Manifests still list the heads that expired or were pruned or deleted after they were written; such files are
+// dropped by dropRemovedFile when they are read.
+func (v *Vault) syncManifests(storeDir string, knowns map[string]bool) (heads map[string][]byte, part, head string) {
+	part, head = v.getManifestPosition(storeDir)
+	ls, err := v.store.ReadDir(path.Join(storeDir, manifestFolder), store.Filter{OnlyFiles: true, AfterName: part})
+	if err != nil {
+		return nil, part, head // no manifests in the segment
+	}
+	sort.Slice(ls, func(i, j int) bool { return ls[i].Name() < ls[j].Name() })
+
+	m := &v.manifests
+	m.mu.Lock()
+	own := m.id
+	m.mu.Unlock()
+	heads = map[string][]byte{}
+	for _, l := range ls {
+		if !isManifestName(l.Name()) {
+			continue
+		}
+		part = max(part, l.Name())
+		if own != "" && strings.HasSuffix(l.Name(), "-"+own) {
+			continue
+		}
+		entries, err := v.readManifest(storeDir, l.Name())
+		if err != nil {
+			core.Info("skipping manifest %s/%s: %v", storeDir, l.Name(), err)
+			continue
+		}
+		for _, e := range entries {
+			head = max(head, e.Name)
+			if !knowns[e.Name] {
+				heads[e.Name] = e.Head
+			}
+		}
+	}
+	return heads, part, head
+}
+
+// compactManifests merges the manifests of the segments closed in the last two intervals into one per segment, so
+// that readers that catch up fetch a single object per segment. A segment is closed when its end is older than the
+// sync overlap, after which writers no longer flush into it. The compacted manifest also lists the heads that are
+// in no manifest, e.g. because their writer stopped before a flush, and leaves out the heads that left the store.
+// It is named after the last manifest it merges, so readers that already read that one only read the compacted
+// manifest. Only writers compact, since the others may not write in the store.
+func (v *Vault) compactManifests() error {
+	access, err := v.GetAccess(v.UserID)
+	if err != nil {
+		return err
+	}
+	if access&Write == 0 {
+		return nil
+	}
+	core.Start("")
+	interval := v.Config.SegmentInterval
+	if interval <= time.Minute {
+		interval = DefaultSegmentInterval
+	}
+	closed := core.Now().Add(-core.DefaultIfZero(v.Config.BlockSyncOverlap, time.Hour))
+	baseDir := v.dataRoot()
+	var errX error
+	minSegment := getSegmentDirAt(interval, closed.Add(-2*interval))
+	for _, segment := range v.listDirs(baseDir, minSegment, getSegmentDirAt(interval, closed.Add(-interval))) {
+		start, err := time.Parse(segmentTimeFormat, segment)
+		if err != nil || start.Add(interval).After(closed) {
+			continue // still open
+		}
+		if err := v.compactSegmentManifests(path.Join(baseDir, segment)); err != nil {
+			errX = err
+		}
+	}
+	if errX != nil {
+		return core.Error(core.FileError, "cannot compact manifests", errX)
+	}
+	core.End("")
+	return nil
+}
+
+func (v *Vault) compactSegmentManifests(storeDir string) error {
+	folder := path.Join(storeDir, manifestFolder)
+	ls, err := v.store.ReadDir(folder, store.Filter{OnlyFiles: true})
+	if err != nil || len(ls) < 2 {
+		return nil // nothing to compact
+	}
+	sort.Slice(ls, func(i, j int) bool { return ls[i].Name() < ls[j].Name() })
+
+	heads := map[string][]byte{}
+	var merged []string
+	for _, l := range ls {
+		if !isManifestName(l.Name()) {
+			continue
+		}
+		entries, err := v.readManifest(storeDir, l.Name())
+		if err != nil {
+			core.Info("cannot compact manifest %s/%s: %v", folder, l.Name(), err)
+			continue
+		}
+		for _, e := range entries {
+			heads[e.Name] = e.Head
+		}
+		merged = append(merged, l.Name())
+	}
+	if len(merged) < 2 {
+		return nil
+	}
+	ls, err = v.store.ReadDir(path.Join(storeDir, "h"), store.Filter{OnlyFiles: true})
+	if err != nil {
+		return core.Error(core.FileError, "cannot list the heads of %s", storeDir, err)
+	}
+	var entries []manifestEntry
+	for _, l := range ls {
+		head, ok := heads[l.Name()]
+		if !ok {
+			head, err = store.ReadFile(v.store, path.Join(storeDir, "h", l.Name()))
+			if err != nil {
+				core.Info("cannot read head %s/h/%s for the manifest: %v", storeDir, l.Name(), err)
+				continue
+			}
+		}
+		entries = append(entries, manifestEntry{Name: l.Name(), Head: head})
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name < entries[j].Name })
+
+	name := merged[len(merged)-1] + manifestCompacted
+	err = v.writeManifest(storeDir, name, entries)
+	if err != nil {
+		return err
+	}
+	for _, n := range merged {
+		if err := v.store.Delete(path.Join(folder, n)); err != nil && !os.IsNotExist(err) {
+			core.Info("cannot delete compacted manifest %s/%s: %v", folder, n, err)
+		}
+	}
+	core.Info("compacted %d manifests of %s into %s with %d entries", len(merged), storeDir, name, len(entries))
+	return nil
+}
+
+// dropRemovedFile removes the file from the database when its head is no longer in the store, e.g. because another
+// instance pruned it after a manifest listed it. It returns true when the file was dropped.
+func (v *Vault) dropRemovedFile(file File) bool {
+	if file.Flags&PendingWrite != 0 {
+		return false // the head is not written yet
+	}
+	_, err := v.store.Stat(path.Join(file.StoreDir, "h", file.StoreName))
+	if !os.IsNotExist(err) {
+		return false
+	}
+	err = v.deleteStoreObject(file.StoreDir, file.StoreName)
+	if err != nil {
+		core.Info("cannot drop removed file %s: %v", file.Name, err)
+		return false
+	}
+	core.Info("dropped file %s, its head %s/h/%s left the store", file.Name, file.StoreDir, file.StoreName)
+	return true
+}
@@ -0,0 +1,133 @@
+package vault
+
+import (
+	"path"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/stregato/bao/lib/core"
+	"github.com/stregato/bao/lib/security"
+	"github.com/stregato/bao/lib/sqlx"
+	"github.com/stregato/bao/lib/store"
+)
+
+func TestManifest(t *testing.T) {
+	alice, aliceSecret := security.NewKeyPairMust()
+	bob, bobSecret := security.NewKeyPairMust()
+
+	db1 := sqlx.NewTestDB(t, "vault_alice.db", "")
+	st := store.LoadTestStore(t, "test")
+	defer st.Close()
+
+	va, err := Create(aliceSecret, st, db1, Config{})
+	core.TestErr(t, err, "Create failed: %v")
+	defer va.Close()
+	err = va.SyncAccess(IOOption{}, AccessChange{UserId: bob, Access: Read})
+	core.TestErr(t, err, "SyncAccess failed: %v")
+
+	var files []File
+	for _, name := range []string{"a.txt", "b.txt", "c.txt"} {
+		file, err := va.Write(name, "", nil, IOOption{})
+		core.TestErr(t, err, "Write failed: %v")
+		files = append(files, file)
+	}
+	err = va.flushManifests()
+	core.TestErr(t, err, "flushManifests failed: %v")
+
+	// with unreadable heads in the store, bob can only learn about the files from the manifest
+	for _, file := range files {
+		err = store.WriteFile(st, path.Join(file.StoreDir, "h", file.StoreName), []byte("unreadable"))
+		core.TestErr(t, err, "cannot overwrite head: %v")
+	}
+	// a forged manifest is ignored
+	err = store.WriteFile(st, path.Join(files[0].StoreDir, manifestFolder, "forged"), []byte("forged"))
+	core.TestErr(t, err, "cannot write forged manifest: %v")
+
+	db2 := sqlx.NewTestDB(t, "vault_bob.db", "")
+	vb, err := Open(bobSecret, alice, st, db2)
+	core.TestErr(t, err, "Open failed: %v")
+	defer vb.Close()
+
+	newFiles, err := vb.Sync()
+	core.TestErr(t, err, "Sync failed: %v")
+	core.Assert(t, len(newFiles) == 3, "bob should import 3 files from the manifest, got %d", len(newFiles))
+
+	// heads that are not in a manifest yet are found by listing
+	time.Sleep(1100 * time.Millisecond)
+	_, err = va.Write("d.txt", "", nil, IOOption{})
+	core.TestErr(t, err, "Write failed: %v")
+	newFiles, err = vb.Sync()
+	core.TestErr(t, err, "Sync failed: %v")
+	core.Assert(t, len(newFiles) == 1 && newFiles[0].Name == "d.txt", "bob should find d.txt by listing, got %v", newFiles)
+
+	// a head removed after the manifest was written, e.g. by retention, is not imported
+	time.Sleep(1100 * time.Millisecond)
+	expired, err := va.Write("e.txt", "", nil, IOOption{})
+	core.TestErr(t, err, "Write failed: %v")
+	err = va.flushManifests()
+	core.TestErr(t, err, "flushManifests failed: %v")
+	err = va.deleteStoreObject(expired.StoreDir, expired.StoreName)
+	core.TestErr(t, err, "deleteStoreObject failed: %v")
+	newFiles, err = vb.Sync()
+	core.TestErr(t, err, "Sync failed: %v")
+	core.Assert(t, len(newFiles) == 1 && newFiles[0].Name == "e.txt", "bob should import e.txt from the manifest, got %v", newFiles)
+	_, err = vb.Read("e.txt", path.Join(t.TempDir(), "e.txt"), IOOption{}, nil)
+	core.Assert(t, err != nil, "reading a removed file should fail")
+	_, err = vb.Stat("e.txt")
+	core.Assert(t, err != nil, "a removed file should be dropped when its read fails")
+
+	// each flush writes a new part with the entries added since the last one
+	time.Sleep(1100 * time.Millisecond)
+	added, err := va.Write("f.txt", "", nil, IOOption{})
+	core.TestErr(t, err, "Write failed: %v")
+	err = va.flushManifests()
+	core.TestErr(t, err, "flushManifests failed: %v")
+	parts, err := st.ReadDir(path.Join(added.StoreDir, manifestFolder), store.Filter{Suffix: "-" + va.manifests.id})
+	core.TestErr(t, err, "ReadDir failed: %v")
+	core.Assert(t, len(parts) >= 2, "every flush should write a new part, got %d", len(parts))
+	sort.Slice(parts, func(i, j int) bool { return parts[i].Name() < parts[j].Name() })
+	last := parts[len(parts)-1].Name()
+	entries, err := vb.readManifest(added.StoreDir, last)
+	core.TestErr(t, err, "readManifest failed: %v")
+	core.Assert(t, len(entries) == 1 && entries[0].Name == added.StoreName, "the last part should only hold f.txt, got %d entries", len(entries))
+	newFiles, err = vb.Sync()
+	core.TestErr(t, err, "Sync failed: %v")
+	core.Assert(t, len(newFiles) == 1 && newFiles[0].Name == "f.txt", "bob should import f.txt, got %v", newFiles)
+
+	// the position is kept in the database, and the listing starts after the heads in the manifests
+	part, head := vb.getManifestPosition(added.StoreDir)
+	core.Assert(t, part == last && head == added.StoreName, "unexpected position %s %s", part, head)
+	vb.Config.BlockSyncOverlap = time.Millisecond
+	time.Sleep(1100 * time.Millisecond)
+	junk := path.Join(added.StoreDir, "h", "00000001")
+	err = store.WriteFile(st, junk, []byte("junk"))
+	core.TestErr(t, err, "cannot write junk head: %v")
+	_, err = vb.syncSegment(added.StoreDir, false)
+	core.TestErr(t, err, "the heads before the position should not be listed: %v")
+	err = st.Delete(junk)
+	core.TestErr(t, err, "cannot delete junk head: %v")
+
+	// once the segment is closed, its manifests are compacted into one
+	core.ClockOffset = DefaultSegmentInterval + 2*time.Hour
+	defer func() { core.ClockOffset = 0 }()
+	err = va.compactManifests()
+	core.TestErr(t, err, "compactManifests failed: %v")
+	parts, err = st.ReadDir(path.Join(added.StoreDir, manifestFolder), store.Filter{Suffix: manifestCompacted})
+	core.TestErr(t, err, "ReadDir failed: %v")
+	core.Assert(t, len(parts) == 1 && parts[0].Name() == last+manifestCompacted, "unexpected compacted manifests %v", parts)
+	all, err := st.ReadDir(path.Join(added.StoreDir, manifestFolder), store.Filter{})
+	core.TestErr(t, err, "ReadDir failed: %v")
+	core.Assert(t, len(all) == 2, "only the compacted manifest and the forged one should be left, got %d", len(all))
+	entries, err = vb.readManifest(added.StoreDir, parts[0].Name())
+	core.TestErr(t, err, "readManifest failed: %v")
+	core.Assert(t, len(entries) == 5, "the compacted manifest should list the 5 heads in the store, got %d", len(entries))
+
+	db3 := sqlx.NewTestDB(t, "vault_bob2.db", "")
+	vc, err := Open(bobSecret, alice, st, db3)
+	core.TestErr(t, err, "Open failed: %v")
+	defer vc.Close()
+	newFiles, err = vc.Sync()
+	core.TestErr(t, err, "Sync failed: %v")
+	core.Assert(t, len(newFiles) == 5, "a new reader should import 5 files from the compacted manifest, got %d", len(newFiles))
+}
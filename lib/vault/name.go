@@ -2,6 +2,7 @@ package vault
 
 import (
 	"strconv"
+	"strings"
 	"sync"
 	"time"
 
@@ -19,8 +20,15 @@ func getMillisOfDay(t time.Time) int64 {
 	return int64(t.Hour()*3600000 + t.Minute()*60000 + t.Second()*1000 + t.Nanosecond()/1e6)
 }
 
+// storeNameLength is the length of the store names. Names are padded and use the UTC time, so that they sort by
+// the time of the writer within a segment.
+const storeNameLength = 8
+
+// segmentTimeFormat is the layout of the segment folders, the UTC time when the segment starts.
+const segmentTimeFormat = "20060102150405"
+
 func generateFilename(t time.Time) string {
-	ms := getMillisOfDay(t)
+	ms := getMillisOfDay(t.UTC())
 
 	seqMutex.Lock()
 	if ms != lastMs {
@@ -36,17 +44,48 @@ func generateFilename(t time.Time) string {
 	id := (ms << 13) | (int64(nodeHash) << 5) | int64(s)
 
 	// Base36 encoding
-	return strconv.FormatUint(uint64(id), 36)
+	return padStoreName(strconv.FormatUint(uint64(id), 36))
+}
+
+func padStoreName(name string) string {
+	if len(name) < storeNameLength {
+		return strings.Repeat("0", storeNameLength-len(name)) + name
+	}
+	return name
+}
+
+// storeNameAt returns the name that sorts right before the names generated at t or later on the same day.
+func storeNameAt(t time.Time) string {
+	id := getMillisOfDay(t.UTC()) << 13
+	if id == 0 {
+		return ""
+	}
+	return padStoreName(strconv.FormatUint(uint64(id-1), 36))
+}
+
+// storeNameTime returns the time when the name was generated, given the start of its segment.
+func storeNameTime(segmentStart time.Time, name string) (time.Time, bool) {
+	id, err := strconv.ParseUint(name, 36, 64)
+	if err != nil {
+		return time.Time{}, false
+	}
+	ms := int64(id >> 13)
+	return segmentStart.UTC().Truncate(24 * time.Hour).Add(time.Duration(ms) * time.Millisecond), true
 }
 
 func getSegmentDir(segmentInterval time.Duration) string {
-	core.Start("segmentInterval %s", segmentInterval)
+	return getSegmentDirAt(segmentInterval, core.Now())
+}
+
+// getSegmentDirAt returns the segment that contains the time t.
+func getSegmentDirAt(segmentInterval time.Duration, t time.Time) string {
+	core.Start("segmentInterval %s, t %s", segmentInterval, t)
 	if segmentInterval <= time.Minute {
 		segmentInterval = DefaultSegmentInterval
 	}
 
-	segmentTime := core.Now().UTC().Truncate(segmentInterval)
-	segmentDir := segmentTime.Format("20060102150405") // YYYY/MM/DD/HH/mm/ss
+	segmentTime := t.UTC().Truncate(segmentInterval)
+	segmentDir := segmentTime.Format(segmentTimeFormat)
 	core.End("segmentDir %s", segmentDir)
 	return segmentDir
 }
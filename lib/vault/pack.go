@@ -0,0 +1,366 @@
+package vault
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"path"
+	"strings"
+	"sync"
+
+	"github.com/stregato/bao/lib/core"
+	"github.com/stregato/bao/lib/sqlx"
+	"github.com/stregato/bao/lib/store"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+// Packs keep the bodies of many small files in one store object, so a batch of writes costs one body object
+// instead of one per file. Each body is encrypted as in a regular write and appended to a pack in <segment>/p.
+// The head of a packed file stays in the h folder, so sync, manifests and retention treat it like any other file,
+// and references the pack, the offset and the length of the body, which readers fetch with a ranged read.
+// Next to the pack, an index lists its members, and each member that is deleted or expires leaves a release marker.
+// A peer deletes the pack when all the members in the index are released, so peers that synced only some members or
+// apply other retention rules never delete bodies that others still reference.
+const (
+	packFolder        = "p"
+	packIndexSuffix   = ".i"     // Suffix of the index of a pack
+	packReleasedInfix = ".r."    // Separates the pack and the member in the name of a release marker
+	MaxPackMemberSize = 1 << 20  // Files larger than this are written with their own body by WriteBatch
+	maxPackSize       = 64 << 20 // Size of the pack above which WriteBatch starts a new one
+	packParallelism   = 16       // Heads written in parallel after a pack
+)
+
+// packIndex is the content of the index of a pack.
+type packIndex struct {
+	Members []string `msgpack:"m"` // Store names of the files in the pack
+}
+
+// PackRef locates the body of a packed file.
+type PackRef struct {
+	Name   string `json:"name"`   // Name of the pack in the p folder of the segment
+	Offset int64  `json:"offset"` // Offset of the encrypted body in the pack
+	Length int64  `json:"length"` // Length of the encrypted body
+}
+
+// BatchItem is a file to write with WriteBatch.
+type BatchItem struct {
+	Dest   string `json:"dest"`            // Name of the file in the vault, with the same syntax as Write
+	Source string `json:"source"`          // Local file with the content
+	Attrs  []byte `json:"attrs,omitempty"` // Optional attributes
+}
+
+func appendPackRef(buf []byte, ref PackRef) []byte {
+	buf = binary.LittleEndian.AppendUint16(buf, uint16(len(ref.Name)))
+	buf = append(buf, ref.Name...)
+	buf = binary.LittleEndian.AppendUint64(buf, uint64(ref.Offset))
+	buf = binary.LittleEndian.AppendUint64(buf, uint64(ref.Length))
+	return buf
+}
+
+func parsePackRef(data []byte) (PackRef, error) {
+	if len(data) < 2 {
+		return PackRef{}, core.Error(core.ParseError, "invalid pack reference length: %d", len(data))
+	}
+	nameLen := int(binary.LittleEndian.Uint16(data[:2]))
+	if len(data) < 2+nameLen+16 {
+		return PackRef{}, core.Error(core.ParseError, "invalid pack reference length: %d", len(data))
+	}
+	data = data[2:]
+	return PackRef{
+		Name:   string(data[:nameLen]),
+		Offset: int64(binary.LittleEndian.Uint64(data[nameLen:])),
+		Length: int64(binary.LittleEndian.Uint64(data[nameLen+8:])),
+	}, nil
+}
+
+func (v *Vault) setFilePack(storeDir, storeName string, ref PackRef) error {
+	_, err := v.DB.Exec("SET_FILE_PACK", sqlx.Args{"vault": v.ID, "storeDir": storeDir, "storeName": storeName,
+		"pack": ref.Name, "offset": ref.Offset, "length": ref.Length})
+	if err != nil {
+		return core.Error(core.DbError, "cannot set pack of %s/%s", storeDir, storeName, err)
+	}
+	return nil
+}
+
+func (v *Vault) getFilePack(storeDir, storeName string) (PackRef, error) {
+	var ref PackRef
+	err := v.DB.QueryRow("GET_FILE_PACK", sqlx.Args{"vault": v.ID, "storeDir": storeDir, "storeName": storeName},
+		&ref.Name, &ref.Offset, &ref.Length)
+	if err != nil {
+		return PackRef{}, core.Error(core.DbError, "cannot get pack of %s/%s", storeDir, storeName, err)
+	}
+	return ref, nil
+}
+
+// releasePack removes a file from its pack and marks it as released in the store.
+func (v *Vault) releasePack(storeDir, storeName string) error {
+	ref, err := v.getFilePack(storeDir, storeName)
+	if isNotFound(err) {
+		return nil // not packed or already released
+	}
+	if err != nil {
+		return err
+	}
+	_, err = v.DB.Exec("DELETE_FILE_PACK", sqlx.Args{"vault": v.ID, "storeDir": storeDir, "storeName": storeName})
+	if err != nil {
+		return core.Error(core.DbError, "cannot delete pack of %s/%s", storeDir, storeName, err)
+	}
+	return v.markPackReleased(storeDir, ref.Name, storeName)
+}
+
+// markPackReleased records that a member no longer uses the pack and deletes the pack, with its index and markers,
+// when all the members in the index are released. A pack without an index is kept until its segment expires.
+func (v *Vault) markPackReleased(storeDir, pack, storeName string) error {
+	folder := path.Join(storeDir, packFolder)
+	err := store.WriteFile(v.store, path.Join(folder, pack+packReleasedInfix+storeName), []byte{})
+	if err != nil {
+		return core.Error(core.FileError, "cannot release %s from pack %s/%s", storeName, folder, pack, err)
+	}
+	data, err := store.ReadFile(v.store, path.Join(folder, pack+packIndexSuffix))
+	if err != nil {
+		core.Info("keeping pack %s/%s without index: %v", folder, pack, err)
+		return nil
+	}
+	var index packIndex
+	err = msgpack.Unmarshal(data, &index)
+	if err != nil {
+		core.Info("keeping pack %s/%s with an invalid index: %v", folder, pack, err)
+		return nil
+	}
+	ls, err := v.store.ReadDir(folder, store.Filter{Prefix: pack + packReleasedInfix, OnlyFiles: true})
+	if err != nil {
+		return core.Error(core.FileError, "cannot list the released members of pack %s/%s", folder, pack, err)
+	}
+	released := map[string]bool{}
+	for _, l := range ls {
+		released[strings.TrimPrefix(l.Name(), pack+packReleasedInfix)] = true
+	}
+	for _, member := range index.Members {
+		if !released[member] {
+			return nil
+		}
+	}
+
+	_ = v.store.Delete(path.Join(folder, pack))
+	_ = v.store.Delete(path.Join(folder, pack+packIndexSuffix))
+	for _, l := range ls {
+		_ = v.store.Delete(path.Join(folder, l.Name()))
+	}
+	core.Info("deleted pack %s/%s, all its %d members are released", folder, pack, len(index.Members))
+	return nil
+}
+
+// readPackedBody reads the encrypted body of a packed file into w.
+func (v *Vault) readPackedBody(file File, w io.Writer, progress chan int64) error {
+	ref := file.Pack
+	if ref == nil {
+		r, err := v.getFilePack(file.StoreDir, file.StoreName)
+		if err != nil {
+			return err
+		}
+		ref = &r
+	}
+	if ref.Length == 0 {
+		return nil
+	}
+	packPath := path.Join(file.StoreDir, packFolder, ref.Name)
+	err := v.store.Read(packPath, &store.Range{From: ref.Offset, To: ref.Offset + ref.Length}, w, progress)
+	if err != nil {
+		return core.Error(core.FileError, "cannot read %d bytes at %d from pack %s", ref.Length, ref.Offset, packPath, err)
+	}
+	return nil
+}
+
+// WriteBatch writes many files at once. The files up to MaxPackMemberSize share a pack object instead of having a
+// body object each, which saves store requests and listing time when writing many small files. Larger files are
+// written as in Write. If the Async option is set, the files are written in the background. If the Scheduled option
+// is set, the files are written later one by one, without packing.
+func (v *Vault) WriteBatch(items []BatchItem, options IOOption) ([]File, error) {
+	core.Start("%d items", len(items))
+	now := core.Now()
+
+	files := make([]File, 0, len(items))
+	for _, item := range items {
+		file, err := v.writeRecord(item.Dest, item.Source, PendingWrite, item.Attrs, options)
+		if err != nil {
+			return files, core.Error(core.FileError, "cannot write record for file %s", item.Dest, err)
+		}
+		files = append(files, file)
+	}
+
+	switch {
+	case options.Async:
+		for _, file := range files {
+			v.scheduleIo(file.Id)
+		}
+		go v.writeBatch(files)
+	case options.Scheduled:
+	default:
+		err := v.writeBatch(files)
+		if err != nil {
+			return files, err
+		}
+	}
+
+	core.End("elapsed %s", core.Since(now))
+	return files, nil
+}
+
+// writeBatch writes the small files in packs, one per segment and up to maxPackSize each, and the others one by one.
+func (v *Vault) writeBatch(files []File) error {
+	var groups [][]File
+	current := map[string]int{} // index of the open group by store dir
+	sizes := map[string]int64{}
+	var errX error
+	for _, file := range files {
+		if file.Size > MaxPackMemberSize {
+			err := v.writeFile(file, nil)
+			if err != nil {
+				errX = err
+			}
+			continue
+		}
+		i, ok := current[file.StoreDir]
+		if !ok || sizes[file.StoreDir]+file.Size > maxPackSize {
+			i = len(groups)
+			groups = append(groups, nil)
+			current[file.StoreDir] = i
+			sizes[file.StoreDir] = 0
+		}
+		groups[i] = append(groups[i], file)
+		sizes[file.StoreDir] += file.Size
+	}
+
+	for _, group := range groups {
+		err := v.writePack(group)
+		if err != nil {
+			errX = err
+		}
+	}
+	if errX != nil {
+		return core.Error(core.FileError, "cannot write batch of %d files", len(files), errX)
+	}
+	return nil
+}
+
+// writePack writes the bodies of files, which share the same store dir, in one pack and then their heads. The heads
+// are written last, so that readers never find a head before its body. Files whose head cannot be written stay
+// pending and are written again one by one.
+func (v *Vault) writePack(files []File) error {
+	storeDir := files[0].StoreDir
+	packName := generateFilename(core.Now())
+	core.Start("pack %s/%s, %d files", storeDir, packName, len(files))
+
+	v.ioThrottleCh <- struct{}{}
+	defer func() {
+		<-v.ioThrottleCh
+		for _, file := range files {
+			v.completeIo(file.Id)
+		}
+	}()
+	v.scheduleChangeFile()
+	defer v.completeChangeFile()
+
+	var pack bytes.Buffer
+	heads := make([][]byte, len(files))
+	for i := range files {
+		file := &files[i]
+		file.Flags = file.Flags&^PendingWrite | Packed
+		encMethod, ecRecipient, err := v.encryptionMethodForFile(*file)
+		if err != nil {
+			return err
+		}
+		var ecKey []byte
+		if encMethod == "ec" && v.Config.EscrowPublicID != "" {
+			ecKey = core.GenerateRandomBytes(32)
+			err = v.writeEscrowCopy(*file, ecKey)
+			if err != nil {
+				return err
+			}
+		}
+
+		offset := int64(pack.Len())
+		if file.LocalCopy != "" {
+			f, err := openLocalSourceReader(file.LocalCopy)
+			if err != nil {
+				return core.Error(core.FileError, "cannot open local file %s in Bao.WriteBatch, name %v",
+					file.LocalCopy, file.Name, err)
+			}
+			r, err := encryptReader(encMethod, *file, ecRecipient, ecKey, f, v.getKey)
+			if err == nil {
+				_, err = io.Copy(&pack, r)
+			}
+			f.Close()
+			if err != nil {
+				return core.Error(core.FileError, "cannot encrypt file %s in Bao.WriteBatch, name %v",
+					file.LocalCopy, file.Name, err)
+			}
+		}
+		file.Pack = &PackRef{Name: packName, Offset: offset, Length: int64(pack.Len()) - offset}
+		heads[i], err = encodeHead(encMethod, *file, ecRecipient, v.UserSecret, v.getKey)
+		if err != nil {
+			return core.Error(core.EncodeError, "cannot encode head in Bao.WriteBatch, name %v", file.Name, err)
+		}
+	}
+
+	// the index goes first, so that no member can be released from a pack without an index
+	index := packIndex{Members: make([]string, len(files))}
+	for i, file := range files {
+		index.Members[i] = file.StoreName
+	}
+	data, err := msgpack.Marshal(index)
+	if err != nil {
+		return core.Error(core.EncodeError, "cannot marshal the index of pack %s", packName, err)
+	}
+	packPath := path.Join(storeDir, packFolder, packName)
+	err = store.WriteFile(v.store, packPath+packIndexSuffix, data)
+	if err != nil {
+		return core.Error(core.FileError, "cannot write the index of pack %s", packPath, err)
+	}
+	err = v.store.Write(packPath, core.NewBytesReader(pack.Bytes()), nil)
+	if err != nil {
+		return core.Error(core.FileError, "cannot write pack %s", packPath, err)
+	}
+
+	errs := make([]error, len(files))
+	sem := make(chan struct{}, packParallelism)
+	var wg sync.WaitGroup
+	for i, file := range files {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int, storeName string) {
+			defer func() { <-sem; wg.Done() }()
+			errs[i] = store.WriteFile(v.store, path.Join(storeDir, "h", storeName), heads[i])
+		}(i, file.StoreName)
+	}
+	wg.Wait()
+
+	var errX error
+	for i, file := range files {
+		if errs[i] != nil {
+			errX = core.Error(core.FileError, "cannot write head for file %s in Bao.WriteBatch, name %v, storeDir %v",
+				file.Name, file.StoreName, storeDir, errs[i])
+			// the file is written again without the pack
+			if err := v.markPackReleased(storeDir, packName, file.StoreName); err != nil {
+				core.LogError("cannot release %s from pack %s: %v", file.StoreName, packName, err)
+			}
+			continue
+		}
+		err = v.setFilePack(storeDir, file.StoreName, *file.Pack)
+		if err != nil {
+			errX = err
+			continue
+		}
+		v.addToManifest(storeDir, file.StoreName, heads[i])
+		v.UpdateFileAllocatedSize(file.Id, file.Size+int64(len(heads[i])))
+		v.UpdateFileFlags(file.Id, file.Flags)
+		v.allocatedSize += file.Size + int64(len(heads[i]))
+		v.notifyChange(path.Join(storeDir, file.StoreName), heads[i])
+	}
+	if errX != nil {
+		return errX
+	}
+
+	core.End("%d bytes", pack.Len())
+	return nil
+}
@@ -0,0 +1,174 @@
+package vault
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stregato/bao/lib/core"
+	"github.com/stregato/bao/lib/security"
+	"github.com/stregato/bao/lib/sqlx"
+	"github.com/stregato/bao/lib/store"
+)
+
+func TestWriteBatch(t *testing.T) {
+	alice, aliceSecret := security.NewKeyPairMust()
+	bob, bobSecret := security.NewKeyPairMust()
+
+	db1 := sqlx.NewTestDB(t, "vault_alice.db", "")
+	st := store.LoadTestStore(t, "test")
+	defer st.Close()
+
+	va, err := Create(aliceSecret, st, db1, Config{})
+	core.TestErr(t, err, "Create failed: %v")
+	defer va.Close()
+	err = va.SyncAccess(IOOption{}, AccessChange{UserId: bob, Access: Read})
+	core.TestErr(t, err, "SyncAccess failed: %v")
+
+	dir := t.TempDir()
+	var items []BatchItem
+	for i := 0; i < 5; i++ {
+		source := filepath.Join(dir, fmt.Sprintf("sample%d.txt", i))
+		err = os.WriteFile(source, []byte(fmt.Sprintf("sample %d", i)), 0644)
+		core.TestErr(t, err, "cannot write source: %v")
+		items = append(items, BatchItem{Dest: fmt.Sprintf("telemetry/sample%d.txt", i), Source: source})
+	}
+	files, err := va.WriteBatch(items, IOOption{})
+	core.TestErr(t, err, "WriteBatch failed: %v")
+	core.Assert(t, len(files) == 5, "expected 5 files, got %d", len(files))
+
+	storeDir := files[0].StoreDir
+	packs, err := st.ReadDir(path.Join(storeDir, packFolder), store.Filter{})
+	core.TestErr(t, err, "cannot list packs: %v")
+	core.Assert(t, len(packs) == 2, "expected one pack and its index, got %d", len(packs))
+	packs, _ = st.ReadDir(path.Join(storeDir, packFolder), store.Filter{Suffix: packIndexSuffix})
+	core.Assert(t, len(packs) == 1, "expected one pack index, got %d", len(packs))
+	packName := strings.TrimSuffix(packs[0].Name(), packIndexSuffix)
+	bodies, _ := st.ReadDir(path.Join(storeDir, "b"), store.Filter{})
+	core.Assert(t, len(bodies) == 0, "packed files should have no body object, got %d", len(bodies))
+
+	db2 := sqlx.NewTestDB(t, "vault_bob.db", "")
+	vb, err := Open(bobSecret, alice, st, db2)
+	core.TestErr(t, err, "Open failed: %v")
+	defer vb.Close()
+	_, err = vb.Sync()
+	core.TestErr(t, err, "Sync failed: %v")
+
+	for i := 0; i < 5; i++ {
+		dest := filepath.Join(dir, fmt.Sprintf("read%d.txt", i))
+		file, err := vb.Read(fmt.Sprintf("telemetry/sample%d.txt", i), dest, IOOption{}, nil)
+		core.TestErr(t, err, "Read failed: %v")
+		core.Assert(t, file.Flags&Packed != 0, "file %s should be packed", file.Name)
+		data, err := os.ReadFile(dest)
+		core.TestErr(t, err, "cannot read local copy: %v")
+		core.Assert(t, string(data) == fmt.Sprintf("sample %d", i), "unexpected content of %s: %s", file.Name, data)
+	}
+
+	// the pack is deleted with its last member
+	for _, file := range files[:4] {
+		err = va.deleteStoreObject(file.StoreDir, file.StoreName)
+		core.TestErr(t, err, "deleteStoreObject failed: %v")
+	}
+	_, err = st.Stat(path.Join(storeDir, packFolder, packName))
+	core.TestErr(t, err, "pack should exist while it has members: %v")
+	err = va.deleteStoreObject(files[4].StoreDir, files[4].StoreName)
+	core.TestErr(t, err, "deleteStoreObject failed: %v")
+	_, err = st.Stat(path.Join(storeDir, packFolder, packName))
+	core.Assert(t, os.IsNotExist(err), "pack should be deleted with its last member, got %v", err)
+}
+
+// hideHeads removes the heads of files from the store and returns a function that puts them back, so that a peer
+// that syncs in between knows only the other files.
+func hideHeads(t *testing.T, st store.Store, files []File) func() {
+	heads := map[string][]byte{}
+	for _, file := range files {
+		name := path.Join(file.StoreDir, "h", file.StoreName)
+		data, err := store.ReadFile(st, name)
+		core.TestErr(t, err, "cannot read head: %v")
+		heads[name] = data
+		err = st.Delete(name)
+		core.TestErr(t, err, "cannot delete head: %v")
+	}
+	return func() {
+		for name, data := range heads {
+			err := store.WriteFile(st, name, data)
+			core.TestErr(t, err, "cannot restore head: %v")
+		}
+	}
+}
+
+func TestPackRelease(t *testing.T) {
+	alice, aliceSecret := security.NewKeyPairMust()
+	bob, bobSecret := security.NewKeyPairMust()
+	carol, carolSecret := security.NewKeyPairMust()
+
+	db1 := sqlx.NewTestDB(t, "vault_alice.db", "")
+	st := store.LoadTestStore(t, "test")
+	defer st.Close()
+
+	va, err := Create(aliceSecret, st, db1, Config{})
+	core.TestErr(t, err, "Create failed: %v")
+	defer va.Close()
+	err = va.SyncAccess(IOOption{}, AccessChange{UserId: bob, Access: Read}, AccessChange{UserId: carol, Access: Read})
+	core.TestErr(t, err, "SyncAccess failed: %v")
+
+	dir := t.TempDir()
+	var items []BatchItem
+	for i := 0; i < 4; i++ {
+		source := filepath.Join(dir, fmt.Sprintf("sample%d.txt", i))
+		err = os.WriteFile(source, []byte(fmt.Sprintf("sample %d", i)), 0644)
+		core.TestErr(t, err, "cannot write source: %v")
+		items = append(items, BatchItem{Dest: fmt.Sprintf("telemetry/sample%d.txt", i), Source: source})
+	}
+	files, err := va.WriteBatch(items, IOOption{})
+	core.TestErr(t, err, "WriteBatch failed: %v")
+	indexes, err := st.ReadDir(path.Join(files[0].StoreDir, packFolder), store.Filter{Suffix: packIndexSuffix})
+	core.TestErr(t, err, "cannot list packs: %v")
+	core.Assert(t, len(indexes) == 1, "expected one pack index, got %d", len(indexes))
+	packName := strings.TrimSuffix(indexes[0].Name(), packIndexSuffix)
+	packPath := path.Join(files[0].StoreDir, packFolder, packName)
+
+	// bob knows only the first two files of the pack and carol only the last two
+	restore := hideHeads(t, st, files[2:])
+	db2 := sqlx.NewTestDB(t, "vault_bob.db", "")
+	vb, err := Open(bobSecret, alice, st, db2)
+	core.TestErr(t, err, "Open failed: %v")
+	defer vb.Close()
+	newFiles, err := vb.Sync()
+	core.TestErr(t, err, "Sync failed: %v")
+	core.Assert(t, len(newFiles) == 2, "bob should know 2 files, got %d", len(newFiles))
+	restore()
+
+	restore = hideHeads(t, st, files[:2])
+	db3 := sqlx.NewTestDB(t, "vault_carol.db", "")
+	vc, err := Open(carolSecret, alice, st, db3)
+	core.TestErr(t, err, "Open failed: %v")
+	defer vc.Close()
+	newFiles, err = vc.Sync()
+	core.TestErr(t, err, "Sync failed: %v")
+	core.Assert(t, len(newFiles) == 2, "carol should know 2 files, got %d", len(newFiles))
+	restore()
+
+	// bob releases all the members he knows, but the pack still holds the files of carol
+	for _, file := range files[:2] {
+		err = vb.deleteStoreObject(file.StoreDir, file.StoreName)
+		core.TestErr(t, err, "deleteStoreObject failed: %v")
+	}
+	_, err = st.Stat(packPath)
+	core.TestErr(t, err, "pack should exist while other peers use it: %v")
+	dest := filepath.Join(dir, "read.txt")
+	_, err = vc.Read("telemetry/sample3.txt", dest, IOOption{}, nil)
+	core.TestErr(t, err, "carol should read her file after bob released his: %v")
+
+	for _, file := range files[2:] {
+		err = vc.deleteStoreObject(file.StoreDir, file.StoreName)
+		core.TestErr(t, err, "deleteStoreObject failed: %v")
+	}
+	_, err = st.Stat(packPath)
+	core.Assert(t, os.IsNotExist(err), "pack should be deleted once all its members are released, got %v", err)
+	ls, _ := st.ReadDir(path.Join(files[0].StoreDir, packFolder), store.Filter{Prefix: packName})
+	core.Assert(t, len(ls) == 0, "the index and the markers should be deleted with the pack, got %d", len(ls))
+}
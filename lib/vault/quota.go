@@ -0,0 +1,218 @@
+package vault
+
+import (
+	"fmt"
+
+	"github.com/stregato/bao/lib/core"
+	"github.com/stregato/bao/lib/security"
+	"github.com/stregato/bao/lib/sqlx"
+)
+
+// Quota limits the storage used by the files of a user, or of all the users with a given access (role).
+// A quota for a specific user takes precedence over the quota for its role.
+type Quota struct {
+	UserId     security.PublicID `json:"userId,omitempty"` // User the quota applies to. Empty when the quota applies to a role
+	Access     Access            `json:"access,omitempty"` // Role the quota applies to when UserId is empty
+	MaxStorage int64             `json:"maxStorage"`       // Maximum storage in bytes; 0 removes the quota
+}
+
+// AuthorUsage is the storage used by a single author.
+type AuthorUsage struct {
+	Files     int   `json:"files"`     // Number of files, including older versions
+	Size      int64 `json:"size"`      // Allocated size in bytes
+	Quota     int64 `json:"quota"`     // Quota that applies to the author, 0 when unlimited
+	OverQuota bool  `json:"overQuota"` // True when the author exceeds the quota
+}
+
+// Usage breaks down the storage used in the vault by author and directory.
+type Usage struct {
+	Total    int64                             `json:"total"`    // Total allocated size in bytes
+	ByAuthor map[security.PublicID]AuthorUsage `json:"byAuthor"` // Usage per author
+	ByDir    map[string]int64                  `json:"byDir"`    // Allocated size per directory
+}
+
+func (q *Quota) Apply(v *Vault, author security.PublicID) error {
+	core.Start("applying Quota by author %s", author)
+
+	adminRight, err := v.hasAdminRight(author)
+	if err != nil {
+		return core.Error(core.DbError, "cannot get access for author %s: %s", author, err.Error(), err)
+	}
+	if !adminRight {
+		return core.Error(core.AuthError, "author %s does not have admin rights to set quotas in vault %s", author, v.ID)
+	}
+
+	args := sqlx.Args{"vault": v.ID, "userId": q.UserId, "access": q.Access, "maxStorage": q.MaxStorage}
+	if q.MaxStorage <= 0 {
+		_, err = v.DB.Exec("DELETE_QUOTA", args)
+	} else {
+		_, err = v.DB.Exec("SET_QUOTA", args)
+	}
+	if err != nil {
+		return core.Error(core.DbError, "cannot set quota in vault %s", v.ID, err)
+	}
+	core.End("")
+	return nil
+}
+
+func (q *Quota) String() string {
+	if q.UserId != "" {
+		return fmt.Sprintf("Quota: user=%x, maxStorage=%d", q.UserId.Hash(), q.MaxStorage)
+	}
+	return fmt.Sprintf("Quota: access=%s, maxStorage=%d", q.Access, q.MaxStorage)
+}
+
+// SetQuota records per-user or per-role storage quotas in the blockchain. Only admins can set quotas.
+func (v *Vault) SetQuota(options IOOption, quotas ...Quota) error {
+	core.Start("%d quotas", len(quotas))
+
+	adminRight, err := v.hasAdminRight(v.UserID)
+	if err != nil {
+		return core.Error(core.DbError, "cannot get access for user %s", v.UserID, err)
+	}
+	if !adminRight {
+		return core.Error(core.AuthError, "only the vault creator or an admin can set quotas")
+	}
+
+	for _, q := range quotas {
+		if q.UserId == "" && q.Access == 0 {
+			return core.Error(core.ParseError, "quota must have a user or an access")
+		}
+		bc, err := marshalChange(&q)
+		if err != nil {
+			return core.Error(core.ParseError, "cannot marshal quota change for vault %s", v.ID, err)
+		}
+		err = v.stageBlockChange(bc)
+		if err != nil {
+			return core.Error(core.GenericError, "cannot stage quota change for vault %s", v.ID, err)
+		}
+	}
+
+	switch {
+	case options.Async:
+		go v.syncBlockChain(false)
+	case options.Scheduled:
+		// Do nothing, sync will be done later
+	default:
+		err = v.syncBlockChain(false)
+		if err != nil {
+			return core.Error(core.GenericError, "cannot synchronize blockchain for quota change", err)
+		}
+	}
+
+	core.End("")
+	return nil
+}
+
+// GetQuotas returns the quotas defined in the vault.
+func (v *Vault) GetQuotas() ([]Quota, error) {
+	core.Start("vault %s", v.ID)
+	rows, err := v.DB.Query("GET_QUOTAS", sqlx.Args{"vault": v.ID})
+	if err != nil {
+		return nil, core.Error(core.DbError, "cannot get quotas for vault %s", v.ID, err)
+	}
+	defer rows.Close()
+
+	var quotas []Quota
+	for rows.Next() {
+		var q Quota
+		err = rows.Scan(&q.UserId, &q.Access, &q.MaxStorage)
+		if err != nil {
+			return nil, core.Error(core.DbError, "cannot scan quota", err)
+		}
+		quotas = append(quotas, q)
+	}
+	core.End("%d quotas", len(quotas))
+	return quotas, nil
+}
+
+// getQuota returns the quota that applies to the user, or 0 when the user has no quota.
+func (v *Vault) getQuota(userId security.PublicID) (int64, error) {
+	var maxStorage int64
+	err := v.DB.QueryRow("GET_USER_QUOTA", sqlx.Args{"vault": v.ID, "userId": userId}, &maxStorage)
+	if err == nil {
+		return maxStorage, nil
+	}
+	if err != sqlx.ErrNoRows {
+		return 0, core.Error(core.DbError, "cannot get quota for user %s", userId, err)
+	}
+
+	access, err := v.GetAccess(userId)
+	if err != nil {
+		return 0, err
+	}
+	err = v.DB.QueryRow("GET_ACCESS_QUOTA", sqlx.Args{"vault": v.ID, "access": access}, &maxStorage)
+	if err == sqlx.ErrNoRows {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, core.Error(core.DbError, "cannot get quota for access %s", access, err)
+	}
+	return maxStorage, nil
+}
+
+func (v *Vault) getAuthorUsage(authorId security.PublicID) (int64, error) {
+	var size int64
+	err := v.DB.QueryRow("GET_AUTHOR_USAGE", sqlx.Args{"vault": v.ID, "authorId": authorId}, &size)
+	if err != nil {
+		return 0, core.Error(core.DbError, "cannot get usage for author %s", authorId, err)
+	}
+	return size, nil
+}
+
+// isOverQuota returns true when adding size bytes to the files of the author exceeds its quota.
+func (v *Vault) isOverQuota(authorId security.PublicID, size int64) (bool, error) {
+	quota, err := v.getQuota(authorId)
+	if err != nil || quota == 0 {
+		return false, err
+	}
+	usage, err := v.getAuthorUsage(authorId)
+	if err != nil {
+		return false, err
+	}
+	return usage+size > quota, nil
+}
+
+// Usage returns the storage used in the vault by author and directory, together with the quota of each author.
+func (v *Vault) Usage() (Usage, error) {
+	core.Start("vault %s", v.ID)
+	usage := Usage{
+		ByAuthor: map[security.PublicID]AuthorUsage{},
+		ByDir:    map[string]int64{},
+	}
+
+	rows, err := v.DB.Query("GET_USAGE", sqlx.Args{"vault": v.ID})
+	if err != nil {
+		return Usage{}, core.Error(core.DbError, "cannot get usage for vault %s", v.ID, err)
+	}
+	for rows.Next() {
+		var authorId security.PublicID
+		var dir string
+		var files int
+		var size int64
+		err = rows.Scan(&authorId, &dir, &files, &size)
+		if err != nil {
+			rows.Close()
+			return Usage{}, core.Error(core.DbError, "cannot scan usage", err)
+		}
+		au := usage.ByAuthor[authorId]
+		au.Files += files
+		au.Size += size
+		usage.ByAuthor[authorId] = au
+		usage.ByDir[dir] += size
+		usage.Total += size
+	}
+	rows.Close()
+
+	for authorId, au := range usage.ByAuthor {
+		au.Quota, err = v.getQuota(authorId)
+		if err != nil {
+			return Usage{}, err
+		}
+		au.OverQuota = au.Quota > 0 && au.Size > au.Quota
+		usage.ByAuthor[authorId] = au
+	}
+
+	core.End("total %d, %d authors, %d dirs", usage.Total, len(usage.ByAuthor), len(usage.ByDir))
+	return usage, nil
+}
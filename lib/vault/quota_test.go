@@ -0,0 +1,86 @@
+package vault
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stregato/bao/lib/core"
+	"github.com/stregato/bao/lib/security"
+	"github.com/stregato/bao/lib/sqlx"
+	"github.com/stregato/bao/lib/store"
+)
+
+func TestQuota(t *testing.T) {
+	alice, aliceSecret := security.NewKeyPairMust()
+	bob, bobSecret := security.NewKeyPairMust()
+
+	db := sqlx.NewTestDB(t, "vault.db", "")
+	store := store.LoadTestStore(t, "test")
+	defer store.Close()
+
+	va, err := Create(aliceSecret, store, db, Config{})
+	core.TestErr(t, err, "Create failed: %v")
+	err = va.SyncAccess(IOOption{}, AccessChange{Access: ReadWrite, UserId: bob})
+	core.TestErr(t, err, "SyncAccess failed: %v")
+
+	dbb := sqlx.NewTestDB(t, "vault2.db", "")
+	vb, err := Open(bobSecret, alice, store, dbb)
+	core.TestErr(t, err, "Open failed: %v")
+	defer vb.Close()
+
+	err = vb.SetQuota(IOOption{}, Quota{UserId: bob, MaxStorage: 1 << 20})
+	core.Assert(t, err != nil, "only admins can set quotas")
+
+	tmpFile := t.TempDir() + "/data.bin"
+	err = os.WriteFile(tmpFile, bytes.Repeat([]byte{1}, 100), 0644)
+	core.TestErr(t, err, "WriteFile failed: %v")
+	var allocated int64
+	for _, name := range []string{"bob/a.bin", "bob/b.bin"} {
+		file, err := vb.Write(name, tmpFile, nil, IOOption{})
+		core.TestErr(t, err, "Write failed: %v")
+		files, err := vb.WaitFiles(context.Background(), file.Id)
+		core.TestErr(t, err, "WaitFiles failed: %v")
+		core.Assert(t, len(files) == 1, "expected one file")
+		st, err := vb.Stat(name)
+		core.TestErr(t, err, "Stat failed: %v")
+		allocated = st.AllocatedSize
+	}
+
+	// the quota fits one file only
+	err = va.SetQuota(IOOption{}, Quota{UserId: bob, MaxStorage: allocated * 3 / 2})
+	core.TestErr(t, err, "SetQuota failed: %v")
+	err = va.SetQuota(IOOption{}, Quota{Access: ReadWrite, MaxStorage: 1 << 30})
+	core.TestErr(t, err, "SetQuota failed: %v")
+	quotas, err := va.GetQuotas()
+	core.TestErr(t, err, "GetQuotas failed: %v")
+	core.Assert(t, len(quotas) == 2, "expected 2 quotas, got %d", len(quotas))
+
+	_, err = va.Sync()
+	core.TestErr(t, err, "Sync failed: %v")
+	ls, err := va.ReadDir("bob", time.Time{}, 0, 0)
+	core.TestErr(t, err, "ReadDir failed: %v")
+	core.Assert(t, len(ls) == 2, "expected 2 files, got %d", len(ls))
+	flagged := 0
+	for _, f := range ls {
+		if f.Flags&OverQuota != 0 {
+			flagged++
+		}
+	}
+	core.Assert(t, flagged == 1, "expected one file over quota, got %d", flagged)
+
+	usage, err := va.Usage()
+	core.TestErr(t, err, "Usage failed: %v")
+	core.Assert(t, usage.ByAuthor[bob].Files == 2, "expected 2 files for bob")
+	core.Assert(t, usage.ByAuthor[bob].OverQuota, "bob should be over quota")
+	core.Assert(t, usage.ByDir["bob"] == usage.ByAuthor[bob].Size, "dir usage should match bob usage")
+
+	err = vb.syncBlockChain(true)
+	core.TestErr(t, err, "syncBlockChain failed: %v")
+	_, err = vb.Write("bob/c.bin", tmpFile, nil, IOOption{})
+	core.Assert(t, errors.Is(err, os.ErrPermission), "write over quota should be denied: %v", err)
+	va.Close()
+}
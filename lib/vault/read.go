@@ -1,6 +1,7 @@
 package vault
 
 import (
+	"io"
 	"os"
 	"path"
 	"time"
@@ -32,18 +33,31 @@ func (v *Vault) readFile(file File, progress chan int64) error {
 		}
 	}()
 
-	encMethod, _, err := v.encryptionMethodForFile(file)
-	if err != nil {
-		return core.Error(core.ParseError, "cannot determine encryption mode for %s", file.Name, err)
-	}
-	writer, err := decryptWriter(encMethod, v.UserSecret, file, f, v.getKey)
-	if err != nil {
-		return core.Error(core.GenericError, "cannot create decrypt writer for %s", file.Name, err)
-	}
+	if file.Flags&Chunked != 0 {
+		err = v.readChunks(file, f, progress) // chunks are decrypted one by one
+	} else {
+		var encMethod string
+		var writer io.Writer
+		encMethod, _, err = v.encryptionMethodForFile(file)
+		if err != nil {
+			return core.Error(core.ParseError, "cannot determine encryption mode for %s", file.Name, err)
+		}
+		writer, err = decryptWriter(encMethod, v.UserSecret, file, f, v.getKey)
+		if err != nil {
+			return core.Error(core.GenericError, "cannot create decrypt writer for %s", file.Name, err)
+		}
 
-	//	bodyDir := strings.ReplaceAll(file.StoreDir, "/h", "/b")
-	err = v.store.Read(path.Join(file.StoreDir, "/b", file.StoreName), nil, writer, progress)
+		//	bodyDir := strings.ReplaceAll(file.StoreDir, "/h", "/b")
+		if file.Flags&Packed != 0 {
+			err = v.readPackedBody(file, writer, progress)
+		} else {
+			err = v.store.Read(path.Join(file.StoreDir, "/b", file.StoreName), nil, writer, progress)
+		}
+	}
 	if err != nil {
+		if v.dropRemovedFile(file) {
+			return core.Error(core.FileError, "file %s is no longer in the store", file.Name, os.ErrNotExist)
+		}
 		return core.Error(core.FileError, "cannot read file %s", file.Name, err)
 	}
 
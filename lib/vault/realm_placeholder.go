@@ -11,3 +11,14 @@ func (v *Vault) dataRoot() string {
 func (v *Vault) blockChainRoot() string {
 	return path.Join(BlockChainFolder)
 }
+
+// signalsRoot is the folder of ephemeral signals. Signals travel only on the relay, so it never exists in the store.
+func (v *Vault) signalsRoot() string {
+	return path.Join(signalsFolder)
+}
+
+// chunksRoot is the folder of the chunks of chunked bodies. Chunks are shared by the versions of a file, so they live
+// outside the segments.
+func (v *Vault) chunksRoot() string {
+	return path.Join(chunksFolder)
+}
@@ -0,0 +1,124 @@
+package vault
+
+import (
+	"fmt"
+
+	"github.com/stregato/bao/lib/core"
+	"github.com/stregato/bao/lib/security"
+	"github.com/stregato/bao/lib/sqlx"
+)
+
+// ReplicaGrant allows a user, or all the users with a given access (role), to write a table or to run a statement
+// of the replicas in the vault. A target with no grants can be written by all the users with write access; once a
+// target has grants, the replicas reject the transactions of the other users. A grant with Revoke set removes the
+// grant with the same target, user and access. Once any target has grants, only admins can run raw SQL statements.
+type ReplicaGrant struct {
+	Target string            `json:"target"`           // Table name or statement key the grant applies to
+	UserId security.PublicID `json:"userId,omitempty"` // User the grant applies to. Empty when the grant applies to a role
+	Access Access            `json:"access,omitempty"` // Role the grant applies to when UserId is empty
+	Revoke bool              `json:"revoke,omitempty"` // Revoke removes the grant
+}
+
+func (rg *ReplicaGrant) Apply(v *Vault, author security.PublicID) error {
+	core.Start("applying ReplicaGrant by author %s", author)
+
+	adminRight, err := v.hasAdminRight(author)
+	if err != nil {
+		return core.Error(core.DbError, "cannot get access for author %s: %s", author, err.Error(), err)
+	}
+	if !adminRight {
+		return core.Error(core.AuthError, "author %s does not have admin rights to set replica grants in vault %s", author, v.ID)
+	}
+
+	args := sqlx.Args{"vault": v.ID, "target": rg.Target, "userId": rg.UserId, "access": rg.Access}
+	if rg.Revoke {
+		_, err = v.DB.Exec("DELETE_REPLICA_GRANT", args)
+	} else {
+		_, err = v.DB.Exec("SET_REPLICA_GRANT", args)
+	}
+	if err != nil {
+		return core.Error(core.DbError, "cannot set replica grant on %s in vault %s", rg.Target, v.ID, err)
+	}
+	core.End("")
+	return nil
+}
+
+func (rg *ReplicaGrant) String() string {
+	if rg.UserId != "" {
+		return fmt.Sprintf("ReplicaGrant: target=%s, user=%x, revoke=%t", rg.Target, rg.UserId.Hash(), rg.Revoke)
+	}
+	return fmt.Sprintf("ReplicaGrant: target=%s, access=%s, revoke=%t", rg.Target, rg.Access, rg.Revoke)
+}
+
+// Allows returns true when the grant applies to the user with the given access.
+func (rg *ReplicaGrant) Allows(userId security.PublicID, access Access) bool {
+	if rg.UserId != "" {
+		return rg.UserId == userId
+	}
+	return access&rg.Access == rg.Access
+}
+
+// SetReplicaGrants records the grants on replica tables and statements in the blockchain. Only admins can set
+// grants.
+func (v *Vault) SetReplicaGrants(options IOOption, grants ...ReplicaGrant) error {
+	core.Start("%d grants", len(grants))
+
+	adminRight, err := v.hasAdminRight(v.UserID)
+	if err != nil {
+		return core.Error(core.DbError, "cannot get access for user %s", v.UserID, err)
+	}
+	if !adminRight {
+		return core.Error(core.AuthError, "only the vault creator or an admin can set replica grants")
+	}
+
+	for _, rg := range grants {
+		if rg.Target == "" || rg.UserId == "" && rg.Access == 0 {
+			return core.Error(core.ParseError, "invalid replica grant %s", rg.String())
+		}
+		bc, err := marshalChange(&rg)
+		if err != nil {
+			return core.Error(core.ParseError, "cannot marshal replica grant change for vault %s", v.ID, err)
+		}
+		err = v.stageBlockChange(bc)
+		if err != nil {
+			return core.Error(core.GenericError, "cannot stage replica grant change for vault %s", v.ID, err)
+		}
+	}
+
+	switch {
+	case options.Async:
+		go v.syncBlockChain(false)
+	case options.Scheduled:
+		// Do nothing, sync will be done later
+	default:
+		err = v.syncBlockChain(false)
+		if err != nil {
+			return core.Error(core.GenericError, "cannot synchronize blockchain for replica grant change", err)
+		}
+	}
+
+	core.End("")
+	return nil
+}
+
+// GetReplicaGrants returns the grants on replica tables and statements defined in the vault.
+func (v *Vault) GetReplicaGrants() ([]ReplicaGrant, error) {
+	core.Start("vault %s", v.ID)
+	rows, err := v.DB.Query("GET_REPLICA_GRANTS", sqlx.Args{"vault": v.ID})
+	if err != nil {
+		return nil, core.Error(core.DbError, "cannot get replica grants for vault %s", v.ID, err)
+	}
+	defer rows.Close()
+
+	var grants []ReplicaGrant
+	for rows.Next() {
+		var rg ReplicaGrant
+		err = rows.Scan(&rg.Target, &rg.UserId, &rg.Access)
+		if err != nil {
+			return nil, core.Error(core.DbError, "cannot scan replica grant", err)
+		}
+		grants = append(grants, rg)
+	}
+	core.End("%d grants", len(grants))
+	return grants, nil
+}
@@ -0,0 +1,42 @@
+package vault
+
+import (
+	"testing"
+
+	"github.com/stregato/bao/lib/core"
+	"github.com/stregato/bao/lib/security"
+	"github.com/stregato/bao/lib/sqlx"
+	"github.com/stregato/bao/lib/store"
+)
+
+func TestReplicaGrants(t *testing.T) {
+	bob, _ := security.NewKeyPairMust()
+	_, aliceSecret := security.NewKeyPairMust()
+
+	db := sqlx.NewTestDB(t, "vault.db", "")
+	store := store.LoadTestStore(t, "test")
+	defer store.Close()
+
+	v, err := Create(aliceSecret, store, db, Config{})
+	core.TestErr(t, err, "Create failed: %v")
+	defer v.Close()
+
+	err = v.SetReplicaGrants(IOOption{}, ReplicaGrant{Target: "prices"})
+	core.Assert(t, err != nil, "a grant needs a user or an access")
+	err = v.SetReplicaGrants(IOOption{},
+		ReplicaGrant{Target: "prices", Access: Admin},
+		ReplicaGrant{Target: "prices", UserId: bob},
+		ReplicaGrant{Target: "INSERT_ORDER", Access: Write},
+	)
+	core.TestErr(t, err, "SetReplicaGrants failed: %v")
+	err = v.SetReplicaGrants(IOOption{}, ReplicaGrant{Target: "prices", UserId: bob, Revoke: true})
+	core.TestErr(t, err, "SetReplicaGrants failed: %v")
+
+	grants, err := v.GetReplicaGrants()
+	core.TestErr(t, err, "GetReplicaGrants failed: %v")
+	core.Assert(t, len(grants) == 2, "expected 2 grants, got %d", len(grants))
+	core.Assert(t, grants[0].Target == "INSERT_ORDER" && grants[1].Target == "prices", "unexpected grants %v", grants)
+	core.Assert(t, grants[1].Allows(v.UserID, ReadWriteAdmin), "admins can write prices")
+	core.Assert(t, !grants[1].Allows(bob, ReadWrite), "writers cannot write prices")
+	core.Assert(t, grants[0].Allows(bob, ReadWrite), "writers can run INSERT_ORDER")
+}
@@ -0,0 +1,249 @@
+package vault
+
+import (
+	"fmt"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/stregato/bao/lib/core"
+	"github.com/stregato/bao/lib/security"
+	"github.com/stregato/bao/lib/sqlx"
+)
+
+// RetentionPolicy defines how long the files under a path prefix are kept and how many versions of each file
+// are retained. When more policies match a file, the one with the longest prefix applies. A policy replaces
+// Config.Retention and IOOption.Retention for the files under its prefix, including files written before the
+// policy was set. A policy with no retention, no forever flag and no version limit removes the policy.
+type RetentionPolicy struct {
+	Prefix      string        `json:"prefix"`                // Path prefix the policy applies to. Empty for the whole vault
+	Retention   time.Duration `json:"retention,omitempty"`   // How long files are kept; 0 uses the vault retention
+	Forever     bool          `json:"forever,omitempty"`     // Files are never removed by retention
+	MaxVersions int           `json:"maxVersions,omitempty"` // Versions kept for each file; 0 keeps all versions until expiry
+}
+
+// retentionSeconds returns the retention stored in the DB: -1 keeps files forever, 0 uses the vault retention.
+func (rp *RetentionPolicy) retentionSeconds() int64 {
+	if rp.Forever {
+		return -1
+	}
+	return int64(rp.Retention / time.Second)
+}
+
+func (rp *RetentionPolicy) Apply(v *Vault, author security.PublicID) error {
+	core.Start("applying RetentionPolicy by author %s", author)
+
+	adminRight, err := v.hasAdminRight(author)
+	if err != nil {
+		return core.Error(core.DbError, "cannot get access for author %s: %s", author, err.Error(), err)
+	}
+	if !adminRight {
+		return core.Error(core.AuthError, "author %s does not have admin rights to set retention policies in vault %s", author, v.ID)
+	}
+
+	prefix := normalizePrefix(rp.Prefix)
+	args := sqlx.Args{"vault": v.ID, "prefix": prefix, "retention": rp.retentionSeconds(), "maxVersions": rp.MaxVersions}
+	if rp.retentionSeconds() == 0 && rp.MaxVersions <= 0 {
+		_, err = v.DB.Exec("DELETE_RETENTION_POLICY", args)
+	} else {
+		_, err = v.DB.Exec("SET_RETENTION_POLICY", args)
+	}
+	if err != nil {
+		return core.Error(core.DbError, "cannot set retention policy on %s in vault %s", prefix, v.ID, err)
+	}
+
+	// Update the expiration of the files already in the vault so that cleanup enforces the new policy
+	_, err = v.DB.Exec("UPDATE_POLICY_EXPIRATIONS", sqlx.Args{
+		"vault":     v.ID,
+		"prefix":    prefix,
+		"retention": int64(effectiveRetention(v.Config.Retention, 0) / time.Second),
+	})
+	if err != nil {
+		return core.Error(core.DbError, "cannot update expirations for retention policy on %s in vault %s", prefix, v.ID, err)
+	}
+	core.End("")
+	return nil
+}
+
+func (rp *RetentionPolicy) String() string {
+	return fmt.Sprintf("RetentionPolicy: prefix=%s, retention=%s, forever=%t, maxVersions=%d", rp.Prefix, rp.Retention,
+		rp.Forever, rp.MaxVersions)
+}
+
+// SetRetentionPolicy records per-prefix retention and version-count policies in the blockchain. Only admins can
+// set policies.
+func (v *Vault) SetRetentionPolicy(options IOOption, policies ...RetentionPolicy) error {
+	core.Start("%d policies", len(policies))
+
+	adminRight, err := v.hasAdminRight(v.UserID)
+	if err != nil {
+		return core.Error(core.DbError, "cannot get access for user %s", v.UserID, err)
+	}
+	if !adminRight {
+		return core.Error(core.AuthError, "only the vault creator or an admin can set retention policies")
+	}
+
+	for _, rp := range policies {
+		if rp.Retention < 0 || rp.MaxVersions < 0 {
+			return core.Error(core.ParseError, "invalid retention policy %s", rp.String())
+		}
+		rp.Prefix = normalizePrefix(rp.Prefix)
+		bc, err := marshalChange(&rp)
+		if err != nil {
+			return core.Error(core.ParseError, "cannot marshal retention policy change for vault %s", v.ID, err)
+		}
+		err = v.stageBlockChange(bc)
+		if err != nil {
+			return core.Error(core.GenericError, "cannot stage retention policy change for vault %s", v.ID, err)
+		}
+	}
+
+	switch {
+	case options.Async:
+		go v.syncBlockChain(false)
+	case options.Scheduled:
+		// Do nothing, sync will be done later
+	default:
+		err = v.syncBlockChain(false)
+		if err != nil {
+			return core.Error(core.GenericError, "cannot synchronize blockchain for retention policy change", err)
+		}
+	}
+
+	core.End("")
+	return nil
+}
+
+// GetRetentionPolicies returns the retention policies defined in the vault.
+func (v *Vault) GetRetentionPolicies() ([]RetentionPolicy, error) {
+	core.Start("vault %s", v.ID)
+	rows, err := v.DB.Query("GET_RETENTION_POLICIES", sqlx.Args{"vault": v.ID})
+	if err != nil {
+		return nil, core.Error(core.DbError, "cannot get retention policies for vault %s", v.ID, err)
+	}
+	defer rows.Close()
+
+	var policies []RetentionPolicy
+	for rows.Next() {
+		var rp RetentionPolicy
+		var retention int64
+		err = rows.Scan(&rp.Prefix, &retention, &rp.MaxVersions)
+		if err != nil {
+			return nil, core.Error(core.DbError, "cannot scan retention policy", err)
+		}
+		rp.Forever = retention < 0
+		if retention > 0 {
+			rp.Retention = time.Duration(retention) * time.Second
+		}
+		policies = append(policies, rp)
+	}
+	core.End("%d policies", len(policies))
+	return policies, nil
+}
+
+// policyExpiresAt returns the expiration of the file with the given name and modification time according to
+// the retention policy that applies to it. It returns def when no policy defines the retention of the file.
+func (v *Vault) policyExpiresAt(name string, modTime time.Time, def time.Time) time.Time {
+	var retention int64
+	var maxVersions int
+	err := v.DB.QueryRow("GET_RETENTION_POLICY_FOR_NAME", sqlx.Args{
+		"vault": v.ID,
+		"name":  strings.Trim(nameWithoutEncryptionToken(name), "/"),
+	}, &retention, &maxVersions)
+	if err == sqlx.ErrNoRows {
+		return def
+	}
+	if err != nil {
+		core.LogError("cannot get retention policy for %s: %v", name, err)
+		return def
+	}
+	switch {
+	case retention < 0:
+		return time.Time{}
+	case retention > 0:
+		return truncateToSecond(modTime.Add(time.Duration(retention) * time.Second))
+	default:
+		return def
+	}
+}
+
+// hasRetainedFiles returns true when a retention policy keeps some files in the store dir after the time now.
+func (v *Vault) hasRetainedFiles(storeDir string, now time.Time) bool {
+	var count int
+	err := v.DB.QueryRow("COUNT_RETAINED_FILES_IN_STORE_DIR", sqlx.Args{"vault": v.ID, "storeDir": storeDir, "now": now.Unix()}, &count)
+	if err != nil {
+		core.LogError("cannot count retained files in %s: %v", storeDir, err)
+		return true // be conservative and keep the segment
+	}
+	return count > 0
+}
+
+// pruneVersions removes the versions that exceed the version-count policies. Held versions are kept.
+func (v *Vault) pruneVersions(now time.Time) (int64, error) {
+	rows, err := v.DB.Query("GET_VERSIONS_TO_PRUNE", sqlx.Args{
+		"vault": v.ID,
+		"now":   now.Unix(),
+		"limit": 5000,
+	})
+	if err != nil {
+		return 0, core.Error(core.DbError, "cannot query versions to prune", err)
+	}
+	type storeObject struct{ storeDir, storeName string }
+	var objects []storeObject
+	for rows.Next() {
+		var o storeObject
+		if err := rows.Scan(&o.storeDir, &o.storeName); err != nil {
+			rows.Close()
+			return 0, core.Error(core.DbError, "cannot scan version to prune", err)
+		}
+		objects = append(objects, o)
+	}
+	rows.Close()
+
+	var pruned int64
+	for _, o := range objects {
+		err = v.deleteStoreObject(o.storeDir, o.storeName)
+		if err != nil {
+			return pruned, err
+		}
+		pruned++
+	}
+	return pruned, nil
+}
+
+// deleteStoreObject removes the head, body and escrow copy of a file from the store and marks the file rows as
+// deleted, so that their allocated size is reclaimed. A packed body is removed with the pack when no other file
+// is left in it, and the chunks of a chunked body are collected by retention when no other file uses them.
+func (v *Vault) deleteStoreObject(storeDir, storeName string) error {
+	// Best-effort store cleanup for both head and body.
+	_ = v.store.Delete(path.Join(storeDir, "h", storeName))
+	_ = v.store.Delete(path.Join(storeDir, "b", storeName))
+	_ = v.store.Delete(path.Join(storeDir, "e", storeName))
+	if err := v.releasePack(storeDir, storeName); err != nil {
+		return err
+	}
+	if _, err := v.DB.Exec("DELETE_FILE_CHUNKS", sqlx.Args{
+		"vault":     v.ID,
+		"storeDir":  storeDir,
+		"storeName": storeName,
+	}); err != nil {
+		return core.Error(core.DbError, "cannot delete chunks of %s/%s", storeDir, storeName, err)
+	}
+
+	if _, err := v.DB.Exec("DELETE_FILES_BY_STORE_OBJECT", sqlx.Args{
+		"vault":     v.ID,
+		"storeDir":  storeDir,
+		"storeName": storeName,
+	}); err != nil {
+		return core.Error(core.DbError, "cannot delete file rows for %s/%s", storeDir, storeName, err)
+	}
+
+	if _, err := v.DB.Exec("DELETE_FILE_EXPIRATION", sqlx.Args{
+		"vault":     v.ID,
+		"storeDir":  storeDir,
+		"storeName": storeName,
+	}); err != nil {
+		return core.Error(core.DbError, "cannot delete expiration row for %s/%s", storeDir, storeName, err)
+	}
+	return nil
+}
@@ -0,0 +1,78 @@
+package vault
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stregato/bao/lib/core"
+	"github.com/stregato/bao/lib/security"
+	"github.com/stregato/bao/lib/sqlx"
+	"github.com/stregato/bao/lib/store"
+)
+
+func TestRetentionPolicy(t *testing.T) {
+	alice := security.NewPrivateIDMust()
+	db := sqlx.NewTestDB(t, "vault_retention.db", "")
+	st := store.LoadTestStore(t, "test")
+	defer st.Close()
+
+	v, err := Create(alice, st, db, Config{Retention: 2 * time.Hour})
+	core.TestErr(t, err, "Create failed: %v")
+	defer v.Close()
+
+	write := func(name string) File {
+		file, err := v.Write(name, "", nil, IOOption{})
+		core.TestErr(t, err, "Write %s failed: %v", name)
+		_, err = v.WaitFiles(context.Background(), file.Id)
+		core.TestErr(t, err, "WaitFiles %s failed: %v", name)
+		file, err = v.Stat(name)
+		core.TestErr(t, err, "Stat %s failed: %v", name)
+		return file
+	}
+
+	old := write("old/a.txt")
+	err = v.SetRetentionPolicy(IOOption{},
+		RetentionPolicy{Prefix: "old", Retention: time.Minute},
+		RetentionPolicy{Prefix: "archive", Forever: true},
+		RetentionPolicy{Prefix: "docs", MaxVersions: 2},
+	)
+	core.TestErr(t, err, "SetRetentionPolicy failed: %v")
+	policies, err := v.GetRetentionPolicies()
+	core.TestErr(t, err, "GetRetentionPolicies failed: %v")
+	core.Assert(t, len(policies) == 3, "expected 3 policies, got %d", len(policies))
+
+	exp := getExpirationUnixSec(t, v, old.StoreDir, old.StoreName)
+	core.Assert(t, exp <= core.Now().Add(time.Minute).Unix(), "policy should apply to existing files: %d", exp)
+
+	archived := write("archive/a.txt")
+	core.Assert(t, archived.ExpiresAt.IsZero(), "files kept forever should not expire: %s", archived.ExpiresAt)
+
+	var docs []File
+	for i := 0; i < 3; i++ {
+		docs = append(docs, write("docs/a.txt"))
+	}
+	before, err := v.calculateAllocatedSize()
+	core.TestErr(t, err, "calculateAllocatedSize failed: %v")
+
+	pruned, err := v.pruneVersions(core.Now())
+	core.TestErr(t, err, "pruneVersions failed: %v")
+	core.Assert(t, pruned == 1, "expected 1 pruned version, got %d", pruned)
+	versions, err := v.Versions("docs/a.txt")
+	core.TestErr(t, err, "Versions failed: %v")
+	core.Assert(t, len(versions) == 2, "expected 2 versions, got %d", len(versions))
+	core.Assert(t, getFileFlagsByStoreObject(t, v, docs[0].StoreDir, docs[0].StoreName)&Deleted != 0,
+		"expected the oldest version to be pruned")
+	after, err := v.calculateAllocatedSize()
+	core.TestErr(t, err, "calculateAllocatedSize failed: %v")
+	core.Assert(t, after == before-docs[0].AllocatedSize, "allocated size should be reclaimed: %d -> %d", before, after)
+
+	_, err = v.cleanupExpiredFiles(core.Now().Add(2 * time.Minute))
+	core.TestErr(t, err, "cleanupExpiredFiles failed: %v")
+	core.Assert(t, getFileFlagsByStoreObject(t, v, old.StoreDir, old.StoreName)&Deleted != 0,
+		"expected old/a.txt to expire by policy")
+	core.Assert(t, getFileFlagsByStoreObject(t, v, docs[2].StoreDir, docs[2].StoreName)&Deleted == 0,
+		"expected docs/a.txt to follow the vault retention")
+	core.Assert(t, v.hasRetainedFiles(archived.StoreDir, core.Now().Add(24*time.Hour)),
+		"expected the segment of archive/a.txt to be retained")
+}
@@ -0,0 +1,182 @@
+package vault
+
+import (
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/stregato/bao/lib/core"
+	"github.com/stregato/bao/lib/security"
+)
+
+const (
+	signalsFolder       = "signals"
+	signalQueueSize     = 64
+	MaxSignalSize       = 16 * 1024 // Maximum size of the payload of a signal
+	presenceTopic       = "~presence"
+	presenceInterval    = 30 * time.Second
+	presenceTimeout     = 2*presenceInterval + 15*time.Second
+	presenceJoin        = "join"
+	presenceAlive       = "alive"
+	presenceLeave       = "leave"
+	reservedTopicPrefix = "~"
+)
+
+// Signal is an ephemeral message published on a topic by a member of the vault.
+type Signal struct {
+	Topic   string            `json:"topic"`
+	Payload []byte            `json:"payload"`
+	Author  security.PublicID `json:"author"`
+	Time    time.Time         `json:"time"`
+}
+
+// Presence is a member of the vault that is connected to the sync relay.
+type Presence struct {
+	UserID   security.PublicID `json:"userId"`
+	LastSeen time.Time         `json:"lastSeen"`
+}
+
+// Subscription receives the signals of a topic. Signals are dropped when C is full.
+type Subscription struct {
+	C     <-chan Signal
+	topic string
+	ch    chan Signal
+	v     *Vault
+}
+
+// signalHub keeps the subscriptions and the presence of the members. The zero value is ready to use.
+type signalHub struct {
+	mu       sync.Mutex
+	subs     map[*Subscription]struct{}
+	presence map[security.PublicID]time.Time
+}
+
+// Publish sends an ephemeral signal on topic to the other instances of the vault connected to the sync relay.
+// The signal is encrypted with the current vault key and never stored, so instances that are offline miss it.
+func (v *Vault) Publish(topic string, payload []byte) error {
+	core.Start("topic %s, payload %d bytes", topic, len(payload))
+	if topic == "" || strings.HasPrefix(topic, reservedTopicPrefix) {
+		return core.Error(core.GenericError, "invalid topic '%s'", topic)
+	}
+	if len(payload) > MaxSignalSize {
+		return core.Error(core.GenericError, "signal payload of %d bytes exceeds the maximum of %d", len(payload), MaxSignalSize)
+	}
+	if v.syncRelayCh == nil {
+		return core.Error(core.ConfigError, "sync relay is not running for vault %s", v.ID)
+	}
+	err := v.sendRelayEvent(path.Join(v.signalsRoot(), topic), nil, payload)
+	if err != nil {
+		return core.Error(core.NetError, "cannot publish signal on %s", topic, err)
+	}
+	core.End("")
+	return nil
+}
+
+// Subscribe returns a subscription to the signals published on topic, or on all topics when topic is empty.
+func (v *Vault) Subscribe(topic string) *Subscription {
+	ch := make(chan Signal, signalQueueSize)
+	s := &Subscription{C: ch, topic: topic, ch: ch, v: v}
+
+	v.signals.mu.Lock()
+	if v.signals.subs == nil {
+		v.signals.subs = map[*Subscription]struct{}{}
+	}
+	v.signals.subs[s] = struct{}{}
+	v.signals.mu.Unlock()
+	core.Info("subscribed to signals on '%s' in vault %s", topic, v.ID)
+	return s
+}
+
+// Next waits up to timeout for the next signal. It returns false on timeout or when the subscription is closed.
+func (s *Subscription) Next(timeout time.Duration) (Signal, bool) {
+	select {
+	case signal, ok := <-s.ch:
+		return signal, ok
+	case <-time.After(timeout):
+		return Signal{}, false
+	}
+}
+
+// Close cancels the subscription and closes C.
+func (s *Subscription) Close() {
+	s.v.signals.mu.Lock()
+	defer s.v.signals.mu.Unlock()
+	if _, ok := s.v.signals.subs[s]; ok {
+		delete(s.v.signals.subs, s)
+		close(s.ch)
+	}
+}
+
+// Presence returns the members connected to the sync relay, including the current user.
+func (v *Vault) Presence() []Presence {
+	now := core.Now()
+	v.signals.mu.Lock()
+	var members []Presence
+	for userID, lastSeen := range v.signals.presence {
+		if now.Sub(lastSeen) > presenceTimeout {
+			delete(v.signals.presence, userID)
+			continue
+		}
+		if userID != v.UserID {
+			members = append(members, Presence{UserID: userID, LastSeen: lastSeen})
+		}
+	}
+	v.signals.mu.Unlock()
+
+	if v.RelayStatus().Connected {
+		members = append(members, Presence{UserID: v.UserID, LastSeen: now})
+	}
+	sort.Slice(members, func(i, j int) bool { return members[i].UserID < members[j].UserID })
+	return members
+}
+
+// publishPresence announces the user to the other members: on join, periodically while connected and on leave.
+func (v *Vault) publishPresence(state string) {
+	if v.syncRelayCh == nil {
+		return
+	}
+	err := v.sendRelayEvent(path.Join(v.signalsRoot(), presenceTopic), nil, []byte(state))
+	if err != nil {
+		core.Info("cannot publish presence %s for vault %s: %v", state, v.ID, err)
+	}
+}
+
+// receiveSignal delivers a signal to the subscribers of its topic or, for presence signals, updates the members
+// online.
+func (v *Vault) receiveSignal(topic string, event relayEvent) {
+	if topic == presenceTopic {
+		v.signals.mu.Lock()
+		if v.signals.presence == nil {
+			v.signals.presence = map[security.PublicID]time.Time{}
+		}
+		if string(event.Data) == presenceLeave {
+			delete(v.signals.presence, event.Author)
+		} else {
+			v.signals.presence[event.Author] = core.Now()
+		}
+		v.signals.mu.Unlock()
+
+		// a member that joins learns about the others without waiting for their next heartbeat, also when it
+		// rejoins after a reconnection that the others did not notice
+		if string(event.Data) == presenceJoin {
+			go v.publishPresence(presenceAlive)
+		}
+		return
+	}
+
+	signal := Signal{Topic: topic, Payload: event.Data, Author: event.Author, Time: time.Unix(event.Time, 0)}
+	v.signals.mu.Lock()
+	defer v.signals.mu.Unlock()
+	for s := range v.signals.subs {
+		if s.topic != "" && s.topic != topic {
+			continue
+		}
+		select {
+		case s.ch <- signal:
+		default:
+			core.Info("subscription to '%s' in vault %s is full, dropping signal", s.topic, v.ID)
+		}
+	}
+}
@@ -0,0 +1,86 @@
+package vault
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stregato/bao/lib/core"
+	"github.com/stregato/bao/lib/relay"
+	"github.com/stregato/bao/lib/security"
+	"github.com/stregato/bao/lib/sqlx"
+	"github.com/stregato/bao/lib/store"
+)
+
+func waitPresence(v *Vault, userID security.PublicID, online bool, timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		found := false
+		for _, p := range v.Presence() {
+			found = found || p.UserID == userID
+		}
+		if found == online {
+			return true
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	return false
+}
+
+func TestSignals(t *testing.T) {
+	server, err := relay.Start("127.0.0.1:0")
+	core.TestErr(t, err, "cannot start relay: %v")
+	defer server.Close()
+
+	alice, aliceSecret := security.NewKeyPairMust()
+	bob, bobSecret := security.NewKeyPairMust()
+
+	db1 := sqlx.NewTestDB(t, "vault_alice.db", "")
+	store := store.LoadTestStore(t, "test")
+	defer store.Close()
+
+	va, err := Create(aliceSecret, store, db1, Config{SyncRelay: server.URL() + "/signals"})
+	core.TestErr(t, err, "Create failed: %v")
+	err = va.SyncAccess(IOOption{}, AccessChange{UserId: bob, Access: Read})
+	core.TestErr(t, err, "SyncAccess failed: %v")
+
+	db2 := sqlx.NewTestDB(t, "vault_bob.db", "")
+	vb, err := Open(bobSecret, alice, store, db2)
+	core.TestErr(t, err, "Open failed: %v")
+	defer vb.Close()
+
+	sub := vb.Subscribe("editing")
+	defer sub.Close()
+	all := vb.Subscribe("")
+	defer all.Close()
+
+	core.Assert(t, waitPresence(vb, alice, true, 5*time.Second), "bob should see alice online")
+	core.Assert(t, waitPresence(va, bob, true, 5*time.Second), "alice should see bob online")
+
+	err = va.Publish("editing", []byte("report.docx"))
+	core.TestErr(t, err, "Publish failed: %v")
+	signal, ok := sub.Next(5 * time.Second)
+	core.Assert(t, ok, "bob should receive the signal")
+	core.Assert(t, signal.Topic == "editing" && string(signal.Payload) == "report.docx" && signal.Author == alice,
+		"unexpected signal %+v", signal)
+	_, ok = all.Next(5 * time.Second)
+	core.Assert(t, ok, "subscriptions without topic receive all the signals")
+
+	err = va.Publish("cursor", []byte("10,20"))
+	core.TestErr(t, err, "Publish failed: %v")
+	signal, ok = all.Next(5 * time.Second)
+	core.Assert(t, ok && signal.Topic == "cursor", "unexpected signal %+v", signal)
+	_, ok = sub.Next(200 * time.Millisecond)
+	core.Assert(t, !ok, "signals on other topics must not be delivered")
+
+	err = va.Publish(presenceTopic, []byte(presenceLeave))
+	core.Assert(t, err != nil, "reserved topics cannot be published")
+	err = va.Publish("large", make([]byte, MaxSignalSize+1))
+	core.Assert(t, err != nil, "large payloads must be rejected")
+
+	va.Close()
+	core.Assert(t, waitPresence(vb, alice, false, 5*time.Second), "alice should be offline after closing the vault")
+
+	sub.Close()
+	_, ok = <-sub.C
+	core.Assert(t, !ok, "closing the subscription closes the channel")
+}
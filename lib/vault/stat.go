@@ -55,3 +55,14 @@ func (v *Vault) GetAuthor(name string) (security.PublicID, error) {
 	core.Info("successfully got author for %s: %s", name, file.AuthorId)
 	return file.AuthorId, nil
 }
+
+// StoreTime returns the time the store received the head of the file. Unlike the modification time, which the
+// author sets, the store time is the same for all instances.
+func (v *Vault) StoreTime(file File) (time.Time, error) {
+	name := path.Join(file.StoreDir, "h", file.StoreName)
+	info, err := v.store.Stat(name)
+	if err != nil {
+		return time.Time{}, core.Error(core.FileError, "cannot stat head %s", name, err)
+	}
+	return info.ModTime(), nil
+}
@@ -11,12 +11,11 @@ import (
 	"sort"
 
 	"github.com/stregato/bao/lib/core"
+	"github.com/stregato/bao/lib/security"
 	"github.com/stregato/bao/lib/sqlx"
 	"github.com/stregato/bao/lib/store"
 )
 
-const ecBodyOverheadBytes = 129
-
 // Sync synchronizes the filesystem for the specified groups.
 // If no groups are specified, it returns an error.
 // It returns a list of new files that were added during the synchronization.
@@ -57,86 +56,124 @@ func (v *Vault) Sync() (newFiles []File, err error) {
 
 	var errX error
 	for _, segment := range segments {
-		storeDir := path.Join(baseDir, segment)
-		ls, err2 := v.store.ReadDir(path.Join(storeDir, "h"), store.Filter{})
-		if err2 != nil {
-			continue // skip if directory does not exist or is not readable
+		files, err := v.syncSegment(path.Join(baseDir, segment), false)
+		if err != nil {
+			errX = err
 		}
+		newFiles = append(newFiles, files...)
+	}
+	if errX != nil {
+		return nil, core.Error(core.GenericError, "errors occurred during synchronization", errX)
+	}
+	if err := v.markChangedAsSeen(baseDir); err != nil {
+		core.Info("cannot mark data guard file as seen for %s: %v", baseDir, err)
+	}
 
-		knowns, err2 := v.getKnownFilesNames(storeDir)
-		if err2 != nil {
-			return nil, core.Error(core.DbError, "cannot get known files in sealed dir %s", storeDir, err2)
-		}
+	core.End("synchronized vault %s in %s, %d new files", v.ID, time.Since(now), len(newFiles))
+	return newFiles, nil
 
-		n := 0
-		for _, entry := range ls {
-			name := entry.Name()
-			if !knowns[name] && !v.isIgnoredStoreName(storeDir, name) {
-				ls[n] = entry
-				n++
-			}
-		}
-		ls = ls[:n] // Filter out known files
+}
+
+// syncSegment imports the heads of a segment that are not known yet. When late is true, the segment is closed and
+// the heads found are late arrivals, which are recorded for the clock skew diagnostic.
+func (v *Vault) syncSegment(storeDir string, late bool) (newFiles []File, err error) {
+	core.Start("storeDir %s, late %t", storeDir, late)
+	knowns, err := v.getKnownFilesNames(storeDir)
+	if err != nil {
+		return nil, core.Error(core.DbError, "cannot get known files in sealed dir %s", storeDir, err)
+	}
 
-		type syncResult struct {
-			storeName string
+	// Heads in the manifests are imported without reading them one by one. The listing finds the others,
+	// and only the heads newer than the last complete listing are considered. Late heads are named before they
+	// arrive, so the listing of a closed segment for late heads includes all the names.
+	heads, part, head := v.syncManifests(storeDir, knowns)
+	listedAt := core.Now()
+	filter := store.Filter{After: v.listingCutoff(storeDir)}
+	if !late {
+		filter.AfterName = v.listingAfterName(storeDir, head)
+	}
+	ls, listErr := v.store.ReadDir(path.Join(storeDir, "h"), filter)
+	if listErr != nil && len(heads) == 0 {
+		core.End("cannot list %s", storeDir)
+		return nil, nil // skip if directory does not exist or is not readable
+	}
 
-			file     File
-			synced   bool
-			deferred bool
-			err      error
+	var names []string
+	storeTimes := map[string]time.Time{}
+	for name := range heads {
+		if !v.isIgnoredStoreName(storeDir, name) {
+			names = append(names, name)
 		}
-		parallelism := min(16, len(ls)) // Limit parallelism to the number of files
-		in := make(chan string, parallelism)
-		out := make(chan syncResult, 10)
-		var wait sync.WaitGroup
-
-		for i := 0; i < parallelism; i++ {
-			wait.Add(1)
-			go func() { // Use a goroutine to handle each file
-				defer wait.Done()
-				name, ok := <-in
-				if !ok {
-					return // channel closed
-				}
-
-				file, synced, deferred, err := v.syncronizeFile(storeDir, name)
-				out <- syncResult{storeName: name, file: file, synced: synced, deferred: deferred, err: err}
-			}()
+	}
+	for _, entry := range ls {
+		name := entry.Name()
+		if _, ok := heads[name]; !ok && !knowns[name] && !v.isIgnoredStoreName(storeDir, name) {
+			names = append(names, name)
+			storeTimes[name] = entry.ModTime()
 		}
-		go func() {
-			for _, l := range ls {
-				in <- l.Name() // send file name to the worker
+	}
+
+	type syncResult struct {
+		storeName string
+
+		file     File
+		synced   bool
+		deferred bool
+		err      error
+	}
+	parallelism := min(16, len(names)) // Limit parallelism to the number of files
+	in := make(chan string, parallelism)
+	out := make(chan syncResult, 10)
+	var wait sync.WaitGroup
+
+	for i := 0; i < parallelism; i++ {
+		wait.Add(1)
+		go func() { // Use a goroutine to handle each file
+			defer wait.Done()
+			for name := range in {
+				file, synced, deferred, err := v.syncronizeHead(storeDir, name, heads[name])
+				out <- syncResult{storeName: name, file: file, synced: synced, deferred: deferred, err: err}
 			}
-			close(in) // close the input channel after sending all file names
-		}()
-		go func() {
-			wait.Wait() // wait for all workers to finish
-			close(out)  // close the output channel
 		}()
+	}
+	go func() {
+		for _, name := range names {
+			in <- name // send file name to the worker
+		}
+		close(in) // close the input channel after sending all file names
+	}()
+	go func() {
+		wait.Wait() // wait for all workers to finish
+		close(out)  // close the output channel
+	}()
 
-		for res := range out {
-			if res.err != nil {
-				errX = res.err
-				core.Info("error synchronizing file in batch %s: %v", segment, res.err)
-				continue
-			}
-			if !res.synced || res.deferred {
-				continue
-			}
-			newFiles = append(newFiles, res.file)
+	var errX error
+	complete := listErr == nil
+	for res := range out {
+		if res.err != nil {
+			errX = res.err
+			complete = false
+			core.Info("error synchronizing file in batch %s: %v", storeDir, res.err)
+			continue
 		}
+		if res.deferred {
+			complete = false
+		}
+		if !res.synced || res.deferred {
+			continue
+		}
+		if storeTime, ok := storeTimes[res.storeName]; ok {
+			v.recordClockSample(res.file.AuthorId, res.file.ModTime, storeTime, late)
+		}
+		newFiles = append(newFiles, res.file)
 	}
-	if errX != nil {
-		return nil, core.Error(core.GenericError, "errors occurred during synchronization", errX)
-	}
-	if err := v.markChangedAsSeen(baseDir); err != nil {
-		core.Info("cannot mark data guard file as seen for %s: %v", baseDir, err)
+	if complete {
+		v.setWatermark(storeDir, listedAt)
+		v.setManifestPosition(storeDir, part, head)
 	}
 
-	core.End("synchronized vault %s in %s, %d new files", v.ID, time.Since(now), len(newFiles))
-	return newFiles, nil
-
+	core.End("%d new files in %s", len(newFiles), storeDir)
+	return newFiles, errX
 }
 
 func ignoredStoreNameKey(storeDir, storeName string) string {
@@ -237,12 +274,20 @@ func (v *Vault) getKnownFilesNames(storeDir string) (map[string]bool, error) {
 //   - synced=false, deferred=false with nil error when the file is valid but not addressed to this user
 //   - error for real failures
 func (v *Vault) syncronizeFile(storeDir, storeName string) (file File, synced bool, deferred bool, err error) {
-	core.Start("storeDir %s, storeName %s", storeDir, storeName)
+	return v.syncronizeHead(storeDir, storeName, nil)
+}
+
+// syncronizeHead imports the file with the given head, e.g. received in a relay notification. When head is nil,
+// it reads the head from the store.
+func (v *Vault) syncronizeHead(storeDir, storeName string, head []byte) (file File, synced bool, deferred bool, err error) {
+	core.Start("storeDir %s, storeName %s, head %d bytes", storeDir, storeName, len(head))
 
 	n := path.Join(storeDir, "h", storeName)
-	head, err := store.ReadFile(v.store, n)
-	if err != nil {
-		return File{}, false, false, core.Error(core.FileError, "cannot read sealed file %s", n, err)
+	if head == nil {
+		head, err = store.ReadFile(v.store, n)
+		if err != nil {
+			return File{}, false, false, core.Error(core.FileError, "cannot read sealed file %s", n, err)
+		}
 	}
 
 	file, notForMe, retryAfterBlockchain, err := decodeHead(head, v.UserSecret, v.getKey, v.getUserByShortId)
@@ -263,6 +308,7 @@ func (v *Vault) syncronizeFile(storeDir, storeName string) (file File, synced bo
 			return file, false, true, nil
 		}
 	}
+	file.ExpiresAt = v.policyExpiresAt(file.Name, file.ModTime, file.ExpiresAt)
 	if err := v.setFileExpiration(storeDir, storeName, file.ExpiresAt); err != nil {
 		return File{}, false, false, err
 	}
@@ -271,14 +317,22 @@ func (v *Vault) syncronizeFile(storeDir, storeName string) (file File, synced bo
 		core.End("file %s is addressed to another user, skipping", n)
 		return file, false, false, nil
 	}
+	if v.violatesHold(file, storeDir, storeName) {
+		v.markIgnoredStoreName(storeDir, storeName)
+		core.End("file %s is on hold, ignoring delete or overwrite from %s", file.Name, file.AuthorId)
+		return file, false, false, nil
+	}
 
 	bodyReadyCheckThreshold := core.DefaultIfZero(v.Config.BodyReadyCheckThreshold, 0)
-	if file.Size > bodyReadyCheckThreshold {
+	if file.Size > bodyReadyCheckThreshold && file.Flags&Chunked == 0 { // chunks are written before the head
 		expectedBodySize := file.Size
 		if file.Flags&EcEncryption != 0 {
-			expectedBodySize += ecBodyOverheadBytes
+			expectedBodySize += security.EcReaderOverhead(file.EcRecipient)
 		}
 		bodyPath := path.Join(storeDir, "b", storeName)
+		if file.Pack != nil {
+			bodyPath = path.Join(storeDir, packFolder, file.Pack.Name)
+		}
 		bodyInfo, statErr := v.store.Stat(bodyPath)
 		if statErr != nil {
 			if os.IsNotExist(statErr) {
@@ -287,7 +341,12 @@ func (v *Vault) syncronizeFile(storeDir, storeName string) (file File, synced bo
 			}
 			return File{}, false, false, core.Error(core.FileError, "cannot stat body file %s", bodyPath, statErr)
 		}
-		if bodyInfo.Size() != expectedBodySize {
+		if file.Pack != nil {
+			if file.Pack.Length != expectedBodySize || bodyInfo.Size() < file.Pack.Offset+file.Pack.Length {
+				core.Info("pack %s does not contain the body of %s, deferring head import", bodyPath, file.Name)
+				return file, false, true, nil
+			}
+		} else if bodyInfo.Size() != expectedBodySize {
 			core.Info("body %s size mismatch (got %d expected %d), deferring head import", bodyPath, bodyInfo.Size(), expectedBodySize)
 			return file, false, true, nil
 		}
@@ -301,6 +360,14 @@ func (v *Vault) syncronizeFile(storeDir, storeName string) (file File, synced bo
 	file.AllocatedSize = int64(len(head)) + file.Size
 	file.StoreDir = storeDir
 	file.StoreName = storeName
+	overQuota, err := v.isOverQuota(file.AuthorId, file.AllocatedSize)
+	if err != nil {
+		return File{}, false, false, core.Error(core.DbError, "cannot check quota for author of %s", n, err)
+	}
+	if overQuota {
+		core.Info("file %s exceeds the quota of author %s, flagging as over quota", file.Name, file.AuthorId)
+		file.Flags |= OverQuota
+	}
 	file, err = v.writeFileHeadToDB(file)
 	if err != nil {
 		return File{}, false, false, core.Error(core.DbError, "cannot write file head to DB for %s", n, err)
@@ -345,6 +412,16 @@ func (v *Vault) writeFileHeadToDB(file File) (File, error) {
 	if err := v.setFileExpiration(file.StoreDir, file.StoreName, file.ExpiresAt); err != nil {
 		return File{}, err
 	}
+	if file.Pack != nil {
+		if err := v.setFilePack(file.StoreDir, file.StoreName, *file.Pack); err != nil {
+			return File{}, err
+		}
+	}
+	if file.Chunks != nil {
+		if err := v.setFileChunks(file.StoreDir, file.StoreName, file.Chunks); err != nil {
+			return File{}, err
+		}
+	}
 	id, err := r.LastInsertId()
 	if err != nil {
 		return File{}, core.Error(core.DbError, "cannot get file ID for %s/%s", dir, name, err)
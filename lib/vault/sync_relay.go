@@ -2,15 +2,19 @@ package vault
 
 import (
 	"fmt"
+	"math/rand"
 	"net/url"
 	"os"
 	"path"
+	"slices"
 	"strings"
 	"sync"
 	"time"
 
 	"github.com/stregato/bao/lib/core"
-	"golang.org/x/net/websocket"
+	"github.com/stregato/bao/lib/relay"
+	"github.com/stregato/bao/lib/security"
+	"github.com/stregato/bao/lib/sqlx"
 )
 
 const watchQueueSize = 1024
@@ -23,6 +27,7 @@ func (v *Vault) relayWatchFolders() []string {
 	return []string{
 		v.dataRoot(),
 		v.blockChainRoot(),
+		v.signalsRoot(),
 	}
 }
 
@@ -36,26 +41,38 @@ func (v *Vault) startSyncRelay() error {
 		return nil
 	}
 
-	// Open or reuse the websocket connection to the sync relay server
+	// Open or reuse the connection to the sync relay server
 	client, err := getOrCreateWatchClient(v.Config.SyncRelay)
 	if err != nil {
 		return err
 	}
 
+	// the channel is ready before the relay accepts the auth, which triggers the presence join
+	v.syncRelayCh = make(chan relayNotification, watchQueueSize)
 	client.mu.Lock()
-	if _, exists := client.subscribers[v.ID]; !exists {
-		for _, folder := range v.relayWatchFolders() {
-			if err := websocket.Message.Send(client.conn, watchAddPrefix+folder); err != nil {
-				client.mu.Unlock()
-				return core.Error(core.NetError, "cannot send watch add message", err)
-			}
+	if client.closed {
+		client.mu.Unlock()
+		v.syncRelayCh = nil
+		return core.Error(core.NetError, "connection to sync relay %s closed", v.Config.SyncRelay)
+	}
+	// While the client reconnects, the subscription happens on the new connection
+	if client.connected {
+		err := client.authenticate(v)
+		if _, exists := client.subscribers[v.ID]; err == nil && !exists {
+			err = client.watch(v)
 		}
+		if err != nil {
+			client.mu.Unlock()
+			v.syncRelayCh = nil
+			return err
+		}
+	}
+	if _, exists := client.subscribers[v.ID]; !exists {
 		client.subscribers[v.ID] = make(map[string]*Vault)
 	}
 	instanceID := v.relayClientID()
 	client.subscribers[v.ID][instanceID] = v
 	client.mu.Unlock()
-	v.syncRelayCh = make(chan string, watchQueueSize)
 	core.Info("sync relay started for vault %s with clientID %s on %s", v.ID, instanceID, v.Config.SyncRelay)
 
 	go v.relayLoop()
@@ -65,30 +82,63 @@ func (v *Vault) startSyncRelay() error {
 func (v *Vault) relayLoop() {
 	defer v.cleanupSyncRelay()
 
+	ch := v.syncRelayCh
 	v.Sync()
+	heartbeat := time.NewTicker(presenceInterval)
+	defer heartbeat.Stop()
+
+	for {
+		select {
+		case n, ok := <-ch:
+			if !ok {
+				return
+			}
+			v.handleRelayNotification(n)
+		case <-heartbeat.C:
+			v.publishPresence(presenceAlive)
+		}
+	}
+}
+
+func (v *Vault) handleRelayNotification(n relayNotification) {
+	if n.accepted {
+		// the relay may start while the blockchain is imported, before the vault has the keys to seal the join
+		v.blockChainMu.Lock()
+		v.blockChainMu.Unlock()
+		v.publishPresence(presenceJoin)
+		return
+	}
 	blockchainPrefix := v.blockChainRoot()
 	dataPrefix := v.dataRoot()
+	signalsPrefix := v.signalsRoot()
 
-	for name := range v.syncRelayCh {
-		core.Info("relay loop received event for vault %s: %s", v.ID, name)
-		switch {
-		case strings.HasPrefix(name, blockchainPrefix+"/"):
-			core.Info("relay loop triggering blockchain sync for vault %s due to %s", v.ID, name)
-			v.syncBlockChain(true)
-		case strings.HasPrefix(name, dataPrefix+"/"):
-			core.Info("relay loop triggering data sync for vault %s due to %s", v.ID, name)
-			now := core.Now()
-			dir, name := path.Split(name)
-			dir = path.Clean(dir)
-			file, synced, deferred, err := v.syncronizeFile(dir, name)
-			if err != nil {
-				core.Error("failed to sync file %s/%s/%s: %v", v.ID, dir, name, err)
-			} else if deferred {
-				v.scheduleDeferredRelayRetry(dir, name, file.Size)
-			} else if synced {
-				v.lastSyncAt = now
-			}
+	event, err := v.openRelayEvent(n.clientID, n.payload)
+	if err != nil {
+		core.Info("relay loop dropping event for vault %s from %s: %v", v.ID, n.clientID, err)
+		return
+	}
+	name, head := event.Name, event.Head
+	core.Info("relay loop received event for vault %s: %s", v.ID, name)
+	switch {
+	case strings.HasPrefix(name, blockchainPrefix+"/"):
+		core.Info("relay loop triggering blockchain sync for vault %s due to %s", v.ID, name)
+		v.syncBlockChain(true)
+	case strings.HasPrefix(name, dataPrefix+"/"):
+		core.Info("relay loop triggering data sync for vault %s due to %s", v.ID, name)
+		now := core.Now()
+		dir, name := path.Split(name)
+		dir = path.Clean(dir)
+		// the head in the notification saves a read from the store
+		file, synced, deferred, err := v.syncronizeHead(dir, name, head)
+		if err != nil {
+			core.Error("failed to sync file %s/%s/%s: %v", v.ID, dir, name, err)
+		} else if deferred {
+			v.scheduleDeferredRelayRetry(dir, name, file.Size)
+		} else if synced {
+			v.lastSyncAt = now
 		}
+	case strings.HasPrefix(name, signalsPrefix+"/"):
+		v.receiveSignal(strings.TrimPrefix(name, signalsPrefix+"/"), event)
 	}
 }
 
@@ -144,9 +194,22 @@ func (v *Vault) scheduleDeferredRelayRetry(storeDir, storeName string, size int6
 	}()
 }
 
+// catchUpRelay syncs the vault after a reconnection to the relay, since the notifications sent while the
+// connection was down are lost.
+func (v *Vault) catchUpRelay() {
+	if v.syncRelayCh == nil {
+		return
+	}
+	core.Info("sync relay reconnected, catching up vault %s", v.ID)
+	v.syncBlockChain(true)
+	v.Sync()
+}
+
 func (v *Vault) cleanupSyncRelay() {
-	client, err := getOrCreateWatchClient(v.Config.SyncRelay)
-	if err != nil {
+	watchClientsMu.Lock()
+	client := watchClients[v.Config.SyncRelay]
+	watchClientsMu.Unlock()
+	if client == nil {
 		return
 	}
 
@@ -166,7 +229,7 @@ func (v *Vault) cleanupSyncRelay() {
 	if len(subs) == 0 {
 		delete(client.subscribers, v.ID)
 
-		// If no more subscribers for any vault, close the websocket
+		// If no more subscribers for any vault, close the connection
 		if len(client.subscribers) == 0 {
 			dropWatchClient(v.Config.SyncRelay, client)
 		}
@@ -178,24 +241,76 @@ func (v *Vault) stopSyncRelay() {
 		return // Sync relay not running, nothing to do
 	}
 
+	v.publishPresence(presenceLeave)
 	close(v.syncRelayCh)
 	v.syncRelayCh = nil
 }
 
+// RelayStatus is the state of the connection to the sync relay.
+type RelayStatus struct {
+	Enabled    bool      `json:"enabled"`             // The sync relay is configured and running for the vault
+	Connected  bool      `json:"connected"`           // The connection is open; false while reconnecting
+	LastEvent  time.Time `json:"lastEvent"`           // Time of the last notification received from the relay
+	Reconnects int       `json:"reconnects"`          // Number of successful reconnections
+	LastError  string    `json:"lastError,omitempty"` // Last connection error, if any
+}
+
+// RelayStatus returns the state of the connection to the sync relay.
+func (v *Vault) RelayStatus() RelayStatus {
+	if v.syncRelayCh == nil {
+		return RelayStatus{}
+	}
+
+	watchClientsMu.Lock()
+	client := watchClients[v.Config.SyncRelay]
+	watchClientsMu.Unlock()
+	if client == nil {
+		return RelayStatus{Enabled: true}
+	}
+
+	client.mu.Lock()
+	defer client.mu.Unlock()
+	status := RelayStatus{
+		Enabled:    true,
+		Connected:  client.connected,
+		LastEvent:  client.lastEventAt,
+		Reconnects: client.reconnects,
+	}
+	if client.lastError != nil {
+		status.LastError = client.lastError.Error()
+	}
+	return status
+}
+
 const watchAddPrefix = "+"
 const watchRemovePrefix = "-"
 
+// Delays between reconnection attempts grow exponentially from relayReconnectMinDelay to relayReconnectMaxDelay.
+const (
+	relayReconnectMinDelay = 250 * time.Millisecond
+	relayReconnectMaxDelay = 30 * time.Second
+)
+
 type syncClient struct {
-	conn *websocket.Conn
+	server string
+	conn   relay.Conn
 	// Subscribers grouped by vault ID.
 	subscribers map[string]map[string]*Vault
 	mu          sync.Mutex
+
+	connected   bool
+	closed      bool // set when the last subscriber leaves; stops reconnections
+	lastEventAt time.Time
+	reconnects  int
+	lastError   error
 }
 
 var watchClientsMu sync.Mutex
 var watchClients = map[string]*syncClient{}
 
-func (v *Vault) notifyChange(filename string) error {
+// notifyChange notifies the other replicas that the file with the given name changed. The head, if not nil,
+// is the encrypted head of the file and is carried in the notification when it is small enough.
+func (v *Vault) notifyChange(filename string, head []byte) error {
 	core.Start("filename %s", filename)
 	if v.syncRelayCh == nil {
 		core.End("sync relay not running, skipping notify")
@@ -205,56 +320,339 @@ func (v *Vault) notifyChange(filename string) error {
 	if name == "" {
 		return core.Error(core.GenericError, "filename is empty")
 	}
+	err := v.sendRelayEvent(name, head, nil)
+	if err != nil {
+		return err
+	}
+	core.End("")
+	return nil
+}
 
+// sendRelayEvent seals an event and sends it to the relay.
+func (v *Vault) sendRelayEvent(name string, head, data []byte) error {
 	client, err := getOrCreateWatchClient(v.Config.SyncRelay)
 	if err != nil {
 		return err
 	}
 	instanceID := v.relayClientID()
-	// Include vaultID and instanceID with notification: format is vaultID:instanceID:filename
-	message := v.ID + ":" + instanceID + ":" + name
-	if err := websocket.Message.Send(client.conn, message); err != nil {
-		dropWatchClient(v.Config.SyncRelay, client)
+	payload, err := v.sealRelayEvent(instanceID, name, head, data)
+	if err != nil {
+		return err
+	}
+	// Include vaultID and instanceID with notification: format is vaultID:instanceID:payload
+	message := v.ID + ":" + instanceID + ":" + payload
+
+	client.mu.Lock()
+	defer client.mu.Unlock()
+	if !client.connected {
+		return core.Error(core.NetError, "sync relay %s is reconnecting", v.Config.SyncRelay)
+	}
+	if err := client.conn.Send(message); err != nil {
+		// closing the connection makes the reader reconnect
+		client.connected = false
+		client.lastError = err
+		client.conn.Close()
 		return core.Error(core.NetError, "cannot send notify message", err)
 	}
-	core.End("")
 	return nil
 }
 
-func readWatchEvents(conn *websocket.Conn, server string) {
-	defer conn.Close()
+// authenticate sends the auth message of the vault user on the connection. When the user is an admin of the vault,
+// it first sends the members of the vault, so that the relay accepts their connections. The caller must hold the
+// mutex.
+func (c *syncClient) authenticate(v *Vault) error {
+	room, err := c.room()
+	if err != nil {
+		return err
+	}
+	if err := c.sendMembers(v, room); err != nil {
+		return err
+	}
+	auth, err := relay.AuthMessage(v.UserSecret, room, v.ID, v.Author)
+	if err != nil {
+		return err
+	}
+	if err := c.conn.Send(auth); err != nil {
+		return core.Error(core.NetError, "cannot send relay auth message", err)
+	}
+	return nil
+}
+
+func (c *syncClient) room() (string, error) {
+	u, err := url.Parse(c.server)
+	if err != nil {
+		return "", core.Error(core.ParseError, "cannot parse sync relay URL", err)
+	}
+	return relay.Room(u.Path), nil
+}
 
+// sendMembers sends the members of the vault to the relay when the user is the creator or an admin of the vault and
+// the members changed since they were last sent. The relay keeps the members by vault and creator, which members
+// know from the vault, and accepts them from the creator and from the admins in the members it has. The length of
+// the blockchain orders the lists, so an admin that is behind cannot replace the members set by a newer block. The
+// caller must hold the mutex.
+func (c *syncClient) sendMembers(v *Vault, room string) error {
+	accesses, err := v.GetAccesses()
+	if err != nil {
+		return err
+	}
+	if v.UserID != v.Author && accesses[v.UserID]&Admin == 0 {
+		return nil
+	}
+	var version int64
+	err = v.DB.QueryRow("COUNT_BLOCKS", sqlx.Args{"vault": v.ID}, &version)
+	if err != nil {
+		return core.Error(core.DbError, "cannot count the blocks of vault %s", v.ID, err)
+	}
+	var ids, admins []security.PublicID
+	for id, access := range accesses {
+		if access != 0 {
+			ids = append(ids, id)
+		}
+		if access&Admin != 0 {
+			admins = append(admins, id)
+		}
+	}
+	slices.Sort(ids)
+	slices.Sort(admins)
+	key := fmt.Sprint(version, ids, admins)
+	if key == v.relayMembers {
+		return nil
+	}
+	message, err := relay.MembersMessage(v.UserSecret, room, v.ID, relay.MemberList{Owner: v.Author,
+		Version: version, IDs: ids, Admins: admins})
+	if err != nil {
+		return err
+	}
+	if err := c.conn.Send(message); err != nil {
+		return core.Error(core.NetError, "cannot send relay members message", err)
+	}
+	v.relayMembers = key
+	return nil
+}
+
+// publishRelayMembers sends the members of the vault to the relay after the access changed, so that the relay
+// closes the connections of the users that are no longer members.
+func (v *Vault) publishRelayMembers() {
+	if v.syncRelayCh == nil {
+		return
+	}
+	watchClientsMu.Lock()
+	client := watchClients[v.Config.SyncRelay]
+	watchClientsMu.Unlock()
+	if client == nil {
+		return
+	}
+
+	client.mu.Lock()
+	defer client.mu.Unlock()
+	if !client.connected {
+		return // the members are sent when the client reconnects
+	}
+	room, err := client.room()
+	if err == nil {
+		err = client.sendMembers(v, room)
+	}
+	if err != nil {
+		core.Info("cannot send members of vault %s to sync relay: %v", v.ID, err)
+	}
+}
+
+// watch subscribes the connection to the folders of the vault. The caller must hold the mutex.
+func (c *syncClient) watch(v *Vault) error {
+	for _, folder := range v.relayWatchFolders() {
+		if err := c.conn.Send(watchAddPrefix + relayFolderToken(v.ID, folder)); err != nil {
+			return core.Error(core.NetError, "cannot send watch add message", err)
+		}
+	}
+	return nil
+}
+
+// resubscribe authenticates and watches the folders of all the subscribers on a new connection and returns
+// the subscribed vault instances. The caller must hold the mutex.
+func (c *syncClient) resubscribe() ([]*Vault, error) {
+	// the members go first, so that the relay knows them when the other vaults authenticate
+	room, err := c.room()
+	if err != nil {
+		return nil, err
+	}
+	for _, subs := range c.subscribers {
+		for _, v := range subs {
+			v.relayMembers = ""
+			if err := c.sendMembers(v, room); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	var vaults []*Vault
+	for _, subs := range c.subscribers {
+		watched := false
+		for _, v := range subs {
+			if err := c.authenticate(v); err != nil {
+				return nil, err
+			}
+			if !watched {
+				if err := c.watch(v); err != nil {
+					return nil, err
+				}
+				watched = true
+			}
+			vaults = append(vaults, v)
+		}
+	}
+	return vaults, nil
+}
+
+// relayBackoff returns the delay before the given reconnection attempt: exponential with jitter, so that
+// clients do not reconnect all at once when the relay restarts.
+func relayBackoff(attempt int) time.Duration {
+	delay := relayReconnectMaxDelay
+	if attempt < 16 {
+		delay = min(relayReconnectMinDelay<<attempt, relayReconnectMaxDelay)
+	}
+	return delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+}
+
+// reconnect dials the relay until it succeeds or the client is dropped, starting from the given attempt. On
+// success it subscribes the vaults again and syncs them to catch up on the notifications missed while disconnected.
+func (c *syncClient) reconnect(attempt int) bool {
+	for ; ; attempt++ {
+		time.Sleep(relayBackoff(attempt))
+		c.mu.Lock()
+		closed := c.closed
+		c.mu.Unlock()
+		if closed {
+			return false
+		}
+
+		conn, err := dialRelay(c.server)
+		c.mu.Lock()
+		if c.closed {
+			c.mu.Unlock()
+			if conn != nil {
+				conn.Close()
+			}
+			return false
+		}
+		if err != nil {
+			c.lastError = err
+			c.mu.Unlock()
+			continue
+		}
+		c.conn = conn
+		vaults, err := c.resubscribe()
+		if err != nil {
+			c.lastError = err
+			c.mu.Unlock()
+			conn.Close()
+			continue
+		}
+		c.connected = true
+		c.reconnects++
+		c.lastError = nil
+		c.mu.Unlock()
+
+		core.Info("reconnected to sync relay %s after %d attempts", c.server, attempt+1)
+		for _, v := range vaults {
+			go v.catchUpRelay()
+		}
+		return true
+	}
+}
+
+// readLoop reads the events from the relay and reconnects when the connection drops or the first dial failed.
+// Connections that drop soon after they open, e.g. because the relay rejects the authentication, do not reset
+// the backoff.
+func (c *syncClient) readLoop() {
+	failures := 0
 	for {
-		var raw string
-		if err := websocket.Message.Receive(conn, &raw); err != nil {
-			dropWatchClient(server, nil)
+		c.mu.Lock()
+		conn := c.conn
+		c.mu.Unlock()
+
+		if conn != nil {
+			openedAt := core.Now()
+			err := c.readWatchEvents(conn)
+			conn.Close()
+
+			c.mu.Lock()
+			closed := c.closed
+			c.connected = false
+			if !closed {
+				c.lastError = err
+			}
+			c.mu.Unlock()
+			if closed {
+				return
+			}
+			if core.Now().Sub(openedAt) < relayReconnectMaxDelay {
+				failures++
+			} else {
+				failures = 0
+			}
+			core.Info("connection to sync relay %s lost, reconnecting: %v", c.server, err)
+		}
+		if !c.reconnect(failures) {
 			return
 		}
+	}
+}
+
+func (c *syncClient) readWatchEvents(conn relay.Conn) error {
+	for {
+		raw, err := conn.Receive()
+		if err != nil {
+			return err
+		}
 
 		if strings.HasPrefix(raw, watchAddPrefix) || strings.HasPrefix(raw, watchRemovePrefix) {
 			continue
 		}
+		if strings.HasPrefix(raw, relay.AcceptedPrefix) {
+			vaultID, userID, _ := strings.Cut(strings.TrimPrefix(raw, relay.AcceptedPrefix), ":")
+			c.accepted(vaultID, security.PublicID(userID))
+			continue
+		}
 
-		// Extract vaultID and clientID from message format "vaultID:clientID:filename"
+		// Extract vaultID and clientID from message format "vaultID:clientID:payload"
 		parts := strings.SplitN(raw, ":", 3)
 		if len(parts) != 3 {
-			core.Info("sync relay received malformed event on %s: %q", server, raw)
+			core.Info("sync relay received malformed event on %s: %q", c.server, raw)
 			continue
 		}
 		vaultID := parts[0]
 		clientID := parts[1]
 		name := strings.TrimSpace(parts[2])
 		if name == "" {
-			core.Info("sync relay received empty filename event on %s for vault %s", server, vaultID)
+			core.Info("sync relay received empty filename event on %s for vault %s", c.server, vaultID)
 			continue
 		}
-		core.Info("sync relay received event on %s: vault=%s sender=%s name=%s", server, vaultID, clientID, name)
+		core.Info("sync relay received event on %s: vault=%s sender=%s name=%s", c.server, vaultID, clientID, name)
 
-		sendToSubscribers(server, name, vaultID, clientID)
+		c.sendToSubscribers(name, vaultID, clientID)
 	}
 }
 
-func safeSend(ch chan string, value string) (ok bool) {
+// accepted queues the presence join of the user once the relay accepted the auth, on the first connection and
+// after every reconnection, so that the join is not dropped by a relay that is still waiting for the members of the
+// vault.
+func (c *syncClient) accepted(vaultID string, userID security.PublicID) {
+	c.mu.Lock()
+	var vaults []*Vault
+	for _, v := range c.subscribers[vaultID] {
+		if v.UserID == userID {
+			vaults = append(vaults, v)
+		}
+	}
+	c.mu.Unlock()
+	core.Info("sync relay %s accepted %s for vault %s", c.server, userID, vaultID)
+	for _, v := range vaults {
+		safeSend(v.syncRelayCh, relayNotification{accepted: true})
+	}
+}
+
+func safeSend(ch chan relayNotification, value relayNotification) (ok bool) {
 	defer func() {
 		if recover() != nil {
 			ok = false
@@ -265,6 +663,16 @@ func safeSend(ch chan string, value string) (ok bool) {
 	return true
 }
 
+func dialRelay(server string) (relay.Conn, error) {
+	core.Info("connecting to sync relay server: %s", server)
+	conn, err := relay.Dial(server)
+	if err != nil {
+		core.LogError("failed to connect to sync relay server %s", server, err)
+		return nil, err
+	}
+	return conn, nil
+}
+
 func getOrCreateWatchClient(server string) (*syncClient, error) {
 	if server == "" {
 		return nil, core.Error(core.ConfigError, "server is empty")
@@ -281,56 +689,31 @@ func getOrCreateWatchClient(server string) (*syncClient, error) {
 		return client, nil
 	}
 
-	u, err := url.Parse(server)
-	if err != nil {
-		return nil, core.Error(core.ParseError, "cannot parse server URL", err)
-	}
-	if u.Scheme != "wss" && u.Scheme != "ws" {
-		return nil, core.Error(core.NetError, "server must be a wss or ws URL")
-	}
-	if u.Host == "" {
-		return nil, core.Error(core.NetError, "server host is empty")
-	}
-	wsURL := u.String()
-	origin := "http://" + u.Host
-	if u.Scheme == "wss" {
-		origin = "https://" + u.Host
-	}
-
-	core.Info("connecting to sync relay server: %s (origin: %s)", wsURL, origin)
-	conn, err := websocket.Dial(wsURL, "", origin)
-	if err != nil {
-		core.LogError("failed to connect to sync relay server %s", wsURL, err)
-		return nil, core.Error(core.NetError, "cannot connect to sync relay server", err)
-	}
-
+	// When the relay is down, the client reconnects in the background and subscribes the vaults then
+	conn, err := dialRelay(server)
 	client = &syncClient{
+		server:      server,
 		conn:        conn,
 		subscribers: make(map[string]map[string]*Vault),
+		connected:   err == nil,
+		lastError:   err,
 	}
 
 	watchClientsMu.Lock()
 	watchClients[cacheKey] = client
 	watchClientsMu.Unlock()
 
-	go readWatchEvents(conn, cacheKey)
+	go client.readLoop()
 	return client, nil
 }
 
-func sendToSubscribers(server string, name string, vaultID string, senderClientID string) {
-	core.Start("server %s, name %s, vaultID %s, senderClientID %s", server, name, vaultID, senderClientID)
-	watchClientsMu.Lock()
-	client := watchClients[server]
-	watchClientsMu.Unlock()
-	if client == nil {
-		core.End("no watch client for server %s", server)
-		return
-	}
-
-	client.mu.Lock()
-	defer client.mu.Unlock()
+func (c *syncClient) sendToSubscribers(name string, vaultID string, senderClientID string) {
+	core.Start("server %s, name %s, vaultID %s, senderClientID %s", c.server, name, vaultID, senderClientID)
+	c.mu.Lock()
+	defer c.mu.Unlock()
 
-	subs := client.subscribers[vaultID]
+	c.lastEventAt = core.Now()
+	subs := c.subscribers[vaultID]
 	if subs == nil {
 		core.End("no subscribers for vaultID %s", vaultID)
 		return
@@ -344,7 +727,7 @@ func sendToSubscribers(server string, name string, vaultID string, senderClientI
 			continue
 		}
 		if v.syncRelayCh != nil {
-			go safeSend(v.syncRelayCh, name)
+			go safeSend(v.syncRelayCh, relayNotification{clientID: senderClientID, payload: name})
 			delivered++
 		} else {
 			inactive++
@@ -353,15 +736,18 @@ func sendToSubscribers(server string, name string, vaultID string, senderClientI
 	core.End("subscribers=%d delivered=%d skippedSender=%d inactive=%d", len(subs), delivered, skippedSender, inactive)
 }
 
+// dropWatchClient removes the client from the cache and closes its connection for good. The caller must hold
+// the mutex of the client.
 func dropWatchClient(server string, client *syncClient) {
 	watchClientsMu.Lock()
-	current := watchClients[server]
-	if client == nil || current == client {
+	if watchClients[server] == client {
 		delete(watchClients, server)
 	}
 	watchClientsMu.Unlock()
 
-	if current != nil && (client == nil || current == client) {
-		_ = current.conn.Close()
+	client.closed = true
+	client.connected = false
+	if client.conn != nil {
+		_ = client.conn.Close()
 	}
 }
@@ -0,0 +1,221 @@
+package vault
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"math/rand"
+	"strings"
+	"time"
+
+	"github.com/stregato/bao/lib/core"
+	"github.com/stregato/bao/lib/security"
+	"github.com/vmihailenco/msgpack/v5"
+	"golang.org/x/crypto/blake2b"
+)
+
+// relayEventMaxAge is the maximum age of a notification. Older notifications are dropped as replays, and newer
+// ones are remembered until they expire, so each is accepted once.
+const relayEventMaxAge = 10 * time.Minute
+
+// relayMemberSyncPeriod is the minimum time between blockchain syncs triggered by events from unknown authors.
+const relayMemberSyncPeriod = time.Minute
+
+// relayDefaultHeadLimit is the default maximum size of a file head carried in a notification.
+const relayDefaultHeadLimit = 4096
+
+// relayEvent is the content of a relay notification. It is signed by the author and encrypted with a key
+// derived from the vault keys, so the relay learns nothing about the activity and cannot inject events.
+type relayEvent struct {
+	Name   string            `msgpack:"n"`
+	Author security.PublicID `msgpack:"a"`
+	Time   int64             `msgpack:"t"`
+	Nonce  uint64            `msgpack:"o"` // Random value that makes every event unique, so replays can be detected
+	Sig    []byte            `msgpack:"s"`
+	Head   []byte            `msgpack:"h,omitempty"` // Encrypted head of the file, so receivers do not read it from the store
+	Data   []byte            `msgpack:"d,omitempty"` // Payload of a signal
+}
+
+// relayNotification is a notification received from the relay for a vault instance.
+type relayNotification struct {
+	clientID string
+	payload  string
+	accepted bool // the relay accepted the auth of the user
+}
+
+// relayFolderToken returns the opaque name used to watch a folder on the relay.
+func relayFolderToken(vaultID, folder string) string {
+	hash := blake2b.Sum256([]byte("bao-relay-folder:" + vaultID + ":" + folder))
+	return hex.EncodeToString(hash[:16])
+}
+
+func relayKey(key security.AESKey) security.AESKey {
+	hash := blake2b.Sum256(append([]byte("bao-relay-key:"), key...))
+	return hash[:]
+}
+
+func relayEventSignedData(vaultID, clientID string, event relayEvent) []byte {
+	data := fmt.Sprintf("bao-relay-event:%s:%s:%s:%d:%d", vaultID, clientID, event.Name, event.Time, event.Nonce)
+	for _, content := range [][]byte{event.Head, event.Data} {
+		if len(content) > 0 {
+			hash := blake2b.Sum256(content)
+			data += ":" + hex.EncodeToString(hash[:])
+		}
+	}
+	return []byte(data)
+}
+
+// relayHead returns the head to carry in a notification, or nil when it exceeds the limit in the config.
+func (v *Vault) relayHead(head []byte) []byte {
+	limit := core.DefaultIfZero(v.Config.RelayHeadLimit, relayDefaultHeadLimit)
+	if limit < 0 || int64(len(head)) > limit {
+		return nil
+	}
+	return head
+}
+
+// relayFolderFor returns the watched folder that contains the file with the given name.
+func (v *Vault) relayFolderFor(name string) (string, bool) {
+	for _, folder := range v.relayWatchFolders() {
+		if name == folder || strings.HasPrefix(name, folder+"/") {
+			return folder, true
+		}
+	}
+	return "", false
+}
+
+// sealRelayEvent returns the payload of a notification for the file with the given name. The payload is
+// <folder token>/<base64 of key id and encrypted event>, so the relay can route it without reading it.
+// The head, if not nil, is carried in the event when it does not exceed the limit in the config; data is the
+// payload of a signal.
+func (v *Vault) sealRelayEvent(clientID, name string, head, data []byte) (string, error) {
+	folder, ok := v.relayFolderFor(name)
+	if !ok {
+		return "", core.Error(core.GenericError, "file %s is not in a watched folder", name)
+	}
+	keyId, key, err := v.getLastKeyFromDB()
+	if err != nil {
+		return "", err
+	}
+
+	event := relayEvent{Name: name, Author: v.UserID, Time: core.Now().Unix(), Nonce: rand.Uint64(),
+		Head: v.relayHead(head), Data: data}
+	event.Sig, err = security.Sign(v.UserSecret, relayEventSignedData(v.ID, clientID, event))
+	if err != nil {
+		return "", core.Error(core.GenericError, "cannot sign relay event", err)
+	}
+	plain, err := msgpack.Marshal(event)
+	if err != nil {
+		return "", core.Error(core.EncodeError, "cannot marshal relay event", err)
+	}
+	encrypted, err := security.EncryptAES(plain, relayKey(key))
+	if err != nil {
+		return "", core.Error(core.EncodeError, "cannot encrypt relay event", err)
+	}
+
+	blob := binary.LittleEndian.AppendUint64(nil, keyId)
+	blob = append(blob, encrypted...)
+	return relayFolderToken(v.ID, folder) + "/" + base64.RawURLEncoding.EncodeToString(blob), nil
+}
+
+// openRelayEvent decrypts and verifies the payload of a notification and returns the event. It fails for
+// unsigned, old, replayed or foreign events and for events from users that are not members of the vault.
+func (v *Vault) openRelayEvent(clientID, payload string) (relayEvent, error) {
+	_, encoded, ok := strings.Cut(payload, "/")
+	if !ok {
+		return relayEvent{}, core.Error(core.ParseError, "malformed relay event")
+	}
+	blob, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil || len(blob) < 8 {
+		return relayEvent{}, core.Error(core.ParseError, "malformed relay event", err)
+	}
+	keyId := binary.LittleEndian.Uint64(blob)
+	key, err := v.getKey(keyId)
+	if err != nil || key == nil {
+		return relayEvent{}, core.Error(core.AuthError, "relay event uses unknown key %d", keyId, err)
+	}
+	data, err := security.DecryptAES(blob[8:], relayKey(key))
+	if err != nil {
+		return relayEvent{}, core.Error(core.AuthError, "cannot decrypt relay event", err)
+	}
+	var event relayEvent
+	err = msgpack.Unmarshal(data, &event)
+	if err != nil {
+		return relayEvent{}, core.Error(core.ParseError, "cannot unmarshal relay event", err)
+	}
+
+	if age := core.Now().Sub(time.Unix(event.Time, 0)); age > relayEventMaxAge || age < -relayEventMaxAge {
+		return relayEvent{}, core.Error(core.AuthError, "relay event for %s is %s old", event.Name, age)
+	}
+	if len(event.Sig) == 0 || !security.Verify(event.Author, relayEventSignedData(v.ID, clientID, event), event.Sig) {
+		return relayEvent{}, core.Error(core.AuthError, "relay event for %s has an invalid signature", event.Name)
+	}
+	if _, ok := v.relayFolderFor(event.Name); !ok {
+		return relayEvent{}, core.Error(core.AuthError, "relay event for %s is outside the watched folders", event.Name)
+	}
+
+	member, err := v.isMember(event.Author)
+	if err == nil && !member && v.relayMemberSyncDue() {
+		// the author may have joined after the last blockchain sync
+		v.syncBlockChain(false)
+		member, err = v.isMember(event.Author)
+	}
+	if err != nil {
+		return relayEvent{}, err
+	}
+	if !member {
+		return relayEvent{}, core.Error(core.AuthError, "relay event for %s comes from %s, who is not a member", event.Name, event.Author)
+	}
+	if !v.markRelayEventSeen(event) {
+		return relayEvent{}, core.Error(core.AuthError, "relay event for %s is a replay", event.Name)
+	}
+	return event, nil
+}
+
+// markRelayEventSeen records the event and returns false when it was already received. Events older than
+// relayEventMaxAge are forgotten, since they are dropped by their age.
+func (v *Vault) markRelayEventSeen(event relayEvent) bool {
+	hash := blake2b.Sum256(event.Sig)
+	key := hex.EncodeToString(hash[:16])
+
+	v.relaySeenMu.Lock()
+	defer v.relaySeenMu.Unlock()
+	if v.relaySeen == nil {
+		v.relaySeen = make(map[string]int64)
+	}
+	horizon := core.Now().Add(-relayEventMaxAge).Unix()
+	for k, t := range v.relaySeen {
+		if t < horizon {
+			delete(v.relaySeen, k)
+		}
+	}
+	if _, ok := v.relaySeen[key]; ok {
+		return false
+	}
+	v.relaySeen[key] = event.Time
+	return true
+}
+
+// relayMemberSyncDue returns true, at most once per relayMemberSyncPeriod, when an event from an unknown author
+// may sync the blockchain, so foreign events cannot force a read of the blockchain each.
+func (v *Vault) relayMemberSyncDue() bool {
+	v.relaySeenMu.Lock()
+	defer v.relaySeenMu.Unlock()
+	if time.Since(v.relayMemberSyncAt) < relayMemberSyncPeriod {
+		return false
+	}
+	v.relayMemberSyncAt = time.Now()
+	return true
+}
+
+func (v *Vault) isMember(userId security.PublicID) (bool, error) {
+	if userId == v.UserID {
+		return true, nil
+	}
+	access, err := v.GetAccess(userId)
+	if err != nil {
+		return false, err
+	}
+	return access != 0, nil
+}
@@ -0,0 +1,256 @@
+package vault
+
+import (
+	"net"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stregato/bao/lib/core"
+	"github.com/stregato/bao/lib/relay"
+	"github.com/stregato/bao/lib/security"
+	"github.com/stregato/bao/lib/sqlx"
+	"github.com/stregato/bao/lib/store"
+)
+
+// waitStat polls the DB of the vault until the file appears. Stat does not sync, so the file arrives only
+// through the relay.
+func waitStat(v *Vault, name string, timeout time.Duration) (File, error) {
+	deadline := time.Now().Add(timeout)
+	for {
+		file, err := v.Stat(name)
+		if err == nil || time.Now().After(deadline) {
+			return file, err
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+func TestSyncRelayLocal(t *testing.T) {
+	server, err := relay.Start("127.0.0.1:0")
+	core.TestErr(t, err, "cannot start relay: %v")
+	defer server.Close()
+
+	// the same relay serves websockets and, for http URLs, event streams
+	for _, url := range []string{server.URL(), strings.Replace(server.URL(), "ws://", "http://", 1)} {
+		scheme := url[:strings.Index(url, ":")]
+		t.Run(scheme, func(t *testing.T) {
+			testSyncRelay(t, url+"/local-"+scheme) // each vault has its own owner, so it needs its own room
+		})
+	}
+}
+
+func testSyncRelay(t *testing.T, relayURL string) {
+	alice, aliceSecret := security.NewKeyPairMust()
+	bob, bobSecret := security.NewKeyPairMust()
+
+	db1 := sqlx.NewTestDB(t, "vault_alice.db", "")
+	store := store.LoadTestStore(t, "test")
+	defer store.Close()
+
+	va, err := Create(aliceSecret, store, db1, Config{SyncRelay: relayURL})
+	core.TestErr(t, err, "Create failed: %v")
+	defer va.Close()
+	err = va.SyncAccess(IOOption{}, AccessChange{UserId: bob, Access: Read})
+	core.TestErr(t, err, "SyncAccess failed: %v")
+
+	db2 := sqlx.NewTestDB(t, "vault_bob.db", "")
+	vb, err := Open(bobSecret, alice, store, db2)
+	core.TestErr(t, err, "Open failed: %v")
+	defer vb.Close()
+	time.Sleep(200 * time.Millisecond) // let the relay loop of bob complete the initial sync
+	core.Assert(t, vb.RelayStatus().Connected, "bob should be connected to the relay")
+
+	_, err = va.Write("relay/test.txt", "", nil, IOOption{})
+	core.TestErr(t, err, "Write failed: %v")
+
+	file, err := waitStat(vb, "relay/test.txt", 5*time.Second)
+	core.TestErr(t, err, "bob should receive the file through the relay: %v")
+	core.Assert(t, file.Name == "relay/test.txt", "unexpected file %s", file.Name)
+}
+
+func TestRelayEventAuth(t *testing.T) {
+	alice, aliceSecret := security.NewKeyPairMust()
+	bob, bobSecret := security.NewKeyPairMust()
+
+	db1 := sqlx.NewTestDB(t, "vault_alice.db", "")
+	store := store.LoadTestStore(t, "test")
+	defer store.Close()
+
+	va, err := Create(aliceSecret, store, db1, Config{})
+	core.TestErr(t, err, "Create failed: %v")
+	defer va.Close()
+	err = va.SyncAccess(IOOption{}, AccessChange{UserId: bob, Access: ReadWrite})
+	core.TestErr(t, err, "SyncAccess failed: %v")
+
+	db2 := sqlx.NewTestDB(t, "vault_bob.db", "")
+	vb, err := Open(bobSecret, alice, store, db2)
+	core.TestErr(t, err, "Open failed: %v")
+	defer vb.Close()
+
+	name := va.dataRoot() + "/202401/secret-report"
+	payload, err := vb.sealRelayEvent("bob-client", name, []byte("sealed head"), nil)
+	core.TestErr(t, err, "sealRelayEvent failed: %v")
+	core.Assert(t, !strings.Contains(payload, "secret-report"), "the filename must be encrypted: %s", payload)
+
+	event, err := va.openRelayEvent("bob-client", payload)
+	core.TestErr(t, err, "openRelayEvent failed: %v")
+	core.Assert(t, event.Name == name, "unexpected name %s", event.Name)
+	core.Assert(t, string(event.Head) == "sealed head", "the head should travel with the event, got %q", event.Head)
+	_, err = va.openRelayEvent("bob-client", payload)
+	core.Assert(t, err != nil, "replayed events must be dropped")
+
+	// heads over the limit are left in the store
+	large, err := vb.sealRelayEvent("bob-client", name, make([]byte, relayDefaultHeadLimit+1), nil)
+	core.TestErr(t, err, "sealRelayEvent failed: %v")
+	event, err = va.openRelayEvent("bob-client", large)
+	core.TestErr(t, err, "openRelayEvent failed: %v")
+	core.Assert(t, event.Head == nil, "heads over the limit must not be carried")
+
+	_, err = va.openRelayEvent("other-client", payload)
+	core.Assert(t, err != nil, "events must be bound to the sender client")
+	_, err = va.openRelayEvent("bob-client", payload[:len(payload)-4]+"AAAA")
+	core.Assert(t, err != nil, "tampered events must be dropped")
+	_, err = va.openRelayEvent("bob-client", "token/plain-filename")
+	core.Assert(t, err != nil, "unsigned events must be dropped")
+
+	// bob is removed from the vault: his events are foreign now
+	err = va.SyncAccess(IOOption{}, AccessChange{UserId: bob, Access: 0})
+	core.TestErr(t, err, "SyncAccess failed: %v")
+	payload, err = vb.sealRelayEvent("bob-client", name, nil, nil)
+	core.TestErr(t, err, "sealRelayEvent failed: %v")
+	_, err = va.openRelayEvent("bob-client", payload)
+	core.Assert(t, err != nil, "events from users who are not members must be dropped")
+}
+
+func TestRelayHead(t *testing.T) {
+	alice, aliceSecret := security.NewKeyPairMust()
+	bob, bobSecret := security.NewKeyPairMust()
+
+	db1 := sqlx.NewTestDB(t, "vault_alice.db", "")
+	st := store.LoadTestStore(t, "test")
+	defer st.Close()
+
+	va, err := Create(aliceSecret, st, db1, Config{})
+	core.TestErr(t, err, "Create failed: %v")
+	defer va.Close()
+	err = va.SyncAccess(IOOption{}, AccessChange{UserId: bob, Access: Read})
+	core.TestErr(t, err, "SyncAccess failed: %v")
+
+	db2 := sqlx.NewTestDB(t, "vault_bob.db", "")
+	vb, err := Open(bobSecret, alice, st, db2)
+	core.TestErr(t, err, "Open failed: %v")
+	defer vb.Close()
+
+	file, err := va.Write("relay/head.txt", "", nil, IOOption{})
+	core.TestErr(t, err, "Write failed: %v")
+	headPath := path.Join(file.StoreDir, "h", file.StoreName)
+	head, err := store.ReadFile(st, headPath)
+	core.TestErr(t, err, "cannot read head: %v")
+
+	// with the head from the notification, bob does not need the store
+	err = st.Delete(headPath)
+	core.TestErr(t, err, "cannot delete head: %v")
+	_, synced, _, err := vb.syncronizeHead(file.StoreDir, file.StoreName, head)
+	core.TestErr(t, err, "syncronizeHead failed: %v")
+	core.Assert(t, synced, "the file should be imported from the head in the notification")
+	_, err = vb.Stat("relay/head.txt")
+	core.TestErr(t, err, "Stat failed: %v")
+
+	_, _, _, err = vb.syncronizeHead(file.StoreDir, file.StoreName, nil)
+	core.Assert(t, err != nil, "without a head in the notification, bob reads it from the store")
+}
+
+func TestSyncRelayReconnect(t *testing.T) {
+	server, err := relay.Start("127.0.0.1:0")
+	core.TestErr(t, err, "cannot start relay: %v")
+	addr := strings.TrimPrefix(server.URL(), "ws://")
+	relayURL := server.URL() + "/reconnect"
+
+	alice, aliceSecret := security.NewKeyPairMust()
+	bob, bobSecret := security.NewKeyPairMust()
+
+	db1 := sqlx.NewTestDB(t, "vault_alice.db", "")
+	store := store.LoadTestStore(t, "test")
+	defer store.Close()
+
+	va, err := Create(aliceSecret, store, db1, Config{SyncRelay: relayURL})
+	core.TestErr(t, err, "Create failed: %v")
+	defer va.Close()
+	err = va.SyncAccess(IOOption{}, AccessChange{UserId: bob, Access: Read})
+	core.TestErr(t, err, "SyncAccess failed: %v")
+
+	db2 := sqlx.NewTestDB(t, "vault_bob.db", "")
+	vb, err := Open(bobSecret, alice, store, db2)
+	core.TestErr(t, err, "Open failed: %v")
+	defer vb.Close()
+	time.Sleep(200 * time.Millisecond)
+
+	status := vb.RelayStatus()
+	core.Assert(t, status.Enabled && status.Connected && status.Reconnects == 0, "unexpected status %+v", status)
+
+	core.Assert(t, waitPresence(va, bob, true, 5*time.Second), "alice should see bob online")
+
+	// the file is written while the relay is down, so bob gets it only from the catch-up sync
+	server.Close()
+	time.Sleep(1100 * time.Millisecond)
+	core.Assert(t, !vb.RelayStatus().Connected, "the connection should be down")
+	va.signals.mu.Lock()
+	va.signals.presence = nil
+	va.signals.mu.Unlock()
+	_, err = va.Write("relay/offline.txt", "", nil, IOOption{})
+	core.TestErr(t, err, "Write failed: %v")
+
+	server, err = relay.Start(addr)
+	core.TestErr(t, err, "cannot restart relay: %v")
+	defer server.Close()
+
+	_, err = waitStat(vb, "relay/offline.txt", 10*time.Second)
+	core.TestErr(t, err, "bob should catch up after reconnecting: %v")
+	status = vb.RelayStatus()
+	core.Assert(t, status.Connected && status.Reconnects == 1, "unexpected status after reconnect %+v", status)
+	core.Assert(t, waitPresence(va, bob, true, 5*time.Second), "bob should join again after reconnecting")
+
+	time.Sleep(1100 * time.Millisecond)
+	_, err = va.Write("relay/online.txt", "", nil, IOOption{})
+	core.TestErr(t, err, "Write failed: %v")
+	_, err = waitStat(vb, "relay/online.txt", 5*time.Second)
+	core.TestErr(t, err, "bob should receive notifications after reconnecting: %v")
+	core.Assert(t, !vb.RelayStatus().LastEvent.IsZero(), "the last event time should be set")
+}
+
+func TestSyncRelayLateStart(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	core.TestErr(t, err, "cannot pick a free port: %v")
+	addr := listener.Addr().String()
+	listener.Close()
+
+	_, aliceSecret := security.NewKeyPairMust()
+	db := sqlx.NewTestDB(t, "vault_alice.db", "")
+	store := store.LoadTestStore(t, "test")
+	defer store.Close()
+
+	// the relay is down when the vault starts, so the client connects in the background once it is up
+	va, err := Create(aliceSecret, store, db, Config{SyncRelay: "ws://" + addr + "/late"})
+	core.TestErr(t, err, "Create failed: %v")
+	defer va.Close()
+	status := va.RelayStatus()
+	core.Assert(t, status.Enabled && !status.Connected && status.LastError != "", "unexpected status %+v", status)
+
+	server, err := relay.Start(addr)
+	core.TestErr(t, err, "cannot start relay: %v")
+	defer server.Close()
+	for i := 0; i < 100 && !va.RelayStatus().Connected; i++ {
+		time.Sleep(50 * time.Millisecond)
+	}
+	core.Assert(t, va.RelayStatus().Connected, "the vault should connect once the relay is up")
+}
+
+func TestRelayBackoff(t *testing.T) {
+	for attempt := 0; attempt < 40; attempt++ {
+		delay := relayBackoff(attempt)
+		core.Assert(t, delay >= relayReconnectMinDelay/2 && delay <= relayReconnectMaxDelay, "delay %s out of range", delay)
+	}
+	core.Assert(t, relayBackoff(30) >= relayReconnectMaxDelay/2, "the delay should reach the maximum")
+}
@@ -17,18 +17,22 @@ const (
 )
 
 type Config struct {
-	SyncRelay               string        `json:"syncRelay"`               // Watch service URL for changes notifications
-	Retention               time.Duration `json:"retention"`               // How long data is kept
-	MaxStorage              int64         `json:"maxStorage"`              // Maximum allowed store.(bytes)
-	SegmentInterval         time.Duration `json:"segmentInterval"`         // Time duration of each batch segment
-	SyncCooldown            time.Duration `json:"syncCooldown"`            // Minimum time between two sync operations (default 5 seconds)
-	WaitTimeout             time.Duration `json:"waitTimeout"`             // Maximum time to wait for I/O operations to complete (default 10 minutes)
-	FilesSyncPeriod         time.Duration `json:"filesSyncPeriod"`         // How often to sync files (default 10 minutes)
-	CleanupPeriod           time.Duration `json:"cleanupPeriod"`           // How often to run housekeeping (default 1 hour)
-	BlockChainSyncPeriod    time.Duration `json:"blockChainSyncPeriod"`    // How often to sync the blockchain (default 10 minutes)
-	BlockSyncOverlap        time.Duration `json:"blockSyncOverlap"`        // Overlap window used when listing blockchain files to tolerate delayed visibility (default 1 hour)
-	BodyReadyCheckThreshold int64         `json:"bodyReadyCheckThreshold"` // Check body readiness only for files strictly larger than this threshold in bytes. 0 means all non-empty files.
-	IoThrottle              int64         `json:"ioThrottle"`              // Maximum number of concurrent I/O operations. Default is 10.
+	SyncRelay               string            `json:"syncRelay"`               // Sync relay URL for change notifications: ws(s) for websockets, http(s) for Server-Sent Events
+	Retention               time.Duration     `json:"retention"`               // How long data is kept
+	MaxStorage              int64             `json:"maxStorage"`              // Maximum allowed store.(bytes)
+	SegmentInterval         time.Duration     `json:"segmentInterval"`         // Time duration of each batch segment
+	SyncCooldown            time.Duration     `json:"syncCooldown"`            // Minimum time between two sync operations (default 5 seconds)
+	WaitTimeout             time.Duration     `json:"waitTimeout"`             // Maximum time to wait for I/O operations to complete (default 10 minutes)
+	FilesSyncPeriod         time.Duration     `json:"filesSyncPeriod"`         // How often to sync files (default 10 minutes)
+	CleanupPeriod           time.Duration     `json:"cleanupPeriod"`           // How often to run housekeeping (default 1 hour)
+	BlockChainSyncPeriod    time.Duration     `json:"blockChainSyncPeriod"`    // How often to sync the blockchain (default 10 minutes)
+	BlockSyncOverlap        time.Duration     `json:"blockSyncOverlap"`        // Overlap window used when listing blockchain files to tolerate delayed visibility (default 1 hour)
+	BodyReadyCheckThreshold int64             `json:"bodyReadyCheckThreshold"` // Check body readiness only for files strictly larger than this threshold in bytes. 0 means all non-empty files.
+	IoThrottle              int64             `json:"ioThrottle"`              // Maximum number of concurrent I/O operations. Default is 10.
+	EscrowPublicID          security.PublicID `json:"escrowPublicId"`          // Optional escrow identity that receives a wrapped copy of every key and EC-encrypted file
+	SegmentLookback         time.Duration     `json:"segmentLookback"`         // How far back housekeeping rescans closed segments for late files. 0 disables the rescan.
+	RelayHeadLimit          int64             `json:"relayHeadLimit"`          // Maximum size in bytes of a file head carried in relay notifications (default 4096). Negative disables.
+	ChunkSize               int64             `json:"chunkSize"`               // Average size in bytes of the chunks of aes-encrypted bodies, so new versions upload only the changed chunks. 0 disables chunking.
 }
 
 type Vault struct {
@@ -40,15 +44,16 @@ type Vault struct {
 	DB         *sqlx.DB           `json:"-"`          // Database connection for storing and retrieving vault metadata
 	Config     Config             `json:"config"`     // Configuration settings for the vault, including retention policies and store.limits
 
-	store              store.Store  // Storage backend for the vault, used for file operations
-	allocatedSize      int64        // Total allocated size for the vault, used for tracking store.usage
-	housekeepingTicker *time.Ticker // Ticker for periodic housekeeping
-	syncRelayCh        chan string  // Channel for receiving sync relay notifications, used to trigger synchronization when changes are detected
+	store              store.Store            // Storage backend for the vault, used for file operations
+	allocatedSize      int64                  // Total allocated size for the vault, used for tracking store.usage
+	housekeepingTicker *time.Ticker           // Ticker for periodic housekeeping
+	syncRelayCh        chan relayNotification // Channel for receiving sync relay notifications, used to trigger synchronization when changes are detected
 
 	lastBlockChainSyncAt time.Time  // Timestamp of the last blockchain synchronization
 	lastCleanupAt        time.Time  // Timestamp of the last retention cleanup
 	lastSyncAt           time.Time  // Timestamp of the last sync operation
 	lastWaitFilesAt      time.Time  // Timestamp of the last files sync operation
+	lastRescanAt         time.Time  // Timestamp of the last rescan of closed segments
 	newFiles             *sync.Cond // Condition variable for signaling changes in watched folders; also protects interrupted flag
 	interrupted          bool       // Flag indicating if an interrupt was signaled (protected by newFiles.L)
 	updateSeq            uint64     // Monotonic counter used by WaitUpdates to avoid missed wakeups
@@ -65,6 +70,17 @@ type Vault struct {
 
 	relayRetryMu sync.Mutex
 	relayRetry   map[string]struct{} // Deduplicates delayed relay retries for deferred files.
+	relayMembers string              // Members last sent to the relay, guarded by the mutex of the relay client
+
+	relaySeenMu       sync.Mutex
+	relaySeen         map[string]int64 // Relay events received recently, by hash of the signature, to drop replays
+	relayMemberSyncAt time.Time        // Last blockchain sync triggered by an event from an unknown author
+
+	signals   signalHub // Subscriptions to ephemeral signals and members online
+	manifests manifests // Manifests of the heads written by this instance and state of the manifests read
+
+	clockSkewsMu sync.Mutex
+	clockSkews   map[security.PublicID]*ClockSkew // Clock skew of the writers estimated during sync
 }
 
 var openedStashes []*Vault
@@ -0,0 +1,176 @@
+package vault
+
+import (
+	"database/sql"
+	"path"
+	"sort"
+	"time"
+
+	"github.com/stregato/bao/lib/core"
+	"github.com/stregato/bao/lib/security"
+	"github.com/stregato/bao/lib/sqlx"
+)
+
+// clockSkewTolerance is the skew above which a writer is reported as skewed.
+const clockSkewTolerance = time.Minute
+
+// ClockSkew is the clock offset of a writer, estimated from the files it wrote. For each file, the difference
+// between the modification time in the head and the time the store received the head is the skew plus the
+// upload delay. The maximum difference is therefore the best estimate of the skew.
+type ClockSkew struct {
+	UserID    security.PublicID `json:"userId"`
+	Skew      time.Duration     `json:"skew"`      // Estimated offset of the writer clock: positive when ahead of the store
+	Samples   int               `json:"samples"`   // Number of files used for the estimate
+	LateFiles int               `json:"lateFiles"` // Files found in closed segments after they were scanned
+	LastSeen  time.Time         `json:"lastSeen"`  // Time of the last sample
+	Skewed    bool              `json:"skewed"`    // The skew exceeds one minute
+}
+
+// getWatermark returns the time of the last complete listing of the segment, or zero if it was never listed.
+func (v *Vault) getWatermark(storeDir string) time.Time {
+	var watermark int64
+	err := v.DB.QueryRow("GET_SEGMENT_WATERMARK", sqlx.Args{"vault": v.ID, "storeDir": storeDir}, &watermark)
+	if err != nil {
+		if err != sql.ErrNoRows {
+			core.LogError("cannot get watermark of %s: %v", storeDir, err)
+		}
+		return time.Time{}
+	}
+	return time.UnixMilli(watermark)
+}
+
+func (v *Vault) setWatermark(storeDir string, t time.Time) {
+	_, err := v.DB.Exec("SET_SEGMENT_WATERMARK", sqlx.Args{"vault": v.ID, "storeDir": storeDir, "watermark": t.UnixMilli()})
+	if err != nil {
+		core.LogError("cannot set watermark of %s: %v", storeDir, err)
+	}
+}
+
+// listingCutoff returns the modification time before which the heads of the segment were already listed.
+func (v *Vault) listingCutoff(storeDir string) time.Time {
+	watermark := v.getWatermark(storeDir)
+	if watermark.IsZero() {
+		return watermark
+	}
+	// tolerate clock skew and delayed visibility in the store
+	return watermark.Add(-core.DefaultIfZero(v.Config.BlockSyncOverlap, time.Hour))
+}
+
+// listingAfterName returns the name after which the store lists the heads of the segment: the later of the last
+// complete listing and the last head in the manifests read, less the overlap for clock skew and for the heads that
+// other writers did not flush yet. Names sort by the time of their writer within a day, so the segments that span
+// more than a day are listed in full.
+func (v *Vault) listingAfterName(storeDir, head string) string {
+	start, err := time.Parse(segmentTimeFormat, path.Base(storeDir))
+	if err != nil {
+		return ""
+	}
+	end := start.Add(v.Config.SegmentInterval)
+	if v.Config.SegmentInterval <= time.Minute {
+		end = start.Add(DefaultSegmentInterval)
+	}
+	if start.Truncate(24*time.Hour) != end.Add(-time.Millisecond).Truncate(24*time.Hour) {
+		return ""
+	}
+	cutoff := v.getWatermark(storeDir)
+	if t, ok := storeNameTime(start, head); ok && head != "" && t.After(cutoff) {
+		cutoff = t
+	}
+	cutoff = cutoff.Add(-core.DefaultIfZero(v.Config.BlockSyncOverlap, time.Hour))
+	if !cutoff.After(start) {
+		return ""
+	}
+	if !cutoff.Before(end) {
+		cutoff = end.Add(-time.Millisecond)
+	}
+	return storeNameAt(cutoff)
+}
+
+// rescanSegments syncs the closed segments within the lookback in the config. Sync only scans the segments after
+// the last known file, so heads that land late in older segments, e.g. from writers with a skewed clock or long
+// uploads, are found only here.
+func (v *Vault) rescanSegments() ([]File, error) {
+	lookback := v.Config.SegmentLookback
+	if lookback <= 0 {
+		return nil, nil
+	}
+	core.Start("lookback %s", lookback)
+
+	baseDir := v.dataRoot()
+	now := core.Now()
+	minSegment := getSegmentDirAt(v.Config.SegmentInterval, now.Add(-lookback))
+	current := getSegmentDir(v.Config.SegmentInterval)
+
+	var newFiles []File
+	var errX error
+	for _, segment := range v.listDirs(baseDir, minSegment, current) {
+		if segment == current {
+			continue // still open, Sync takes care of it
+		}
+		storeDir := path.Join(baseDir, segment)
+		// heads found in segments that were already listed are late
+		late := !v.getWatermark(storeDir).IsZero()
+		files, err := v.syncSegment(storeDir, late)
+		if err != nil {
+			errX = err
+		}
+		newFiles = append(newFiles, files...)
+	}
+
+	_, err := v.DB.Exec("DELETE_SEGMENT_WATERMARKS_BEFORE", sqlx.Args{"vault": v.ID, "storeDir": path.Join(baseDir, minSegment)})
+	if err != nil {
+		core.LogError("cannot delete old watermarks: %v", err)
+	}
+	_, err = v.DB.Exec("DELETE_MANIFEST_POSITIONS_BEFORE", sqlx.Args{"vault": v.ID, "storeDir": path.Join(baseDir, minSegment)})
+	if err != nil {
+		core.LogError("cannot delete old manifest positions: %v", err)
+	}
+	if len(newFiles) > 0 {
+		v.signalUpdate()
+	}
+	if errX != nil {
+		return newFiles, core.Error(core.GenericError, "errors occurred during rescan", errX)
+	}
+	core.End("%d late files", len(newFiles))
+	return newFiles, nil
+}
+
+// recordClockSample updates the clock skew of the author with a file that has the given modification time and
+// was received by the store at storeTime.
+func (v *Vault) recordClockSample(author security.PublicID, modTime, storeTime time.Time, late bool) {
+	if modTime.IsZero() || storeTime.IsZero() {
+		return
+	}
+	diff := modTime.Sub(storeTime)
+
+	v.clockSkewsMu.Lock()
+	defer v.clockSkewsMu.Unlock()
+	if v.clockSkews == nil {
+		v.clockSkews = map[security.PublicID]*ClockSkew{}
+	}
+	skew := v.clockSkews[author]
+	if skew == nil {
+		skew = &ClockSkew{UserID: author, Skew: diff}
+		v.clockSkews[author] = skew
+	}
+	skew.Skew = max(skew.Skew, diff)
+	skew.Samples++
+	skew.LastSeen = core.Now()
+	if late {
+		skew.LateFiles++
+		core.Info("late file from %s in a closed segment, modTime %s, received %s", author, modTime, storeTime)
+	}
+	skew.Skewed = skew.Skew > clockSkewTolerance || skew.Skew < -clockSkewTolerance
+}
+
+// ClockSkews returns the clock skew of the writers whose files were imported since the vault was opened.
+func (v *Vault) ClockSkews() []ClockSkew {
+	v.clockSkewsMu.Lock()
+	defer v.clockSkewsMu.Unlock()
+	skews := make([]ClockSkew, 0, len(v.clockSkews))
+	for _, skew := range v.clockSkews {
+		skews = append(skews, *skew)
+	}
+	sort.Slice(skews, func(i, j int) bool { return skews[i].UserID < skews[j].UserID })
+	return skews
+}
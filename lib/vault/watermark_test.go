@@ -0,0 +1,88 @@
+package vault
+
+import (
+	"path"
+	"testing"
+	"time"
+
+	"github.com/stregato/bao/lib/core"
+	"github.com/stregato/bao/lib/security"
+	"github.com/stregato/bao/lib/sqlx"
+	"github.com/stregato/bao/lib/store"
+)
+
+// moveHead moves the head of a file to another segment, as if it was written there.
+func moveHead(t *testing.T, st store.Store, file File, segment string) {
+	src := path.Join(file.StoreDir, "h", file.StoreName)
+	data, err := store.ReadFile(st, src)
+	core.TestErr(t, err, "cannot read head: %v")
+	err = store.WriteFile(st, path.Join(path.Dir(file.StoreDir), segment, "h", file.StoreName), data)
+	core.TestErr(t, err, "cannot write head: %v")
+	err = st.Delete(src)
+	core.TestErr(t, err, "cannot delete head: %v")
+}
+
+func TestLateFiles(t *testing.T) {
+	alice, aliceSecret := security.NewKeyPairMust()
+	bob, bobSecret := security.NewKeyPairMust()
+
+	db1 := sqlx.NewTestDB(t, "vault_alice.db", "")
+	st := store.LoadTestStore(t, "test")
+	defer st.Close()
+
+	va, err := Create(aliceSecret, st, db1, Config{})
+	core.TestErr(t, err, "Create failed: %v")
+	defer va.Close()
+	err = va.SyncAccess(IOOption{}, AccessChange{UserId: bob, Access: Read})
+	core.TestErr(t, err, "SyncAccess failed: %v")
+
+	previous := getSegmentDirAt(0, core.Now().Add(-DefaultSegmentInterval))
+	early, err := va.Write("early.txt", "", nil, IOOption{})
+	core.TestErr(t, err, "Write failed: %v")
+	moveHead(t, st, early, previous)
+	_, err = va.Write("current.txt", "", nil, IOOption{})
+	core.TestErr(t, err, "Write failed: %v")
+
+	db2 := sqlx.NewTestDB(t, "vault_bob.db", "")
+	vb, err := Open(bobSecret, alice, st, db2)
+	core.TestErr(t, err, "Open failed: %v")
+	defer vb.Close()
+	newFiles, err := vb.Sync()
+	core.TestErr(t, err, "Sync failed: %v")
+	core.Assert(t, len(newFiles) == 2, "bob should find both files, got %d", len(newFiles))
+	core.Assert(t, !vb.getWatermark(path.Join(vb.dataRoot(), previous)).IsZero(), "the previous segment should have a watermark")
+
+	// a head lands in the previous segment after bob scanned it
+	time.Sleep(1100 * time.Millisecond)
+	late, err := va.Write("late.txt", "", nil, IOOption{})
+	core.TestErr(t, err, "Write failed: %v")
+	moveHead(t, st, late, previous)
+	_, err = vb.Sync()
+	core.TestErr(t, err, "Sync failed: %v")
+	_, err = vb.Stat("late.txt")
+	core.Assert(t, err != nil, "Sync does not scan closed segments")
+
+	newFiles, err = vb.rescanSegments()
+	core.TestErr(t, err, "rescanSegments failed: %v")
+	core.Assert(t, len(newFiles) == 0, "the rescan is disabled without lookback")
+	vb.Config.SegmentLookback = 2 * DefaultSegmentInterval
+	newFiles, err = vb.rescanSegments()
+	core.TestErr(t, err, "rescanSegments failed: %v")
+	core.Assert(t, len(newFiles) == 1 && newFiles[0].Name == "late.txt", "the rescan should find the late file, got %v", newFiles)
+
+	skews := vb.ClockSkews()
+	core.Assert(t, len(skews) == 1 && skews[0].UserID == alice, "unexpected skews %v", skews)
+	core.Assert(t, skews[0].LateFiles == 1 && !skews[0].Skewed, "unexpected skew %+v", skews[0])
+
+	// a writer whose clock is 5 minutes ahead of the store
+	now := core.Now()
+	vb.recordClockSample(bob, now.Add(5*time.Minute), now, false)
+	vb.recordClockSample(bob, now.Add(4*time.Minute), now, false)
+	skews = vb.ClockSkews()
+	core.Assert(t, len(skews) == 2, "unexpected skews %v", skews)
+	for _, skew := range skews {
+		if skew.UserID == bob {
+			core.Assert(t, skew.Skewed && skew.Skew == 5*time.Minute && skew.Samples == 2, "unexpected skew %+v", skew)
+		}
+	}
+}
@@ -91,7 +91,7 @@ func (v *Vault) writeRecord(dest, source string, flags Flags, attrs []byte, opti
 	core.Start("writing record to %s", dest)
 	now := core.Now()
 	retention := effectiveRetention(v.Config.Retention, options.Retention)
-	expiresAt := truncateToSecond(now.Add(retention))
+	expiresAt := v.policyExpiresAt(dest, now, truncateToSecond(now.Add(retention)))
 
 	var size int64
 	if source != "" {
@@ -107,6 +107,13 @@ func (v *Vault) writeRecord(dest, source string, flags Flags, attrs []byte, opti
 	if v.Config.MaxStorage > 0 && v.allocatedSize+size > v.Config.MaxStorage {
 		return File{}, core.Error(core.FileError, "cannot write file %s in vaultgroup %s: allocated size limit exceeded", dest, v.ID, os.ErrPermission)
 	}
+	overQuota, err := v.isOverQuota(v.UserID, size)
+	if err != nil {
+		return File{}, core.Error(core.DbError, "cannot check quota for %s", dest, err)
+	}
+	if overQuota {
+		return File{}, core.Error(core.AccessDenied, "cannot write file %s in vault %s: quota exceeded for user %s", dest, v.ID, v.UserID, os.ErrPermission)
+	}
 
 	baseFolder := v.dataRoot()
 
@@ -114,6 +121,12 @@ func (v *Vault) writeRecord(dest, source string, flags Flags, attrs []byte, opti
 	if err != nil {
 		return File{}, err
 	}
+	if _, err := v.Stat(cleanDest); err == nil {
+		err = v.checkNotHeld(cleanDest) // held files are write-once
+		if err != nil {
+			return File{}, err
+		}
+	}
 	if options.NoEncryption {
 		encMethod = "public"
 		ecRecipient = ""
@@ -191,11 +204,28 @@ func (v *Vault) writeFile(file File, progress chan int64) error {
 	if err != nil {
 		return err
 	}
+	if v.useChunks(file, encMethod) {
+		// chunks go first, so that readers never find a head before its chunks
+		file.Chunks, err = v.writeChunks(file)
+		if err != nil {
+			return err
+		}
+		file.Flags |= Chunked
+	}
 	head, err := encodeHead(encMethod, file, ecRecipient, v.UserSecret, v.getKey)
 	if err != nil {
 		return core.Error(core.EncodeError, "cannot encode head in Bao.Write", err)
 	}
 
+	var ecKey []byte
+	if encMethod == "ec" && v.Config.EscrowPublicID != "" {
+		ecKey = core.GenerateRandomBytes(32)
+		err = v.writeEscrowCopy(file, ecKey)
+		if err != nil {
+			return err
+		}
+	}
+
 	var err2 error
 	var wg sync.WaitGroup
 	wg.Add(1)
@@ -215,7 +245,7 @@ func (v *Vault) writeFile(file File, progress chan int64) error {
 		}
 		wg.Done()
 	}()
-	if file.LocalCopy != "" {
+	if file.LocalCopy != "" && file.Flags&Chunked == 0 {
 		f, err := openLocalSourceReader(file.LocalCopy)
 		if err != nil {
 			return core.Error(core.FileError, "cannot open local file %s in Bao.Write, name %v, storeDir %v",
@@ -223,7 +253,7 @@ func (v *Vault) writeFile(file File, progress chan int64) error {
 		}
 		defer f.Close()
 
-		r, err := encryptReader(encMethod, file, ecRecipient, f, v.getKey)
+		r, err := encryptReader(encMethod, file, ecRecipient, ecKey, f, v.getKey)
 		if err != nil {
 			return core.Error(core.FileError, "cannot encrypt reader for file %s in Bao.Write, name %v, storeDir %v",
 				file.Name, file.LocalCopy, file.StoreDir, err)
@@ -240,10 +270,17 @@ func (v *Vault) writeFile(file File, progress chan int64) error {
 		return err2
 	}
 
+	if file.Flags&Chunked != 0 {
+		err = v.setFileChunks(file.StoreDir, file.StoreName, file.Chunks)
+		if err != nil {
+			return err
+		}
+	}
+	v.addToManifest(file.StoreDir, file.StoreName, head)
 	v.UpdateFileAllocatedSize(file.Id, file.Size+int64(len(head)))
 	v.UpdateFileFlags(file.Id, file.Flags) // Update the file flags in the database
 	v.allocatedSize += file.Size + int64(len(head))
-	v.notifyChange(path.Join(file.StoreDir, file.StoreName))
+	v.notifyChange(path.Join(file.StoreDir, file.StoreName), head)
 
 	core.End("elapsed %s", core.Since(now))
 	return nil
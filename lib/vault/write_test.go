@@ -317,3 +317,51 @@ func TestWriteWithSyncRelay(t *testing.T) {
 	db1.Close()
 	db2.Close()
 }
+
+func TestWriteHybrid(t *testing.T) {
+	alice, aliceSecret := security.NewKeyPairMust()
+	bob, bobSecret, err := security.NewHybridKeyPair()
+	core.TestErr(t, err, "cannot create hybrid keys: %v")
+
+	db := sqlx.NewTestDB(t, "vault.db", "")
+	store := store.LoadTestStore(t, "test")
+	defer store.Close()
+
+	v, err := Create(aliceSecret, store, db, Config{})
+	core.TestErr(t, err, "Create failed: %v")
+
+	err = v.SyncAccess(IOOption{}, AccessChange{Access: ReadWrite, UserId: bob})
+	core.TestErr(t, err, "SyncAccess failed: %v")
+
+	tmpFile := t.TempDir() + "/simple.txt"
+	err = os.WriteFile(tmpFile, []byte("Hello World"), 0644)
+	core.TestErr(t, err, "WriteFile failed: %v")
+	file, err := v.Write("folder/simple.txt", tmpFile, nil, IOOption{})
+	core.TestErr(t, err, "Write failed: %v")
+	_, err = v.WaitFiles(context.Background(), file.Id)
+	core.TestErr(t, err, "WaitFiles failed: %v")
+
+	ecName := "shared/simple.txt,ec=" + bob.String()
+	file, err = v.Write(ecName, tmpFile, nil, IOOption{})
+	core.TestErr(t, err, "Write failed: %v")
+	_, err = v.WaitFiles(context.Background(), file.Id)
+	core.TestErr(t, err, "WaitFiles failed: %v")
+	v.Close()
+	db.Close()
+
+	db = sqlx.NewTestDB(t, "vault2.db", "")
+	v, err = Open(bobSecret, alice, store, db)
+	core.TestErr(t, err, "Open failed: %v")
+	_, err = v.Sync()
+	core.TestErr(t, err, "Sync failed: %v")
+
+	for _, name := range []string{"folder/simple.txt", ecName} {
+		tmpFile2 := t.TempDir() + "/simple2.txt"
+		_, err = v.Read(name, tmpFile2, IOOption{}, nil)
+		core.TestErr(t, err, "Read %s failed: %v", name)
+		content, err := os.ReadFile(tmpFile2)
+		core.TestErr(t, err, "ReadFile failed: %v")
+		core.Assert(t, string(content) == "Hello World", "unexpected content for %s", name)
+	}
+	v.Close()
+}
@@ -23,6 +23,10 @@ export default {
 
 const WATCH_ADD_PREFIX = "+";
 const WATCH_REMOVE_PREFIX = "-";
+const AUTH_PREFIX = "!";
+const MEMBERS_PREFIX = "=";
+const ACCEPTED_PREFIX = "@";
+const MAX_AUTH_SKEW_SECONDS = 5 * 60;
 
 export class SyncRelayRoom {
   constructor(state, env) {
@@ -46,7 +50,8 @@ export class SyncRelayRoom {
     const currentWebSockets = this.state.getWebSockets();
     console.log(`[SyncRelayRoom.fetch#${connId}] Current connected clients: ${currentWebSockets.length}, Accepting new WebSocket connection`);
     
-    server.serializeAttachment(JSON.stringify({ folders: [], connId }));
+    const room = new URL(request.url).pathname.replace(/^\/+|\/+$/g, "") || "default";
+    server.serializeAttachment(JSON.stringify({ folders: [], connId, room, vaults: {}, pending: {} }));
     this.state.acceptWebSocket(server);
     
     const afterWebSockets = this.state.getWebSockets();
@@ -55,7 +60,7 @@ export class SyncRelayRoom {
     return new Response(null, { status: 101, webSocket: client });
   }
 
-  webSocketMessage(ws, message) {
+  async webSocketMessage(ws, message) {
     const raw = ws.deserializeAttachment();
     const data = raw ? JSON.parse(raw) : {};
     const connId = data.connId || "unknown";
@@ -65,6 +70,57 @@ export class SyncRelayRoom {
       return;
     }
 
+    const room = data.room || "default";
+    if (message.startsWith(MEMBERS_PREFIX)) {
+      await this.setMembers(message.slice(MEMBERS_PREFIX.length), room, connId);
+      return;
+    }
+
+    if (message.startsWith(AUTH_PREFIX)) {
+      const auth = await verifyAuth(message.slice(AUTH_PREFIX.length), room);
+      const pinned = auth && this.owners()[auth.vault];
+      if (!auth || (pinned && auth.owner !== pinned)) {
+        console.warn(`[webSocketMessage#${connId}] Authentication failed, closing`);
+        ws.close(1008, "authentication failed");
+        return;
+      }
+      // a connection can authenticate several identities for the same vault, e.g. two users of the same client
+      const identity = { vault: auth.vault, publicID: auth.publicID, owner: auth.owner };
+      const key = identityKey(identity);
+      const members = await this.state.storage.get(membersKey(auth.vault, auth.owner));
+      const vaults = { ...(data.vaults || {}) };
+      const pending = { ...(data.pending || {}) };
+      if (!members) {
+        // the members are not known yet, e.g. no admin has connected: wait for them
+        pending[key] = identity;
+        console.log(`[webSocketMessage#${connId}] Waiting for the members of vault ${auth.vault}`);
+      } else if (isMember(members, auth.publicID)) {
+        delete pending[key];
+        vaults[key] = identity;
+        console.log(`[webSocketMessage#${connId}] Authenticated as ${auth.publicID} for vault ${auth.vault}`);
+      } else {
+        delete pending[key];
+        delete vaults[key];
+        console.warn(`[webSocketMessage#${connId}] ${auth.publicID} is not a member of vault ${auth.vault}`);
+        if (Object.keys(vaults).length === 0 && Object.keys(pending).length === 0) {
+          ws.close(1008, "authentication failed");
+          return;
+        }
+      }
+      ws.serializeAttachment(JSON.stringify({ ...data, folders: getFolders(ws), vaults, pending }));
+      if (vaults[key] || (pending[key] && anonymousAllowed(this.env))) {
+        ws.send(`${ACCEPTED_PREFIX}${auth.vault}:${auth.publicID}`);
+      }
+      return;
+    }
+
+    const anonymous = anonymousAllowed(this.env);
+    const authenticated = Object.keys(data.vaults || {}).length > 0 || Object.keys(data.pending || {}).length > 0;
+    if (!authenticated && !anonymous) {
+      console.warn(`[webSocketMessage#${connId}] Not authenticated, dropping message`);
+      return;
+    }
+
     if (message.startsWith(WATCH_ADD_PREFIX)) {
       const add = message.slice(WATCH_ADD_PREFIX.length);
       if (!add) {
@@ -74,7 +130,7 @@ export class SyncRelayRoom {
       const current = getFolders(ws);
       const next = mergeFolders(current, [add]);
       console.log(`[webSocketMessage#${connId}] Added folder: ${add}. Current folders: ${next.join(", ")}`);
-      ws.serializeAttachment(JSON.stringify({ folders: next, connId }));
+      ws.serializeAttachment(JSON.stringify({ ...data, folders: next }));
       return;
     }
 
@@ -87,7 +143,7 @@ export class SyncRelayRoom {
       const current = getFolders(ws);
       const next = current.filter((f) => f !== remove);
       console.log(`[webSocketMessage#${connId}] Removed folder: ${remove}. Remaining folders: ${next.join(", ")}`);
-      ws.serializeAttachment(JSON.stringify({ folders: next, connId }));
+      ws.serializeAttachment(JSON.stringify({ ...data, folders: next }));
       return;
     }
 
@@ -116,6 +172,11 @@ export class SyncRelayRoom {
       console.warn(`[webSocketMessage#${connId}] Invalid message format: vaultID="${vaultID}", clientID="${clientID}", filename="${filename}"`);
       return;
     }
+    const owners = new Set(Object.values(data.vaults || {}).filter((i) => i.vault === vaultID).map((i) => i.owner));
+    if (!anonymous && owners.size === 0) {
+      console.warn(`[webSocketMessage#${connId}] Not authenticated for vault ${vaultID}, dropping message`);
+      return;
+    }
 
     console.log(`[webSocketMessage#${connId}] Broadcasting change: vaultID="${vaultID}", clientID="${clientID}", filename="${filename}"`);
     const sockets = this.state.getWebSockets();
@@ -123,6 +184,10 @@ export class SyncRelayRoom {
     for (const socket of sockets) {
       const socketData = socket.deserializeAttachment();
       const socketConnId = socketData ? JSON.parse(socketData).connId : "unknown";
+      const to = socketData ? Object.values(JSON.parse(socketData).vaults || {}) : [];
+      if (!anonymous && !to.some((i) => i.vault === vaultID && owners.has(i.owner))) {
+        continue;
+      }
 
       const folders = getFolders(socket);
       console.log(`[webSocketMessage#${connId}] Checking socket connId#${socketConnId} with folders: ${JSON.stringify(folders)}`);
@@ -139,6 +204,73 @@ export class SyncRelayRoom {
     console.log(`[webSocketMessage#${connId}] Sent notification to ${sent} socket(s) out of ${sockets.length} total`);
   }
 
+  owners() {
+    return this.env.OWNERS ? JSON.parse(this.env.OWNERS) : {};
+  }
+
+  // setMembers stores the members of a vault from
+  // "vaultID:signerID:unixTime:ownerID:version:members:admins:signature". Members are kept by vault and owner, the
+  // identity that created the vault, and the owner can be pinned in the OWNERS variable, a JSON object from vault ID
+  // to public ID. The owner and the admins in the current members sign the next members, and a list with a lower
+  // version, the length of the chain of the vault known to the signer, is rejected. Pending identities of members
+  // are authenticated, and the identities that are not members are dropped.
+  async setMembers(message, room, connId) {
+    const members = await verifyMembers(message, room);
+    if (!members) {
+      console.warn(`[setMembers#${connId}] Invalid members message`);
+      return;
+    }
+    const key = membersKey(members.vault, members.owner);
+    const current = await this.state.storage.get(key);
+    const pinned = this.owners()[members.vault];
+    const signer = members.signer;
+    delete members.signer;
+    if ((pinned && members.owner !== pinned) ||
+      (signer !== members.owner && !(current && canSet(current, signer))) ||
+      (current && (members.version < current.version ||
+        (members.version === current.version && members.unix < current.unix)))) {
+      console.warn(`[setMembers#${connId}] Members of vault ${members.vault} by ${signer} rejected`);
+      return;
+    }
+    await this.state.storage.put(key, members);
+
+    for (const socket of this.state.getWebSockets()) {
+      const raw = socket.deserializeAttachment();
+      const socketData = raw ? JSON.parse(raw) : {};
+      const vaults = { ...(socketData.vaults || {}) };
+      const pending = { ...(socketData.pending || {}) };
+      const accepted = [];
+      let dropped = false;
+      for (const [id, waiting] of Object.entries(pending)) {
+        if (waiting.vault !== members.vault || waiting.owner !== members.owner) {
+          continue;
+        }
+        delete pending[id];
+        if (isMember(members, waiting.publicID)) {
+          vaults[id] = waiting;
+          accepted.push(waiting);
+        } else {
+          dropped = true;
+        }
+      }
+      for (const [id, current] of Object.entries(vaults)) {
+        if (current.vault === members.vault && current.owner === members.owner && !isMember(members, current.publicID)) {
+          delete vaults[id];
+          dropped = true;
+        }
+      }
+      socket.serializeAttachment(JSON.stringify({ ...socketData, vaults, pending }));
+      for (const identity of accepted) {
+        socket.send(`${ACCEPTED_PREFIX}${identity.vault}:${identity.publicID}`);
+      }
+      if (dropped && Object.keys(vaults).length === 0 && Object.keys(pending).length === 0) {
+        console.log(`[setMembers#${connId}] Closing connId#${socketData.connId}, not a member`);
+        socket.close(1008, "not a member");
+      }
+    }
+    console.log(`[setMembers#${connId}] Members of vault ${members.vault} set by ${signer}`);
+  }
+
   webSocketClose(ws) {
     const data = ws.deserializeAttachment();
     const connId = data ? JSON.parse(data).connId : "unknown";
@@ -196,3 +328,87 @@ function matchesAnyFolder(name, folders) {
   console.log(`[matchesAnyFolder] → NO MATCH found`);
   return false;
 }
+
+function base64UrlDecode(value) {
+  const base64 = value.replace(/-/g, "+").replace(/_/g, "/");
+  const padded = base64 + "=".repeat((4 - (base64.length % 4)) % 4);
+  const binary = atob(padded);
+  return Uint8Array.from(binary, (c) => c.charCodeAt(0));
+}
+
+function membersKey(vault, owner) {
+  return `members:${vault}:${owner}`;
+}
+
+function identityKey(identity) {
+  return `${identity.vault}:${identity.publicID}`;
+}
+
+function anonymousAllowed(env) {
+  return env.ALLOW_ANONYMOUS === "true";
+}
+
+function isMember(members, publicID) {
+  return publicID === members.owner || members.ids.includes(publicID);
+}
+
+function canSet(members, publicID) {
+  return publicID === members.owner || (members.admins || []).includes(publicID);
+}
+
+// verifySigned checks "vaultID:publicID:unixTime:<n fields>:signature" where the signature is an ed25519
+// signature of the data returned by signed. The ed25519 key is stored in the public ID after the 33 bytes
+// secp256k1 key.
+async function verifySigned(message, n, signed) {
+  const parts = message.split(":");
+  if (parts.length !== 4 + n || !parts[0]) {
+    return null;
+  }
+  const [vault, publicID, unix] = parts;
+  const fields = parts.slice(3, 3 + n);
+  if (Math.abs(Date.now() / 1000 - Number(unix)) > MAX_AUTH_SKEW_SECONDS) {
+    return null;
+  }
+  try {
+    const signKey = base64UrlDecode(publicID).slice(33, 65);
+    const key = await crypto.subtle.importKey("raw", signKey, { name: "Ed25519" }, false, ["verify"]);
+    const data = new TextEncoder().encode(signed(vault, unix, fields));
+    const ok = await crypto.subtle.verify({ name: "Ed25519" }, key, base64UrlDecode(parts[3 + n]), data);
+    return ok ? { vault, publicID, unix: Number(unix), fields } : null;
+  } catch (err) {
+    console.warn(`[verifySigned] ${err}`);
+    return null;
+  }
+}
+
+// verifyAuth checks "vaultID:publicID:unixTime:ownerID:signature" signed over
+// "bao-relay-auth:<room>:<vaultID>:<ownerID>:<unixTime>".
+async function verifyAuth(auth, room) {
+  const signed = await verifySigned(auth, 1, (vault, unix, fields) =>
+    `bao-relay-auth:${room}:${vault}:${fields[0]}:${unix}`);
+  if (!signed || !signed.fields[0]) {
+    return null;
+  }
+  return { vault: signed.vault, publicID: signed.publicID, owner: signed.fields[0] };
+}
+
+// verifyMembers checks "vaultID:signerID:unixTime:ownerID:version:members:admins:signature", where members and
+// admins are comma separated public IDs, signed over
+// "bao-relay-members:<room>:<vaultID>:<ownerID>:<unixTime>:<version>:<members>:<admins>".
+async function verifyMembers(message, room) {
+  const signed = await verifySigned(message, 4, (vault, unix, fields) =>
+    `bao-relay-members:${room}:${vault}:${fields[0]}:${unix}:${fields[1]}:${fields[2]}:${fields[3]}`);
+  if (!signed || !signed.fields[0] || !/^-?\d+$/.test(signed.fields[1])) {
+    return null;
+  }
+  const split = (field) => field.split(",").filter((id) => id);
+  return {
+    vault: signed.vault,
+    owner: signed.fields[0],
+    signer: signed.publicID,
+    unix: signed.unix,
+    version: Number(signed.fields[1]),
+    ids: split(signed.fields[2]),
+    admins: split(signed.fields[3]),
+  };
+}